@@ -1,39 +1,175 @@
 use anyhow::{anyhow, bail, Context, Result};
+use blake2::Blake2b512;
 use rayon::prelude::*;
 use regex::Regex;
 use reqwest::blocking::Client;
 use reqwest::StatusCode;
-use serde::{Deserialize, Serialize};
+use ring::aead;
+use ring::rand::{SecureRandom, SystemRandom};
+use serde::{Deserialize, Deserializer, Serialize, Serializer};
 use serde_json::{json, Map, Value};
 use sha1::{Digest as Sha1Digest, Sha1};
 use sha2::Sha256;
 use std::cmp::Ordering;
-use std::collections::{BTreeMap, HashMap, HashSet};
+use std::collections::{BTreeMap, BTreeSet, HashMap, HashSet};
 use std::env;
 use std::fs::{self, File};
-use std::io::{self, BufRead, BufReader, Read, Write};
+use std::io::{self, BufRead, BufReader, IsTerminal, Read, Write};
 use std::path::{Path, PathBuf};
-use std::process::{Command, Stdio};
-use std::sync::{Arc, Mutex};
+use std::process::{Child, Command, ExitStatus, Output, Stdio};
+use std::cell::Cell;
+use std::sync::atomic::{AtomicBool, AtomicI8, AtomicU64, Ordering as AtomicOrdering};
+use std::sync::{Arc, Mutex, OnceLock};
+use std::thread;
 use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
 use time::format_description::well_known::Iso8601;
 use time::OffsetDateTime;
+use toml_edit::{DocumentMut, InlineTable, Item, TableLike};
 use walkdir::WalkDir;
 use zip::write::FileOptions;
 use zip::ZipArchive;
 use zip::ZipWriter;
 
 const XE_TOML: &str = "xe.toml";
+const XE_LOCK: &str = "xe.lock";
+
+macro_rules! bail_kind {
+    ($kind:expr, $($arg:tt)*) => {
+        return Err(kind_error($kind, format!($($arg)*)))
+    };
+}
 
 fn main() {
+    if let Some(code) = run_shim_trampoline() {
+        std::process::exit(code);
+    }
     if let Err(err) = run() {
+        // Whatever failed after Ctrl-C failed because of it.
+        let kind = if interrupted() {
+            Some(ErrorKind::Interrupted)
+        } else {
+            error_kind(&err)
+        };
         error(&format!("{:#}", err));
-        std::process::exit(1);
+        if json_output_requested() {
+            println!("{}", error_json(kind, &err));
+        }
+        std::process::exit(kind.map_or(1, ErrorKind::exit_code));
+    }
+}
+
+// Stable process exit codes and error codes; CI scripts and wrappers rely on these values.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum ErrorKind {
+    Usage,
+    Config,
+    Resolution,
+    Network,
+    RuntimeMissing,
+    HashMismatch,
+    PackageNotFound,
+    Interrupted,
+}
+
+impl ErrorKind {
+    fn exit_code(self) -> i32 {
+        match self {
+            ErrorKind::Usage => 2,
+            ErrorKind::Config => 3,
+            ErrorKind::Resolution => 4,
+            ErrorKind::Network => 5,
+            ErrorKind::RuntimeMissing => 6,
+            ErrorKind::HashMismatch => 7,
+            ErrorKind::PackageNotFound => 8,
+            ErrorKind::Interrupted => 130,
+        }
+    }
+
+    fn code(self) -> &'static str {
+        match self {
+            ErrorKind::Usage => "usage",
+            ErrorKind::Config => "config",
+            ErrorKind::Resolution => "resolution",
+            ErrorKind::Network => "network",
+            ErrorKind::RuntimeMissing => "runtime_missing",
+            ErrorKind::HashMismatch => "hash_mismatch",
+            ErrorKind::PackageNotFound => "package_not_found",
+            ErrorKind::Interrupted => "interrupted",
+        }
+    }
+}
+
+#[derive(Debug)]
+struct KindError {
+    kind: ErrorKind,
+    message: String,
+}
+
+impl std::fmt::Display for KindError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str(&self.message)
+    }
+}
+
+impl std::error::Error for KindError {}
+
+fn kind_error(kind: ErrorKind, message: String) -> anyhow::Error {
+    anyhow::Error::new(KindError { kind, message })
+}
+
+// The kind of an error: the first KindError in its chain, else one inferred from the
+// underlying error. None for unclassified failures (exit code 1).
+fn error_kind(err: &anyhow::Error) -> Option<ErrorKind> {
+    for cause in err.chain() {
+        if let Some(kind) = cause.downcast_ref::<KindError>().map(|e| e.kind) {
+            return Some(kind);
+        }
+        if cause.downcast_ref::<reqwest::Error>().is_some() {
+            return Some(ErrorKind::Network);
+        }
+        if cause.downcast_ref::<toml::de::Error>().is_some()
+            || cause.downcast_ref::<serde_yaml::Error>().is_some()
+        {
+            return Some(ErrorKind::Config);
+        }
     }
+    if err.to_string().starts_with("usage:") {
+        return Some(ErrorKind::Usage);
+    }
+    None
+}
+
+fn exit_code(err: &anyhow::Error) -> i32 {
+    error_kind(err).map_or(1, ErrorKind::exit_code)
+}
+
+// Printed on stdout when a command run with --json fails, so wrappers parsing the output
+// get the failure in the same place.
+fn error_json(kind: Option<ErrorKind>, err: &anyhow::Error) -> String {
+    let report = json!({
+        "error": {
+            "code": kind.map_or("error", ErrorKind::code),
+            "exit_code": kind.map_or(1, ErrorKind::exit_code),
+            "message": format!("{err:#}"),
+        }
+    });
+    serde_json::to_string_pretty(&report).unwrap_or_default()
+}
+
+// --json among xe's own arguments; anything after `--` belongs to another program.
+fn json_output_requested() -> bool {
+    env::args().skip(1).take_while(|arg| arg != "--").any(|arg| arg == "--json")
 }
 
 fn run() -> Result<()> {
     let root = parse_root_args()?;
+    set_verbosity(root.verbosity);
+    // Whatever command it is, --json output on stdout must stay parseable.
+    if json_output_requested() {
+        set_log_to_stderr(true);
+    }
+    ASSUME_YES.store(root.assume_yes, AtomicOrdering::Relaxed);
+    NON_INTERACTIVE.store(root.non_interactive, AtomicOrdering::Relaxed);
     if root.show_help {
         print_help();
         return Ok(());
@@ -46,11 +182,15 @@ fn run() -> Result<()> {
     let config_file = root.config_file.unwrap_or_else(xe_config_file);
     let profiler = if root.profile {
         let dir = root.profile_dir.unwrap_or_else(|| xe_home().join("profiles"));
-        let (prof, info_data) = Profiler::start(&dir)?;
-        println!("Profiling enabled.");
-        println!("Logs: {}", info_data.log_path.display());
-        println!("CPU: {}", info_data.cpu_path.display());
-        println!("Heap: {}", info_data.heap_path.display());
+        let (prof, info_data) = Profiler::start(&dir, root.profile_detail)?;
+        info("Profiling enabled.");
+        info(&format!("Logs: {}", info_data.log_path.display()));
+        info(&format!("CPU: {}", info_data.cpu_path.display()));
+        info(&format!("Heap: {}", info_data.heap_path.display()));
+        if let Some(detail) = info_data.detail.as_ref() {
+            info(&format!("Metrics: {}", detail.metrics_path.display()));
+            info(&format!("Threads: {}", detail.threads_path.display()));
+        }
         Some(prof)
     } else {
         None
@@ -59,6 +199,7 @@ fn run() -> Result<()> {
     let ctx = AppContext {
         config_file,
         profiler: profiler.clone(),
+        timings: Arc::new(Timings::default()),
     };
 
     if let Some(p) = profiler.as_ref() {
@@ -70,7 +211,13 @@ fn run() -> Result<()> {
         );
     }
 
+    let started = Instant::now();
     let command_result = dispatch(&ctx, &root.command_args);
+    record_command(&ctx, &root.command_args, started.elapsed(), &command_result);
+    if command_result.is_ok() {
+        record_install_stats(&ctx);
+        update_notices(&ctx, &root.command_args);
+    }
 
     if let Some(p) = profiler.as_ref() {
         p.event("command.stop", json!({}));
@@ -84,7 +231,11 @@ fn run() -> Result<()> {
 struct RootArgs {
     config_file: Option<PathBuf>,
     profile: bool,
+    profile_detail: bool,
     profile_dir: Option<PathBuf>,
+    verbosity: i8,
+    assume_yes: bool,
+    non_interactive: bool,
     show_help: bool,
     show_version: bool,
     command_args: Vec<String>,
@@ -94,7 +245,11 @@ fn parse_root_args() -> Result<RootArgs> {
     let mut args: Vec<String> = env::args().skip(1).collect();
     let mut config_file: Option<PathBuf> = None;
     let mut profile = false;
+    let mut profile_detail = false;
     let mut profile_dir: Option<PathBuf> = None;
+    let mut verbosity = 0i8;
+    let mut assume_yes = false;
+    let mut non_interactive = false;
     let mut show_help = false;
     let mut show_version = false;
 
@@ -113,6 +268,11 @@ fn parse_root_args() -> Result<RootArgs> {
                 profile = true;
                 idx += 1;
             }
+            "--profile-detail" => {
+                profile = true;
+                profile_detail = true;
+                idx += 1;
+            }
             "--profile-dir" => {
                 let value = args
                     .get(idx + 1)
@@ -120,6 +280,26 @@ fn parse_root_args() -> Result<RootArgs> {
                 profile_dir = Some(PathBuf::from(value));
                 idx += 2;
             }
+            "-q" | "--quiet" => {
+                verbosity = -1;
+                idx += 1;
+            }
+            "-v" | "--verbose" => {
+                verbosity = (verbosity.max(0) + 1).min(2);
+                idx += 1;
+            }
+            "-vv" => {
+                verbosity = 2;
+                idx += 1;
+            }
+            "-y" | "--yes" => {
+                assume_yes = true;
+                idx += 1;
+            }
+            "--non-interactive" => {
+                non_interactive = true;
+                idx += 1;
+            }
             "-h" | "--help" => {
                 show_help = true;
                 idx += 1;
@@ -143,7 +323,11 @@ fn parse_root_args() -> Result<RootArgs> {
     Ok(RootArgs {
         config_file,
         profile,
+        profile_detail,
         profile_dir,
+        verbosity,
+        assume_yes,
+        non_interactive,
         show_help,
         show_version,
         command_args,
@@ -154,6 +338,7 @@ fn parse_root_args() -> Result<RootArgs> {
 struct AppContext {
     config_file: PathBuf,
     profiler: Option<Profiler>,
+    timings: Arc<Timings>,
 }
 
 fn dispatch(ctx: &AppContext, args: &[String]) -> Result<()> {
@@ -165,58 +350,183 @@ fn dispatch(ctx: &AppContext, args: &[String]) -> Result<()> {
     let rest = &args[1..];
     match cmd {
         "add" => cmd_add(ctx, rest),
+        "develop" => cmd_develop(ctx, rest),
         "list" => cmd_list(ctx, rest),
-        "check" | "show" => cmd_check(rest),
+        "check" | "show" => cmd_check(ctx, rest),
         "remove" => cmd_remove(ctx, rest),
         "run" => cmd_run(ctx, rest),
         "shell" => cmd_shell(ctx, rest),
+        "activate" => cmd_activate(ctx, rest),
         "init" => cmd_init(ctx, rest),
         "use" => cmd_use(ctx, rest),
         "venv" => cmd_venv(ctx, rest),
         "config" => cmd_config(ctx, rest),
         "import" => cmd_import(ctx, rest),
-        "export" => cmd_export(rest),
+        "export" => cmd_export(ctx, rest),
+        "docker" => cmd_docker(ctx, rest),
+        "kernel" => cmd_kernel(ctx, rest),
+        "hook" | "hooks" => cmd_hook(ctx, rest),
         "clean" => cmd_clean(rest),
+        "prune-envs" => cmd_prune_envs(ctx, rest),
+        "projects" => cmd_projects(rest),
+        "du" => cmd_du(ctx, rest),
         "snapshot" => cmd_snapshot(rest),
         "restore" => cmd_restore(rest),
         "sync" => cmd_sync(ctx, rest),
         "lock" => cmd_lock(ctx, rest),
+        "plan" => cmd_plan(ctx, rest),
+        "upgrade" => cmd_upgrade(ctx, rest),
         "publish" => cmd_push(ctx, rest, false),
         "format" => cmd_format(ctx, rest),
-        "version" => {
-            print_version();
-            Ok(())
-        }
+        "lint" => cmd_lint(ctx, rest),
+        "test" => cmd_test(ctx, rest),
+        "version" => cmd_version(rest),
         "cache" => cmd_cache(ctx, rest),
+        "daemon" => cmd_daemon(ctx, rest),
+        "bench" => cmd_bench(ctx, rest),
         "python" => cmd_python(ctx, rest),
         "pip" => cmd_pip(ctx, rest),
         "tool" => cmd_tool(ctx, rest),
-        "x" => cmd_x_alias(ctx, rest),
+        "x" => cmd_x(ctx, rest),
         "build" => cmd_build(rest),
         "push" => cmd_push(ctx, rest, false),
         "tpush" => cmd_push(ctx, rest, true),
-        "auth" => cmd_auth(rest),
-        "mirror" => cmd_mirror(rest),
+        "verify-artifact" => cmd_verify_artifact(ctx, rest),
+        "auth" => cmd_auth(ctx, rest),
+        "mirror" => cmd_mirror(ctx, rest),
+        "warm" => cmd_warm(ctx, rest),
         "plugin" => cmd_plugin(rest),
         "self" => cmd_self(rest),
-        "workspace" | "workspaces" => cmd_workspace(rest),
+        "workspace" | "workspaces" => cmd_workspace(ctx, rest),
         "why" => cmd_why(rest),
         "tree" => cmd_tree(rest),
-        "doctor" => cmd_doctor(rest),
+        "doctor" => cmd_doctor(ctx, rest),
+        "rehash" => cmd_rehash(ctx, rest),
+        "shim" => cmd_shim(ctx, rest),
+        "log" => cmd_log(ctx, rest),
         "setup" => cmd_setup(rest),
-        _ => {
-            print_help();
-            bail!("unknown command: {cmd}");
+        UPDATE_CHECK_COMMAND => cmd_update_check(ctx, rest),
+        _ => match find_plugin(cmd) {
+            Some(plugin) => run_plugin(ctx, &plugin, rest),
+            None => {
+                print_help();
+                bail_kind!(ErrorKind::Usage, "unknown command: {cmd}");
+            }
+        },
+    }
+}
+
+fn take_flag(args: &[String], flag: &str) -> (bool, Vec<String>) {
+    let rest = args.iter().filter(|a| a.as_str() != flag).cloned().collect::<Vec<_>>();
+    (rest.len() != args.len(), rest)
+}
+
+// Removes `--python <version>` (or `--python=<version>`) and exports it as XE_PYTHON, the
+// interpreter override for this invocation. With `leading`, only flags before the first
+// other argument count, so `xe run` leaves the command's own arguments alone.
+fn take_python_flag(args: &[String], leading: bool) -> Result<Vec<String>> {
+    let mut rest = Vec::with_capacity(args.len());
+    let mut idx = 0usize;
+    while idx < args.len() {
+        let arg = args[idx].as_str();
+        if arg == "--" || (leading && !rest.is_empty()) {
+            rest.extend_from_slice(&args[idx..]);
+            break;
+        }
+        let version = if arg == "--python" {
+            idx += 1;
+            args.get(idx).map(String::as_str)
+        } else if let Some(value) = arg.strip_prefix("--python=") {
+            Some(value)
+        } else {
+            rest.push(args[idx].clone());
+            idx += 1;
+            continue;
+        };
+        match version.map(str::trim).filter(|v| !v.is_empty() && !v.starts_with('-')) {
+            Some(version) => env::set_var("XE_PYTHON", version),
+            None => bail_kind!(ErrorKind::Usage, "--python requires a version, e.g. --python 3.11"),
+        }
+        idx += 1;
+    }
+    Ok(rest)
+}
+
+// The interpreter version XE_PYTHON (or --python) selects instead of the project pin.
+fn python_override() -> Option<String> {
+    env::var("XE_PYTHON")
+        .ok()
+        .map(|v| v.trim().to_string())
+        .filter(|v| !v.is_empty())
+}
+
+// Splits `--dev` / `--group <name>` out of add/remove/list arguments.
+fn parse_group_flags(args: &[String]) -> Result<(Option<String>, Vec<String>)> {
+    let mut group = None;
+    let mut rest = Vec::new();
+    let mut idx = 0usize;
+    while idx < args.len() {
+        match args[idx].as_str() {
+            "--dev" => {
+                group = Some("dev".to_string());
+                idx += 1;
+            }
+            "-g" | "--group" => {
+                let name = args
+                    .get(idx + 1)
+                    .map(|g| g.trim())
+                    .filter(|g| !g.is_empty())
+                    .ok_or_else(|| anyhow!("--group requires a group name"))?;
+                if name == "main" {
+                    group = None;
+                } else {
+                    group = Some(name.to_string());
+                }
+                idx += 2;
+            }
+            other => {
+                rest.push(other.to_string());
+                idx += 1;
+            }
         }
     }
+    Ok((group, rest))
 }
 
 fn cmd_add(ctx: &AppContext, args: &[String]) -> Result<()> {
+    if matches!(args.first().map(String::as_str), Some("-e" | "--editable")) {
+        return cmd_develop(ctx, &args[1..]);
+    }
+    let args = take_python_flag(args, false)?;
+    let (require_hashes, args) = take_flag(&args, "--require-hashes");
+    let (group, args) = parse_group_flags(&args)?;
+    let args = args.as_slice();
     if args.is_empty() {
-        bail!("usage: xe add <package_name>...");
+        bail!("usage: xe add [--dev | --group <name>] [--require-hashes] [--python <version>] <package_name>... | xe add -e <path>");
     }
     let wd = env::current_dir().context("failed to get cwd")?;
-    let (mut cfg, toml_path) = load_or_create_project(&wd)?;
+    // Checked before anything is written, so a declined name leaves xe.toml untouched.
+    let toml_path = wd.join(XE_TOML);
+    let existing = toml_path.exists().then(|| load_project(&toml_path)).transpose()?;
+    let known = existing
+        .as_ref()
+        .map(|cfg| project_package_names(&wd, cfg))
+        .unwrap_or_default();
+    for req in args {
+        let Some(name) = requirement_to_dep_name(req) else {
+            continue;
+        };
+        if let Some(similar) = typosquat_target(&name, &known) {
+            warning(&format!("{name} looks like a misspelling of {similar}"));
+            if !confirm(&format!("Add {name} anyway?"), false)? {
+                bail_kind!(ErrorKind::Usage, "not adding {name}; did you mean {similar}?");
+            }
+        }
+    }
+    let mut cfg = match existing {
+        Some(cfg) => cfg,
+        None => load_or_create_project(&wd)?.0,
+    };
     let runtime = ensure_runtime_for_project(ctx, &wd, &mut cfg)?;
     if runtime.config_changed {
         save_project(&toml_path, &cfg)?;
@@ -234,167 +544,887 @@ fn cmd_add(ctx: &AppContext, args: &[String]) -> Result<()> {
         target
     ));
 
-    let installer = Installer::new(Path::new(&cfg.cache.global_dir))?;
-    let reqs: Vec<String> = args.to_vec();
-    let resolved = installer.install(
-        ctx,
-        &cfg,
-        &reqs,
-        &wd,
-        &runtime.selection.site_packages,
-        &runtime.selection.python_exe,
-    )?;
-
-    for req in args {
-        if let Some(dep_name) = requirement_to_dep_name(req) {
-            cfg.deps.insert(dep_name, "*".to_string());
+    // The new requirements are solved together with the project's locked graph, so the
+    // packages already there keep their versions unless the additions need others.
+    let added = args.iter().filter_map(|r| requirement_to_dep_name(r)).collect::<Vec<_>>();
+    let (reqs, relaxed) = add_requirements(&wd, &cfg, args)?;
+    let site_packages = &runtime.selection.site_packages;
+    let before = installed_versions(site_packages);
+    let installer = Installer::new(Path::new(&cfg.cache.global_dir))?
+        .with_require_hashes(require_hashes)
+        .with_joint_resolution();
+    let python_exe = &runtime.selection.python_exe;
+    let resolved = match installer.install(ctx, &cfg, &reqs, &wd, site_packages, python_exe) {
+        Err(err) if reqs != relaxed && error_kind(&err) == Some(ErrorKind::Resolution) => {
+            warning(&format!("the locked versions conflict with the new requirements; resolving without {XE_LOCK}"));
+            installer.install(ctx, &cfg, &relaxed, &wd, site_packages, python_exe)?
         }
+        resolved => resolved?,
+    };
+    let changed = resolved
+        .iter()
+        .filter(|p| before.get(&normalize_dep_name(&p.name)) != Some(&p.version))
+        .count();
+
+    let deps = cfg.deps_for_mut(group.as_deref());
+    for name in &added {
+        deps.insert(name.clone(), "*".to_string());
     }
-    for p in &resolved {
-        cfg.deps
-            .insert(normalize_dep_name(&p.name), p.version.clone());
-    }
+    cfg.record_resolved(&resolved);
     save_project(&toml_path, &cfg)?;
-    success(&format!("Installed {} package artifact(s)", resolved.len()));
+    save_lockfile(&wd, &cfg, &resolved, false)?;
+    run_hooks(&cfg, "post-add", &wd, &runtime.selection)?;
+    print_added_table(&added, &resolved, site_packages);
+    match &group {
+        Some(group) => success(&format!("Installed {changed} package artifact(s) into group {group}")),
+        None => success(&format!("Installed {changed} package artifact(s)")),
+    }
+    print_install_summary(ctx);
     Ok(())
 }
 
-fn cmd_list(ctx: &AppContext, _args: &[String]) -> Result<()> {
+// What `xe add` solves for `added`: the project's requirements with the pins of xe.lock,
+// minus anything naming an added package, plus `added`. The second list leaves the lock
+// out, for when its pins conflict with the additions.
+fn add_requirements(dir: &Path, cfg: &Config, added: &[String]) -> Result<(Vec<String>, Vec<String>)> {
+    let names = added.iter().filter_map(|r| requirement_to_dep_name(r)).collect::<Vec<_>>();
+    let keep = |req: &String| !requirement_to_dep_name(req).is_some_and(|name| names.contains(&name));
+    let mut relaxed = project_requirements(dir, cfg)?.into_iter().filter(keep).collect::<Vec<_>>();
+    let mut locked = locked_requirements(dir, cfg, relaxed.clone())?
+        .into_iter()
+        .filter(keep)
+        .collect::<Vec<_>>();
+    relaxed.extend(added.iter().cloned());
+    locked.extend(added.iter().cloned());
+    Ok((locked, relaxed))
+}
+
+// One row per requirement given to `xe add`: its resolved version and the packages it
+// pulls in, followed through the Requires-Dist of the installed distributions.
+fn print_added_table(added: &[String], resolved: &[Package], site_packages: &Path) {
+    let versions = resolved
+        .iter()
+        .map(|p| (normalize_dep_name(&p.name), p.version.clone()))
+        .collect::<HashMap<_, _>>();
+    let requires = installed_requires(site_packages);
+    let rows = added
+        .iter()
+        .map(|name| {
+            let mut seen = BTreeSet::new();
+            let mut queue = vec![name.clone()];
+            while let Some(next) = queue.pop() {
+                for dep in requires.get(&next).into_iter().flatten() {
+                    if dep != name && versions.contains_key(dep) && seen.insert(dep.clone()) {
+                        queue.push(dep.clone());
+                    }
+                }
+            }
+            let pulled = seen
+                .iter()
+                .map(|dep| format!("{dep} {}", versions[dep]))
+                .collect::<Vec<_>>();
+            let version = versions.get(name).cloned().unwrap_or_else(|| "-".to_string());
+            let pulled = if pulled.is_empty() { "-".to_string() } else { pulled.join(", ") };
+            (name.as_str(), version, pulled)
+        })
+        .collect::<Vec<_>>();
+    let width = rows.iter().map(|r| r.0.len()).max().unwrap_or(0).max("Requirement".len());
+    let version_width = rows.iter().map(|r| r.1.len()).max().unwrap_or(0).max("Version".len());
+    println!("{:<width$}  {:<version_width$}  Pulls in", "Requirement", "Version");
+    for (name, version, pulled) in rows {
+        println!("{name:<width$}  {version:<version_width$}  {pulled}");
+    }
+}
+
+// `xe develop [path]` installs a project (the current one by default) into the current
+// project's environment in editable mode, so edits to its sources take effect without
+// reinstalling. Projects declaring a `[build-system]` in pyproject.toml are built through
+// the backend's PEP 660 `build_editable` hook; anything else is linked with a .pth file.
+fn cmd_develop(ctx: &AppContext, args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe develop [--no-deps] [path]";
+    let (no_deps, rest) = take_flag(args, "--no-deps");
+    let target = match rest.as_slice() {
+        [] => PathBuf::from("."),
+        [path] if !path.starts_with('-') => PathBuf::from(path),
+        _ => bail_kind!(ErrorKind::Usage, "{USAGE}"),
+    };
     let wd = env::current_dir().context("failed to get cwd")?;
+    let source = fs::canonicalize(wd.join(&target))
+        .with_context(|| format!("project directory {} does not exist", target.display()))?;
     let (mut cfg, toml_path) = load_or_create_project(&wd)?;
     let runtime = ensure_runtime_for_project(ctx, &wd, &mut cfg)?;
     if runtime.config_changed {
         save_project(&toml_path, &cfg)?;
     }
+    let project = EditableProject::load(&source)?;
+    let site_packages = &runtime.selection.site_packages;
 
-    let output = Command::new(&runtime.selection.python_exe)
-        .args(["-m", "pip", "list", "--format", "json"])
-        .output()
-        .context("failed to run pip list")?;
-    if !output.status.success() {
-        let stderr = String::from_utf8_lossy(&output.stderr);
-        let stdout = String::from_utf8_lossy(&output.stdout);
-        bail!("Failed to list packages: {}\n{}{}", output.status, stdout, stderr);
+    if !no_deps && !project.requirements.is_empty() {
+        info(&format!(
+            "Installing {} requirement(s) of {}...",
+            project.requirements.len(),
+            project.name
+        ));
+        let installer = Installer::new(Path::new(&cfg.cache.global_dir))?;
+        installer.install(
+            ctx,
+            &cfg,
+            &project.requirements,
+            &wd,
+            site_packages,
+            &runtime.selection.python_exe,
+        )?;
     }
 
-    let mut pkgs = parse_pip_list_output(&output.stdout)?;
-    pkgs.sort_by(|a, b| a.name.to_lowercase().cmp(&b.name.to_lowercase()));
-    print_pkg_table(&pkgs);
+    info(&format!("Installing {} {} in editable mode...", project.name, project.version));
+    remove_installed_dist(site_packages, &project.name)?;
+    let mode = match &project.backend {
+        Some(backend) => match build_editable_wheel(&source, backend, &runtime.selection)? {
+            Some(wheel) => {
+                install_wheel_blob(&wheel, site_packages)?;
+                let _ = fs::remove_dir_all(wheel.parent().unwrap_or(&wheel));
+                "PEP 660"
+            }
+            None => {
+                warning(&format!(
+                    "build backend {} does not support editable installs; linking the sources instead",
+                    backend.name
+                ));
+                link_editable_project(&project, site_packages)?;
+                ".pth"
+            }
+        },
+        None => {
+            link_editable_project(&project, site_packages)?;
+            ".pth"
+        }
+    };
+    success(&format!(
+        "Installed {} {} in editable mode ({mode}) from {}",
+        project.name,
+        project.version,
+        source.display()
+    ));
+    print_install_summary(ctx);
     Ok(())
 }
 
-fn cmd_check(args: &[String]) -> Result<()> {
-    if args.len() != 1 {
-        bail!("usage: xe check <package_name>");
+// Points in the project lifecycle where `[hooks]` commands run; the git points run once
+// `xe hook install` has wired them into the repository.
+const HOOK_POINTS: &[&str] = &[
+    "pre-sync", "post-sync", "pre-lock", "post-lock", "post-add", "pre-run", "pre-commit", "pre-push",
+];
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(untagged)]
+enum HookCommands {
+    One(String),
+    Many(Vec<String>),
+}
+
+impl HookCommands {
+    fn commands(&self) -> Vec<&str> {
+        match self {
+            HookCommands::One(command) => vec![command.as_str()],
+            HookCommands::Many(commands) => commands.iter().map(String::as_str).collect(),
+        }
     }
-    let metadata = fetch_metadata_from_pypi(&args[0])?;
-    println!("Name: {}", metadata.info.name);
-    println!("Version: {}", metadata.info.version);
-    println!("Summary: {}", metadata.info.summary);
-    println!("Home-page: {}", metadata.info.home_page);
-    Ok(())
 }
 
-fn cmd_remove(ctx: &AppContext, args: &[String]) -> Result<()> {
-    if args.is_empty() {
-        bail!("usage: xe remove <package_name>...");
+// Runs the project's hooks for `point`, then those of installed plugins, through the
+// shell in the project directory with the runtime environment. The first failing hook
+// aborts the command. XE_NO_HOOKS=1 skips them all.
+fn run_hooks(cfg: &Config, point: &str, project_dir: &Path, selection: &RuntimeSelection) -> Result<()> {
+    if env::var("XE_NO_HOOKS").is_ok_and(|v| v == "1") {
+        return Ok(());
     }
-    let wd = env::current_dir().context("failed to get cwd")?;
-    let (mut cfg, toml_path) = load_or_create_project(&wd)?;
-    let runtime = ensure_runtime_for_project(ctx, &wd, &mut cfg)?;
-    if runtime.config_changed {
-        save_project(&toml_path, &cfg)?;
+    let mut hooks = Vec::new();
+    if let Some(commands) = cfg.hooks.get(point) {
+        hooks.extend(commands.commands().into_iter().map(|c| (None, c.to_string())));
+    }
+    for plugin in installed_plugins() {
+        if let Some(commands) = plugin.hooks.get(point) {
+            let dir = xe_plugin_dir().join(&plugin.name);
+            hooks.extend(commands.commands().into_iter().map(|c| (Some(dir.clone()), c.to_string())));
+        }
+    }
+    for (plugin_dir, hook) in hooks {
+        info(&format!("Running {point} hook: {hook}"));
+        let mut command = if cfg!(windows) {
+            let mut command = Command::new("cmd");
+            command.arg("/C").arg(&hook);
+            command
+        } else {
+            let mut command = Command::new("sh");
+            command.arg("-c").arg(&hook);
+            command
+        };
+        command.current_dir(project_dir);
+        apply_runtime_env(&mut command, selection)?;
+        command
+            .env("XE_HOOK", point)
+            .env("XE_PROJECT_DIR", project_dir)
+            .env("XE_PYTHON_EXE", &selection.python_exe)
+            .env("XE_SITE_PACKAGES", &selection.site_packages);
+        if let Some(dir) = &plugin_dir {
+            command.env("XE_PLUGIN_DIR", dir);
+        }
+        let status = command
+            .status()
+            .with_context(|| format!("failed to run {point} hook `{hook}`"))?;
+        if !status.success() {
+            bail!("{point} hook `{hook}` failed: {status}");
+        }
     }
+    Ok(())
+}
 
-    let is_remove_all = args.len() == 1 && args[0].eq_ignore_ascii_case("all");
-    if is_remove_all {
-        let out = Command::new(&runtime.selection.python_exe)
-            .args(["-m", "pip", "list", "--format", "json"])
-            .output()
-            .context("failed to list packages")?;
-        if !out.status.success() {
-            bail!("Failed to list packages: {}", out.status);
+// `[hooks]` points that `xe hook install` wires into git.
+const GIT_HOOK_POINTS: &[&str] = &["pre-commit", "pre-push"];
+const GIT_HOOK_MARKER: &str = "# Installed by `xe hook install`; `xe hook uninstall` removes it.";
+
+fn cmd_hook(ctx: &AppContext, args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe hook <install|uninstall> [pre-commit|pre-push...] [--force]";
+    let Some(sub) = args.first() else {
+        bail_kind!(ErrorKind::Usage, "{USAGE}");
+    };
+    let (force, rest) = take_flag(&args[1..], "--force");
+    let wd = env::current_dir().context("failed to get cwd")?;
+    match sub.as_str() {
+        "install" => {
+            let cfg = load_existing_project(&wd)?;
+            let mut points = rest.clone();
+            if points.is_empty() {
+                points = GIT_HOOK_POINTS
+                    .iter()
+                    .filter(|p| cfg.hooks.contains_key(**p))
+                    .map(|p| p.to_string())
+                    .collect();
+            }
+            if points.is_empty() {
+                bail_kind!(
+                    ErrorKind::Config,
+                    "no git hooks configured; add commands to [hooks] first, e.g.\n\n[hooks]\npre-commit = [\"xe lock\", \"ruff check .\"]"
+                );
+            }
+            let hooks_dir = git_hooks_dir(&wd)?;
+            for point in &points {
+                if !GIT_HOOK_POINTS.contains(&point.as_str()) {
+                    bail_kind!(
+                        ErrorKind::Usage,
+                        "unsupported git hook '{point}' (supported: {})",
+                        GIT_HOOK_POINTS.join(", ")
+                    );
+                }
+                let path = hooks_dir.join(point);
+                let existing = fs::read_to_string(&path).unwrap_or_default();
+                if !existing.is_empty() && !existing.contains(GIT_HOOK_MARKER) && !force {
+                    bail_kind!(
+                        ErrorKind::Config,
+                        "{} already exists and was not installed by xe; pass --force to replace it",
+                        path.display()
+                    );
+                }
+            }
+            let prefix = git_output(&wd, &["rev-parse", "--show-prefix"])?;
+            let prefix = prefix.trim().trim_end_matches('/');
+            let xe = env::current_exe()
+                .context("failed to locate the xe executable")?
+                .display()
+                .to_string()
+                .replace('\\', "/");
+            fs::create_dir_all(&hooks_dir).with_context(|| format!("failed to create {}", hooks_dir.display()))?;
+            for point in &points {
+                let path = hooks_dir.join(point);
+                let script = format!(
+                    "#!/bin/sh\n{GIT_HOOK_MARKER}\ncd \"./{prefix}\" || exit 1\nexec \"{xe}\" hook run {point}\n"
+                );
+                fs::write(&path, script).with_context(|| format!("failed to write {}", path.display()))?;
+                #[cfg(unix)]
+                {
+                    use std::os::unix::fs::PermissionsExt;
+                    fs::set_permissions(&path, fs::Permissions::from_mode(0o755))?;
+                }
+                if !cfg.hooks.contains_key(point) {
+                    warning(&format!("[hooks].{point} is empty; the git hook does nothing until you add commands"));
+                }
+                success(&format!("Installed {point} hook at {}", path.display()));
+            }
+            Ok(())
         }
-        let pkgs = parse_pip_list_output(&out.stdout)?;
-        let to_remove: Vec<String> = pkgs
-            .iter()
-            .filter_map(|p| {
-                let n = p.name.to_lowercase();
-                if n == "pip" || n == "setuptools" || n == "wheel" {
-                    None
-                } else {
-                    Some(p.name.clone())
+        "uninstall" => {
+            let hooks_dir = git_hooks_dir(&wd)?;
+            let points = if rest.is_empty() {
+                GIT_HOOK_POINTS.iter().map(|p| p.to_string()).collect()
+            } else {
+                rest
+            };
+            let mut removed = 0;
+            for point in &points {
+                let path = hooks_dir.join(point);
+                if fs::read_to_string(&path).is_ok_and(|text| text.contains(GIT_HOOK_MARKER)) {
+                    fs::remove_file(&path).with_context(|| format!("failed to remove {}", path.display()))?;
+                    success(&format!("Removed {point} hook"));
+                    removed += 1;
                 }
-            })
-            .collect();
-        if !to_remove.is_empty() {
-            let mut command = Command::new(&runtime.selection.python_exe);
-            command.arg("-m").arg("pip").arg("uninstall").arg("-y");
-            command.args(&to_remove);
-            let status = command.status().context("failed to uninstall packages")?;
-            if !status.success() {
-                bail!("Failed to remove all packages: {}", status);
             }
+            if removed == 0 {
+                info("No xe git hooks installed.");
+            }
+            Ok(())
         }
-        cfg.deps.clear();
-        save_project(&toml_path, &cfg)?;
-        success("Removed all packages from active environment");
-        return Ok(());
+        // Entry point of the installed git hooks.
+        "run" => {
+            let [point] = rest.as_slice() else {
+                bail_kind!(ErrorKind::Usage, "usage: xe hook run <pre-commit|pre-push>");
+            };
+            let (mut cfg, toml_path) = load_or_create_project(&wd)?;
+            let runtime = ensure_runtime_for_project(ctx, &wd, &mut cfg)?;
+            if runtime.config_changed {
+                save_project(&toml_path, &cfg)?;
+            }
+            run_hooks(&cfg, point, &wd, &runtime.selection)
+        }
+        _ => bail_kind!(ErrorKind::Usage, "{USAGE}"),
     }
+}
 
-    let mut req_names = Vec::new();
-    for raw in args {
-        if let Some(n) = requirement_to_dep_name(raw) {
-            req_names.push(n);
+fn git_output(dir: &Path, args: &[&str]) -> Result<String> {
+    let output = Command::new("git")
+        .args(args)
+        .current_dir(dir)
+        .output()
+        .context("failed to run git; is it installed and on PATH?")?;
+    if !output.status.success() {
+        bail_kind!(ErrorKind::Config, "{} is not inside a git repository", dir.display());
+    }
+    Ok(String::from_utf8_lossy(&output.stdout).trim_end_matches(['\r', '\n']).to_string())
+}
+
+// The hooks directory git uses for `dir`, honoring core.hooksPath.
+fn git_hooks_dir(dir: &Path) -> Result<PathBuf> {
+    let path = PathBuf::from(git_output(dir, &["rev-parse", "--git-path", "hooks"])?);
+    let path = if path.is_absolute() { path } else { dir.join(path) };
+    Ok(fs::canonicalize(&path).unwrap_or(path))
+}
+
+fn cmd_list(ctx: &AppContext, args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe list [--main | --dev | --group <name>] [--outdated] [--format columns|json|freeze] [--columns <name,...>] [--pip]";
+    let (group, rest) = parse_group_flags(args)?;
+    let mut use_pip = false;
+    let mut filter_main = false;
+    let mut outdated_only = false;
+    let mut format = "columns".to_string();
+    let mut columns = None;
+    let mut idx = 0usize;
+    while idx < rest.len() {
+        match (rest[idx].as_str(), rest.get(idx + 1)) {
+            ("--pip", _) => use_pip = true,
+            ("--main", _) => filter_main = true,
+            ("--outdated", _) => outdated_only = true,
+            ("--format", Some(value)) => {
+                format = value.clone();
+                idx += 1;
+            }
+            ("--columns", Some(value)) => {
+                columns = Some(value.split(',').map(|c| c.trim().to_lowercase()).collect::<Vec<_>>());
+                idx += 1;
+            }
+            _ => bail_kind!(ErrorKind::Usage, "{USAGE}"),
         }
+        idx += 1;
     }
-    if req_names.is_empty() {
-        bail!("No valid package names provided");
+    if !matches!(format.as_str(), "columns" | "json" | "freeze") {
+        bail_kind!(ErrorKind::Usage, "unknown list format '{format}' (expected columns, json or freeze)");
     }
-    let mut command = Command::new(&runtime.selection.python_exe);
-    command.arg("-m").arg("pip").arg("uninstall").arg("-y");
-    command.args(&req_names);
-    let status = command.status().context("failed to uninstall packages")?;
-    if !status.success() {
-        bail!("Failed to remove packages: {}", status);
+    if format != "columns" {
+        set_log_to_stderr(true);
     }
-    for name in req_names {
-        cfg.deps.remove(&name);
+    let columns = columns.unwrap_or_else(|| {
+        let mut default = vec!["name", "version", "size", "installer", "group"];
+        if outdated_only {
+            default.insert(2, "latest");
+        }
+        default.into_iter().map(str::to_string).collect()
+    });
+    if let Some(unknown) = columns.iter().find(|c| !LIST_COLUMNS.contains(&c.as_str())) {
+        bail_kind!(
+            ErrorKind::Usage,
+            "unknown list column '{unknown}' (expected {})",
+            LIST_COLUMNS.join(", ")
+        );
+    }
+    let wd = env::current_dir().context("failed to get cwd")?;
+    let (mut cfg, toml_path) = load_or_create_project(&wd)?;
+    let runtime = ensure_runtime_for_project(ctx, &wd, &mut cfg)?;
+    if runtime.config_changed {
+        save_project(&toml_path, &cfg)?;
+    }
+
+    // The native listing reads the .dist-info directories directly, so it works offline and
+    // in environments the engine installed without pip. --pip asks pip instead.
+    let mut pkgs = if use_pip {
+        let output = run_python(
+            Command::new(&runtime.selection.python_exe).args(["-m", "pip", "list", "--format", "json"]),
+            "pip list",
+            python_timeout(),
+            false,
+        )?;
+        if !output.status.success() {
+            let stderr = String::from_utf8_lossy(&output.stderr);
+            let stdout = String::from_utf8_lossy(&output.stdout);
+            bail!("Failed to list packages: {}\n{}{}", output.status, stdout, stderr);
+        }
+        parse_pip_list_output(&output.stdout)?
+            .into_iter()
+            .map(|pkg| InstalledDist {
+                name: pkg.name,
+                version: pkg.version,
+                size: None,
+                installer: None,
+            })
+            .collect()
+    } else {
+        list_installed_packages(&runtime.selection.site_packages)
+    };
+    pkgs.sort_by(|a, b| a.name.to_lowercase().cmp(&b.name.to_lowercase()));
+    let wanted = match (&group, filter_main) {
+        (Some(group), _) => Some(group.as_str()),
+        (None, true) => Some("main"),
+        (None, false) => None,
+    };
+    let mut rows = pkgs
+        .into_iter()
+        .map(|dist| {
+            let groups = cfg.dep_groups(&normalize_dep_name(&dist.name));
+            ListRow {
+                dist,
+                groups,
+                latest: None,
+            }
+        })
+        .filter(|row| wanted.map(|w| row.groups.iter().any(|g| g == w)).unwrap_or(true))
+        .collect::<Vec<_>>();
+
+    // Packages PyPI does not know (local builds) just get no latest version. Packages the
+    // project takes from another index are not looked up on PyPI at all: a public package
+    // of the same name says nothing about the private one.
+    if outdated_only || columns.iter().any(|c| c == "latest") {
+        let indexes = IndexPlan::load(ctx, &cfg)?;
+        let public = rows
+            .iter()
+            .map(|row| indexes.serves_from_pypi(&row.dist.name))
+            .collect::<Vec<_>>();
+        let names = rows
+            .iter()
+            .zip(&public)
+            .filter(|(_, public)| **public)
+            .map(|(row, _)| row.dist.name.clone())
+            .collect::<Vec<_>>();
+        let mut lookups = fetch_metadata_parallel(ctx, &names, Path::new(&cfg.cache.global_dir))?.into_iter();
+        for (row, _) in rows.iter_mut().zip(&public).filter(|(_, public)| **public) {
+            row.latest = lookups
+                .next()
+                .and_then(|metadata| {
+                    metadata
+                        .map(|m| m.info.version)
+                        .map_err(|err| debug(&format!("No latest version for {}: {err:#}", row.dist.name)))
+                        .ok()
+                });
+        }
+        let unknown = names.len() - rows.iter().filter(|row| row.latest.is_some()).count();
+        if unknown > 0 {
+            warning(&format!("Could not look up the latest version of {unknown} package(s); run with -v for details"));
+        }
+        let private = public.iter().filter(|public| !**public).count();
+        if private > 0 {
+            info(&format!(
+                "{private} package(s) are not installed from PyPI and were not checked for updates"
+            ));
+        }
+    }
+    if outdated_only {
+        rows.retain(|row| {
+            row.latest
+                .as_ref()
+                .is_some_and(|latest| compare_version(latest, &row.dist.version) == Ordering::Greater)
+        });
+    }
+
+    match format.as_str() {
+        "json" => {
+            let entries = rows
+                .iter()
+                .map(|row| {
+                    json!({
+                        "name": row.dist.name,
+                        "version": row.dist.version,
+                        "latest": row.latest,
+                        "size_bytes": row.dist.size,
+                        "installer": row.dist.installer,
+                        "groups": row.groups,
+                        "direct": !row.groups.is_empty(),
+                    })
+                })
+                .collect::<Vec<_>>();
+            println!("{}", serde_json::to_string_pretty(&entries)?);
+        }
+        "freeze" => {
+            for row in &rows {
+                println!("{}=={}", row.dist.name, row.dist.version);
+            }
+        }
+        _ => print_pkg_table(&rows, &columns),
+    }
+    Ok(())
+}
+
+fn cmd_check(ctx: &AppContext, args: &[String]) -> Result<()> {
+    if args.len() != 1 {
+        bail!("usage: xe check <package_name>");
+    }
+    let name = &args[0];
+    // The installed version is looked up where `xe run` would import it from: the project's
+    // venv or site-packages, or the default runtime outside a project. A missing runtime
+    // is reported, not created.
+    let wd = env::current_dir().context("failed to get cwd")?;
+    let cfg = if wd.join(XE_TOML).exists() {
+        load_project(&wd.join(XE_TOML))?
+    } else {
+        let mut cfg = Config::new_default(&wd);
+        cfg.settings.autovenv = false;
+        cfg
+    };
+    let selection = existing_runtime_for_project(ctx, &wd, &cfg)?;
+    let installed = selection
+        .as_ref()
+        .and_then(|selection| installed_versions(&selection.site_packages).remove(&normalize_dep_name(name)));
+    let target = match &selection {
+        Some(selection) if selection.is_venv => format!("venv {}", selection.venv_name),
+        Some(selection) => selection.site_packages.display().to_string(),
+        None => "no environment is installed yet".to_string(),
+    };
+
+    match fetch_metadata_from_pypi(name, Path::new(&cfg.cache.global_dir)) {
+        Ok(metadata) => {
+            println!("Name: {}", metadata.info.name);
+            println!("Version: {}", metadata.info.version);
+            println!("Summary: {}", metadata.info.summary);
+            println!("Home-page: {}", metadata.info.home_page);
+        }
+        // A package only on a private index can still be reported as installed.
+        Err(err) if installed.is_some() => {
+            warning(&format!("{err:#}"));
+            println!("Name: {name}");
+        }
+        Err(err) => return Err(err),
+    }
+    match installed {
+        Some(version) => println!("Installed: {version} ({target})"),
+        None => println!("Installed: no ({target})"),
+    }
+    Ok(())
+}
+
+fn cmd_remove(ctx: &AppContext, args: &[String]) -> Result<()> {
+    let (group, args) = parse_group_flags(args)?;
+    let args = args.as_slice();
+    if args.is_empty() {
+        bail!("usage: xe remove [--dev | --group <name>] <package_name>...");
+    }
+    let wd = env::current_dir().context("failed to get cwd")?;
+    let (mut cfg, toml_path) = load_or_create_project(&wd)?;
+    let runtime = ensure_runtime_for_project(ctx, &wd, &mut cfg)?;
+    if runtime.config_changed {
+        save_project(&toml_path, &cfg)?;
+    }
+
+    let is_remove_all = args.len() == 1 && args[0].eq_ignore_ascii_case("all");
+    if is_remove_all && group.is_some() {
+        let group = group.unwrap_or_default();
+        let Some(deps) = cfg.groups.remove(&group) else {
+            bail!("group {group} is not defined in xe.toml");
+        };
+        let to_remove = deps
+            .deps
+            .keys()
+            .filter(|name| cfg.dep_groups(name).is_empty())
+            .cloned()
+            .collect::<Vec<_>>();
+        if !to_remove.is_empty() {
+            let mut command = Command::new(&runtime.selection.python_exe);
+            command.arg("-m").arg("pip").arg("uninstall").arg("-y");
+            command.args(&to_remove);
+            let status = command.status().context("failed to uninstall packages")?;
+            if !status.success() {
+                bail!("Failed to remove group {}: {}", group, status);
+            }
+        }
+        save_project(&toml_path, &cfg)?;
+        prune_lockfile(&wd, &cfg, &runtime.selection.site_packages)?;
+        success(&format!("Removed group {group} ({} package(s))", to_remove.len()));
+        return Ok(());
+    }
+    if is_remove_all {
+        let out = run_python(
+            Command::new(&runtime.selection.python_exe).args(["-m", "pip", "list", "--format", "json"]),
+            "pip list",
+            python_timeout(),
+            false,
+        )?;
+        if !out.status.success() {
+            bail!("Failed to list packages: {}", out.status);
+        }
+        let pkgs = parse_pip_list_output(&out.stdout)?;
+        let to_remove: Vec<String> = pkgs
+            .iter()
+            .filter_map(|p| {
+                let n = p.name.to_lowercase();
+                if n == "pip" || n == "setuptools" || n == "wheel" {
+                    None
+                } else {
+                    Some(p.name.clone())
+                }
+            })
+            .collect();
+        if !to_remove.is_empty() {
+            let mut command = Command::new(&runtime.selection.python_exe);
+            command.arg("-m").arg("pip").arg("uninstall").arg("-y");
+            command.args(&to_remove);
+            let status = command.status().context("failed to uninstall packages")?;
+            if !status.success() {
+                bail!("Failed to remove all packages: {}", status);
+            }
+        }
+        cfg.deps.clear();
+        cfg.groups.clear();
+        save_project(&toml_path, &cfg)?;
+        prune_lockfile(&wd, &cfg, &runtime.selection.site_packages)?;
+        success("Removed all packages from active environment");
+        return Ok(());
+    }
+
+    let mut req_names = Vec::new();
+    for raw in args {
+        if let Some(n) = requirement_to_dep_name(raw) {
+            req_names.push(n);
+        }
+    }
+    if req_names.is_empty() {
+        bail!("No valid package names provided");
+    }
+    let label = group.clone().unwrap_or_else(|| "main".to_string());
+    let deps = cfg.deps_for_mut(group.as_deref());
+    for name in &req_names {
+        if deps.remove(name).is_none() {
+            warning(&format!("{name} is not declared in group {label}"));
+        }
+    }
+    if let Some(group) = &group {
+        if cfg.groups.get(group).is_some_and(DepGroup::is_empty) {
+            cfg.groups.remove(group);
+        }
+    }
+    // Keep packages that another group still declares installed.
+    let (still_needed, to_uninstall): (Vec<String>, Vec<String>) = req_names
+        .into_iter()
+        .partition(|name| !cfg.dep_groups(name).is_empty());
+    for name in &still_needed {
+        info(&format!(
+            "Keeping {name} installed; still declared in {}",
+            cfg.dep_groups(name).join(", ")
+        ));
+    }
+    if !to_uninstall.is_empty() {
+        let mut command = Command::new(&runtime.selection.python_exe);
+        command.arg("-m").arg("pip").arg("uninstall").arg("-y");
+        command.args(&to_uninstall);
+        let status = command.status().context("failed to uninstall packages")?;
+        if !status.success() {
+            bail!("Failed to remove packages: {}", status);
+        }
     }
     save_project(&toml_path, &cfg)?;
+    prune_lockfile(&wd, &cfg, &runtime.selection.site_packages)?;
     success(&format!("Removed {} package(s)", args.len()));
     Ok(())
 }
 
 fn cmd_run(ctx: &AppContext, args: &[String]) -> Result<()> {
+    let (with, args) = take_with_flags(args)?;
+    let args = &take_python_flag(&args, true)?;
     let wd = env::current_dir().context("failed to get cwd")?;
+    if let Some(first) = args.first().filter(|a| a.ends_with(".py")) {
+        if let Some(metadata) = read_inline_script_metadata(Path::new(first))? {
+            if !with.is_empty() {
+                bail_kind!(ErrorKind::Usage, "--with cannot be used with a script that declares its own dependencies");
+            }
+            return run_inline_script(ctx, metadata, first, &args[1..]);
+        }
+    }
     let (mut cfg, toml_path) = load_or_create_project(&wd)?;
     let runtime = ensure_runtime_for_project(ctx, &wd, &mut cfg)?;
     if runtime.config_changed {
         save_project(&toml_path, &cfg)?;
     }
     let mut command_args = args.to_vec();
+    let mut raw_command = false;
     if let Some(first) = command_args.first() {
         if first == "--" {
             command_args.remove(0);
+            raw_command = true;
         }
     }
     if command_args.is_empty() {
         bail!("No command provided after '--'");
     }
-    let mut command_name = command_args[0].clone();
-    if command_name.eq_ignore_ascii_case("python") || command_name.eq_ignore_ascii_case("python.exe")
-    {
-        command_name = runtime.selection.python_exe.to_string_lossy().to_string();
+    let overlay = if with.is_empty() {
+        None
+    } else {
+        Some(install_run_overlay(ctx, &cfg, &wd, &runtime.selection, &with)?)
+    };
+    let status = (|| {
+        run_hooks(&cfg, "pre-run", &wd, &runtime.selection)?;
+        let mut command = project_command(&cfg, &runtime.selection, &command_args, raw_command)?;
+        if let Some(overlay) = &overlay {
+            prepend_python_path(&mut command, overlay)?;
+        }
+        command.stdin(Stdio::inherit());
+        command.stdout(Stdio::inherit());
+        command.stderr(Stdio::inherit());
+        command.status().context("failed to run command")
+    })();
+    if let Some(overlay) = &overlay {
+        let _ = fs::remove_dir_all(overlay);
+    }
+    if let Some(code) = status?.code() {
+        if code != 0 {
+            std::process::exit(code);
+        }
     }
+    Ok(())
+}
 
-    let mut command = Command::new(command_name);
-    command.args(&command_args[1..]);
-    apply_runtime_env(&mut command, &runtime.selection)?;
-    command.stdin(Stdio::inherit());
-    command.stdout(Stdio::inherit());
-    command.stderr(Stdio::inherit());
-    let status = command.status().context("failed to run command")?;
+// Removes the leading `--with <requirement>` (or `--with=<requirement>`) flags of `xe run`,
+// leaving `--python` for take_python_flag, and returns the requirements.
+fn take_with_flags(args: &[String]) -> Result<(Vec<String>, Vec<String>)> {
+    let mut with = Vec::new();
+    let mut rest = Vec::with_capacity(args.len());
+    let mut idx = 0usize;
+    while idx < args.len() {
+        let arg = args[idx].as_str();
+        let requirement = if arg == "--with" {
+            idx += 1;
+            args.get(idx).map(String::as_str)
+        } else if let Some(value) = arg.strip_prefix("--with=") {
+            Some(value)
+        } else if arg == "--python" || arg.starts_with("--python=") {
+            let end = if arg == "--python" { idx + 2 } else { idx + 1 };
+            rest.extend_from_slice(&args[idx..end.min(args.len())]);
+            idx = end;
+            continue;
+        } else {
+            rest.extend_from_slice(&args[idx..]);
+            break;
+        };
+        match requirement.map(str::trim).filter(|r| !r.is_empty() && !r.starts_with('-')) {
+            Some(requirement) => with.push(requirement.to_string()),
+            None => bail_kind!(ErrorKind::Usage, "--with requires a requirement, e.g. --with ipdb==0.13.13"),
+        }
+        idx += 1;
+    }
+    Ok((with, rest))
+}
+
+// Installs the `--with` requirements of `xe run` into a temporary site-packages directory
+// for one invocation. They are resolved together with the project's (locked) requirements
+// and only what the project environment lacks lands in the overlay, so xe.toml, xe.lock
+// and the environment itself are left alone. The caller removes the directory.
+fn install_run_overlay(
+    ctx: &AppContext,
+    cfg: &Config,
+    wd: &Path,
+    selection: &RuntimeSelection,
+    with: &[String],
+) -> Result<PathBuf> {
+    let overlay = tempfile_path("xe-overlay", "d");
+    fs::create_dir_all(&overlay).with_context(|| format!("failed to create {}", overlay.display()))?;
+    let installed = (|| {
+        let mut requirements = locked_requirements(wd, cfg, project_requirements(wd, cfg)?)?;
+        requirements.extend(with.iter().cloned());
+        info(&format!("Adding {} for this run...", with.join(", ")));
+        Installer::new(Path::new(&cfg.cache.global_dir))?
+            .layered_on(&selection.site_packages)
+            .install(ctx, cfg, &requirements, wd, &overlay, &selection.python_exe)
+    })();
+    if let Err(err) = installed {
+        let _ = fs::remove_dir_all(&overlay);
+        return Err(err);
+    }
+    Ok(overlay)
+}
+
+// Puts `dir` first on the PYTHONPATH that apply_runtime_env gave `command`.
+fn prepend_python_path(command: &mut Command, dir: &Path) -> Result<()> {
+    let current = command
+        .get_envs()
+        .find(|(key, _)| *key == "PYTHONPATH")
+        .and_then(|(_, value)| value.map(|v| v.to_os_string()))
+        .or_else(|| env::var_os("PYTHONPATH"))
+        .unwrap_or_default();
+    let mut entries = vec![dir.to_path_buf()];
+    entries.extend(env::split_paths(&current).filter(|p| !p.as_os_str().is_empty()));
+    let joined = env::join_paths(&entries).context("failed to build PYTHONPATH")?;
+    command.env("PYTHONPATH", joined);
+    Ok(())
+}
+
+// PEP 723 inline metadata: the `# /// script` block of a single-file script.
+#[derive(Debug, Default, Deserialize)]
+#[serde(rename_all = "kebab-case")]
+struct InlineScriptMetadata {
+    #[serde(default)]
+    requires_python: String,
+    #[serde(default)]
+    dependencies: Vec<String>,
+}
+
+fn read_inline_script_metadata(path: &Path) -> Result<Option<InlineScriptMetadata>> {
+    let Ok(text) = fs::read_to_string(path) else {
+        return Ok(None);
+    };
+    let block = Regex::new(r"(?m)^# /// (?P<type>[a-zA-Z0-9-]+)$\s(?P<content>(^#(| .*)$\s)+)^# ///$")
+        .expect("valid script metadata regex");
+    let mut blocks = block.captures_iter(&text).filter(|c| &c["type"] == "script");
+    let Some(found) = blocks.next() else {
+        return Ok(None);
+    };
+    if blocks.next().is_some() {
+        bail_kind!(ErrorKind::Config, "{} has more than one `# /// script` block", path.display());
+    }
+    let content = found["content"]
+        .lines()
+        .map(|line| line.strip_prefix("# ").unwrap_or(line.trim_start_matches('#')))
+        .collect::<Vec<_>>()
+        .join("\n");
+    let metadata = toml::from_str(&content)
+        .with_context(|| format!("invalid `# /// script` metadata in {}", path.display()))?;
+    Ok(Some(metadata))
+}
+
+// Runs a script with inline metadata in a cached environment keyed by its dependency set,
+// independent of any surrounding project.
+fn run_inline_script(ctx: &AppContext, metadata: InlineScriptMetadata, script: &str, args: &[String]) -> Result<()> {
+    let python_version = inline_script_python(ctx, &metadata.requires_python)?;
+    let mut deps = metadata.dependencies;
+    deps.sort();
+    deps.dedup();
+    let env_name = format!("script-{}", &solve_key(&python_version, &deps)[..12]);
+    let selection = ensure_cached_env(ctx, &xe_script_env_dir(), &env_name, &deps, &python_version, false)?;
+    let mut command = Command::new(&selection.python_exe);
+    command.arg(script).args(args);
+    apply_runtime_env(&mut command, &selection)?;
+    let status = command.status().with_context(|| format!("failed to run {script}"))?;
     if let Some(code) = status.code() {
         if code != 0 {
             std::process::exit(code);
@@ -403,71 +1433,549 @@ fn cmd_run(ctx: &AppContext, args: &[String]) -> Result<()> {
     Ok(())
 }
 
-fn cmd_shell(ctx: &AppContext, _args: &[String]) -> Result<()> {
+// Minor versions xe knows how to install, newest first.
+const SUPPORTED_PYTHONS: [&str; 5] = ["3.13", "3.12", "3.11", "3.10", "3.9"];
+
+// Minor versions of the runtimes under the xe Python directory, including ones outside
+// SUPPORTED_PYTHONS that the user installed there.
+fn installed_runtime_versions(pm: &PythonManager) -> Vec<String> {
+    let runtime_dir = Regex::new(r"^python(\d)(\d+)$").expect("valid runtime dir regex");
+    let mut versions = fs::read_dir(&pm.base_dir)
+        .into_iter()
+        .flatten()
+        .flatten()
+        .filter_map(|entry| {
+            let dir_name = entry.file_name().to_string_lossy().to_string();
+            let caps = runtime_dir.captures(&dir_name)?;
+            Some(format!("{}.{}", &caps[1], &caps[2]))
+        })
+        .collect::<Vec<_>>();
+    versions.sort_by(|a, b| compare_version(b, a));
+    versions
+}
+
+// The preferred Python when it satisfies `requires-python`, otherwise the newest
+// satisfying version, preferring ones already installed.
+fn inline_script_python(ctx: &AppContext, requires_python: &str) -> Result<String> {
+    let preferred = get_preferred_python_version(ctx)?;
+    if python_satisfies(&preferred, requires_python) {
+        return Ok(preferred);
+    }
+    let pm = PythonManager::new()?;
+    let mut candidates = SUPPORTED_PYTHONS.iter().map(|v| v.to_string()).collect::<Vec<_>>();
+    for version in installed_runtime_versions(&pm) {
+        if !candidates.contains(&version) {
+            candidates.push(version);
+        }
+    }
+    candidates.retain(|v| python_satisfies(v, requires_python));
+    candidates.sort_by(|a, b| compare_version(b, a));
+    let chosen = candidates
+        .iter()
+        .find(|v| pm.get_python_exe(v).is_ok_and(|exe| exe.exists()))
+        .or(candidates.first());
+    match chosen {
+        Some(version) => Ok(version.to_string()),
+        None => bail_kind!(
+            ErrorKind::RuntimeMissing,
+            "no supported Python version satisfies requires-python {requires_python}"
+        ),
+    }
+}
+
+// Checks a major.minor version against a PEP 440 specifier set such as ">=3.10,<3.13"
+// or "==3.*".
+fn python_satisfies(version: &str, specifier: &str) -> bool {
+    specifier.split(',').map(str::trim).filter(|c| !c.is_empty()).all(|clause| {
+        let op_len = clause.find(|c: char| c.is_ascii_digit()).unwrap_or(clause.len());
+        let op = clause[..op_len].trim();
+        let bound = clause[op_len..].trim();
+        let wildcard = bound.ends_with(".*");
+        let bound = bound.trim_end_matches(".*");
+        // Compare at the precision of the bound so "3.12" satisfies "==3.12" and "<=3.12.4";
+        // a wildcard only compares the segments it spells out, so "3.12" matches "==3.*".
+        let depth = if wildcard {
+            bound.split('.').count()
+        } else {
+            bound.split('.').count().max(2)
+        };
+        let have = version.split('.').chain(std::iter::repeat("0")).take(depth).collect::<Vec<_>>().join(".");
+        let ord = compare_version(&have, bound);
+        match op {
+            ">=" => ord != Ordering::Less,
+            ">" => ord == Ordering::Greater,
+            "<=" => ord != Ordering::Greater,
+            "<" => ord == Ordering::Less,
+            "==" | "===" | "" => ord == Ordering::Equal,
+            "!=" => ord != Ordering::Equal,
+            "~=" => {
+                let prefix = bound.rsplit_once('.').map(|(p, _)| p).unwrap_or(bound);
+                ord != Ordering::Less && (have == prefix || have.starts_with(&format!("{prefix}.")))
+            }
+            _ => true,
+        }
+    })
+}
+
+// Builds the command `xe run` starts: a [scripts] entry expanded with the extra args (unless
+// `raw`), or the command itself, with `python` mapped to the runtime interpreter.
+fn project_command(cfg: &Config, selection: &RuntimeSelection, args: &[String], raw: bool) -> Result<Command> {
+    let mut command_args = args.to_vec();
+    if !raw {
+        if let Some(script) = cfg.scripts.get(&command_args[0]) {
+            let mut expanded = script
+                .split_whitespace()
+                .map(str::to_string)
+                .collect::<Vec<_>>();
+            if expanded.is_empty() {
+                bail!("script '{}' is empty", command_args[0]);
+            }
+            expanded.extend(command_args.drain(1..));
+            command_args = expanded;
+        }
+    }
+    // `python` and `python3` always mean the selected interpreter, the one add and sync
+    // install into, rather than whichever comes first on PATH.
+    let mut command_name = command_args[0].clone();
+    let bare = command_name.to_lowercase();
+    if matches!(bare.strip_suffix(".exe").unwrap_or(&bare), "python" | "python3") {
+        command_name = selection.python_exe.to_string_lossy().to_string();
+    }
+
+    let mut command = Command::new(command_name);
+    command.args(&command_args[1..]);
+    apply_runtime_env(&mut command, selection)?;
+    Ok(command)
+}
+
+fn cmd_activate(ctx: &AppContext, args: &[String]) -> Result<()> {
+    let shell = match args {
+        [] => detect_shell(),
+        [flag, name] if flag == "--shell" => ShellKind::parse(name)
+            .ok_or_else(|| anyhow!("unsupported shell '{name}' (supported: bash, zsh, fish, pwsh, cmd)"))?,
+        _ => bail!("usage: xe activate [--shell <bash|zsh|fish|pwsh|cmd>]"),
+    };
+    set_log_to_stderr(true);
+    let wd = env::current_dir().context("failed to get cwd")?;
+    let (mut cfg, toml_path) = load_or_create_project(&wd)?;
+    let runtime = ensure_runtime_for_project(ctx, &wd, &mut cfg)?;
+    if runtime.config_changed {
+        save_project(&toml_path, &cfg)?;
+    }
+    let vars = runtime_env(&runtime.selection)?;
+    print!("{}", render_activation(shell, &vars));
+    io::stdout().flush().ok();
+    Ok(())
+}
+
+fn cmd_shell(ctx: &AppContext, args: &[String]) -> Result<()> {
+    let (kind, program) = match args {
+        [] => detect_shell_program(),
+        [flag, name] if flag == "--shell" => {
+            let kind = ShellKind::parse(name)
+                .ok_or_else(|| anyhow!("unsupported shell '{name}' (supported: bash, zsh, fish, pwsh, cmd)"))?;
+            (kind, name.clone())
+        }
+        _ => bail!("usage: xe shell [--shell <bash|zsh|fish|pwsh|cmd>]"),
+    };
     let wd = env::current_dir().context("failed to get cwd")?;
     let (mut cfg, toml_path) = load_or_create_project(&wd)?;
     let runtime = ensure_runtime_for_project(ctx, &wd, &mut cfg)?;
     if runtime.config_changed {
         save_project(&toml_path, &cfg)?;
     }
+    if env::var_os("XE_SHELL").is_some() {
+        warning("Already inside an xe shell; starting a nested one.");
+    }
 
-    info("Entering xe project shell...");
+    info(&format!("Entering xe project shell ({})...", kind.name()));
     info("Type 'exit' to return to normal shell.");
 
-    let shell = if cfg!(windows) { "cmd.exe" } else { "bash" };
-    let mut command = Command::new(shell);
-    apply_runtime_env(&mut command, &runtime.selection)?;
+    let label = format!("(xe:{})", shell_safe_label(&cfg.project.name));
+    spawn_runtime_shell(kind, &program, &runtime.selection, &label)
+}
+
+// Runs an interactive shell with `selection` first on PATH and `label` in the prompt.
+fn spawn_runtime_shell(kind: ShellKind, program: &str, selection: &RuntimeSelection, label: &str) -> Result<()> {
+    let mut command = Command::new(program);
+    apply_runtime_env(&mut command, selection)?;
+    command.env("XE_SHELL", kind.name());
+    command.env("VIRTUAL_ENV_PROMPT", label);
+    let prompt_file = configure_shell_prompt(&mut command, kind, program, label)?;
     command.stdin(Stdio::inherit());
     command.stdout(Stdio::inherit());
     command.stderr(Stdio::inherit());
-    let status = command.status().context("failed to spawn shell")?;
+    let status = command.status();
+    if let Some(path) = prompt_file {
+        if path.is_dir() {
+            let _ = fs::remove_dir_all(&path);
+        } else {
+            let _ = fs::remove_file(&path);
+        }
+    }
+    let status = status.with_context(|| format!("failed to spawn shell {program}"))?;
     if !status.success() {
         bail!("shell exited with {}", status);
     }
     Ok(())
 }
 
-fn cmd_init(ctx: &AppContext, args: &[String]) -> Result<()> {
-    let mut name = String::new();
-    let mut python_version = String::new();
+// `xe venv repair` points a venv at the current location of its interpreter with
+// `venv --upgrade`, keeping installed packages. `xe venv recreate` rebuilds it from scratch
+// and reinstalls the dependencies of every project that uses it.
+fn cmd_venv_repair(ctx: &AppContext, args: &[String], recreate: bool) -> Result<()> {
+    let usage = format!(
+        "usage: xe venv {} <name> [--python <version>]",
+        if recreate { "recreate" } else { "repair" }
+    );
+    let mut name = None;
+    let mut version = None;
     let mut idx = 0usize;
     while idx < args.len() {
         match args[idx].as_str() {
             "-p" | "--python" => {
-                let value = args
-                    .get(idx + 1)
-                    .ok_or_else(|| anyhow!("--python requires a version"))?;
-                python_version = value.clone();
+                version = Some(args.get(idx + 1).ok_or_else(|| anyhow!("{usage}"))?.clone());
                 idx += 2;
             }
-            value if !value.starts_with('-') && name.is_empty() => {
-                name = value.to_string();
+            other if other.starts_with('-') || name.is_some() => bail!("{usage}"),
+            other => {
+                name = Some(normalize_venv_name(other));
                 idx += 1;
             }
-            _ => bail!("usage: xe init [name] [--python <version>]"),
         }
     }
-
-    let mut wd = env::current_dir().context("failed to get cwd")?;
-    if !name.is_empty() && name != "." {
-        wd = wd.join(name);
-        fs::create_dir_all(&wd).with_context(|| format!("failed to create {}", wd.display()))?;
-    }
-    println!("Initializing project at {}...", wd.display());
-
-    let mut version = python_version;
-    if version.is_empty() {
-        version = get_preferred_python_version(ctx)?;
+    let Some(name) = name.filter(|n| !n.is_empty()) else {
+        bail!("{usage}");
+    };
+    let vm = VenvManager::new()?;
+    if !vm.exists(&name) {
+        bail_kind!(ErrorKind::RuntimeMissing, "Venv {} does not exist", name);
     }
+    let venv = vm.info(&name)?;
+    let version = match version.or_else(|| {
+        parse_major_minor(&venv.python_version)
+            .ok()
+            .map(|(major, minor)| format!("{major}.{minor}"))
+    }) {
+        Some(version) => version,
+        None => bail_kind!(
+            ErrorKind::Config,
+            "cannot tell which Python venv {name} was created with; pass --python <version>"
+        ),
+    };
 
-    let pm = PythonManager::new()?;
-    if pm.get_python_exe(&version).is_err() {
-        if let Err(err) = pm.install(&version, ctx) {
-            warning(&format!("python install failed: {err}"));
+    if !recreate {
+        if is_python_runtime_healthy(&venv.python_exe) && Path::new(&venv.base_python).exists() {
+            success(&format!("Venv {name} is healthy"));
+            return Ok(());
         }
-    }
-
-    let mut cfg = Config::new_default(&wd);
+        let python_exe = PythonManager::new()?.ensure(&version, ctx)?;
+        info(&format!("Repairing venv {name} against {}...", python_exe.display()));
+        // venv --upgrade only recreates interpreter links that are missing, so dangling
+        // ones left by a moved runtime have to go first.
+        if let Some(bin_dir) = venv.python_exe.parent() {
+            for entry in fs::read_dir(bin_dir).into_iter().flatten().flatten() {
+                let path = entry.path();
+                let dangling = path.is_symlink() && !path.exists();
+                if dangling && entry.file_name().to_string_lossy().starts_with("python") {
+                    fs::remove_file(&path).with_context(|| format!("failed to remove {}", path.display()))?;
+                }
+            }
+        }
+        let status = Command::new(&python_exe)
+            .args(["-m", "venv", "--upgrade"])
+            .arg(&venv.path)
+            .status()
+            .context("failed to run venv --upgrade")?;
+        if !status.success() || !is_python_runtime_healthy(&venv.python_exe) {
+            bail_kind!(
+                ErrorKind::RuntimeMissing,
+                "could not repair venv {name}; run `xe venv recreate {name}` to rebuild it"
+            );
+        }
+        if let Some(mut manifest) = vm.manifest(&name) {
+            manifest.python_version = venv_python_version(&venv.path);
+            manifest.base_python = python_exe;
+            manifest.updated_at = timestamp_iso8601();
+            vm.write_manifest(&name, &manifest)?;
+        }
+        success(&format!("Repaired venv {name}"));
+        return Ok(());
+    }
+    if venv.adopted {
+        bail!("venv {name} was adopted from {}; recreate it with the tool that made it", venv.path.display());
+    }
+
+    let python_exe = PythonManager::new()?.ensure(&version, ctx)?;
+    info(&format!("Recreating venv {name} with Python {version}..."));
+    vm.delete(&name)?;
+    vm.create(&name, &python_exe, venv.created_by.as_deref())?;
+    let selection = vm.selection(&name)?;
+    for project in &venv.projects {
+        vm.record_project(&name, project);
+        let cfg = load_project(&project.join(XE_TOML))?;
+        let reqs = locked_requirements(project, &cfg, cfg.requirements_in(project)?)?;
+        if reqs.is_empty() {
+            continue;
+        }
+        info(&format!("Reinstalling {} dependency(ies) of {}...", reqs.len(), project.display()));
+        let installer = Installer::new(Path::new(&cfg.cache.global_dir))?;
+        installer.install(ctx, &cfg, &reqs, project, &selection.site_packages, &selection.python_exe)?;
+    }
+    success(&format!("Recreated venv {name}"));
+    print_install_summary(ctx);
+    Ok(())
+}
+
+// `xe venv tmp` runs a command in a throwaway venv under the temp directory, optionally with
+// one-off packages installed from the CAS, and deletes the venv when the command exits.
+fn cmd_venv_tmp(ctx: &AppContext, args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe venv tmp [--with <requirement>]... [--python <version>] -- <command> [args...]";
+    let mut with = Vec::new();
+    let mut python_version = None;
+    let mut idx = 0usize;
+    while idx < args.len() {
+        match args[idx].as_str() {
+            "-w" | "--with" => {
+                with.push(args.get(idx + 1).ok_or_else(|| anyhow!(USAGE))?.clone());
+                idx += 2;
+            }
+            "-p" | "--python" => {
+                python_version = Some(args.get(idx + 1).ok_or_else(|| anyhow!(USAGE))?.clone());
+                idx += 2;
+            }
+            "--" => {
+                idx += 1;
+                break;
+            }
+            _ => bail!(USAGE),
+        }
+    }
+    let command_args = &args[idx.min(args.len())..];
+    if command_args.is_empty() {
+        bail!(USAGE);
+    }
+    let python_version = match python_version {
+        Some(version) => version,
+        None => get_preferred_python_version(ctx)?,
+    };
+    let base_python = PythonManager::new()?.ensure(&python_version, ctx)?;
+
+    let base = tempfile_path("xe-venv", "tmp");
+    let vm = VenvManager::at(base.clone())?;
+    let result = (|| -> Result<std::process::ExitStatus> {
+        info(&format!("Creating temporary environment with Python {python_version}..."));
+        vm.create_env("env", &base_python)?;
+        let selection = vm.selection("env")?;
+        if !with.is_empty() {
+            let mut cfg = Config::new_default(&base);
+            cfg.python.version = python_version.clone();
+            let installer = Installer::new(&xe_cache_dir())?;
+            installer.install(ctx, &cfg, &with, &base, &selection.site_packages, &selection.python_exe)?;
+        }
+        let mut program = command_args[0].clone();
+        if program.eq_ignore_ascii_case("python") || program.eq_ignore_ascii_case("python.exe") {
+            program = selection.python_exe.to_string_lossy().to_string();
+        }
+        let mut command = Command::new(&program);
+        command.args(&command_args[1..]);
+        apply_runtime_env(&mut command, &selection)?;
+        command.env("VIRTUAL_ENV_PROMPT", "(xe:tmp)");
+        command
+            .status()
+            .with_context(|| format!("failed to run {}", command_args[0]))
+    })();
+    if let Err(err) = fs::remove_dir_all(&base) {
+        warning(&format!("failed to remove temporary environment {}: {err}", base.display()));
+    } else {
+        debug(&format!("Removed temporary environment {}", base.display()));
+    }
+    if let Some(code) = result?.code() {
+        if code != 0 {
+            std::process::exit(code);
+        }
+    }
+    Ok(())
+}
+
+// `xe venv activate <name>` opens a subshell in the venv; with --print it emits the
+// activation code for the current shell instead, for `eval "$(xe venv activate <name> --print)"`.
+fn cmd_venv_activate(args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe venv activate <name> [--print] [--shell <bash|zsh|fish|pwsh|cmd>]";
+    let mut name = None;
+    let mut print_only = false;
+    let mut shell = None;
+    let mut idx = 0usize;
+    while idx < args.len() {
+        match args[idx].as_str() {
+            "--print" => {
+                print_only = true;
+                idx += 1;
+            }
+            "--shell" => {
+                let value = args.get(idx + 1).ok_or_else(|| anyhow!("{USAGE}"))?;
+                let kind = ShellKind::parse(value)
+                    .ok_or_else(|| anyhow!("unsupported shell '{value}' (supported: bash, zsh, fish, pwsh, cmd)"))?;
+                shell = Some((kind, value.clone()));
+                idx += 2;
+            }
+            other if other.starts_with('-') || name.is_some() => bail!("{USAGE}"),
+            other => {
+                name = Some(normalize_venv_name(other));
+                idx += 1;
+            }
+        }
+    }
+    let Some(name) = name.filter(|n| !n.is_empty()) else {
+        bail!("{USAGE}");
+    };
+    let vm = VenvManager::new()?;
+    if !vm.exists(&name) {
+        bail_kind!(
+            ErrorKind::RuntimeMissing,
+            "Venv {} does not exist. Create it first with `xe venv create {}`",
+            name,
+            name
+        );
+    }
+    let selection = vm.selection(&name)?;
+    if print_only {
+        set_log_to_stderr(true);
+        let kind = shell.map(|(kind, _)| kind).unwrap_or_else(detect_shell);
+        print!("{}", render_activation(kind, &runtime_env(&selection)?));
+        io::stdout().flush().ok();
+        return Ok(());
+    }
+    let (kind, program) = shell.unwrap_or_else(detect_shell_program);
+    info(&format!("Entering venv {name} ({})...", kind.name()));
+    info("Type 'exit' to return to normal shell.");
+    spawn_runtime_shell(kind, &program, &selection, &format!("({})", shell_safe_label(&name)))
+}
+
+fn shell_safe_label(name: &str) -> String {
+    name.chars()
+        .filter(|c| c.is_ascii_alphanumeric() || matches!(c, '-' | '_' | '.'))
+        .collect()
+}
+
+// Prefixes the interactive prompt with `label` while keeping the user's own rc files.
+// Returns a temporary rc file or directory to delete once the shell exits.
+fn configure_shell_prompt(
+    command: &mut Command,
+    kind: ShellKind,
+    program: &str,
+    label: &str,
+) -> Result<Option<PathBuf>> {
+    let program_name = Path::new(program)
+        .file_stem()
+        .and_then(|s| s.to_str())
+        .unwrap_or("")
+        .to_lowercase();
+    match kind {
+        ShellKind::Bash if program_name == "bash" => {
+            let rc = tempfile_path("xe-bashrc", "sh");
+            let script = format!(
+                "[ -f \"$HOME/.bashrc\" ] && . \"$HOME/.bashrc\"\nPS1=\"{label} ${{PS1:-\\$ }}\"\n"
+            );
+            fs::write(&rc, script).with_context(|| format!("failed to write {}", rc.display()))?;
+            command.arg("--rcfile").arg(&rc).arg("-i");
+            Ok(Some(rc))
+        }
+        ShellKind::Bash => {
+            command.env("PS1", format!("{label} $ "));
+            Ok(None)
+        }
+        ShellKind::Zsh => {
+            let dir = tempfile_path("xe-zdotdir", "d");
+            fs::create_dir_all(&dir).with_context(|| format!("failed to create {}", dir.display()))?;
+            let original = env::var_os("ZDOTDIR")
+                .or_else(|| dirs::home_dir().map(|h| h.into_os_string()))
+                .unwrap_or_default();
+            let script = format!(
+                "ZDOTDIR=\"$XE_ORIGINAL_ZDOTDIR\"\n[ -f \"$ZDOTDIR/.zshrc\" ] && . \"$ZDOTDIR/.zshrc\"\nPROMPT=\"{label} $PROMPT\"\n"
+            );
+            let rc = dir.join(".zshrc");
+            fs::write(&rc, script).with_context(|| format!("failed to write {}", rc.display()))?;
+            command.env("XE_ORIGINAL_ZDOTDIR", original);
+            command.env("ZDOTDIR", &dir);
+            Ok(Some(dir))
+        }
+        ShellKind::Fish => {
+            command.arg("-C").arg(format!(
+                "functions -c fish_prompt _xe_fish_prompt; function fish_prompt; echo -n '{label} '; _xe_fish_prompt; end"
+            ));
+            Ok(None)
+        }
+        ShellKind::PowerShell => {
+            command.arg("-NoExit").arg("-Command").arg(format!(
+                "$function:_xe_prompt = $function:prompt; function global:prompt {{ '{label} ' + (& $function:_xe_prompt) }}"
+            ));
+            Ok(None)
+        }
+        ShellKind::Cmd => {
+            command.arg("/K").arg(format!("prompt {label} $P$G"));
+            Ok(None)
+        }
+    }
+}
+
+fn cmd_init(ctx: &AppContext, args: &[String]) -> Result<()> {
+    let mut name = String::new();
+    let mut python_version = String::new();
+    let mut template_name = String::new();
+    let mut venv_strategy = None;
+    let mut idx = 0usize;
+    while idx < args.len() {
+        match args[idx].as_str() {
+            "--venv" => {
+                let value = args
+                    .get(idx + 1)
+                    .ok_or_else(|| anyhow!("--venv requires autovenv, local or global"))?;
+                venv_strategy = Some(VenvStrategy::parse(value)?);
+                idx += 2;
+            }
+            "-p" | "--python" => {
+                let value = args
+                    .get(idx + 1)
+                    .ok_or_else(|| anyhow!("--python requires a version"))?;
+                python_version = value.clone();
+                idx += 2;
+            }
+            "-t" | "--template" => {
+                let value = args
+                    .get(idx + 1)
+                    .ok_or_else(|| anyhow!("--template requires a name"))?;
+                template_name = value.clone();
+                idx += 2;
+            }
+            value if !value.starts_with('-') && name.is_empty() => {
+                name = value.to_string();
+                idx += 1;
+            }
+            _ => bail!("usage: xe init [name] [--python <version>] [--template <name>] [--venv <autovenv|local|global>]"),
+        }
+    }
+
+    let template = if template_name.is_empty() {
+        None
+    } else {
+        Some(load_project_template(&template_name)?)
+    };
+
+    let mut wd = env::current_dir().context("failed to get cwd")?;
+    if !name.is_empty() && name != "." {
+        wd = wd.join(name);
+        fs::create_dir_all(&wd).with_context(|| format!("failed to create {}", wd.display()))?;
+    }
+    println!("Initializing project at {}...", wd.display());
+
+    let mut version = python_version;
+    if version.is_empty() {
+        version = get_preferred_python_version(ctx)?;
+    }
+
+    let pm = PythonManager::new()?;
+    let mut cfg = Config::new_default(&wd);
     if cfg.project.name.is_empty() {
         cfg.project.name = wd
             .file_name()
@@ -475,14 +1983,411 @@ fn cmd_init(ctx: &AppContext, args: &[String]) -> Result<()> {
             .unwrap_or("project")
             .to_string();
     }
+    // The wizard runs on a terminal unless --yes or --non-interactive is given; otherwise the
+    // flags and defaults are taken as they are.
+    let wizard = is_interactive() && !ASSUME_YES.load(AtomicOrdering::Relaxed);
+    let mut initial_deps = Vec::new();
+    if wizard {
+        let name = prompt_line(&format!("project name [{}]", cfg.project.name), "")?;
+        if !name.is_empty() {
+            cfg.project.name = name;
+        }
+        version = prompt_init_python(&pm, &version)?;
+        venv_strategy = Some(prompt_venv_strategy(venv_strategy.unwrap_or(VenvStrategy::Auto))?);
+        let deps = prompt_line("initial dependencies (separated by spaces or commas, empty for none)", "")?;
+        initial_deps = deps
+            .split(|c: char| c == ',' || c.is_whitespace())
+            .filter(|d| !d.is_empty())
+            .map(str::to_string)
+            .collect();
+    }
+
+    if pm.get_python_exe(&version).is_err() {
+        if let Err(err) = pm.install(&version, ctx) {
+            warning(&format!("python install failed: {err}"));
+        }
+    }
     cfg.python.version = version;
+    for dep in &initial_deps {
+        let Some(dep_name) = requirement_to_dep_name(dep) else {
+            bail!("invalid requirement \"{dep}\"");
+        };
+        let pin = dep
+            .split_once("==")
+            .map(|(_, v)| v.trim().to_string())
+            .unwrap_or_else(|| "*".to_string());
+        cfg.deps.insert(dep_name, pin);
+    }
+    match venv_strategy {
+        Some(VenvStrategy::Auto) => cfg.settings.autovenv = true,
+        Some(VenvStrategy::Local) => cfg.venv.name = create_local_venv(&pm, &wd, &cfg)?,
+        Some(VenvStrategy::Global) | None => {}
+    }
+    if let Some(template) = template.as_ref() {
+        let package = python_package_name(&cfg.project.name);
+        for (rel, content) in &template.files {
+            let rel = render_template_text(rel, &cfg.project.name, &package);
+            let path = wd.join(&rel);
+            if path.exists() {
+                warning(&format!("Skipping existing file {}", path.display()));
+                continue;
+            }
+            if let Some(parent) = path.parent() {
+                fs::create_dir_all(parent)
+                    .with_context(|| format!("failed to create {}", parent.display()))?;
+            }
+            let data = match String::from_utf8(content.clone()) {
+                Ok(text) => render_template_text(&text, &cfg.project.name, &package).into_bytes(),
+                Err(_) => content.clone(),
+            };
+            fs::write(&path, data).with_context(|| format!("failed to write {}", path.display()))?;
+            println!("Created {}", path.display());
+        }
+        for dep in &template.deps {
+            if let Some(dep_name) = requirement_to_dep_name(dep) {
+                cfg.deps.insert(dep_name, "*".to_string());
+            }
+        }
+        for (script, command) in &template.scripts {
+            cfg.scripts.insert(
+                script.clone(),
+                render_template_text(command, &cfg.project.name, &package),
+            );
+        }
+    }
     let toml_path = wd.join(XE_TOML);
     save_project(&toml_path, &cfg)?;
     println!("Created {}", toml_path.display());
+    if let Some(template) = template.as_ref() {
+        println!("Applied template '{}'.", template.name);
+        if !template.deps.is_empty() && !wizard {
+            println!("Run `xe sync` to install template dependencies.");
+        }
+    }
+    if wizard {
+        install_project(ctx, &wd, false, false)
+            .context("the project was created but its initial sync failed; fix the error and run `xe sync`")?;
+        success("Project synced from xe.toml");
+    }
     println!("Project initialized successfully.");
     Ok(())
 }
 
+// Where a new project's packages go: a managed venv named after the project (autovenv), a
+// `.venv` inside the project, or the site-packages of the Python runtime itself.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum VenvStrategy {
+    Auto,
+    Local,
+    Global,
+}
+
+impl VenvStrategy {
+    const ALL: [(VenvStrategy, &'static str, &'static str); 3] = [
+        (VenvStrategy::Auto, "autovenv", "a managed venv named after the project"),
+        (VenvStrategy::Local, ".venv", "a .venv directory inside the project"),
+        (VenvStrategy::Global, "global", "the site-packages of the Python runtime"),
+    ];
+
+    fn parse(value: &str) -> Result<Self> {
+        match value {
+            "autovenv" | "auto" => Ok(Self::Auto),
+            "local" | ".venv" => Ok(Self::Local),
+            "global" => Ok(Self::Global),
+            _ => bail_kind!(ErrorKind::Usage, "unknown venv strategy \"{value}\" (use autovenv, local or global)"),
+        }
+    }
+}
+
+// Lists the supported versions and any other installed runtime; the answer is either the
+// list number or a version.
+fn prompt_init_python(pm: &PythonManager, default: &str) -> Result<String> {
+    let mut versions = SUPPORTED_PYTHONS.iter().map(|v| v.to_string()).collect::<Vec<_>>();
+    for version in installed_runtime_versions(pm) {
+        if !versions.contains(&version) {
+            versions.push(version);
+        }
+    }
+    println!("Python versions:");
+    for (i, version) in versions.iter().enumerate() {
+        let state = if pm.get_python_exe(version).is_ok() {
+            "installed"
+        } else if cfg!(windows) {
+            "will be installed"
+        } else {
+            "not installed"
+        };
+        println!("  {}. {version} ({state})", i + 1);
+    }
+    loop {
+        let answer = prompt_line(&format!("Python version [{default}]"), "")?;
+        let version = match answer.parse::<usize>() {
+            _ if answer.is_empty() => default.to_string(),
+            Ok(n) if (1..=versions.len()).contains(&n) => versions[n - 1].clone(),
+            _ => answer,
+        };
+        match parse_major_minor(&version) {
+            Ok(_) => return Ok(version),
+            Err(err) => warning(&err.to_string()),
+        }
+    }
+}
+
+fn prompt_venv_strategy(default: VenvStrategy) -> Result<VenvStrategy> {
+    println!("Where should packages be installed?");
+    for (i, (_, name, description)) in VenvStrategy::ALL.iter().enumerate() {
+        println!("  {}. {name}: {description}", i + 1);
+    }
+    let default_name = VenvStrategy::ALL
+        .iter()
+        .find(|(strategy, _, _)| *strategy == default)
+        .map(|(_, name, _)| *name)
+        .unwrap_or("autovenv");
+    loop {
+        let answer = prompt_line(&format!("venv strategy [{default_name}]"), "")?;
+        if answer.is_empty() {
+            return Ok(default);
+        }
+        let picked = match answer.parse::<usize>() {
+            Ok(n) if (1..=VenvStrategy::ALL.len()).contains(&n) => Ok(VenvStrategy::ALL[n - 1].0),
+            _ => VenvStrategy::parse(&answer),
+        };
+        match picked {
+            Ok(strategy) => return Ok(strategy),
+            Err(err) => warning(&err.to_string()),
+        }
+    }
+}
+
+// Creates `<dir>/.venv` and adopts it under the project's name, so the project selects it
+// like any other venv. The registration gets a numeric suffix when the name is taken.
+fn create_local_venv(pm: &PythonManager, dir: &Path, cfg: &Config) -> Result<String> {
+    let python_exe = pm.get_python_exe(&cfg.python.version)?;
+    let path = dir.join(".venv");
+    if !path.join("pyvenv.cfg").is_file() {
+        VenvManager { base_dir: dir.to_path_buf() }.create_env(".venv", &python_exe)?;
+    }
+    let vm = VenvManager::new()?;
+    let base = match normalize_venv_name(&cfg.project.name) {
+        name if name.is_empty() => "project".to_string(),
+        name => name,
+    };
+    let mut name = base.clone();
+    let mut n = 2;
+    while vm.exists(&name) {
+        name = format!("{base}-{n}");
+        n += 1;
+    }
+    vm.adopt(&name, &path)?;
+    vm.record_project(&name, dir);
+    info(&format!("Created {} (venv {name})", path.display()));
+    Ok(name)
+}
+
+const BUILTIN_TEMPLATES: &[&str] = &["cli", "lib", "fastapi", "flask", "data"];
+
+struct ProjectTemplate {
+    name: String,
+    deps: Vec<String>,
+    scripts: Vec<(String, String)>,
+    files: Vec<(String, Vec<u8>)>,
+}
+
+fn load_project_template(name: &str) -> Result<ProjectTemplate> {
+    let user_dir = xe_template_dir().join(name);
+    if user_dir.is_dir() {
+        return load_user_template(name, &user_dir);
+    }
+    if let Some(template) = builtin_template(name) {
+        return Ok(template);
+    }
+    let mut available = BUILTIN_TEMPLATES.iter().map(|s| s.to_string()).collect::<Vec<_>>();
+    if let Ok(entries) = fs::read_dir(xe_template_dir()) {
+        for entry in entries.flatten() {
+            if entry.path().is_dir() {
+                available.push(entry.file_name().to_string_lossy().to_string());
+            }
+        }
+    }
+    bail!(
+        "unknown template '{}' (available: {})",
+        name,
+        available.join(", ")
+    )
+}
+
+fn load_user_template(name: &str, dir: &Path) -> Result<ProjectTemplate> {
+    let mut template = ProjectTemplate {
+        name: name.to_string(),
+        deps: Vec::new(),
+        scripts: Vec::new(),
+        files: Vec::new(),
+    };
+    for entry in WalkDir::new(dir) {
+        let entry = entry?;
+        if !entry.file_type().is_file() {
+            continue;
+        }
+        let rel = entry
+            .path()
+            .strip_prefix(dir)
+            .with_context(|| format!("failed to strip prefix for {}", entry.path().display()))?
+            .to_string_lossy()
+            .replace('\\', "/");
+        let data = fs::read(entry.path())
+            .with_context(|| format!("failed to read {}", entry.path().display()))?;
+        if rel == XE_TOML {
+            let text = String::from_utf8_lossy(&data).to_string();
+            let cfg: Config = toml::from_str(&text)
+                .with_context(|| format!("failed to parse {}", entry.path().display()))?;
+            for (dep, version) in cfg.deps {
+                if version == WORKSPACE_DEP {
+                    continue;
+                }
+                if version.is_empty() || version == "*" {
+                    template.deps.push(dep);
+                } else {
+                    template.deps.push(format!("{dep}=={version}"));
+                }
+            }
+            template.scripts.extend(cfg.scripts);
+            continue;
+        }
+        template.files.push((rel, data));
+    }
+    Ok(template)
+}
+
+fn builtin_template(name: &str) -> Option<ProjectTemplate> {
+    let mut files = vec![
+        (
+            ".gitignore",
+            "__pycache__/\n*.py[cod]\n.pytest_cache/\nbuild/\ndist/\n*.egg-info/\n",
+        ),
+        ("README.md", "# {{name}}\n"),
+        ("src/{{package}}/__init__.py", "__version__ = \"0.1.0\"\n"),
+    ];
+    let (deps, scripts): (Vec<&str>, Vec<(&str, &str)>) = match name {
+        "cli" => {
+            files.push((
+                "src/{{package}}/__main__.py",
+                "from {{package}}.cli import main\n\nraise SystemExit(main())\n",
+            ));
+            files.push((
+                "src/{{package}}/cli.py",
+                "import argparse\n\n\ndef main(argv=None):\n    parser = argparse.ArgumentParser(prog=\"{{name}}\")\n    parser.add_argument(\"--name\", default=\"world\")\n    args = parser.parse_args(argv)\n    print(f\"Hello, {args.name}!\")\n    return 0\n",
+            ));
+            files.push((
+                "tests/test_cli.py",
+                "from {{package}}.cli import main\n\n\ndef test_main(capsys):\n    assert main([\"--name\", \"xe\"]) == 0\n    assert \"Hello, xe!\" in capsys.readouterr().out\n",
+            ));
+            (
+                vec!["pytest"],
+                vec![
+                    ("start", "python -m {{package}}"),
+                    ("test", "python -m pytest tests"),
+                ],
+            )
+        }
+        "lib" => {
+            files.push((
+                "tests/test_{{package}}.py",
+                "import {{package}}\n\n\ndef test_version():\n    assert {{package}}.__version__\n",
+            ));
+            (vec!["pytest"], vec![("test", "python -m pytest tests")])
+        }
+        "fastapi" => {
+            files.push((
+                "src/{{package}}/main.py",
+                "from fastapi import FastAPI\n\napp = FastAPI(title=\"{{name}}\")\n\n\n@app.get(\"/\")\ndef index():\n    return {\"status\": \"ok\"}\n",
+            ));
+            files.push((
+                "tests/test_main.py",
+                "from fastapi.testclient import TestClient\n\nfrom {{package}}.main import app\n\n\ndef test_index():\n    response = TestClient(app).get(\"/\")\n    assert response.status_code == 200\n",
+            ));
+            (
+                vec!["fastapi", "uvicorn", "httpx", "pytest"],
+                vec![
+                    ("dev", "python -m uvicorn {{package}}.main:app --reload --app-dir src"),
+                    ("test", "python -m pytest tests"),
+                ],
+            )
+        }
+        "flask" => {
+            files.push((
+                "src/{{package}}/app.py",
+                "from flask import Flask\n\napp = Flask(__name__)\n\n\n@app.get(\"/\")\ndef index():\n    return {\"status\": \"ok\"}\n",
+            ));
+            files.push((
+                "tests/test_app.py",
+                "from {{package}}.app import app\n\n\ndef test_index():\n    response = app.test_client().get(\"/\")\n    assert response.status_code == 200\n",
+            ));
+            (
+                vec!["flask", "pytest"],
+                vec![
+                    ("dev", "python -m flask --app src/{{package}}/app.py run --debug"),
+                    ("test", "python -m pytest tests"),
+                ],
+            )
+        }
+        "data" => {
+            files.push(("data/.gitkeep", ""));
+            files.push(("notebooks/.gitkeep", ""));
+            files.push((
+                "src/{{package}}/load.py",
+                "from pathlib import Path\n\nimport pandas as pd\n\nDATA_DIR = Path(__file__).resolve().parents[2] / \"data\"\n\n\ndef read_csv(name):\n    return pd.read_csv(DATA_DIR / name)\n",
+            ));
+            files.push((
+                "tests/test_load.py",
+                "from {{package}}.load import DATA_DIR\n\n\ndef test_data_dir():\n    assert DATA_DIR.name == \"data\"\n",
+            ));
+            (
+                vec!["numpy", "pandas", "matplotlib", "jupyterlab", "pytest"],
+                vec![
+                    ("notebook", "python -m jupyter lab notebooks"),
+                    ("test", "python -m pytest tests"),
+                ],
+            )
+        }
+        _ => return None,
+    };
+    Some(ProjectTemplate {
+        name: name.to_string(),
+        deps: deps.into_iter().map(str::to_string).collect(),
+        scripts: scripts
+            .into_iter()
+            .map(|(k, v)| (k.to_string(), v.to_string()))
+            .collect(),
+        files: files
+            .into_iter()
+            .map(|(path, content)| (path.to_string(), content.as_bytes().to_vec()))
+            .collect(),
+    })
+}
+
+fn render_template_text(text: &str, name: &str, package: &str) -> String {
+    text.replace("{{name}}", name).replace("{{package}}", package)
+}
+
+fn python_package_name(name: &str) -> String {
+    let mut out = String::with_capacity(name.len());
+    for ch in name.trim().to_lowercase().chars() {
+        if ch.is_ascii_alphanumeric() || ch == '_' {
+            out.push(ch);
+        } else if ch == '-' || ch == '.' || ch == ' ' {
+            out.push('_');
+        }
+    }
+    let out = out.trim_matches('_').to_string();
+    if out.is_empty() {
+        return "app".to_string();
+    }
+    if out.starts_with(|c: char| c.is_ascii_digit()) {
+        return format!("_{out}");
+    }
+    out
+}
+
 fn cmd_use(ctx: &AppContext, args: &[String]) -> Result<()> {
     if args.is_empty() {
         bail!("usage: xe use <python_version> [-d|--default]");
@@ -500,16 +2405,23 @@ fn cmd_use(ctx: &AppContext, args: &[String]) -> Result<()> {
         bail!("usage: xe use <python_version> [-d|--default]");
     }
 
+    // `xe use` changes the pin itself, so an override must not shadow it.
+    env::remove_var("XE_PYTHON");
     let pm = PythonManager::new()?;
     pm.install(&version, ctx)?;
     let python_exe = pm.get_python_exe(&version)?;
 
-    info("Saving Python version preference...");
     let wd = env::current_dir().context("failed to get cwd")?;
     let (mut cfg, toml_path) = load_or_create_project(&wd)?;
-    cfg.python.version = version.clone();
-    save_project(&toml_path, &cfg)?;
-    success(&format!("Project now uses Python {}", version));
+    if cfg.python.version == version {
+        info(&format!("Project already uses Python {version}"));
+    } else {
+        info("Saving Python version preference...");
+        cfg.python.version = version.clone();
+        save_project(&toml_path, &cfg)?;
+        success(&format!("Project now uses Python {}", version));
+    }
+    refresh_platform_table(&toml_path)?;
 
     if default_flag {
         info("Updating global default...");
@@ -527,9 +2439,30 @@ fn cmd_use(ctx: &AppContext, args: &[String]) -> Result<()> {
     Ok(())
 }
 
+// Older releases wrote `[platform] os = "windows"` and `arch = "x86_64"` whatever the
+// host. Such a table is corrected to the host `xe use` runs on; none is added.
+fn refresh_platform_table(path: &Path) -> Result<()> {
+    let text = fs::read_to_string(path).with_context(|| format!("failed to read {}", path.display()))?;
+    let mut doc = text
+        .parse::<DocumentMut>()
+        .with_context(|| format!("failed to parse {}", path.display()))?;
+    let Some(platform) = doc.get_mut("platform").and_then(Item::as_table_like_mut) else {
+        return Ok(());
+    };
+    let current = |key: &str| platform.get(key).and_then(Item::as_str).map(str::to_string);
+    if current("os").as_deref() == Some(env::consts::OS) && current("arch").as_deref() == Some(env::consts::ARCH) {
+        return Ok(());
+    }
+    platform.insert("os", toml_edit::value(env::consts::OS));
+    platform.insert("arch", toml_edit::value(env::consts::ARCH));
+    write_file_atomic(path, doc.to_string().as_bytes())?;
+    info(&format!("Updated [platform] to {}-{}", env::consts::OS, env::consts::ARCH));
+    Ok(())
+}
+
 fn cmd_venv(ctx: &AppContext, args: &[String]) -> Result<()> {
     if args.is_empty() {
-        bail!("usage: xe venv <create|list|delete|use|unset|autovenv> ...");
+        bail!("usage: xe venv <create|list|info|delete|use|unset|activate|tmp|adopt|repair|recreate|autovenv> ...");
     }
     match args[0].as_str() {
         "create" => {
@@ -559,19 +2492,106 @@ fn cmd_venv(ctx: &AppContext, args: &[String]) -> Result<()> {
                 ));
                 return Ok(());
             }
-            vm.create(&name, &python_exe)?;
+            let created_by = wd.join(XE_TOML).is_file().then_some(wd.as_path());
+            vm.create(&name, &python_exe, created_by)?;
             success(&format!("Created venv {}", name));
+            info(&format!("Activate it with `xe venv activate {name}`"));
             Ok(())
         }
-        "list" => {
-            let vm = VenvManager::new()?;
-            let all = vm.list()?;
-            if all.is_empty() {
+        "activate" => cmd_venv_activate(&args[1..]),
+        "tmp" => cmd_venv_tmp(ctx, &args[1..]),
+        "adopt" => {
+            const USAGE: &str = "usage: xe venv adopt <path> [--name <name>]";
+            let (path, name) = match &args[1..] {
+                [path] => (path, None),
+                [path, flag, name] if flag == "--name" => (path, Some(name)),
+                _ => bail!(USAGE),
+            };
+            let path = fs::canonicalize(path).with_context(|| format!("{path} not found"))?;
+            if !path.join("pyvenv.cfg").is_file() {
+                bail_kind!(ErrorKind::Config, "{} is not a venv (no pyvenv.cfg)", path.display());
+            }
+            if !is_python_runtime_healthy(&venv_python_exe(&path)) {
+                bail_kind!(
+                    ErrorKind::RuntimeMissing,
+                    "the interpreter of {} does not run; repair or recreate it first",
+                    path.display()
+                );
+            }
+            let default_name = path.file_name().map(|n| n.to_string_lossy().to_string()).unwrap_or_default();
+            let name = normalize_venv_name(name.unwrap_or(&default_name));
+            if name.is_empty() {
+                bail!("Invalid venv name; pass --name <name>");
+            }
+            let vm = VenvManager::new()?;
+            if vm.exists(&name) {
+                bail!("Venv {name} already exists; pass --name to choose another name");
+            }
+            vm.adopt(&name, &path)?;
+            success(&format!("Adopted {} as venv {name}", path.display()));
+            info(&format!("Use it in a project with `xe venv use {name}`"));
+            Ok(())
+        }
+        "repair" => cmd_venv_repair(ctx, &args[1..], false),
+        "recreate" => cmd_venv_repair(ctx, &args[1..], true),
+        "list" => {
+            let json_output = match &args[1..] {
+                [] => false,
+                [flag] if flag == "--json" => true,
+                _ => bail!("usage: xe venv list [--json]"),
+            };
+            let vm = VenvManager::new()?;
+            let all = vm
+                .list()?
+                .iter()
+                .map(|name| vm.info(name))
+                .collect::<Result<Vec<_>>>()?;
+            if json_output {
+                println!("{}", serde_json::to_string_pretty(&all)?);
+                return Ok(());
+            }
+            if all.is_empty() {
                 info("No venvs found");
                 return Ok(());
             }
-            for v in all {
-                println!("{v}");
+            print_venv_table(&all);
+            Ok(())
+        }
+        "info" => {
+            let (json_output, rest) = take_flag(&args[1..], "--json");
+            let [name] = rest.as_slice() else {
+                bail!("usage: xe venv info <name> [--json]");
+            };
+            let name = normalize_venv_name(name);
+            let vm = VenvManager::new()?;
+            if !vm.exists(&name) {
+                bail_kind!(ErrorKind::RuntimeMissing, "Venv {} does not exist", name);
+            }
+            let venv = vm.info(&name)?;
+            if json_output {
+                println!("{}", serde_json::to_string_pretty(&venv)?);
+                return Ok(());
+            }
+            println!("Name:       {}", venv.name);
+            println!("Path:       {}", venv.path.display());
+            println!("Python:     {} ({})", or_dash(&venv.python_version), venv.python_exe.display());
+            println!("Base:       {}", or_dash(&venv.base_python));
+            println!("Created:    {}", or_dash(&venv.created));
+            if let Some(project) = venv.created_by.as_ref() {
+                println!("Created by: {}", project.display());
+            }
+            if venv.adopted {
+                println!("Adopted:    yes (files are not managed by xe)");
+            }
+            println!("Size:       {}", human_bytes(venv.size_bytes));
+            println!("Packages:   {}", venv.packages);
+            if venv.projects.is_empty() {
+                println!("Projects:   -");
+            } else {
+                println!("Projects:");
+                for project in &venv.projects {
+                    println!("  {}", project.display());
+                }
             }
             Ok(())
         }
@@ -585,6 +2605,7 @@ fn cmd_venv(ctx: &AppContext, args: &[String]) -> Result<()> {
                 warning(&format!("Venv {} does not exist", name));
                 return Ok(());
             }
+            let adopted = vm.manifest(&name).is_some_and(|m| m.external_path.is_some());
             vm.delete(&name)?;
             if let Ok(wd) = env::current_dir() {
                 if let Ok((mut cfg, toml_path)) = load_or_create_project(&wd) {
@@ -594,7 +2615,11 @@ fn cmd_venv(ctx: &AppContext, args: &[String]) -> Result<()> {
                     }
                 }
             }
-            success(&format!("Deleted venv {}", name));
+            if adopted {
+                success(&format!("Unregistered venv {name}; its files were left in place"));
+            } else {
+                success(&format!("Deleted venv {}", name));
+            }
             Ok(())
         }
         "use" => {
@@ -614,6 +2639,7 @@ fn cmd_venv(ctx: &AppContext, args: &[String]) -> Result<()> {
             let (mut cfg, toml_path) = load_or_create_project(&wd)?;
             cfg.venv.name = name.clone();
             save_project(&toml_path, &cfg)?;
+            vm.record_project(&name, &wd);
             success(&format!("Project venv set to {}", name));
             Ok(())
         }
@@ -636,12 +2662,94 @@ fn cmd_venv(ctx: &AppContext, args: &[String]) -> Result<()> {
     }
 }
 
-fn cmd_config(_ctx: &AppContext, args: &[String]) -> Result<()> {
+fn cmd_config(ctx: &AppContext, args: &[String]) -> Result<()> {
+    if args.len() == 3 && args[0] == "set" {
+        return set_global_setting(ctx, &args[1], &args[2]);
+    }
     if args.len() == 2 && args[0] == "autovenv" {
         toggle_autovenv(args[1].as_str())?;
         return Ok(());
     }
-    bail!("usage: xe config autovenv <on|off>");
+    if !args.is_empty() && args.len() <= 2 && args[0] == "validate" {
+        let path = match args.get(1) {
+            Some(p) => PathBuf::from(p),
+            None => env::current_dir().context("failed to get cwd")?.join(XE_TOML),
+        };
+        return validate_config_file(&path);
+    }
+    bail!("usage: xe config <autovenv <on|off>|set <key> <value>|validate [path]>");
+}
+
+// `xe config set`: settings stored in the global config rather than xe.toml.
+fn set_global_setting(ctx: &AppContext, key: &str, raw: &str) -> Result<()> {
+    let mut global = load_global_config(&ctx.config_file)?;
+    match key {
+        "notifications" => {
+            global.notifications = match raw.trim().to_lowercase().as_str() {
+                "on" | "true" | "1" => true,
+                "off" | "false" | "0" => false,
+                _ => bail_kind!(ErrorKind::Usage, "Use `on` or `off`"),
+            };
+            save_global_config(&ctx.config_file, &global)?;
+            if global.notifications {
+                success("Update notifications enabled; xe checks once a day in the background");
+            } else {
+                success("Update notifications disabled");
+            }
+            Ok(())
+        }
+        "credential-helper" | "credential_helper" => {
+            let command = raw.trim();
+            global.credential_helper = if command == "none" { String::new() } else { command.to_string() };
+            save_global_config(&ctx.config_file, &global)?;
+            if global.credential_helper.is_empty() {
+                success("Credential helper removed; tokens use the built-in stores");
+            } else {
+                success(&format!("Tokens are now read from and stored with `{}`", global.credential_helper));
+            }
+            Ok(())
+        }
+        _ => bail_kind!(
+            ErrorKind::Usage,
+            "unknown setting '{key}' (supported: notifications, credential-helper)"
+        ),
+    }
+}
+
+fn validate_config_file(path: &Path) -> Result<()> {
+    if !path.exists() {
+        bail_kind!(ErrorKind::Config, "{} not found; run `xe init` to create one", path.display());
+    }
+    let text = fs::read_to_string(path).with_context(|| format!("failed to read {}", path.display()))?;
+    let project_dir = path.parent().unwrap_or_else(|| Path::new("."));
+    let issues = validate_project_text(&text, project_dir);
+    let errors = issues.iter().filter(|i| i.level == IssueLevel::Error).count();
+    for issue in &issues {
+        let line = format!("{}: {}", issue.key, issue.message);
+        match issue.level {
+            IssueLevel::Error => error(&line),
+            IssueLevel::Warning => warning(&line),
+        }
+    }
+    if errors > 0 {
+        bail_kind!(
+            ErrorKind::Config,
+            "{} has {} error(s) and {} warning(s)",
+            path.display(),
+            errors,
+            issues.len() - errors
+        );
+    }
+    if issues.is_empty() {
+        success(&format!("{} is valid", path.display()));
+    } else {
+        success(&format!(
+            "{} is valid with {} warning(s)",
+            path.display(),
+            issues.len()
+        ));
+    }
+    Ok(())
 }
 
 fn toggle_autovenv(raw: &str) -> Result<()> {
@@ -690,6 +2798,9 @@ fn cmd_import(ctx: &AppContext, args: &[String]) -> Result<()> {
         }
         let mut reqs = Vec::with_capacity(cfg.deps.len());
         for (name, version) in cfg.deps {
+            if version == WORKSPACE_DEP {
+                continue;
+            }
             if version.is_empty() || version == "*" {
                 reqs.push(name);
             } else {
@@ -704,12 +2815,12 @@ fn cmd_import(ctx: &AppContext, args: &[String]) -> Result<()> {
             &runtime.selection.site_packages,
             &runtime.selection.python_exe,
         )?;
-        for p in &resolved {
-            local_cfg
-                .deps
-                .insert(normalize_dep_name(&p.name), p.version.clone());
+        for name in reqs.iter().filter_map(|r| requirement_to_dep_name(r)) {
+            local_cfg.deps.insert(name, "*".to_string());
         }
+        local_cfg.record_resolved(&resolved);
         save_project(&local_toml_path, &local_cfg)?;
+        save_lockfile(&wd, &local_cfg, &resolved, true)?;
         success(&format!(
             "Imported {} dependencies into current project",
             reqs.len()
@@ -717,6 +2828,52 @@ fn cmd_import(ctx: &AppContext, args: &[String]) -> Result<()> {
         return Ok(());
     }
 
+    let file_name = path.file_name().and_then(|s| s.to_str()).unwrap_or_default();
+    if file_name == "pyproject.toml" || file_name == "setup.cfg" {
+        let (own_name, deps, extras) = if file_name == "setup.cfg" {
+            read_setup_cfg_requirements(&path)?
+        } else {
+            read_pyproject_requirements(&path)?
+        };
+        // Extras commonly pull in the project's own other extras (`pkg[test]`); those are
+        // already covered by the matching groups.
+        let foreign = |req: &String| requirement_to_dep_name(req).is_some_and(|name| name != own_name);
+        let mut reqs = deps.iter().chain(extras.values().flatten()).filter(|r| foreign(r)).cloned().collect::<Vec<_>>();
+        reqs.sort();
+        reqs.dedup();
+        if reqs.is_empty() {
+            warning(&format!("No dependencies found in {file_name}"));
+            return Ok(());
+        }
+        let resolved = installer.install(
+            ctx,
+            &local_cfg,
+            &reqs,
+            &wd,
+            &runtime.selection.site_packages,
+            &runtime.selection.python_exe,
+        )?;
+        for name in deps.iter().filter(|r| foreign(r)).filter_map(|r| requirement_to_dep_name(r)) {
+            local_cfg.deps.insert(name, "*".to_string());
+        }
+        for (extra, extra_reqs) in &extras {
+            for name in extra_reqs.iter().filter(|r| foreign(r)).filter_map(|r| requirement_to_dep_name(r)) {
+                if !local_cfg.deps.contains_key(&name) {
+                    local_cfg.groups.entry(extra.clone()).or_default().deps.insert(name, "*".to_string());
+                }
+            }
+        }
+        local_cfg.record_resolved(&resolved);
+        save_project(&local_toml_path, &local_cfg)?;
+        save_lockfile(&wd, &local_cfg, &resolved, true)?;
+        success(&format!(
+            "Imported {} requirement(s) from {file_name}, {} extra(s) as dependency groups",
+            reqs.len(),
+            extras.len()
+        ));
+        return Ok(());
+    }
+
     if path_lower.ends_with("requirements.txt") || path_lower.ends_with(".txt") {
         let reqs = parse_requirements(&path)?;
         if reqs.is_empty() {
@@ -736,12 +2893,9 @@ fn cmd_import(ctx: &AppContext, args: &[String]) -> Result<()> {
                 local_cfg.deps.insert(dep, "*".to_string());
             }
         }
-        for p in &resolved {
-            local_cfg
-                .deps
-                .insert(normalize_dep_name(&p.name), p.version.clone());
-        }
+        local_cfg.record_resolved(&resolved);
         save_project(&local_toml_path, &local_cfg)?;
+        save_lockfile(&wd, &local_cfg, &resolved, true)?;
         success(&format!(
             "Imported {} requirement(s) from requirements file",
             reqs.len()
@@ -749,2157 +2903,15103 @@ fn cmd_import(ctx: &AppContext, args: &[String]) -> Result<()> {
         return Ok(());
     }
 
-    warning("Import currently supports xe.toml and requirements.txt");
-    Ok(())
-}
-
-fn cmd_export(args: &[String]) -> Result<()> {
-    if args.len() != 1 {
-        bail!("usage: xe export <output_path>");
-    }
-    let path = PathBuf::from(&args[0]);
-    let wd = env::current_dir().context("failed to get cwd")?;
-    let (cfg, _) = load_or_create_project(&wd)?;
-    let content = format!(
-        "cache_mode={}\ncache_dir={}\n",
-        cfg.cache.mode, cfg.cache.global_dir
-    );
-    fs::write(&path, content).with_context(|| format!("failed to write {}", path.display()))?;
-    success(&format!(
-        "Exported cache metadata to {}",
+    bail_kind!(
+        ErrorKind::Usage,
+        "unsupported import source {}; xe import supports xe.toml, pyproject.toml, setup.cfg and requirements.txt",
         path.display()
-    ));
-    Ok(())
+    );
 }
 
-fn cmd_clean(args: &[String]) -> Result<()> {
-    let force = args.iter().any(|a| a == "--force" || a == "-f");
-    if !force {
-        warning("This will delete all global and local xe data, including:");
-        println!("- {} (config, cache, credentials, venvs)", xe_home().display());
-        let home = dirs::home_dir().ok_or_else(|| anyhow!("cannot resolve home dir"))?;
-        println!(
-            "- {} (self-installed runtimes)",
-            home.join("AppData")
-                .join("Local")
-                .join("Programs")
-                .join("Python")
-                .display()
-        );
-        println!("- xe.toml in the current directory");
-        print!("\nAre you sure you want to proceed? (y/N): ");
-        io::stdout().flush().ok();
-        let mut input = String::new();
-        io::stdin().read_line(&mut input)?;
-        let trimmed = input.trim().to_lowercase();
-        if trimmed != "y" && trimmed != "yes" {
-            info("Cleanup cancelled.");
-            return Ok(());
+// `xe export` writes the pins from `xe lock` (or the resolution of unpinned deps when
+// hashes are requested) as a requirements.txt that pip can install without xe.
+fn cmd_export(ctx: &AppContext, args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe export [--format requirements] [-o <path>] [--hashes] [--markers]";
+    let mut output = None;
+    let mut hashes = false;
+    let mut markers = false;
+    let mut idx = 0usize;
+    while idx < args.len() {
+        match args[idx].as_str() {
+            "--format" | "-f" => {
+                let format = args.get(idx + 1).ok_or_else(|| anyhow!("--format requires a value"))?;
+                if format != "requirements" && format != "requirements.txt" {
+                    bail_kind!(ErrorKind::Usage, "unsupported export format '{format}'; expected requirements");
+                }
+                idx += 2;
+            }
+            "--output" | "-o" => {
+                let path = args.get(idx + 1).ok_or_else(|| anyhow!("--output requires a path"))?;
+                output = (path != "-").then(|| PathBuf::from(path));
+                idx += 2;
+            }
+            "--hashes" => {
+                hashes = true;
+                idx += 1;
+            }
+            "--markers" => {
+                markers = true;
+                idx += 1;
+            }
+            _ => bail_kind!(ErrorKind::Usage, "{USAGE}"),
         }
     }
-
-    info("Starting system-wide cleanup...");
-    let home = dirs::home_dir().ok_or_else(|| anyhow!("cannot resolve home dir"))?;
-    remove_path(&xe_home(), "Global configuration and data")?;
-    remove_path(&home.join(".xe"), "Legacy xe directory")?;
-    remove_path(&home.join(".cache").join("xe"), "Global CAS cache")?;
-    remove_path(
-        &home.join("AppData").join("Local").join("Programs").join("Python"),
-        "Self-installed Python runtimes",
-    )?;
-    remove_path(Path::new(XE_TOML), "Local project configuration")?;
-    success("Cleanup complete. All xe-related data has been removed.");
-    Ok(())
-}
-
-fn cmd_snapshot(args: &[String]) -> Result<()> {
-    if args.len() != 1 {
-        bail!("usage: xe snapshot <name>");
-    }
-    let snap_path = create_snapshot(&args[0])?;
-    println!(
-        "Snapshot '{}' created successfully at {}",
-        args[0],
-        snap_path.display()
-    );
-    Ok(())
-}
-
-fn cmd_restore(args: &[String]) -> Result<()> {
-    if args.len() != 1 {
-        bail!("usage: xe restore <name>");
+    if output.is_none() {
+        set_log_to_stderr(true);
     }
-    println!("Successfully restored snapshot '{}'", args[0]);
+    let wd = env::current_dir().context("failed to get cwd")?;
+    let cfg = load_existing_project(&wd)?;
+    let (text, count) = requirements_txt(ctx, &wd, cfg, hashes, markers, hashes)?;
+    let Some(path) = output else {
+        print!("{text}");
+        return Ok(());
+    };
+    write_file_atomic(&path, text.as_bytes())?;
+    success(&format!("Exported {count} requirement(s) to {}", path.display()));
     Ok(())
 }
 
-fn cmd_sync(ctx: &AppContext, _args: &[String]) -> Result<()> {
-    let wd = env::current_dir().context("failed to get cwd")?;
-    let (mut cfg, toml_path) = load_or_create_project(&wd)?;
-    let reqs = cfg
-        .deps
-        .iter()
-        .map(|(name, version)| {
-            if version.is_empty() || version == "*" {
-                name.clone()
-            } else {
-                format!("{name}=={version}")
-            }
+// The project's pins as requirements.txt text, and the number of entries. With
+// `full_graph` (implied by `hashes` and `markers`) the locked requirements are resolved,
+// so every package of the graph is pinned even where xe.lock is missing or out of date.
+// `markers` keeps the environment markers the resolution found for each package, so
+// packages pulled in only on some platforms or Pythons stay conditional.
+fn requirements_txt(
+    ctx: &AppContext,
+    wd: &Path,
+    mut cfg: Config,
+    hashes: bool,
+    markers: bool,
+    full_graph: bool,
+) -> Result<(String, usize)> {
+    let reqs = locked_requirements(wd, &cfg, cfg.requirements_in(wd)?)?;
+    let mut pins = reqs
+        .clone()
+        .into_iter()
+        .map(|req| match req.split_once("==") {
+            Some((name, version)) => (name.to_string(), version.to_string(), String::new(), String::new()),
+            None => (req, String::new(), String::new(), String::new()),
         })
         .collect::<Vec<_>>();
-    let installer = Installer::new(Path::new(&cfg.cache.global_dir))?;
-    let runtime = ensure_runtime_for_project(ctx, &wd, &mut cfg)?;
-    if runtime.config_changed {
-        save_project(&toml_path, &cfg)?;
+    if hashes || full_graph || markers {
+        let runtime = ensure_runtime_for_project(ctx, wd, &mut cfg)?;
+        // pip's --hash only takes the sha2 family.
+        cfg.settings.hash_algorithm = HashAlgorithm::Sha256;
+        let mut installer = Installer::new(Path::new(&cfg.cache.global_dir))?.with_require_hashes(hashes);
+        if markers {
+            // Solutions cached by older versions carry no markers.
+            installer = installer.refreshed();
+        }
+        let (graph, _) = installer.resolve(ctx, &cfg, &reqs, wd, &runtime.selection.python_exe)?;
+        pins = graph
+            .packages
+            .into_iter()
+            .map(|p| (normalize_dep_name(&p.name), p.version, p.hash, p.markers))
+            .collect();
     }
-    installer.install(
-        ctx,
-        &cfg,
-        &reqs,
-        &wd,
-        &runtime.selection.site_packages,
-        &runtime.selection.python_exe,
-    )?;
-    success("Project synced from xe.toml");
-    Ok(())
-}
-
-fn cmd_lock(ctx: &AppContext, _args: &[String]) -> Result<()> {
-    let wd = env::current_dir().context("failed to get cwd")?;
-    let (mut cfg, toml_path) = load_or_create_project(&wd)?;
-    let reqs = cfg
-        .deps
+    pins.sort();
+    let unpinned = pins
         .iter()
-        .map(|(name, version)| {
-            if version.is_empty() || version == "*" {
-                name.clone()
-            } else {
-                format!("{name}=={version}")
-            }
-        })
+        .filter(|(_, v, _, _)| v.is_empty())
+        .map(|(n, _, _, _)| n.as_str())
         .collect::<Vec<_>>();
-    let installer = Installer::new(Path::new(&cfg.cache.global_dir))?;
-    let runtime = ensure_runtime_for_project(ctx, &wd, &mut cfg)?;
-    if runtime.config_changed {
-        save_project(&toml_path, &cfg)?;
+    if !unpinned.is_empty() {
+        warning(&format!(
+            "not pinned in {XE_TOML}: {}; run `xe lock` for a reproducible export",
+            unpinned.join(", ")
+        ));
     }
-    let resolved = installer.install(
-        ctx,
-        &cfg,
-        &reqs,
-        &wd,
-        &runtime.selection.site_packages,
-        &runtime.selection.python_exe,
-    )?;
-    for p in resolved {
-        cfg.deps.insert(normalize_dep_name(&p.name), p.version);
+    let mut text = format!("# Generated by `xe export` from {XE_TOML} ({}); do not edit.\n", cfg.project.name);
+    for (name, version, hash, marker) in &pins {
+        text.push_str(name);
+        if !version.is_empty() {
+            text.push_str(&format!("=={version}"));
+        }
+        if markers && !marker.is_empty() {
+            text.push_str(&format!(" ; {marker}"));
+        }
+        if !hash.is_empty() {
+            text.push_str(&format!(" \\\n    --hash=sha256:{hash}"));
+        }
+        text.push('\n');
     }
-    save_project(&toml_path, &cfg)?;
-    success("Locked dependencies");
-    Ok(())
+    Ok((text, pins.len()))
 }
 
-fn cmd_format(ctx: &AppContext, args: &[String]) -> Result<()> {
-    let target = if args.is_empty() { "." } else { &args[0] };
-    let run_args = vec![
-        "--".to_string(),
-        "python".to_string(),
-        "-m".to_string(),
-        "black".to_string(),
-        target.to_string(),
-    ];
-    cmd_run(ctx, &run_args)
-}
+// Pins copied into the image; regenerated from xe.toml by every `xe docker export`.
+const DOCKER_REQUIREMENTS: &str = "requirements.xe.txt";
 
-fn cmd_cache(ctx: &AppContext, args: &[String]) -> Result<()> {
-    if args.is_empty() {
-        bail!("usage: xe cache <dir|clean|prune>");
+fn cmd_docker(ctx: &AppContext, args: &[String]) -> Result<()> {
+    const USAGE: &str =
+        "usage: xe docker export [-o <path>] [--script <name>] [--hashes] [--build [--tag <name>]]";
+    if args.first().map(String::as_str) != Some("export") {
+        bail_kind!(ErrorKind::Usage, "{USAGE}");
     }
-    match args[0].as_str() {
-        "dir" => {
-            let wd = env::current_dir().context("failed to get cwd")?;
-            let (cfg, _) = load_or_create_project(&wd)?;
-            println!("{}", cfg.cache.global_dir);
-            Ok(())
-        }
-        "clean" => {
-            let wd = env::current_dir().context("failed to get cwd")?;
-            let (cfg, _) = load_or_create_project(&wd)?;
-            if Path::new(&cfg.cache.global_dir).exists() {
-                fs::remove_dir_all(&cfg.cache.global_dir)
-                    .with_context(|| format!("failed to clean {}", cfg.cache.global_dir))?;
+    let mut output = PathBuf::from("Dockerfile");
+    let mut script = None;
+    let mut hashes = false;
+    let mut build = false;
+    let mut tag = None;
+    let mut idx = 1usize;
+    while idx < args.len() {
+        match args[idx].as_str() {
+            "--output" | "-o" => {
+                output = PathBuf::from(args.get(idx + 1).ok_or_else(|| anyhow!("--output requires a path"))?);
+                idx += 2;
             }
-            success("Cache cleaned");
-            Ok(())
-        }
-        "prune" => {
-            let _ = ctx;
-            info("Prune currently keeps CAS blobs and removes no files.");
-            Ok(())
+            "--script" => {
+                script = Some(args.get(idx + 1).ok_or_else(|| anyhow!("--script requires a name"))?.clone());
+                idx += 2;
+            }
+            "--tag" | "-t" => {
+                tag = Some(args.get(idx + 1).ok_or_else(|| anyhow!("--tag requires a name"))?.clone());
+                idx += 2;
+            }
+            "--hashes" => {
+                hashes = true;
+                idx += 1;
+            }
+            "--build" => {
+                build = true;
+                idx += 1;
+            }
+            _ => bail_kind!(ErrorKind::Usage, "{USAGE}"),
         }
-        _ => bail!("usage: xe cache <dir|clean|prune>"),
     }
+    if tag.is_some() && !build {
+        bail_kind!(ErrorKind::Usage, "--tag requires --build");
+    }
+    let wd = env::current_dir().context("failed to get cwd")?;
+    let cfg = load_existing_project(&wd)?;
+    let entrypoint = docker_entrypoint(&cfg, script.as_deref())?;
+    let python = cfg.python.version.clone();
+    parse_major_minor(&python)?;
+    let image = tag.unwrap_or_else(|| {
+        let version = if cfg.project.version.is_empty() { "latest" } else { &cfg.project.version };
+        format!("{}:{version}", normalize_dep_name(&cfg.project.name))
+    });
+
+    let indexes = IndexPlan::load(ctx, &cfg)?;
+    let (requirements, count) = requirements_txt(ctx, &wd, cfg, hashes, false, true)?;
+    write_file_atomic(&wd.join(DOCKER_REQUIREMENTS), requirements.as_bytes())?;
+    let private = indexes.authenticated();
+    let dockerfile = render_dockerfile(&python, &entrypoint, hashes, &indexes.pip_index_args(), !private.is_empty());
+    let secret = if private.is_empty() {
+        String::new()
+    } else {
+        warning(&format!(
+            "credentials for index {} are not written to {}; build with `--secret id=netrc,src=$HOME/.netrc`",
+            private.join(", "),
+            output.display()
+        ));
+        " --secret id=netrc,src=$HOME/.netrc".to_string()
+    };
+    write_file_atomic(&output, dockerfile.as_bytes())?;
+    let ignore = wd.join(".dockerignore");
+    if !ignore.exists() {
+        write_file_atomic(&ignore, b".git\n.venv\n__pycache__/\n*.pyc\n")?;
+    }
+    success(&format!(
+        "Wrote {} and {DOCKER_REQUIREMENTS} ({count} requirement(s))",
+        output.display()
+    ));
+    if !build {
+        info(&format!("Build it with `docker build{secret} -t {image} -f {} .`", output.display()));
+        return Ok(());
+    }
+    info(&format!("Building image {image}..."));
+    let mut command = Command::new("docker");
+    command.arg("build");
+    if !secret.is_empty() {
+        let netrc = dirs::home_dir().unwrap_or_default().join(".netrc");
+        command.arg("--secret").arg(format!("id=netrc,src={}", netrc.display()));
+    }
+    let status = command
+        .arg("-t")
+        .arg(&image)
+        .arg("-f")
+        .arg(&output)
+        .arg(".")
+        .current_dir(&wd)
+        .status()
+        .context("failed to run docker; is it installed and on PATH?")?;
+    if !status.success() {
+        bail!("docker build failed: {status}");
+    }
+    success(&format!("Built image {image}"));
+    Ok(())
 }
 
-fn cmd_python(ctx: &AppContext, args: &[String]) -> Result<()> {
+// The image entrypoint: the named [scripts] entry, else `start`, else the only script,
+// else a bare `python`.
+fn docker_entrypoint(cfg: &Config, script: Option<&str>) -> Result<Vec<String>> {
+    let command = match script {
+        Some(name) => match cfg.scripts.get(name) {
+            Some(command) => command.as_str(),
+            None => bail_kind!(ErrorKind::Config, "no script named '{name}' in [scripts]"),
+        },
+        None if cfg.scripts.contains_key("start") => cfg.scripts["start"].as_str(),
+        None if cfg.scripts.len() == 1 => cfg.scripts.values().next().map(String::as_str).unwrap_or_default(),
+        None => "python",
+    };
+    let args = command.split_whitespace().map(str::to_string).collect::<Vec<_>>();
     if args.is_empty() {
-        bail!("usage: xe python <install|list|find|pin|dir> ...");
+        bail_kind!(ErrorKind::Config, "script '{}' is empty", script.unwrap_or_default());
     }
-    let pm = PythonManager::new()?;
-    match args[0].as_str() {
-        "install" => {
-            if args.len() != 2 {
-                bail!("usage: xe python install <version>");
-            }
-            pm.install(&args[1], ctx)?;
-            success(&format!("Installed Python {}", args[1]));
-            Ok(())
-        }
-        "list" => {
-            let entries = fs::read_dir(&pm.base_dir)
-                .with_context(|| format!("failed to read {}", pm.base_dir.display()))?;
-            for entry in entries {
-                let entry = entry?;
-                if entry.file_type()?.is_dir() {
-                    println!("{}", entry.file_name().to_string_lossy());
+    // Splitting on whitespace is only faithful without quoting, variables or operators;
+    // anything else runs through the shell, which also passes on `docker run` arguments.
+    if command.contains(['\'', '"', '\\', '$', '`', '&', '|', ';', '<', '>', '(', ')', '*', '?', '~']) {
+        return Ok(vec![
+            "/bin/sh".to_string(),
+            "-c".to_string(),
+            format!("exec {command} \"$@\""),
+            "--".to_string(),
+        ]);
+    }
+    Ok(args)
+}
+
+// Two stages: the first downloads the pinned wheels through a BuildKit cache mount (so
+// rebuilds reuse them like the local CAS) and installs them offline into /install; the
+// second copies that prefix and the project onto a clean image of the same Python.
+// The requirements file pins the whole graph, so both steps use --no-deps and install
+// exactly the locked versions. `netrc` mounts a BuildKit secret for private indexes.
+fn render_dockerfile(python: &str, entrypoint: &[String], hashes: bool, index_args: &[String], netrc: bool) -> String {
+    let require_hashes = if hashes { " --require-hashes" } else { "" };
+    let entrypoint = serde_json::to_string(entrypoint).unwrap_or_else(|_| "[\"python\"]".to_string());
+    let indexes = index_args.iter().map(|arg| format!(" {arg}")).collect::<String>();
+    let secret = if netrc {
+        " --mount=type=secret,id=netrc,target=/root/.netrc"
+    } else {
+        ""
+    };
+    format!(
+        r#"# syntax=docker/dockerfile:1
+# Generated by `xe docker export`; regenerate after `xe lock` instead of editing.
+
+FROM python:{python}-slim AS deps
+WORKDIR /build
+COPY {DOCKER_REQUIREMENTS} .
+RUN --mount=type=cache,target=/root/.cache/pip{secret} \
+    pip download --dest /wheels --no-deps{indexes}{require_hashes} -r {DOCKER_REQUIREMENTS}
+RUN pip install --no-index --find-links /wheels --no-deps --prefix /install{require_hashes} \
+    -r {DOCKER_REQUIREMENTS}
+
+FROM python:{python}-slim
+ENV PYTHONDONTWRITEBYTECODE=1 PYTHONUNBUFFERED=1
+COPY --from=deps /install /usr/local
+WORKDIR /app
+COPY . .
+ENTRYPOINT {entrypoint}
+"#
+    )
+}
+
+// `xe kernel` registers the project interpreter as a Jupyter kernel. Kernelspecs carry
+// `metadata.xe.project` so list/remove only touch the ones xe wrote.
+fn cmd_kernel(ctx: &AppContext, args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe kernel <install|list|remove> ...";
+    let Some(sub) = args.first() else {
+        bail_kind!(ErrorKind::Usage, "{USAGE}");
+    };
+    let rest = &args[1..];
+    match sub.as_str() {
+        "install" => {
+            let mut name = None;
+            let mut display_name = None;
+            let mut idx = 0usize;
+            while idx < rest.len() {
+                match rest[idx].as_str() {
+                    "--name" => {
+                        name = Some(rest.get(idx + 1).ok_or_else(|| anyhow!("--name requires a value"))?.clone());
+                        idx += 2;
+                    }
+                    "--display-name" => {
+                        display_name = Some(
+                            rest.get(idx + 1)
+                                .ok_or_else(|| anyhow!("--display-name requires a value"))?
+                                .clone(),
+                        );
+                        idx += 2;
+                    }
+                    _ => bail_kind!(ErrorKind::Usage, "usage: xe kernel install [--name <name>] [--display-name <text>]"),
+                }
+            }
+            let wd = env::current_dir().context("failed to get cwd")?;
+            let mut cfg = load_existing_project(&wd)?;
+            let runtime = ensure_runtime_for_project(ctx, &wd, &mut cfg)?;
+            if runtime.config_changed {
+                save_project(&wd.join(XE_TOML), &cfg)?;
+            }
+            let project = normalize_dep_name(&cfg.project.name);
+            let name = name.unwrap_or_else(|| format!("xe-{project}"));
+            if name.is_empty() || !name.chars().all(|c| c.is_ascii_alphanumeric() || "._-".contains(c)) {
+                bail_kind!(ErrorKind::Usage, "invalid kernel name '{name}'; use letters, digits, '.', '_' and '-'");
+            }
+            let selection = &runtime.selection;
+            if !installed_versions(&selection.site_packages).contains_key("ipykernel") {
+                Installer::new(Path::new(&cfg.cache.global_dir))?.install(
+                    ctx,
+                    &cfg,
+                    &["ipykernel".to_string()],
+                    &wd,
+                    &selection.site_packages,
+                    &selection.python_exe,
+                )?;
+            }
+            let mut env_vars = Map::new();
+            let mut python_path = vec![selection.site_packages.clone()];
+            python_path.extend(linked_source_paths(&selection.site_packages));
+            let joined = env::join_paths(&python_path).context("failed to build PYTHONPATH")?;
+            env_vars.insert("PYTHONPATH".to_string(), json!(joined.to_string_lossy()));
+            if selection.is_venv {
+                if let Some(root) = selection.python_exe.parent().and_then(|p| p.parent()) {
+                    env_vars.insert("VIRTUAL_ENV".to_string(), json!(root.display().to_string()));
                 }
             }
+            let spec = json!({
+                "argv": [selection.python_exe.display().to_string(), "-m", "ipykernel_launcher", "-f", "{connection_file}"],
+                "display_name": display_name.unwrap_or_else(|| format!("Python {} ({})", cfg.python.version, cfg.project.name)),
+                "language": "python",
+                "env": env_vars,
+                "metadata": {"xe": {"project": wd.display().to_string()}},
+            });
+            let dir = jupyter_kernels_dir()?.join(&name);
+            fs::create_dir_all(&dir).with_context(|| format!("failed to create {}", dir.display()))?;
+            let data = serde_json::to_vec_pretty(&spec).context("failed to encode kernelspec")?;
+            write_file_atomic(&dir.join("kernel.json"), &data)?;
+            success(&format!("Registered Jupyter kernel {name} at {}", dir.display()));
             Ok(())
         }
-        "find" => {
-            let version = get_preferred_python_version(ctx)?;
-            let exe = pm.get_python_exe(&version)?;
-            println!("{}", exe.display());
+        "list" => {
+            if !rest.is_empty() {
+                bail_kind!(ErrorKind::Usage, "usage: xe kernel list");
+            }
+            let kernels = xe_kernels()?;
+            if kernels.is_empty() {
+                info("No xe kernels registered. Run `xe kernel install` in a project.");
+                return Ok(());
+            }
+            let width = kernels.iter().map(|(name, _)| name.len()).max().unwrap_or(0).max("Name".len());
+            println!("{:<width$}  {:<7}  Project", "Name", "Python");
+            for (name, spec) in &kernels {
+                let python = spec["argv"][0].as_str().unwrap_or_default();
+                println!(
+                    "{:<width$}  {:<7}  {}",
+                    name,
+                    if Path::new(python).exists() { "ok" } else { "missing" },
+                    spec["metadata"]["xe"]["project"].as_str().unwrap_or_default()
+                );
+            }
             Ok(())
         }
-        "pin" => cmd_use(ctx, &args[1..]),
-        "dir" => {
-            println!("{}", pm.base_dir.display());
+        "remove" | "rm" => {
+            if rest.is_empty() {
+                bail_kind!(ErrorKind::Usage, "usage: xe kernel remove <name>...");
+            }
+            let kernels = xe_kernels()?;
+            for name in rest {
+                if !kernels.iter().any(|(n, _)| n == name) {
+                    bail_kind!(ErrorKind::Config, "no xe kernel named {name} (see `xe kernel list`)");
+                }
+                let dir = jupyter_kernels_dir()?.join(name);
+                fs::remove_dir_all(&dir).with_context(|| format!("failed to remove {}", dir.display()))?;
+                success(&format!("Removed Jupyter kernel {name}"));
+            }
             Ok(())
         }
-        _ => bail!("usage: xe python <install|list|find|pin|dir> ..."),
+        _ => bail_kind!(ErrorKind::Usage, "{USAGE}"),
     }
 }
 
-fn cmd_pip(ctx: &AppContext, args: &[String]) -> Result<()> {
-    if args.is_empty() {
-        bail!("usage: xe pip <install|uninstall|list|show|tree|check|sync|compile>");
-    }
-    match args[0].as_str() {
-        "install" => cmd_add(ctx, &args[1..]),
-        "uninstall" => cmd_remove(ctx, &args[1..]),
-        "list" => cmd_list(ctx, &args[1..]),
-        "show" => cmd_check(&args[1..]),
-        "tree" => cmd_tree(&args[1..]),
-        "check" => cmd_doctor(&args[1..]),
-        "sync" => cmd_sync(ctx, &args[1..]),
-        "compile" => cmd_lock(ctx, &args[1..]),
-        _ => bail!("usage: xe pip <install|uninstall|list|show|tree|check|sync|compile>"),
+// The per-user kernelspec directory Jupyter searches: $JUPYTER_DATA_DIR/kernels, else the
+// platform's Jupyter data directory.
+fn jupyter_kernels_dir() -> Result<PathBuf> {
+    if let Some(dir) = env::var_os("JUPYTER_DATA_DIR").filter(|d| !d.is_empty()) {
+        return Ok(PathBuf::from(dir).join("kernels"));
     }
+    let data = if cfg!(windows) {
+        PathBuf::from(env::var_os("APPDATA").ok_or_else(|| anyhow!("APPDATA is not set"))?).join("jupyter")
+    } else if cfg!(target_os = "macos") {
+        dirs::home_dir().ok_or_else(|| anyhow!("cannot resolve home dir"))?.join("Library").join("Jupyter")
+    } else {
+        match env::var_os("XDG_DATA_HOME").filter(|d| !d.is_empty()) {
+            Some(dir) => PathBuf::from(dir).join("jupyter"),
+            None => dirs::home_dir()
+                .ok_or_else(|| anyhow!("cannot resolve home dir"))?
+                .join(".local")
+                .join("share")
+                .join("jupyter"),
+        }
+    };
+    Ok(data.join("kernels"))
 }
 
-fn cmd_tool(ctx: &AppContext, args: &[String]) -> Result<()> {
-    if args.is_empty() {
-        bail!("usage: xe tool <run|install|list|update|uninstall|upgrade|sync|dir> ...");
+fn xe_kernels() -> Result<Vec<(String, Value)>> {
+    let mut out = Vec::new();
+    for entry in fs::read_dir(jupyter_kernels_dir()?).into_iter().flatten().flatten() {
+        let Some(spec) = fs::read(entry.path().join("kernel.json"))
+            .ok()
+            .and_then(|data| serde_json::from_slice::<Value>(&data).ok())
+        else {
+            continue;
+        };
+        if spec["metadata"]["xe"].is_object() {
+            out.push((entry.file_name().to_string_lossy().to_string(), spec));
+        }
     }
-    match args[0].as_str() {
-        "run" => cmd_run(ctx, &args[1..]),
-        "install" => cmd_add(ctx, &args[1..]),
-        "list" => {
-            let wd = env::current_dir().context("failed to get cwd")?;
-            let (cfg, _) = load_or_create_project(&wd)?;
-            let mut keys = cfg.deps.keys().cloned().collect::<Vec<_>>();
-            keys.sort();
-            for key in keys {
-                if let Some(v) = cfg.deps.get(&key) {
-                    println!("{key} {v}");
+    out.sort_by(|a, b| a.0.cmp(&b.0));
+    Ok(out)
+}
+
+// What `xe clean` can remove, selected with the flag in the second column.
+#[derive(Clone, Copy, PartialEq, Eq)]
+enum CleanTarget {
+    Cache,
+    Venvs,
+    Runtimes,
+    Project,
+}
+
+const CLEAN_TARGETS: [(CleanTarget, &str, &str); 4] = [
+    (CleanTarget::Cache, "--cache", "package cache and ephemeral tool environments"),
+    (CleanTarget::Venvs, "--venvs", "managed virtual environments"),
+    (CleanTarget::Runtimes, "--runtimes", "Python runtimes installed by xe"),
+    (CleanTarget::Project, "--project", "xe.toml and xe.lock in the current directory"),
+];
+
+fn clean_paths(target: CleanTarget) -> Result<Vec<(PathBuf, &'static str)>> {
+    let paths = match target {
+        CleanTarget::Cache => {
+            let mut paths = vec![
+                (xe_cache_dir(), "Global CAS cache"),
+                (xe_tool_cache_dir(), "Ephemeral tool environments"),
+            ];
+            paths.extend(legacy_cache_dirs().into_iter().map(|dir| (dir, "Legacy cache directory")));
+            if let Ok(cfg) = load_project(Path::new(XE_TOML)) {
+                let project_cache = PathBuf::from(&cfg.cache.global_dir);
+                if !cfg.cache.global_dir.is_empty() && !paths.iter().any(|(p, _)| *p == project_cache) {
+                    paths.push((project_cache, "Project cache directory"));
                 }
             }
-            Ok(())
+            paths
         }
-        "update" => cmd_add(ctx, &args[1..]),
-        "uninstall" => cmd_remove(ctx, &args[1..]),
-        "upgrade" => cmd_sync(ctx, &args[1..]),
-        "sync" => cmd_sync(ctx, &args[1..]),
-        "dir" => {
-            let wd = env::current_dir().context("failed to get cwd")?;
-            let (mut cfg, toml_path) = load_or_create_project(&wd)?;
-            let runtime = ensure_runtime_for_project(ctx, &wd, &mut cfg)?;
-            if runtime.config_changed {
-                save_project(&toml_path, &cfg)?;
+        CleanTarget::Venvs => vec![
+            (xe_venv_dir(), "Managed virtual environments"),
+            (xe_script_env_dir(), "Script environments"),
+        ],
+        CleanTarget::Runtimes => recorded_runtimes()
+            .into_iter()
+            .map(|dir| (dir, "Python runtime"))
+            .collect(),
+        CleanTarget::Project => vec![
+            (PathBuf::from(XE_TOML), "Local project configuration"),
+            (PathBuf::from(XE_LOCK), "Local lockfile"),
+        ],
+    };
+    Ok(paths)
+}
+
+fn cmd_clean(args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe clean [--cache] [--venvs] [--runtimes] [--project] [--all] [--force]";
+    let mut force = false;
+    let mut all = false;
+    let mut targets = Vec::new();
+    for arg in args {
+        match arg.as_str() {
+            "--force" | "-f" => force = true,
+            "--all" => all = true,
+            flag => match CLEAN_TARGETS.iter().find(|(_, name, _)| *name == flag) {
+                Some((target, _, _)) if !targets.contains(target) => targets.push(*target),
+                Some(_) => {}
+                None => bail_kind!(ErrorKind::Usage, "{USAGE}"),
+            },
+        }
+    }
+    if all {
+        targets = CLEAN_TARGETS.iter().map(|(target, _, _)| *target).collect();
+    } else if targets.is_empty() {
+        // --yes confirms a deletion; it never picks what gets deleted.
+        if ASSUME_YES.load(AtomicOrdering::Relaxed) || !is_interactive() {
+            bail_kind!(
+                ErrorKind::Usage,
+                "choose what to clean: pass --cache, --venvs, --runtimes, --project or --all"
+            );
+        }
+        println!("What should be cleaned?");
+        for (idx, (_, flag, what)) in CLEAN_TARGETS.iter().enumerate() {
+            println!("  {}. {what} ({flag})", idx + 1);
+        }
+        let picked = select_many(
+            "items to clean",
+            CLEAN_TARGETS.len(),
+            "pass --cache, --venvs, --runtimes, --project or --all",
+        )?;
+        targets = picked.into_iter().map(|idx| CLEAN_TARGETS[idx].0).collect();
+        if targets.is_empty() {
+            info("Nothing selected.");
+            return Ok(());
+        }
+    }
+
+    let mut paths = Vec::new();
+    for target in &targets {
+        paths.extend(clean_paths(*target)?);
+    }
+    if all {
+        let home = dirs::home_dir().ok_or_else(|| anyhow!("cannot resolve home dir"))?;
+        paths.push((xe_home(), "Global configuration and data"));
+        paths.push((home.join(".xe"), "Legacy xe directory"));
+    }
+    paths.retain(|(path, _)| path.exists());
+    if paths.is_empty() {
+        info("Nothing to clean.");
+        return Ok(());
+    }
+    if !force {
+        warning("This will delete:");
+        for (path, what) in &paths {
+            println!("- {} ({})", path.display(), what.to_lowercase());
+        }
+        println!();
+        if !confirm("Are you sure you want to proceed?", false)? {
+            info("Cleanup cancelled.");
+            return Ok(());
+        }
+    }
+
+    for (path, what) in &paths {
+        remove_path(path, what)?;
+    }
+    if targets.contains(&CleanTarget::Runtimes) && !all {
+        let removed = paths.iter().map(|(path, _)| path.clone()).collect::<Vec<_>>();
+        forget_runtimes(&removed);
+    }
+    success("Cleanup complete.");
+    Ok(())
+}
+
+fn cmd_projects(args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe projects [list [--json] | forget <dir>... | forget --missing]";
+    match args.first().map(String::as_str) {
+        None | Some("list") => {
+            let json_output = match args.get(1..).unwrap_or_default() {
+                [] => false,
+                [flag] if flag == "--json" => true,
+                _ => bail_kind!(ErrorKind::Usage, "{USAGE}"),
+            };
+            let rows = load_project_registry()
+                .into_iter()
+                .map(|(dir, record)| {
+                    let cfg = load_project(&dir.join(XE_TOML)).ok();
+                    json!({
+                        "path": dir,
+                        "python": cfg.as_ref().map(|cfg| cfg.python.version.clone()).unwrap_or_default(),
+                        "venv": cfg.as_ref().map(|cfg| cfg.venv.name.clone()).unwrap_or_default(),
+                        "last_used": record.last_used,
+                        "missing": cfg.is_none(),
+                    })
+                })
+                .collect::<Vec<_>>();
+            if json_output {
+                println!("{}", serde_json::to_string_pretty(&rows)?);
+                return Ok(());
+            }
+            if rows.is_empty() {
+                info("No projects recorded yet; xe records a project whenever it runs in one.");
+                return Ok(());
+            }
+            print_project_table(&rows);
+            let missing = rows.iter().filter(|row| row["missing"] == true).count();
+            if missing > 0 {
+                info(&format!(
+                    "{missing} project(s) no longer have an {XE_TOML}; drop them with `xe projects forget --missing`"
+                ));
             }
-            println!("{}", runtime.selection.site_packages.display());
             Ok(())
         }
-        _ => bail!("usage: xe tool <run|install|list|update|uninstall|upgrade|sync|dir> ..."),
+        Some("forget") => update_project_registry(|registry| {
+            let forget = match &args[1..] {
+                [] => bail_kind!(ErrorKind::Usage, "{USAGE}"),
+                [flag] if flag == "--missing" => registry
+                    .keys()
+                    .filter(|dir| !dir.join(XE_TOML).is_file())
+                    .cloned()
+                    .collect::<Vec<_>>(),
+                dirs => {
+                    let mut out = Vec::new();
+                    for dir in dirs {
+                        let dir = fs::canonicalize(dir).unwrap_or_else(|_| PathBuf::from(dir));
+                        if !registry.contains_key(&dir) {
+                            bail!("{} is not a recorded project", dir.display());
+                        }
+                        out.push(dir);
+                    }
+                    out
+                }
+            };
+            for dir in &forget {
+                registry.remove(dir);
+            }
+            success(&format!("Forgot {} project(s)", forget.len()));
+            Ok(())
+        }),
+        Some(_) => bail_kind!(ErrorKind::Usage, "{USAGE}"),
     }
 }
 
-fn cmd_x_alias(ctx: &AppContext, args: &[String]) -> Result<()> {
-    let filtered = args
+fn print_project_table(rows: &[Value]) {
+    let text = |row: &Value, key: &str| row[key].as_str().unwrap_or_default().to_string();
+    let cells = rows
         .iter()
-        .filter(|a| !a.trim().is_empty())
-        .cloned()
+        .map(|row| {
+            let last_used = text(row, "last_used").replace('T', " ");
+            [
+                text(row, "path"),
+                if row["missing"] == true { "missing".to_string() } else { or_dash(&text(row, "python")).to_string() },
+                or_dash(&text(row, "venv")).to_string(),
+                last_used.get(..16).unwrap_or(&last_used).to_string(),
+            ]
+        })
+        .collect::<Vec<_>>();
+    let headers = ["Project", "Python", "Venv", "Last used"];
+    let widths = (0..headers.len())
+        .map(|i| cells.iter().map(|c| c[i].len()).max().unwrap_or(0).max(headers[i].len()))
         .collect::<Vec<_>>();
-    cmd_run(ctx, &filtered)
+    let line = |values: [&str; 4]| {
+        let [path, python, venv, last] = values;
+        println!(
+            "{path:<w0$}  {python:<w1$}  {venv:<w2$}  {last}",
+            w0 = widths[0],
+            w1 = widths[1],
+            w2 = widths[2]
+        );
+    };
+    line(headers);
+    for row in &cells {
+        line([&row[0], &row[1], &row[2], &row[3]]);
+    }
 }
 
-fn cmd_build(_args: &[String]) -> Result<()> {
-    println!("Building wheel...");
-    println!("Successfully built xe_project-1.0.0-py3-none-any.whl");
-    Ok(())
-}
+// Disk usage of the project's environment per package, then of the cache, the managed
+// venvs and the Python runtimes. Package sizes come from RECORD, so files a package wrote
+// after installing show up as "other files".
+fn cmd_du(ctx: &AppContext, args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe du [--top <n>] [--json]";
+    let (json_output, rest) = take_flag(args, "--json");
+    let top = match rest.as_slice() {
+        [] => 20,
+        [flag, n] if flag == "--top" => match n.parse::<usize>() {
+            Ok(n) => n,
+            Err(_) => bail_kind!(ErrorKind::Usage, "--top requires a number (0 shows every package)"),
+        },
+        _ => bail_kind!(ErrorKind::Usage, "{USAGE}"),
+    };
+    if json_output {
+        set_log_to_stderr(true);
+    }
 
-fn cmd_push(_ctx: &AppContext, _args: &[String], test_pypi: bool) -> Result<()> {
-    let mut token = load_token().unwrap_or_default();
-    if token.trim().is_empty() {
-        if test_pypi {
-            println!("No TestPyPI token found in secure storage.");
-            print!("Enter TestPyPI Token: ");
-        } else {
-            println!("No PyPI token found in secure storage.");
-            print!("Enter PyPI Token: ");
-        }
-        io::stdout().flush().ok();
-        token = read_stdin_line()?.trim().to_string();
-        if token.is_empty() {
-            bail!("Push requires an authentication token.");
+    let wd = env::current_dir().context("failed to get cwd")?;
+    let mut environment = None;
+    let mut cache_dir = xe_cache_dir();
+    let in_project = wd.join(XE_TOML).is_file();
+    let selection = if in_project {
+        let cfg = load_project(&wd.join(XE_TOML))?;
+        if !cfg.cache.global_dir.is_empty() {
+            cache_dir = PathBuf::from(&cfg.cache.global_dir);
         }
-        save_token(&token)?;
-        println!("Token saved securely.");
+        existing_runtime_for_project(ctx, &wd, &cfg)?
+    } else {
+        None
+    };
+    if let Some(selection) = selection {
+        let root = if selection.is_venv {
+            selection
+                .python_exe
+                .parent()
+                .and_then(Path::parent)
+                .map(Path::to_path_buf)
+                .unwrap_or_else(|| selection.site_packages.clone())
+        } else {
+            selection.site_packages.clone()
+        };
+        let mut packages = list_installed_packages(&selection.site_packages);
+        packages.sort_by(|a, b| b.size.unwrap_or(0).cmp(&a.size.unwrap_or(0)).then(a.name.cmp(&b.name)));
+        environment = Some((root.clone(), dir_size(&root), packages));
     }
+    let vm = VenvManager::new()?;
+    let pm = PythonManager::new()?;
+    let runtime_dir = Regex::new(r"^python(\d)(\d+)$").expect("valid runtime dir regex");
+    let mut runtimes = fs::read_dir(&pm.base_dir)
+        .into_iter()
+        .flatten()
+        .flatten()
+        .filter(|entry| runtime_dir.is_match(&entry.file_name().to_string_lossy()))
+        .map(|entry| (entry.file_name().to_string_lossy().to_string(), dir_size(&entry.path())))
+        .collect::<Vec<_>>();
+    runtimes.sort();
+    let cache_bytes = dir_size(&cache_dir);
+    let venv_bytes = dir_size(&vm.base_dir);
+    let runtime_bytes = runtimes.iter().map(|(_, size)| size).sum::<u64>();
 
-    if test_pypi {
-        println!("Uploading package to TestPyPI...");
-        println!("Successfully pushed to TestPyPI!");
-    } else {
-        println!("Uploading package to PyPI...");
-        println!("Successfully pushed to PyPI!");
+    if json_output {
+        let environment = environment.as_ref().map(|(root, size, packages)| {
+            json!({
+                "path": root,
+                "size": size,
+                "packages": packages
+                    .iter()
+                    .map(|p| json!({"name": p.name, "version": p.version, "size": p.size}))
+                    .collect::<Vec<_>>(),
+            })
+        });
+        let report = json!({
+            "environment": environment,
+            "cache": {"path": cache_dir, "size": cache_bytes},
+            "venvs": {"path": vm.base_dir, "size": venv_bytes},
+            "runtimes": runtimes
+                .iter()
+                .map(|(name, size)| json!({"name": name, "path": pm.base_dir.join(name), "size": size}))
+                .collect::<Vec<_>>(),
+        });
+        println!("{}", serde_json::to_string_pretty(&report)?);
+        return Ok(());
+    }
+
+    match &environment {
+        Some((root, size, packages)) => {
+            println!("Project environment {}: {}", root.display(), human_bytes(*size));
+            let shown = if top == 0 { packages.len() } else { top.min(packages.len()) };
+            let width = packages[..shown].iter().map(|p| p.name.len()).max().unwrap_or(0).max("Package".len());
+            let version_width = packages[..shown]
+                .iter()
+                .map(|p| p.version.len())
+                .max()
+                .unwrap_or(0)
+                .max("Version".len());
+            println!("  {:<width$}  {:<version_width$}  {:>10}", "Package", "Version", "Size");
+            for p in &packages[..shown] {
+                let size = p.size.map(human_bytes).unwrap_or_else(|| "-".to_string());
+                println!("  {:<width$}  {:<version_width$}  {:>10}", p.name, p.version, size);
+            }
+            let rest = &packages[shown..];
+            if !rest.is_empty() {
+                let bytes = rest.iter().filter_map(|p| p.size).sum::<u64>();
+                println!("  ... {} more package(s), {}", rest.len(), human_bytes(bytes));
+            }
+            let listed = packages.iter().filter_map(|p| p.size).sum::<u64>();
+            println!("  other files: {}", human_bytes(size.saturating_sub(listed)));
+        }
+        None if in_project => println!("Project environment: not installed"),
+        None => info(&format!("No {XE_TOML} here; showing shared usage only")),
+    }
+    println!("Cache {}: {}", cache_dir.display(), human_bytes(cache_bytes));
+    println!("Venvs {}: {}", vm.base_dir.display(), human_bytes(venv_bytes));
+    println!("Runtimes {}: {}", pm.base_dir.display(), human_bytes(runtime_bytes));
+    for (name, size) in &runtimes {
+        println!("  {name}: {}", human_bytes(*size));
     }
     Ok(())
 }
 
-fn cmd_auth(args: &[String]) -> Result<()> {
-    if args.is_empty() {
-        bail!("usage: xe auth <login|revoke>");
+// A venv or xe-installed runtime that no known project, tool or the global default uses.
+struct UnusedEnv {
+    label: String,
+    path: PathBuf,
+    venv: Option<String>,
+    size_bytes: u64,
+}
+
+fn cmd_prune_envs(ctx: &AppContext, args: &[String]) -> Result<()> {
+    let dry_run = match args {
+        [] => false,
+        [flag] if flag == "--dry-run" => true,
+        _ => bail!("usage: xe prune-envs [--dry-run]"),
+    };
+    let vm = VenvManager::new()?;
+    let pm = PythonManager::new()?;
+    let projects = known_projects();
+    if projects.is_empty() {
+        warning("No projects are known yet, so every venv looks unused; check the list carefully.");
     }
-    match args[0].as_str() {
-        "login" => {
-            print!("Enter PyPI Token: ");
-            io::stdout().flush().ok();
-            let token = read_stdin_line()?.trim().to_string();
-            save_token(&token)?;
-            if cfg!(windows) {
-                println!("Token saved securely in Windows Credential Manager");
-            } else {
-                println!("Token saved securely in {}", xe_home().display());
+
+    let venvs = vm.list().unwrap_or_default();
+    let mut used_venvs = HashSet::new();
+    let mut used_runtimes = HashSet::new();
+    // Runs under XE_PYTHON get their own `<venv>-pyXY` sibling.
+    let mut keep_venv = |venv: &str| {
+        let venv = venv.trim().to_lowercase();
+        if !venv.is_empty() {
+            let versioned = format!("{venv}-py");
+            used_venvs.extend(venvs.iter().filter(|v| **v == venv || v.starts_with(&versioned)).cloned());
+        }
+    };
+    let mut unreadable = Vec::new();
+    for dir in &projects {
+        let cfg = match load_project(&dir.join(XE_TOML)) {
+            Ok(cfg) => cfg,
+            Err(_) => {
+                unreadable.push(dir.clone());
+                continue;
             }
-            Ok(())
+        };
+        if let Ok(runtime) = pm.get_python_path(&cfg.python.version) {
+            used_runtimes.insert(runtime);
         }
-        "revoke" => {
-            revoke_token()?;
-            println!("Token revoked successfully");
-            Ok(())
+        keep_venv(&cfg.venv.name);
+    }
+    // A registered project whose xe.toml is gone or unreadable may be on an unmounted
+    // disk or mid-edit, so its venvs stay until `xe projects forget` drops it: the ones
+    // that list it as a user, and the autovenv its directory name gives.
+    unreadable.extend(
+        load_project_registry()
+            .into_keys()
+            .filter(|dir| !dir.join(XE_TOML).is_file()),
+    );
+    for dir in &unreadable {
+        keep_venv(&auto_venv_name(&Config::new_default(dir), dir));
+    }
+    for name in &venvs {
+        let listed = fs::read_to_string(vm.base_dir.join(name).join(VENV_PROJECTS_FILE)).unwrap_or_default();
+        if listed.lines().any(|line| unreadable.iter().any(|dir| Path::new(line) == dir)) {
+            used_venvs.insert(name.clone());
         }
-        _ => bail!("usage: xe auth <login|revoke>"),
     }
-}
-
-fn cmd_mirror(args: &[String]) -> Result<()> {
-    if args.is_empty() {
-        bail!("usage: xe mirror <add|list>");
+    if !unreadable.is_empty() {
+        info(&format!(
+            "Keeping the venvs of {} project(s) whose {XE_TOML} is missing or unreadable; drop them with `xe projects forget`",
+            unreadable.len()
+        ));
     }
-    match args[0].as_str() {
-        "add" => {
-            if args.len() != 2 {
-                bail!("usage: xe mirror add <url>");
-            }
-            println!("Added mirror: {}", args[1]);
-            Ok(())
+    for name in &used_venvs {
+        let version = vm.info(name).map(|info| info.python_version).unwrap_or_default();
+        if let Ok(runtime) = pm.get_python_path(&version) {
+            used_runtimes.insert(runtime);
         }
-        "list" => {
-            println!("Configured mirrors:");
-            println!("- https://pypi.org/simple (Default)");
-            Ok(())
+    }
+    let mut versions = installed_tools()
+        .unwrap_or_default()
+        .into_iter()
+        .map(|(_, receipt)| receipt.python_version)
+        .collect::<Vec<_>>();
+    // Script and ephemeral tool environments are rebuilt on demand, but only while the
+    // runtime they were created with is still there.
+    for base in [xe_script_env_dir(), xe_tool_cache_dir()] {
+        for entry in fs::read_dir(&base).into_iter().flatten().flatten() {
+            let receipt = fs::read(entry.path().join(TOOL_RECEIPT))
+                .ok()
+                .and_then(|data| serde_json::from_slice::<ToolReceipt>(&data).ok());
+            versions.extend(receipt.map(|receipt| receipt.python_version));
         }
-        _ => bail!("usage: xe mirror <add|list>"),
     }
-}
+    versions.push(load_global_config(&ctx.config_file)?.default_python);
+    used_runtimes.extend(versions.iter().filter_map(|v| pm.get_python_path(v).ok()));
 
-fn cmd_plugin(args: &[String]) -> Result<()> {
-    if args.len() == 1 && args[0] == "list" {
-        println!("Plugins directory: {}", xe_plugin_dir().display());
-        println!("No plugins installed.");
+    let mut unused = Vec::new();
+    for name in venvs.iter().filter(|v| !used_venvs.contains(*v)) {
+        let info = vm.info(name)?;
+        // Deleting an adopted venv only drops its registration.
+        let size_bytes = if info.adopted { 0 } else { info.size_bytes };
+        unused.push(UnusedEnv {
+            label: format!("venv {name} (Python {})", info.python_version),
+            path: info.path,
+            venv: Some(name.clone()),
+            size_bytes,
+        });
+    }
+    // Only runtimes xe installed are candidates; interpreters found on the system are not ours.
+    for dir in recorded_runtimes().into_iter().filter(|dir| !used_runtimes.contains(dir)) {
+        let name = dir.file_name().map(|n| n.to_string_lossy().to_string()).unwrap_or_default();
+        unused.push(UnusedEnv {
+            label: format!("runtime {name}"),
+            size_bytes: dir_size(&dir),
+            path: dir,
+            venv: None,
+        });
+    }
+    if unused.is_empty() {
+        success(&format!("No unused venvs or runtimes ({} known project(s))", projects.len()));
         return Ok(());
     }
-    bail!("usage: xe plugin list")
-}
 
-fn cmd_self(args: &[String]) -> Result<()> {
-    if args.len() == 1 && args[0] == "update" {
-        println!("Checking for updates...");
-        println!("xe is already up to date (v1.0.0)");
+    println!("Unused by the {} known project(s):", projects.len());
+    for (idx, env) in unused.iter().enumerate() {
+        println!(
+            "  {}. {} {} at {}",
+            idx + 1,
+            env.label,
+            human_bytes(env.size_bytes),
+            env.path.display()
+        );
+    }
+    println!(
+        "Total: {}",
+        human_bytes(unused.iter().map(|env| env.size_bytes).sum::<u64>())
+    );
+    if dry_run {
         return Ok(());
     }
-    bail!("usage: xe self update")
+    let picked = select_many(
+        "environments to delete",
+        unused.len(),
+        "pass --yes to delete all of them, or --dry-run to only list them",
+    )?;
+    if picked.is_empty() {
+        info("Nothing deleted.");
+        return Ok(());
+    }
+    let mut freed = 0u64;
+    let mut removed_runtimes = Vec::new();
+    for env in picked.into_iter().map(|idx| &unused[idx]) {
+        match &env.venv {
+            Some(name) => {
+                info(&format!("Deleting {}...", env.label));
+                vm.delete(name)?;
+            }
+            None => {
+                remove_path(&env.path, &env.label)?;
+                removed_runtimes.push(env.path.clone());
+            }
+        }
+        freed += env.size_bytes;
+    }
+    forget_runtimes(&removed_runtimes);
+    success(&format!("Freed {}", human_bytes(freed)));
+    Ok(())
 }
 
-fn cmd_workspace(args: &[String]) -> Result<()> {
-    if args.is_empty() {
-        bail!("usage: xe workspace <init|add>");
-    }
-    match args[0].as_str() {
-        "init" => {
-            println!("Initialized xe workspace");
+fn cmd_snapshot(args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe snapshot <name> | create <name> | list [--json] | restore <name> | delete <name>...";
+    match args.first().map(String::as_str) {
+        None => bail_kind!(ErrorKind::Usage, "{USAGE}"),
+        Some("list") => {
+            let json_output = match &args[1..] {
+                [] => false,
+                [flag] if flag == "--json" => true,
+                _ => bail_kind!(ErrorKind::Usage, "usage: xe snapshot list [--json]"),
+            };
+            let snapshots = list_snapshots()?;
+            if json_output {
+                let entries = snapshots
+                    .iter()
+                    .map(|snap| {
+                        json!({
+                            "name": snap.name,
+                            "created": snapshot_date(snap.created),
+                            "size_bytes": snap.size_bytes,
+                            "path": snap.path,
+                        })
+                    })
+                    .collect::<Vec<_>>();
+                println!("{}", serde_json::to_string_pretty(&entries)?);
+                return Ok(());
+            }
+            if snapshots.is_empty() {
+                info("No snapshots found");
+                return Ok(());
+            }
+            print_snapshot_table(&snapshots);
             Ok(())
         }
-        "add" => {
-            if args.len() != 2 {
-                bail!("usage: xe workspace add <path>");
+        Some("restore") => cmd_restore(&args[1..]),
+        Some("delete" | "rm") => {
+            if args.len() < 2 {
+                bail_kind!(ErrorKind::Usage, "usage: xe snapshot delete <name>...");
+            }
+            for name in &args[1..] {
+                let matches = matching_snapshots(name)?;
+                for snap in &matches {
+                    fs::remove_file(&snap.path)
+                        .with_context(|| format!("failed to remove {}", snap.path.display()))?;
+                }
+                success(&format!("Deleted {} snapshot(s) named '{name}'", matches.len()));
             }
-            println!("Added {} to workspace", args[1]);
             Ok(())
         }
-        _ => bail!("usage: xe workspace <init|add>"),
+        Some("create") if args.len() == 2 => create_named_snapshot(&args[1]),
+        Some(_) if args.len() == 1 => create_named_snapshot(&args[0]),
+        Some(_) => bail_kind!(ErrorKind::Usage, "{USAGE}"),
     }
 }
 
-fn cmd_why(args: &[String]) -> Result<()> {
-    if args.len() != 1 {
-        bail!("usage: xe why <package_name>");
-    }
-    println!("Analyzing dependency chain for {}...", args[0]);
-    println!("project -> requests (2.32.0) -> idna (3.7) -> {}", args[0]);
+fn create_named_snapshot(name: &str) -> Result<()> {
+    let snap_path = create_snapshot(name)?;
+    println!("Snapshot '{}' created successfully at {}", name, snap_path.display());
     Ok(())
 }
 
-fn cmd_tree(_args: &[String]) -> Result<()> {
-    println!("xe project");
-    println!("|-- requests (2.32.0)");
-    println!("|   |-- urllib3 (2.2.1)");
-    println!("|   |-- idna (3.7)");
-    println!("|   |-- certifi (2024.2.2)");
-    println!("|   `-- charset-normalizer (3.3.2)");
-    println!("`-- pandas (2.2.2)");
-    println!("    |-- numpy (1.26.4)");
-    println!("    `-- python-dateutil (2.9.0)");
+fn cmd_restore(args: &[String]) -> Result<()> {
+    if args.len() != 1 {
+        bail_kind!(ErrorKind::Usage, "usage: xe restore <name>");
+    }
+    let (snapshot, backup) = restore_snapshot(&args[0])?;
+    success(&format!(
+        "Restored snapshot '{}' from {}",
+        snapshot.name,
+        snapshot_date(snapshot.created)
+    ));
+    info(&format!("Previous state saved as {}", backup.display()));
     Ok(())
 }
 
-fn cmd_doctor(_args: &[String]) -> Result<()> {
-    println!("Checking environment health...");
-    println!("[OK] Python runtime");
-    println!("[OK] All dependencies verified");
-    println!("[OK] Toolchain compatibility confirmed");
+fn cmd_sync(ctx: &AppContext, args: &[String]) -> Result<()> {
+    let args = take_python_flag(args, false)?;
+    let (require_hashes, rest) = take_flag(&args, "--require-hashes");
+    if !rest.is_empty() {
+        bail!("usage: xe sync [--require-hashes] [--python <version>]");
+    }
+    let wd = env::current_dir().context("failed to get cwd")?;
+    install_project(ctx, &wd, require_hashes, false)?;
+    success("Project synced from xe.toml");
+    print_install_summary(ctx);
     Ok(())
 }
 
-fn cmd_setup(_args: &[String]) -> Result<()> {
-    let shim_dir = xe_shim_dir();
-    fs::create_dir_all(&shim_dir)
-        .with_context(|| format!("failed to create {}", shim_dir.display()))?;
-    add_to_path(&shim_dir)?;
-    println!(
-        "Successfully added {} to your PATH. Please restart your terminal.",
-        shim_dir.display()
-    );
+fn cmd_lock(ctx: &AppContext, args: &[String]) -> Result<()> {
+    let (require_hashes, rest) = take_flag(args, "--require-hashes");
+    if !rest.is_empty() {
+        bail!("usage: xe lock [--require-hashes]");
+    }
+    let wd = env::current_dir().context("failed to get cwd")?;
+    install_project(ctx, &wd, require_hashes, true)?;
+    success("Locked dependencies");
+    print_install_summary(ctx);
     Ok(())
 }
 
-fn print_help() {
-    println!("xe is a Python toolchain manager with global CAS caching");
-    println!();
-    println!("Usage:");
-    println!("  xe [--config <path>] [--profile] [--profile-dir <dir>] <command> [args]");
-    println!();
-    println!("Core commands:");
-    println!("  init, use, add, remove, list, run, shell, sync, lock");
-    println!("  python install|list|find|pin|dir");
-    println!("  venv create|list|delete|use|unset|autovenv");
-    println!("  pip install|uninstall|list|show|tree|check|sync|compile");
-    println!("  tool run|install|list|update|uninstall|upgrade|sync|dir");
-    println!("  cache dir|clean|prune");
+// What `xe plan` expects the install to do with one resolved package.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "kebab-case")]
+enum PlanAction {
+    // Already in the environment at this version.
+    Installed,
+    // The artifact is in the cache; only extraction is left.
+    Cached,
+    Download,
+    // A source distribution without a cached build for this machine.
+    Build,
 }
 
-fn print_version() {
-    println!("xe 2.0.0");
-    println!("os={} arch={}", env::consts::OS, env::consts::ARCH);
+impl PlanAction {
+    fn label(self) -> &'static str {
+        match self {
+            PlanAction::Installed => "installed",
+            PlanAction::Cached => "cached",
+            PlanAction::Download => "download",
+            PlanAction::Build => "build",
+        }
+    }
 }
 
-fn info(msg: &str) {
-    println!(" INFO  {msg}");
+#[derive(Debug, Serialize)]
+struct PlanStep {
+    name: String,
+    version: String,
+    action: PlanAction,
+    // Whether the artifact (the wheel, or the sdist to build) is already in the cache.
+    cached: bool,
+    // Size of the artifact; None when the index does not say.
+    size: Option<u64>,
 }
 
-fn success(msg: &str) {
-    println!(" SUCCESS  {msg}");
-}
+// `xe plan [sync | add <requirement>...]`: what `xe sync` or `xe add` would do, resolved
+// but not installed. Resolution runs (and is cached, so the real command skips it), but
+// nothing is downloaded, built, created or written to the project.
+fn cmd_plan(ctx: &AppContext, args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe plan [--json] [--python <version>] [sync | add <requirement>...]";
+    let args = take_python_flag(args, false)?;
+    let (json_output, args) = take_flag(&args, "--json");
+    let added = match args.split_first() {
+        None => None,
+        Some((cmd, [])) if cmd == "sync" => None,
+        Some((cmd, reqs)) if cmd == "add" && !reqs.is_empty() => Some(reqs.to_vec()),
+        _ => bail_kind!(ErrorKind::Usage, "{USAGE}"),
+    };
+    if json_output {
+        set_log_to_stderr(true);
+    }
+    let wd = env::current_dir().context("failed to get cwd")?;
+    let mut cfg = load_existing_project(&wd)?;
 
-fn warning(msg: &str) {
-    println!(" WARNING  {msg}");
-}
+    // The runtime ensure_runtime_for_project would select, without creating anything.
+    let pinned = select_python_version(ctx, &mut cfg)?;
+    let pm = PythonManager::new()?;
+    let vm = VenvManager::new()?;
+    let mut setup = Vec::new();
+    let mut python_exe = pm.get_python_exe(&cfg.python.version).ok();
+    if python_exe.is_none() {
+        setup.push(format!("install Python {}", cfg.python.version));
+    }
+    let mut venv_name = cfg.venv.name.trim().to_string();
+    if venv_name.is_empty() && cfg.settings.autovenv {
+        venv_name = auto_venv_name(&cfg, &wd);
+    }
+    venv_name = venv_for_version(&venv_name, &pinned, &cfg.python.version);
+    let (target, site_packages) = if venv_name.is_empty() {
+        ("global".to_string(), pm.get_site_packages_dir(&cfg.python.version).ok())
+    } else if vm.exists(&venv_name) {
+        python_exe = Some(vm.get_python_exe(&venv_name));
+        (format!("venv:{venv_name}"), Some(vm.selection(&venv_name)?.site_packages))
+    } else {
+        setup.push(format!("create venv {venv_name}"));
+        (format!("venv:{venv_name}"), None)
+    };
+    let Some(python_exe) = python_exe else {
+        if json_output {
+            let report = json!({"target": target, "python": cfg.python.version, "setup": setup, "packages": null});
+            println!("{}", serde_json::to_string_pretty(&report)?);
+        } else {
+            println!("Target: {target} (Python {})", cfg.python.version);
+            for step in &setup {
+                println!("  would {step}");
+            }
+        }
+        info(&format!(
+            "Packages are resolved with the project's interpreter; install it with `xe python install {}` to see them",
+            cfg.python.version
+        ));
+        return Ok(());
+    };
 
-fn error(msg: &str) {
-    eprintln!("  ERROR   {msg}");
-}
+    let mut installer = Installer::new(Path::new(&cfg.cache.global_dir))?.dry_run();
+    let (reqs, relaxed) = match &added {
+        None => {
+            let reqs = locked_requirements(&wd, &cfg, project_requirements(&wd, &cfg)?)?;
+            (reqs.clone(), reqs)
+        }
+        Some(added) => {
+            installer = installer.with_joint_resolution();
+            add_requirements(&wd, &cfg, added)?
+        }
+    };
+    let (reqs, relaxed) = (normalize_requirements(&reqs), normalize_requirements(&relaxed));
+    let (mut packages, indexes) = if reqs.is_empty() {
+        (Vec::new(), IndexPlan::load(ctx, &cfg)?)
+    } else {
+        let (graph, indexes) = match installer.resolve(ctx, &cfg, &reqs, &wd, &python_exe) {
+            Err(err) if reqs != relaxed && error_kind(&err) == Some(ErrorKind::Resolution) => {
+                warning(&format!(
+                    "the locked versions conflict with the new requirements; resolving without {XE_LOCK}"
+                ));
+                installer.resolve(ctx, &cfg, &relaxed, &wd, &python_exe)?
+            }
+            resolved => resolved?,
+        };
+        (graph.packages, indexes)
+    };
+    let resolve_cached = ctx.timings.counter("install.solution_hit") > 0;
+    sort_install_order(&mut packages);
 
-#[derive(Debug, Clone, Serialize, Deserialize)]
-struct Config {
-    #[serde(default)]
-    project: ProjectConfig,
-    #[serde(default)]
-    python: PythonConfig,
-    #[serde(default)]
-    deps: HashMap<String, String>,
-    #[serde(default)]
-    cache: CacheConfig,
-    #[serde(default)]
-    venv: VenvConfig,
-    #[serde(default)]
-    settings: SettingsConfig,
-}
+    let installed = match &site_packages {
+        Some(site) => installed_package_key_set(site)?,
+        None => HashSet::new(),
+    };
+    let build_target = match packages.iter().any(is_sdist) {
+        true => Some(BuildTarget::detect(&python_exe, detect_toolchain())?),
+        false => None,
+    };
+    let cas = &installer.cas;
+    let mut steps = packages
+        .iter()
+        .filter(|pkg| !pkg.download_url.trim().is_empty())
+        .map(|pkg| {
+            let blob = cas.cached_blob(pkg.hash_algorithm, &pkg.hash);
+            let built = build_target
+                .as_ref()
+                .filter(|_| is_sdist(pkg))
+                .map(|target| cas.built_wheel(&pkg.hash, &target.key()));
+            let action = if installed.contains(&package_identity_key(&pkg.name, &pkg.version)) {
+                PlanAction::Installed
+            } else if matches!(built, Some(None)) {
+                PlanAction::Build
+            } else if blob.is_some() {
+                PlanAction::Cached
+            } else {
+                PlanAction::Download
+            };
+            PlanStep {
+                name: pkg.name.clone(),
+                version: pkg.version.clone(),
+                action,
+                cached: blob.is_some(),
+                size: blob.and_then(|b| fs::metadata(b).ok()).map(|m| m.len()),
+            }
+        })
+        .collect::<Vec<_>>();
+    // Artifacts still to fetch are sized with a HEAD request, on the download pool.
+    let pool = rayon::ThreadPoolBuilder::new()
+        .num_threads(http_concurrency(ctx).min(steps.len().max(1)))
+        .build()
+        .context("failed to start download pool")?;
+    pool.install(|| {
+        steps.par_iter_mut().for_each(|step| {
+            if step.cached || step.action == PlanAction::Installed {
+                return;
+            }
+            let pkg = packages.iter().find(|p| p.name == step.name);
+            step.size = pkg.and_then(|pkg| artifact_size(&pkg.download_url, indexes.auth_for(&pkg.download_url)));
+        })
+    });
 
-#[derive(Debug, Clone, Serialize, Deserialize, Default)]
-struct ProjectConfig {
-    #[serde(default)]
-    name: String,
+    let count = |action: PlanAction| steps.iter().filter(|s| s.action == action).count();
+    let downloads = steps
+        .iter()
+        .filter(|s| !s.cached && s.action != PlanAction::Installed)
+        .collect::<Vec<_>>();
+    let download_bytes = downloads.iter().filter_map(|s| s.size).sum::<u64>();
+    let estimate = estimate_install(ctx, &steps);
+    if json_output {
+        let report = json!({
+            "target": target,
+            "python": cfg.python.version,
+            "site_packages": site_packages,
+            "setup": setup,
+            "resolution_cached": resolve_cached,
+            "packages": steps,
+            "install_order": steps.iter().map(|s| s.name.as_str()).collect::<Vec<_>>(),
+            "download_bytes": download_bytes,
+            "estimated_ms": estimate.map(|d| d.as_millis() as u64),
+        });
+        println!("{}", serde_json::to_string_pretty(&report)?);
+        return Ok(());
+    }
+
+    println!("Target: {target} (Python {})", cfg.python.version);
+    if let Some(site) = &site_packages {
+        println!("  site-packages: {}", site.display());
+    }
+    for step in &setup {
+        println!("  would {step}");
+    }
+    if resolve_cached {
+        println!("Resolution: cached");
+    } else {
+        println!(
+            "Resolution: resolved in {}, now cached for the real run",
+            human_duration(ctx.timings.span("install.resolve").unwrap_or_default())
+        );
+    }
+    if steps.is_empty() {
+        success("Nothing to install");
+        return Ok(());
+    }
+    let width = steps.iter().map(|s| s.name.len()).max().unwrap_or(0).max("Package".len());
+    let version_width = steps.iter().map(|s| s.version.len()).max().unwrap_or(0).max("Version".len());
+    println!("{:>3}  {:<width$}  {:<version_width$}  {:<9}  {:>10}", "#", "Package", "Version", "Action", "Size");
+    for (idx, step) in steps.iter().enumerate() {
+        println!(
+            "{:>3}  {:<width$}  {:<version_width$}  {:<9}  {:>10}",
+            idx + 1,
+            step.name,
+            step.version,
+            step.action.label(),
+            step.size.map(human_bytes).unwrap_or_else(|| "-".to_string())
+        );
+    }
+    println!(
+        "Packages are listed in install order, each after its dependencies; up to {} are fetched at a time.",
+        http_concurrency(ctx)
+    );
+    println!(
+        "{} to download ({}), {} from the cache, {} to build, {} already installed",
+        downloads.len(),
+        human_bytes(download_bytes),
+        count(PlanAction::Cached),
+        count(PlanAction::Build),
+        count(PlanAction::Installed)
+    );
+    match estimate {
+        Some(estimate) => println!("Estimated time: about {}", human_duration(estimate)),
+        None if steps.iter().all(|s| s.action == PlanAction::Installed) => success("Nothing to install"),
+        None => info("No install history on this machine yet, so there is no time estimate"),
+    }
+    Ok(())
 }
 
-#[derive(Debug, Clone, Serialize, Deserialize)]
-struct PythonConfig {
-    #[serde(default = "default_python_version")]
-    version: String,
+// The size of a remote artifact from a HEAD request (or the file for file:// URLs).
+fn artifact_size(url: &str, auth: Option<&IndexAuth>) -> Option<u64> {
+    if url.starts_with("file://") {
+        let path = reqwest::Url::parse(url).ok()?.to_file_path().ok()?;
+        return fs::metadata(path).ok().map(|m| m.len());
+    }
+    let mut request = http_client().ok()?.head(url).timeout(Duration::from_secs(20));
+    if let Some(auth) = auth {
+        request = request.basic_auth(&auth.username, Some(&auth.password));
+    }
+    let resp = request.send().ok()?;
+    if !resp.status().is_success() {
+        return None;
+    }
+    resp.headers()
+        .get(reqwest::header::CONTENT_LENGTH)?
+        .to_str()
+        .ok()?
+        .parse()
+        .ok()
 }
 
-#[derive(Debug, Clone, Serialize, Deserialize)]
-struct CacheConfig {
-    #[serde(default = "default_cache_mode")]
-    mode: String,
-    #[serde(default)]
-    global_dir: String,
+// Per-package download, extract and build times averaged over the recorded installs,
+// spread over the download pool like the install does. None without history for a step
+// the plan needs.
+fn estimate_install(ctx: &AppContext, steps: &[PlanStep]) -> Option<Duration> {
+    let history = load_install_stats();
+    let rate = |ms: fn(&InstallStats) -> u64, n: fn(&InstallStats) -> u64| {
+        let total = history.iter().map(n).sum::<u64>();
+        (total > 0).then(|| history.iter().map(ms).sum::<u64>() as f64 / total as f64)
+    };
+    let count = |actions: &[PlanAction]| steps.iter().filter(|s| actions.contains(&s.action)).count() as f64;
+    let pending = count(&[PlanAction::Download, PlanAction::Cached, PlanAction::Build]);
+    if pending == 0.0 {
+        return None;
+    }
+    let mut work = pending * rate(|s| s.extract_ms, |s| s.extracted)?;
+    let downloads = steps.iter().filter(|s| !s.cached && s.action != PlanAction::Installed).count() as f64;
+    if downloads > 0.0 {
+        work += downloads * rate(|s| s.download_ms, |s| s.downloaded)?;
+    }
+    let builds = count(&[PlanAction::Build]);
+    if builds > 0.0 {
+        work += builds * rate(|s| s.build_ms, |s| s.built)?;
+    }
+    let parallel = (http_concurrency(ctx) as f64).min(pending);
+    Some(Duration::from_millis((work / parallel) as u64))
 }
 
-#[derive(Debug, Clone, Serialize, Deserialize, Default)]
-struct VenvConfig {
-    #[serde(default)]
-    name: String,
+// What `xe sync` installs: the project's requirements plus those of linked workspace members.
+fn project_requirements(dir: &Path, cfg: &Config) -> Result<Vec<String>> {
+    let mut reqs = cfg.requirements_in(dir)?;
+    for link in workspace_links(dir, cfg)? {
+        reqs.extend(link.config.requirements_in(&link.dir)?);
+    }
+    Ok(reqs)
 }
 
-#[derive(Debug, Clone, Serialize, Deserialize, Default)]
-struct SettingsConfig {
+// xe.lock: every package of the last resolution, pinned. xe.toml only lists what the user
+// asked for. `requirements` records the project's requirements the lock was written for;
+// the lock is only applied while they still match.
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct LockFile {
     #[serde(default)]
-    autovenv: bool,
+    requirements: Vec<String>,
+    #[serde(default, rename = "package")]
+    packages: Vec<Package>,
 }
 
-impl Default for PythonConfig {
-    fn default() -> Self {
-        Self {
-            version: default_python_version(),
+fn load_lockfile(dir: &Path) -> Option<LockFile> {
+    let path = dir.join(XE_LOCK);
+    let text = fs::read_to_string(&path).ok()?;
+    match toml::from_str(&text) {
+        Ok(lock) => Some(lock),
+        Err(err) => {
+            warning(&format!("ignoring {}: {err}", path.display()));
+            None
         }
     }
 }
 
-impl Default for CacheConfig {
-    fn default() -> Self {
-        Self {
-            mode: default_cache_mode(),
-            global_dir: String::new(),
+// Writes xe.lock for the project's current requirements. With `merge`, packages of a
+// partial resolution (`xe add`, `xe upgrade`) replace their entries in the existing lock
+// instead of the whole graph.
+fn save_lockfile(dir: &Path, cfg: &Config, packages: &[Package], merge: bool) -> Result<()> {
+    let mut locked = BTreeMap::new();
+    if merge {
+        for pkg in load_lockfile(dir).map(|lock| lock.packages).unwrap_or_default() {
+            locked.insert(normalize_dep_name(&pkg.name), pkg);
         }
     }
+    for pkg in packages {
+        locked.insert(normalize_dep_name(&pkg.name), pkg.clone());
+    }
+    let mut requirements = project_requirements(dir, cfg)?;
+    requirements.sort();
+    let lock = LockFile {
+        requirements,
+        packages: locked.into_values().collect(),
+    };
+    let text = format!(
+        "# Generated by `xe lock`; do not edit by hand.\n{}",
+        toml::to_string(&lock).context("failed to serialize xe.lock")?
+    );
+    write_file_atomic(&dir.join(XE_LOCK), text.as_bytes())
 }
 
-impl Config {
-    fn new_default(project_dir: &Path) -> Self {
-        let name = project_dir
-            .file_name()
-            .and_then(|s| s.to_str())
-            .unwrap_or("project")
-            .to_string();
-        Self {
-            project: ProjectConfig { name },
-            python: PythonConfig::default(),
-            deps: HashMap::new(),
-            cache: CacheConfig {
-                mode: default_cache_mode(),
-                global_dir: xe_cache_dir().to_string_lossy().to_string(),
-            },
-            venv: VenvConfig::default(),
-            settings: SettingsConfig { autovenv: false },
+// Drops the lock entries nothing declared in `cfg` still needs, after packages were
+// removed from xe.toml. Reachability follows the Requires-Dist of what is installed, so
+// the lock keeps matching the project without a new resolution.
+fn prune_lockfile(dir: &Path, cfg: &Config, site_packages: &Path) -> Result<()> {
+    let Some(lock) = load_lockfile(dir) else {
+        return Ok(());
+    };
+    let requires = installed_requires(site_packages);
+    let mut needed = cfg.deps.keys().map(|name| normalize_dep_name(name)).collect::<HashSet<_>>();
+    for group in cfg.groups.values() {
+        needed.extend(group.deps.keys().map(|name| normalize_dep_name(name)));
+    }
+    let mut pending = needed.iter().cloned().collect::<Vec<_>>();
+    while let Some(name) = pending.pop() {
+        for dep in requires.get(&name).into_iter().flatten() {
+            if needed.insert(dep.clone()) {
+                pending.push(dep.clone());
+            }
         }
     }
+    let packages = lock
+        .packages
+        .into_iter()
+        .filter(|pkg| needed.contains(&normalize_dep_name(&pkg.name)))
+        .collect::<Vec<_>>();
+    save_lockfile(dir, cfg, &packages, false)
+}
 
-    fn normalize(&mut self, project_dir: &Path) {
-        if self.project.name.trim().is_empty() {
-            self.project.name = project_dir
-                .file_name()
-                .and_then(|s| s.to_str())
-                .unwrap_or("project")
-                .to_string();
-        }
-        if self.python.version.trim().is_empty() {
-            self.python.version = default_python_version();
-        }
-        if self.cache.mode.trim().is_empty() {
-            self.cache.mode = default_cache_mode();
+// `reqs` plus the pins xe.lock holds for packages they do not name, so syncing reproduces
+// the locked graph. Loose requirements (`*` entries, lines of included requirements files)
+// take their locked version too; ones with extras, markers or a URL are kept as written.
+// A lock written for other requirements is ignored with a warning.
+fn locked_requirements(dir: &Path, cfg: &Config, mut reqs: Vec<String>) -> Result<Vec<String>> {
+    let Some(lock) = load_lockfile(dir) else {
+        return Ok(reqs);
+    };
+    let mut current = project_requirements(dir, cfg)?;
+    current.sort();
+    if current != lock.requirements {
+        warning(&format!("{XE_LOCK} is out of date with {XE_TOML}; run `xe lock` to update it"));
+        return Ok(reqs);
+    }
+    let locked = lock
+        .packages
+        .iter()
+        .map(|pkg| (normalize_dep_name(&pkg.name), pkg.version.as_str()))
+        .collect::<HashMap<_, _>>();
+    for req in reqs.iter_mut() {
+        if req.contains("==") || req.contains(['[', ';', '@']) {
+            continue;
         }
-        if self.cache.global_dir.trim().is_empty() {
-            self.cache.global_dir = xe_cache_dir().to_string_lossy().to_string();
+        if let Some(name) = requirement_to_dep_name(req) {
+            if let Some(version) = locked.get(&name) {
+                *req = format!("{name}=={version}");
+            }
         }
     }
+    let named = reqs.iter().filter_map(|r| requirement_to_dep_name(r)).collect::<HashSet<_>>();
+    reqs.extend(
+        lock.packages
+            .iter()
+            .filter(|pkg| !named.contains(&normalize_dep_name(&pkg.name)))
+            .map(|pkg| format!("{}=={}", normalize_dep_name(&pkg.name), pkg.version)),
+    );
+    Ok(reqs)
 }
 
-fn default_python_version() -> String {
-    "3.12".to_string()
+// Names each installed distribution requires, from the Requires-Dist lines of its
+// METADATA. Requirements that only apply to an extra are left out.
+fn installed_requires(site_packages: &Path) -> HashMap<String, HashSet<String>> {
+    let mut out = HashMap::new();
+    for entry in fs::read_dir(site_packages).into_iter().flatten().flatten() {
+        let dir_name = entry.file_name().to_string_lossy().to_string();
+        let Some((dist, _)) = dir_name
+            .strip_suffix(".dist-info")
+            .and_then(|base| base.rsplit_once('-'))
+        else {
+            continue;
+        };
+        let requires = fs::read_to_string(entry.path().join("METADATA"))
+            .unwrap_or_default()
+            .lines()
+            .take_while(|line| !line.is_empty())
+            .filter_map(|line| line.strip_prefix("Requires-Dist:"))
+            .filter(|req| !req.split_once(';').is_some_and(|(_, marker)| marker.contains("extra")))
+            .filter_map(requirement_to_dep_name)
+            .collect();
+        out.insert(normalize_dep_name(dist), requires);
+    }
+    out
 }
 
-fn default_cache_mode() -> String {
-    "global-cas".to_string()
+// Releases before xe.lock pinned every resolved package into xe.toml. A manifest that
+// declares the whole resolution was written that way; its entries another declared
+// package requires, pinned to exactly the resolved version, are the transitive ones xe
+// added. They are dropped from xe.toml (the lock written next keeps their pins) and their
+// names returned. Manifests that do not declare every resolved package were curated by
+// hand and are left alone.
+fn migrate_transitive_deps(cfg: &mut Config, site_packages: &Path, resolved: &[Package]) -> Vec<String> {
+    let mut declared = cfg.deps.keys().cloned().collect::<HashSet<_>>();
+    for group in cfg.groups.values() {
+        declared.extend(group.deps.keys().cloned());
+    }
+    let versions = resolved
+        .iter()
+        .map(|pkg| (normalize_dep_name(&pkg.name), pkg.version.as_str()))
+        .collect::<HashMap<_, _>>();
+    if versions.is_empty() || !versions.keys().all(|name| declared.contains(name)) {
+        return Vec::new();
+    }
+    let requires = installed_requires(site_packages);
+    let transitive = declared
+        .iter()
+        .filter(|name| {
+            declared
+                .iter()
+                .any(|other| other != *name && requires.get(other).is_some_and(|r| r.contains(*name)))
+        })
+        .cloned()
+        .collect::<HashSet<_>>();
+    let mut moved = Vec::new();
+    for deps in std::iter::once(&mut cfg.deps).chain(cfg.groups.values_mut().map(|group| &mut group.deps)) {
+        deps.retain(|name, version| {
+            let drop = transitive.contains(name) && versions.get(name) == Some(&version.as_str());
+            if drop {
+                moved.push(name.clone());
+            }
+            !drop
+        });
+    }
+    cfg.groups.retain(|_, deps| !deps.is_empty());
+    moved.sort();
+    moved.dedup();
+    moved
 }
 
-fn load_or_create_project(project_dir: &Path) -> Result<(Config, PathBuf)> {
-    let toml_path = project_dir.join(XE_TOML);
-    if !toml_path.exists() {
-        let cfg = Config::new_default(project_dir);
+// Installs the project in `dir` from its xe.toml and xe.lock, recording the resolved
+// versions when `lock` is set. Workspace members it depends on are linked into the
+// environment.
+fn install_project(ctx: &AppContext, dir: &Path, require_hashes: bool, lock: bool) -> Result<()> {
+    let (mut cfg, toml_path) = load_or_create_project(dir)?;
+    let links = workspace_links(dir, &cfg)?;
+    let reqs = locked_requirements(dir, &cfg, project_requirements(dir, &cfg)?)?;
+    let installer = Installer::new(Path::new(&cfg.cache.global_dir))?.with_require_hashes(require_hashes);
+    let runtime = ensure_runtime_for_project(ctx, dir, &mut cfg)?;
+    if runtime.config_changed {
         save_project(&toml_path, &cfg)?;
-        return Ok((cfg, toml_path));
     }
-    let cfg = load_project(&toml_path)?;
-    Ok((cfg, toml_path))
+    let (pre, post) = if lock { ("pre-lock", "post-lock") } else { ("pre-sync", "post-sync") };
+    run_hooks(&cfg, pre, dir, &runtime.selection)?;
+    let resolved = installer.install(
+        ctx,
+        &cfg,
+        &reqs,
+        dir,
+        &runtime.selection.site_packages,
+        &runtime.selection.python_exe,
+    )?;
+    link_workspace_members(&runtime.selection.site_packages, &links)?;
+    if lock {
+        if !dir.join(XE_LOCK).exists() {
+            let moved = migrate_transitive_deps(&mut cfg, &runtime.selection.site_packages, &resolved);
+            if !moved.is_empty() {
+                info(&format!(
+                    "Moved {} transitive package(s) from {XE_TOML} to {XE_LOCK}: {}",
+                    moved.len(),
+                    moved.join(", ")
+                ));
+            }
+        }
+        cfg.record_resolved(&resolved);
+        cfg.toolchain = resolved.iter().any(is_sdist).then(detect_toolchain);
+        save_project(&toml_path, &cfg)?;
+        save_lockfile(dir, &cfg, &resolved, false)?;
+    }
+    run_hooks(&cfg, post, dir, &runtime.selection)
 }
 
-fn load_project(path: &Path) -> Result<Config> {
-    let text = fs::read_to_string(path).with_context(|| format!("failed to read {}", path.display()))?;
-    let mut cfg: Config = toml::from_str(&text).with_context(|| format!("failed to parse {}", path.display()))?;
-    let project_dir = path.parent().unwrap_or_else(|| Path::new("."));
-    cfg.normalize(project_dir);
-    Ok(cfg)
+struct OutdatedDep {
+    name: String,
+    current: String,
+    latest: String,
+    groups: Vec<String>,
 }
 
-fn save_project(path: &Path, cfg: &Config) -> Result<()> {
-    let mut normalized = cfg.clone();
-    let project_dir = path.parent().unwrap_or_else(|| Path::new("."));
-    normalized.normalize(project_dir);
-    let encoded = toml::to_string_pretty(&normalized).context("failed to encode xe.toml")?;
-    fs::write(path, encoded).with_context(|| format!("failed to write {}", path.display()))?;
+fn cmd_upgrade(ctx: &AppContext, args: &[String]) -> Result<()> {
+    let mut interactive = false;
+    let mut names = Vec::new();
+    for arg in args {
+        match arg.as_str() {
+            "-i" | "--interactive" => interactive = true,
+            other if other.starts_with('-') => {
+                bail!("usage: xe upgrade [--interactive] [package_name...]")
+            }
+            other => names.push(normalize_dep_name(other)),
+        }
+    }
+    let wd = env::current_dir().context("failed to get cwd")?;
+    let (mut cfg, toml_path) = load_or_create_project(&wd)?;
+    let mut declared = cfg.deps.keys().cloned().collect::<Vec<_>>();
+    for group in cfg.groups.values() {
+        declared.extend(group.deps.keys().cloned());
+    }
+    let members = cfg.workspace_deps();
+    declared.retain(|name| !members.contains(name));
+    declared.sort();
+    declared.dedup();
+    for name in &names {
+        if !declared.contains(name) {
+            bail!("{name} is not declared in xe.toml");
+        }
+    }
+    if !names.is_empty() {
+        declared.retain(|name| names.contains(name));
+    }
+
+    info(&format!("Checking {} package(s) for updates...", declared.len()));
+    let latest = declared
+        .iter()
+        .zip(fetch_metadata_parallel(ctx, &declared, Path::new(&cfg.cache.global_dir))?)
+        .map(|(name, metadata)| metadata.map(|m| (name.clone(), m.info.version)))
+        .collect::<Result<Vec<_>>>()?;
+    let outdated = latest
+        .into_iter()
+        .filter_map(|(name, latest)| {
+            let groups = cfg.dep_groups(&name);
+            let current = cfg
+                .deps
+                .get(&name)
+                .or_else(|| cfg.groups.values().find_map(|group| group.deps.get(&name)))
+                .cloned()
+                .unwrap_or_default();
+            let behind = current.is_empty()
+                || current == "*"
+                || compare_version(&latest, &current) == Ordering::Greater;
+            behind.then_some(OutdatedDep {
+                name,
+                current,
+                latest,
+                groups,
+            })
+        })
+        .collect::<Vec<_>>();
+    if outdated.is_empty() {
+        success("All dependencies are up to date");
+        return Ok(());
+    }
+    print_outdated_table(&outdated, interactive);
+
+    let selected = if interactive {
+        let picked = select_many(
+            "packages to upgrade",
+            outdated.len(),
+            "pass package names or --yes instead of --interactive",
+        )?;
+        outdated
+            .into_iter()
+            .enumerate()
+            .filter(|(idx, _)| picked.contains(idx))
+            .map(|(_, dep)| dep)
+            .collect::<Vec<_>>()
+    } else {
+        outdated
+    };
+    if selected.is_empty() {
+        info("Nothing selected; xe.toml left unchanged");
+        return Ok(());
+    }
+
+    let runtime = ensure_runtime_for_project(ctx, &wd, &mut cfg)?;
+    let installer = Installer::new(Path::new(&cfg.cache.global_dir))?;
+    let reqs = selected
+        .iter()
+        .map(|dep| format!("{}=={}", dep.name, dep.latest))
+        .collect::<Vec<_>>();
+    let resolved = installer.install(
+        ctx,
+        &cfg,
+        &reqs,
+        &wd,
+        &runtime.selection.site_packages,
+        &runtime.selection.python_exe,
+    )?;
+    cfg.record_resolved(&resolved);
+    save_project(&toml_path, &cfg)?;
+    save_lockfile(&wd, &cfg, &resolved, true)?;
+    for dep in &selected {
+        println!("{} {} -> {}", dep.name, display_dep_version(&dep.current), dep.latest);
+    }
+    success(&format!("Upgraded {} package(s)", selected.len()));
     Ok(())
 }
 
-fn normalize_dep_name(name: &str) -> String {
-    name.trim()
-        .to_lowercase()
-        .replace('_', "-")
-        .replace('.', "-")
+fn display_dep_version(version: &str) -> &str {
+    if version.is_empty() || version == "*" {
+        "(unpinned)"
+    } else {
+        version
+    }
 }
 
-fn requirement_to_dep_name(requirement: &str) -> Option<String> {
-    let mut name = requirement.trim().to_string();
-    if name.is_empty() {
-        return None;
-    }
-    if let Some(idx) = name.find('[') {
-        name = name[..idx].to_string();
+fn print_outdated_table(rows: &[OutdatedDep], numbered: bool) {
+    let width = rows.iter().map(|r| r.name.len()).max().unwrap_or(0).max("Package".len());
+    let current_width = rows
+        .iter()
+        .map(|r| display_dep_version(&r.current).len())
+        .max()
+        .unwrap_or(0)
+        .max("Current".len());
+    let latest_width = rows.iter().map(|r| r.latest.len()).max().unwrap_or(0).max("Latest".len());
+    let prefix = |label: String| if numbered { format!("{label:>4}  ") } else { String::new() };
+    println!(
+        "{}{:<width$}  {:<current_width$}  {:<latest_width$}  Group",
+        prefix("#".to_string()),
+        "Package",
+        "Current",
+        "Latest"
+    );
+    for (idx, row) in rows.iter().enumerate() {
+        println!(
+            "{}{:<width$}  {:<current_width$}  {:<latest_width$}  {}",
+            prefix(format!("[{}]", idx + 1)),
+            row.name,
+            display_dep_version(&row.current),
+            row.latest,
+            row.groups.join(",")
+        );
     }
-    if let Some(idx) = name.find(|c: char| " <>=!~;".contains(c)) {
-        name = name[..idx].to_string();
+}
+
+// `xe test` runs the project's `test` script when [scripts] has one, otherwise
+// `python -m <settings.test_runner>` (pytest by default), installing the runner into the
+// project environment first. The runner's exit code becomes xe's.
+fn cmd_test(ctx: &AppContext, args: &[String]) -> Result<()> {
+    let wd = env::current_dir().context("failed to get cwd")?;
+    let (mut cfg, toml_path) = load_or_create_project(&wd)?;
+    let runtime = ensure_runtime_for_project(ctx, &wd, &mut cfg)?;
+    if runtime.config_changed {
+        save_project(&toml_path, &cfg)?;
     }
-    let name = name.trim();
-    if name.is_empty() {
-        None
+    let selection = &runtime.selection;
+    let mut command = if cfg.scripts.contains_key("test") {
+        let mut command_args = vec!["test".to_string()];
+        command_args.extend(args.iter().cloned());
+        project_command(&cfg, selection, &command_args, false)?
     } else {
-        Some(normalize_dep_name(name))
+        let runner = cfg.settings.test_runner.trim();
+        let runner = if runner.is_empty() { "pytest" } else { runner };
+        if runner != "unittest" && !installed_versions(&selection.site_packages).contains_key(&normalize_dep_name(runner)) {
+            info(&format!("Installing {runner} into the project environment..."));
+            Installer::new(Path::new(&cfg.cache.global_dir))?.install(
+                ctx,
+                &cfg,
+                &[runner.to_string()],
+                &wd,
+                &selection.site_packages,
+                &selection.python_exe,
+            )?;
+        }
+        let mut command = Command::new(&selection.python_exe);
+        command.arg("-m").arg(runner).args(args);
+        apply_runtime_env(&mut command, selection)?;
+        command
+    };
+    run_hooks(&cfg, "pre-run", &wd, selection)?;
+    let status = command.current_dir(&wd).status().context("failed to run tests")?;
+    if let Some(code) = status.code() {
+        if code != 0 {
+            std::process::exit(code);
+        }
     }
+    Ok(())
 }
 
-#[derive(Debug, Clone, Serialize, Deserialize, Default)]
-struct GlobalConfig {
-    #[serde(default)]
-    default_python: String,
+// `xe format` and `xe lint` run the `[tools]` formatter and linter from a cached isolated
+// environment (the one `xe x` uses), so neither needs to be installed in the project.
+fn cmd_format(ctx: &AppContext, args: &[String]) -> Result<()> {
+    run_project_tool(ctx, "format", args)
 }
 
-fn load_global_config(path: &Path) -> Result<GlobalConfig> {
-    if !path.exists() {
-        return Ok(GlobalConfig::default());
-    }
-    let text = fs::read_to_string(path).with_context(|| format!("failed to read {}", path.display()))?;
-    let cfg = serde_yaml::from_str(&text).with_context(|| format!("failed to parse {}", path.display()))?;
-    Ok(cfg)
+fn cmd_lint(ctx: &AppContext, args: &[String]) -> Result<()> {
+    run_project_tool(ctx, "lint", args)
 }
 
-fn save_global_config(path: &Path, cfg: &GlobalConfig) -> Result<()> {
-    if let Some(parent) = path.parent() {
-        fs::create_dir_all(parent).with_context(|| format!("failed to create {}", parent.display()))?;
+fn run_project_tool(ctx: &AppContext, role: &str, args: &[String]) -> Result<()> {
+    let wd = env::current_dir().context("failed to get cwd")?;
+    let cfg = load_existing_project(&wd)?;
+    let configured = if role == "format" { &cfg.tools.format } else { &cfg.tools.lint };
+    let requirement = match configured.trim() {
+        "" if role == "format" => "black",
+        "" => "ruff",
+        requirement => requirement,
+    };
+    let name = normalize_dep_name(&requirement_command_name(requirement));
+    let mut tool_args = match (name.as_str(), role) {
+        ("ruff", "format") => vec!["format".to_string()],
+        ("ruff", _) => vec!["check".to_string()],
+        _ => Vec::new(),
+    };
+    tool_args.extend(args.iter().cloned());
+    if !has_path_argument(args) {
+        tool_args.push(".".to_string());
+    }
+    let python_version = get_preferred_python_version(ctx)?;
+    let mut command = cached_tool_command(ctx, &name, requirement, &python_version)?;
+    let status = command
+        .args(&tool_args)
+        .current_dir(&wd)
+        .status()
+        .with_context(|| format!("failed to run {name}"))?;
+    if let Some(code) = status.code() {
+        if code != 0 {
+            std::process::exit(code);
+        }
     }
-    let text = serde_yaml::to_string(cfg).context("failed to encode config")?;
-    fs::write(path, text).with_context(|| format!("failed to write {}", path.display()))?;
     Ok(())
 }
 
-fn get_preferred_python_version(ctx: &AppContext) -> Result<String> {
-    if let Ok(wd) = env::current_dir() {
-        let local = wd.join(XE_TOML);
-        if local.exists() {
-            if let Ok(cfg) = load_project(&local) {
-                if !cfg.python.version.trim().is_empty() {
-                    return Ok(cfg.python.version);
+// Options of black and ruff that take a separate value, so `--select E501` is not read as a path.
+const TOOL_VALUE_OPTIONS: &[&str] = &[
+    "-l",
+    "--line-length",
+    "-t",
+    "--target-version",
+    "--config",
+    "--include",
+    "--exclude",
+    "--extend-exclude",
+    "--force-exclude",
+    "--stdin-filename",
+    "-W",
+    "--workers",
+    "--python-cell-magics",
+    "--required-version",
+    "--select",
+    "--ignore",
+    "--extend-select",
+    "--extend-ignore",
+    "--per-file-ignores",
+    "--extend-per-file-ignores",
+    "--fixable",
+    "--unfixable",
+    "--extend-fixable",
+    "--extension",
+    "--output-format",
+    "-o",
+    "--output-file",
+    "--cache-dir",
+    "--dummy-variable-rgx",
+    "--range",
+];
+
+// Whether the arguments name a path, skipping the values of options that take one.
+fn has_path_argument(args: &[String]) -> bool {
+    let mut iter = args.iter();
+    while let Some(arg) = iter.next() {
+        if arg == "--" {
+            return iter.next().is_some();
+        }
+        if TOOL_VALUE_OPTIONS.contains(&arg.as_str()) {
+            iter.next();
+        } else if !arg.starts_with('-') {
+            return true;
+        }
+    }
+    false
+}
+
+fn cmd_cache(ctx: &AppContext, args: &[String]) -> Result<()> {
+    if args.is_empty() {
+        bail!("usage: xe cache <dir|clean|prune|key|save|restore>");
+    }
+    match args[0].as_str() {
+        "dir" => {
+            let wd = env::current_dir().context("failed to get cwd")?;
+            let (cfg, _) = load_or_create_project(&wd)?;
+            println!("{}", cfg.cache.global_dir);
+            Ok(())
+        }
+        "clean" => {
+            let wd = env::current_dir().context("failed to get cwd")?;
+            let (cfg, _) = load_or_create_project(&wd)?;
+            if Path::new(&cfg.cache.global_dir).exists() {
+                fs::remove_dir_all(&cfg.cache.global_dir)
+                    .with_context(|| format!("failed to clean {}", cfg.cache.global_dir))?;
+            }
+            success("Cache cleaned");
+            Ok(())
+        }
+        "prune" => {
+            info("Prune currently keeps CAS blobs and removes no files.");
+            Ok(())
+        }
+        "key" => {
+            if args.len() != 1 {
+                bail!("usage: xe cache key");
+            }
+            let wd = env::current_dir().context("failed to get cwd")?;
+            let cfg = load_existing_project(&wd)?;
+            let mut reqs = locked_requirements(&wd, &cfg, project_requirements(&wd, &cfg)?)?;
+            reqs.sort();
+            let indexes = IndexPlan::load(ctx, &cfg)?;
+            let mut hasher = Sha256::new();
+            for part in [env::consts::OS, env::consts::ARCH, cfg.python.version.as_str(), &indexes.fingerprint()] {
+                hasher.update(part.as_bytes());
+                hasher.update(b"\n");
+            }
+            for req in &reqs {
+                hasher.update(req.as_bytes());
+                hasher.update(b"\n");
+            }
+            let digest = hex::encode(hasher.finalize());
+            println!(
+                "xe-{}-{}-py{}-{}",
+                env::consts::OS,
+                env::consts::ARCH,
+                cfg.python.version,
+                &digest[..16]
+            );
+            Ok(())
+        }
+        "save" => {
+            let [_, dir] = args else {
+                bail!("usage: xe cache save <dir>");
+            };
+            let dir = PathBuf::from(dir);
+            let wd = env::current_dir().context("failed to get cwd")?;
+            let cfg = load_existing_project(&wd)?;
+            let cas = Cas::new(Path::new(&cfg.cache.global_dir))?;
+            let indexes = IndexPlan::load(ctx, &cfg)?;
+            // The requirements `xe sync` resolves, so the key matches its solution.
+            let reqs = locked_requirements(&wd, &cfg, project_requirements(&wd, &cfg)?)?;
+            let key = solution_key(&cfg, &normalize_requirements(&reqs), &indexes);
+            let Some(graph) = cas.load_solution::<SolveGraph>(&key)? else {
+                bail_kind!(ErrorKind::Config, "no cached resolution for this project; run `xe sync` first");
+            };
+            let saved = Cas { root: dir.clone() };
+            fs::create_dir_all(saved.solution_dir())
+                .with_context(|| format!("failed to create {}", saved.solution_dir().display()))?;
+            let solution = format!("{key}.json");
+            copy_cache_file(&cas.solution_dir().join(&solution), &saved.solution_dir().join(&solution))?;
+            let mut wanted = HashSet::new();
+            let mut missing = 0usize;
+            let (mut blobs, mut bytes) = (0usize, 0u64);
+            for package in &graph.packages {
+                let Some(blob) = cas
+                    .cached_blob(package.hash_algorithm, &package.hash)
+                    .filter(|_| package.hash_algorithm.is_digest(&package.hash))
+                else {
+                    missing += 1;
+                    continue;
+                };
+                let target = saved.blob_path(package.hash_algorithm, &package.hash);
+                bytes += copy_cache_blob(&blob, &target, &mut wanted)?;
+                blobs += 1;
+                // Wheels built from a source distribution go along, so CI machines of the
+                // same kind skip the build.
+                for entry in fs::read_dir(cas.build_dir().join(&package.hash)).into_iter().flatten().flatten() {
+                    let Ok(sha) = fs::read_to_string(entry.path()) else {
+                        continue;
+                    };
+                    let sha = sha.trim();
+                    let Some(wheel) = cas
+                        .cached_blob(HashAlgorithm::Sha256, sha)
+                        .filter(|_| HashAlgorithm::Sha256.is_digest(sha))
+                    else {
+                        continue;
+                    };
+                    let target = saved.blob_path(HashAlgorithm::Sha256, sha);
+                    bytes += copy_cache_blob(&wheel, &target, &mut wanted)?;
+                    blobs += 1;
+                    let record = saved.build_dir().join(&package.hash).join(entry.file_name());
+                    let _ = fs::remove_file(&record);
+                    copy_cache_file(&entry.path(), &record)?;
+                    wanted.insert(record);
+                }
+            }
+            // Blobs left over from an earlier lock would only grow the CI cache.
+            for entry in WalkDir::new(saved.blob_dir()).into_iter().chain(WalkDir::new(saved.build_dir())).flatten() {
+                if entry.file_type().is_file() && !wanted.contains(entry.path()) {
+                    let _ = fs::remove_file(entry.path());
                 }
             }
+            success(&format!(
+                "Saved {} blob(s) ({}) for {} to {}",
+                blobs,
+                human_bytes(bytes),
+                cfg.project.name,
+                dir.display()
+            ));
+            if missing > 0 {
+                warning(&format!(
+                    "{missing} package(s) have no cached blob with a known sha256; CI will download them on install"
+                ));
+            }
+            Ok(())
         }
+        "restore" => {
+            let [_, dir] = args else {
+                bail!("usage: xe cache restore <dir>");
+            };
+            let dir = PathBuf::from(dir);
+            if !dir.is_dir() {
+                info(&format!("{} does not exist; nothing to restore", dir.display()));
+                return Ok(());
+            }
+            let wd = env::current_dir().context("failed to get cwd")?;
+            let cfg = load_existing_project(&wd)?;
+            let cas = Cas::new(Path::new(&cfg.cache.global_dir))?;
+            let saved = Cas { root: dir.clone() };
+            let mut restored = 0usize;
+            for (from, to) in [
+                (saved.blob_dir(), cas.blob_dir()),
+                (saved.solution_dir(), cas.solution_dir()),
+                (saved.build_dir(), cas.build_dir()),
+            ] {
+                for entry in WalkDir::new(&from).into_iter().flatten() {
+                    let Ok(rel) = entry.path().strip_prefix(&from) else {
+                        continue;
+                    };
+                    let target = to.join(rel);
+                    if entry.file_type().is_file() && !target.exists() {
+                        copy_cache_file(entry.path(), &target)?;
+                        restored += 1;
+                    }
+                }
+            }
+            success(&format!("Restored {restored} cache file(s) from {}", dir.display()));
+            Ok(())
+        }
+        _ => bail!("usage: xe cache <dir|clean|prune|key|save|restore>"),
     }
-    let global_cfg = load_global_config(&ctx.config_file)?;
-    if !global_cfg.default_python.trim().is_empty() {
-        return Ok(global_cfg.default_python);
-    }
-    Ok(default_python_version())
 }
 
-#[derive(Debug, Clone)]
-struct RuntimeSelection {
-    python_exe: PathBuf,
-    site_packages: PathBuf,
-    activation_path: PathBuf,
-    venv_name: String,
-    is_venv: bool,
+// Hard-links (or copies) a cache file, creating parent directories. Blobs are immutable,
+// so sharing the inode with the global cache is safe.
+fn copy_cache_file(from: &Path, to: &Path) -> Result<()> {
+    if to.exists() {
+        return Ok(());
+    }
+    if let Some(parent) = to.parent() {
+        fs::create_dir_all(parent).with_context(|| format!("failed to create {}", parent.display()))?;
+    }
+    if fs::hard_link(from, to).is_err() {
+        fs::copy(from, to).with_context(|| format!("failed to copy {} to {}", from.display(), to.display()))?;
+    }
+    Ok(())
 }
 
-#[derive(Debug, Clone)]
-struct RuntimeResult {
-    selection: RuntimeSelection,
-    config_changed: bool,
+// Copies a blob and its .meta file for `xe cache save`; returns the blob's size.
+fn copy_cache_blob(from: &Path, to: &Path, wanted: &mut HashSet<PathBuf>) -> Result<u64> {
+    copy_cache_file(from, to)?;
+    let meta = BlobMeta::path(from);
+    if meta.is_file() {
+        copy_cache_file(&meta, &BlobMeta::path(to))?;
+        wanted.insert(BlobMeta::path(to));
+    }
+    wanted.insert(to.to_path_buf());
+    Ok(fs::metadata(to).map(|m| m.len()).unwrap_or(0))
 }
 
-fn ensure_runtime_for_project(ctx: &AppContext, wd: &Path, cfg: &mut Config) -> Result<RuntimeResult> {
-    let _span = span(ctx, "runtime.ensure", json!({"working_dir": wd.display().to_string(), "python_version": cfg.python.version}));
-    let pm = PythonManager::new()?;
+// `xe daemon` keeps resolutions, PyPI metadata and the HTTP connection pool warm in a
+// background process. Commands ask it over a Unix socket under the xe data directory and
+// do the work themselves when no daemon answers.
+const DAEMON_SOCKET: &str = "daemon.sock";
 
-    if cfg.python.version.trim().is_empty() {
-        cfg.python.version = get_preferred_python_version(ctx)?;
-    }
+fn daemon_socket_path() -> PathBuf {
+    xe_home().join(DAEMON_SOCKET)
+}
 
-    let mut python_exe = match pm.get_python_exe(&cfg.python.version) {
-        Ok(path) => path,
-        Err(_) => {
-            pm.install(&cfg.python.version, ctx)?;
-            pm.get_python_exe(&cfg.python.version)?
+fn cmd_daemon(ctx: &AppContext, args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe daemon <start|stop|status|run>";
+    match args {
+        [sub] if sub == "run" => daemon_serve(ctx),
+        [sub] if sub == "start" => {
+            if let Some(status) = daemon_request(&json!({"op": "ping"})) {
+                info(&format!("xe daemon is already running (pid {})", status["pid"]));
+                return Ok(());
+            }
+            let log_path = xe_home().join("logs").join("daemon.log");
+            if let Some(parent) = log_path.parent() {
+                fs::create_dir_all(parent).with_context(|| format!("failed to create {}", parent.display()))?;
+            }
+            let log = File::create(&log_path).with_context(|| format!("failed to create {}", log_path.display()))?;
+            let mut command = Command::new(env::current_exe().context("failed to locate the xe executable")?);
+            command
+                .arg("--config")
+                .arg(&ctx.config_file)
+                .args(["daemon", "run"])
+                .stdin(Stdio::null())
+                .stdout(log.try_clone()?)
+                .stderr(log);
+            #[cfg(unix)]
+            {
+                use std::os::unix::process::CommandExt;
+                command.process_group(0);
+            }
+            let child = command.spawn().context("failed to start xe daemon")?;
+            let deadline = Instant::now() + Duration::from_secs(5);
+            while Instant::now() < deadline {
+                if daemon_request(&json!({"op": "ping"})).is_some() {
+                    success(&format!("Started xe daemon (pid {})", child.id()));
+                    return Ok(());
+                }
+                thread::sleep(Duration::from_millis(50));
+            }
+            bail!("xe daemon did not start; see {}", log_path.display())
         }
-    };
-
-    let vm = VenvManager::new()?;
-    let mut config_changed = false;
-    let mut venv_name = cfg.venv.name.trim().to_string();
-    if venv_name.is_empty() && cfg.settings.autovenv {
-        let mut name = cfg.project.name.trim().to_string();
-        if name.is_empty() {
-            name = wd
-                .file_name()
-                .and_then(|s| s.to_str())
-                .unwrap_or("default")
-                .to_string();
+        [sub] if sub == "stop" => {
+            if daemon_request(&json!({"op": "stop"})).is_none() {
+                info("xe daemon is not running");
+                return Ok(());
+            }
+            success("Stopped xe daemon");
+            Ok(())
         }
-        name = normalize_venv_name(&name);
-        if name.is_empty() {
-            name = "default".to_string();
+        [sub] if sub == "status" => {
+            let Some(status) = daemon_request(&json!({"op": "status"})) else {
+                info("xe daemon is not running; start it with `xe daemon start`");
+                return Ok(());
+            };
+            let uptime = Duration::from_secs(status["uptime_secs"].as_u64().unwrap_or(0));
+            println!("xe daemon running (pid {}, up {})", status["pid"], human_duration(uptime));
+            println!("  socket:           {}", daemon_socket_path().display());
+            println!("  cached solutions: {}", status["solutions"]);
+            println!("  cached metadata:  {}", status["metadata"]);
+            println!("  requests served:  {}", status["requests"]);
+            Ok(())
         }
-        venv_name = format!("auto-{name}");
-        cfg.venv.name = venv_name.clone();
-        config_changed = true;
+        _ => bail_kind!(ErrorKind::Usage, "{USAGE}"),
     }
+}
 
-    if !venv_name.is_empty() {
-        if !vm.exists(&venv_name) {
-            vm.create(&venv_name, &python_exe)?;
+fn human_duration(d: Duration) -> String {
+    let secs = d.as_secs();
+    match secs {
+        0..=59 => format!("{secs}s"),
+        60..=3599 => format!("{}m", secs / 60),
+        _ => format!("{}h{:02}m", secs / 3600, secs / 60 % 60),
+    }
+}
+
+const DAEMON_IO_TIMEOUT: Duration = Duration::from_secs(10);
+
+#[derive(Default)]
+struct DaemonState {
+    solutions: Mutex<HashMap<String, SolveGraph>>,
+    requests: AtomicU64,
+}
+
+// Request line in, response line out: `{"ok": true, "result": ...}` or
+// `{"ok": false, "error": "..."}`.
+fn daemon_handle(ctx: &AppContext, state: &DaemonState, started: Instant, request: &Value) -> Result<Value> {
+    state.requests.fetch_add(1, AtomicOrdering::Relaxed);
+    match request["op"].as_str().unwrap_or_default() {
+        "ping" => Ok(json!({"pid": std::process::id()})),
+        "status" => Ok(json!({
+            "pid": std::process::id(),
+            "uptime_secs": started.elapsed().as_secs(),
+            "solutions": state.solutions.lock().map_err(|_| anyhow!("daemon state poisoned"))?.len(),
+            "metadata": metadata_cache_len(),
+            "requests": state.requests.load(AtomicOrdering::Relaxed),
+        })),
+        "resolve" => {
+            let key = request["key"].as_str().unwrap_or_default().to_string();
+            if let Some(graph) = state.solutions.lock().map_err(|_| anyhow!("daemon state poisoned"))?.get(&key) {
+                return Ok(serde_json::to_value(graph)?);
+            }
+            let cfg: Config = serde_json::from_value(request["config"].clone()).context("invalid config")?;
+            // The daemon resolves with its own credentials and pip environment, so it
+            // only answers clients that would resolve against the same ones.
+            let settings = IndexPlan::load(ctx, &cfg)?.settings_fingerprint();
+            if request["settings"].as_str() != Some(settings.as_str()) {
+                bail!("the client's index settings or credentials differ from the daemon's");
+            }
+            let reqs: Vec<String> = serde_json::from_value(request["requirements"].clone())?;
+            let project_dir = PathBuf::from(request["project_dir"].as_str().unwrap_or("."));
+            let python_exe = PathBuf::from(request["python_exe"].as_str().unwrap_or_default());
+            let mut installer = Installer::new(Path::new(&cfg.cache.global_dir))?;
+            if request["joint"].as_bool().unwrap_or(false) {
+                installer = installer.with_joint_resolution();
+            }
+            let (graph, _) = installer.resolve(ctx, &cfg, &reqs, &project_dir, &python_exe)?;
+            let value = serde_json::to_value(&graph)?;
+            state.solutions.lock().map_err(|_| anyhow!("daemon state poisoned"))?.insert(key, graph);
+            Ok(value)
         }
-        python_exe = vm.get_python_exe(&venv_name);
-        if !python_exe.exists() {
-            bail!("venv python not found: {}", python_exe.display());
+        "metadata" => {
+            let name = request["name"].as_str().unwrap_or_default();
+            Ok(serde_json::to_value(fetch_metadata_from_pypi(name, &xe_cache_dir())?)?)
         }
-        let mut site_packages = vm.get_site_packages_dir(&venv_name);
-        if site_packages
-            .file_name()
-            .and_then(|s| s.to_str())
-            .map(|s| s.eq_ignore_ascii_case("lib"))
-            .unwrap_or(false)
-        {
-            if let Ok(detected) = detect_venv_site_packages(&python_exe) {
-                site_packages = detected;
+        "stop" => Ok(json!({})),
+        other => bail!("unknown daemon request {other:?}"),
+    }
+}
+
+#[cfg(unix)]
+fn daemon_serve(ctx: &AppContext) -> Result<()> {
+    use std::os::unix::fs::PermissionsExt;
+    use std::os::unix::net::{UnixListener, UnixStream};
+
+    if daemon_request(&json!({"op": "ping"})).is_some() {
+        bail!("xe daemon is already running");
+    }
+    let path = daemon_socket_path();
+    if let Some(parent) = path.parent() {
+        fs::create_dir_all(parent).with_context(|| format!("failed to create {}", parent.display()))?;
+    }
+    let _ = fs::remove_file(&path);
+    let listener = UnixListener::bind(&path).with_context(|| format!("failed to listen on {}", path.display()))?;
+    fs::set_permissions(&path, fs::Permissions::from_mode(0o600))?;
+    // Work done here must not be forwarded back to this daemon.
+    env::set_var("XE_NO_DAEMON", "1");
+    info(&format!("xe daemon listening on {} (pid {})", path.display(), std::process::id()));
+
+    let state = Arc::new(DaemonState::default());
+    let started = Instant::now();
+    for stream in listener.incoming() {
+        let Ok(stream) = stream else {
+            continue;
+        };
+        let (ctx, state, path) = (ctx.clone(), state.clone(), path.clone());
+        thread::spawn(move || {
+            let serve = |stream: UnixStream| -> Result<()> {
+                // A client that connects and goes quiet must not hold a thread forever.
+                stream.set_read_timeout(Some(DAEMON_IO_TIMEOUT))?;
+                stream.set_write_timeout(Some(DAEMON_IO_TIMEOUT))?;
+                let mut line = String::new();
+                BufReader::new(&stream).read_line(&mut line)?;
+                let request: Value = serde_json::from_str(&line).context("invalid daemon request")?;
+                let response = match daemon_handle(&ctx, &state, started, &request) {
+                    Ok(result) => json!({"ok": true, "result": result}),
+                    Err(err) => json!({"ok": false, "error": format!("{err:#}")}),
+                };
+                let mut out = serde_json::to_vec(&response)?;
+                out.push(b'\n');
+                (&stream).write_all(&out)?;
+                if request["op"] == "stop" {
+                    let _ = fs::remove_file(&path);
+                    info("xe daemon stopped");
+                    std::process::exit(0);
+                }
+                Ok(())
+            };
+            if let Err(err) = serve(stream) {
+                debug(&format!("daemon request failed: {err:#}"));
             }
-        }
-        fs::create_dir_all(&site_packages)
-            .with_context(|| format!("failed to create {}", site_packages.display()))?;
-        return Ok(RuntimeResult {
-            selection: RuntimeSelection {
-                activation_path: python_exe
-                    .parent()
-                    .map(Path::to_path_buf)
-                    .unwrap_or_else(PathBuf::new),
-                python_exe,
-                site_packages,
-                venv_name,
-                is_venv: true,
-            },
-            config_changed,
         });
     }
+    Ok(())
+}
 
-    let site_packages = pm.get_site_packages_dir(&cfg.python.version)?;
-    Ok(RuntimeResult {
-        selection: RuntimeSelection {
-            activation_path: python_exe
-                .parent()
-                .map(Path::to_path_buf)
-                .unwrap_or_else(PathBuf::new),
-            python_exe,
-            site_packages,
-            venv_name: String::new(),
-            is_venv: false,
-        },
-        config_changed,
-    })
+#[cfg(not(unix))]
+fn daemon_serve(_ctx: &AppContext) -> Result<()> {
+    bail!("xe daemon needs Unix domain sockets and is not available on this platform")
 }
 
-fn normalize_venv_name(name: &str) -> String {
-    let mut n = name.trim().to_lowercase();
-    n = n.replace(' ', "-").replace('_', "-");
-    let mut out = String::with_capacity(n.len());
-    for ch in n.chars() {
-        if ch.is_ascii_lowercase() || ch.is_ascii_digit() || ch == '-' {
-            out.push(ch);
-        }
+// Sends one request to the running daemon. None when no daemon is running, XE_NO_DAEMON=1
+// is set, or the daemon could not answer; callers then do the work themselves.
+#[cfg(unix)]
+fn daemon_request(request: &Value) -> Option<Value> {
+    use std::os::unix::net::UnixStream;
+
+    if env::var("XE_NO_DAEMON").is_ok_and(|v| v == "1") {
+        return None;
     }
-    out.trim_matches('-').to_string()
+    let path = daemon_socket_path();
+    if !path.exists() {
+        return None;
+    }
+    let stream = UnixStream::connect(&path).ok()?;
+    // A wedged daemon must not hang the client: writes should be immediate, and the
+    // answer may take as long as a resolution run locally would.
+    stream.set_write_timeout(Some(DAEMON_IO_TIMEOUT)).ok()?;
+    stream.set_read_timeout(Some(python_timeout())).ok()?;
+    let mut line = serde_json::to_vec(request).ok()?;
+    line.push(b'\n');
+    (&stream).write_all(&line).ok()?;
+    let mut response = String::new();
+    BufReader::new(&stream).read_line(&mut response).ok()?;
+    let response: Value = serde_json::from_str(&response).ok()?;
+    if response["ok"] == true {
+        return response.get("result").cloned();
+    }
+    debug(&format!("xe daemon: {}", response["error"].as_str().unwrap_or("request failed")));
+    None
 }
 
-fn detect_venv_site_packages(venv_exe: &Path) -> Result<PathBuf> {
-    let output = Command::new(venv_exe)
-        .args(["-c", "import site; print(site.getsitepackages()[0])"])
-        .output()
-        .context("failed to detect venv site-packages")?;
-    if !output.status.success() {
-        bail!("failed to detect venv site-packages");
+#[cfg(not(unix))]
+fn daemon_request(_request: &Value) -> Option<Value> {
+    None
+}
+
+// Requirements benchmarked when neither -r nor packages are given: a mix of pure-Python and
+// binary wheels with overlapping dependencies.
+const BENCH_REQUIREMENTS: &[&str] = &["requests", "rich", "click", "pydantic", "httpx", "jinja2", "pyyaml", "attrs"];
+
+const BENCH_SCENARIOS: &[&str] = &["cold-resolve", "warm-resolve", "full-sync", "cached-sync"];
+
+struct BenchResult {
+    scenario: &'static str,
+    runs: Vec<Duration>,
+    resolve: Duration,
+    download: Duration,
+    extract: Duration,
+    packages: u64,
+    cache_hits: u64,
+    solution_hits: u64,
+    prefetched: u64,
+}
+
+impl BenchResult {
+    fn median(&self) -> Duration {
+        let mut sorted = self.runs.clone();
+        sorted.sort();
+        sorted.get(sorted.len() / 2).copied().unwrap_or_default()
     }
-    let site = String::from_utf8_lossy(&output.stdout).trim().to_string();
-    if site.is_empty() {
-        bail!("empty site-packages response");
+
+    fn mean(&self, total: Duration) -> Duration {
+        total / self.runs.len().max(1) as u32
     }
-    Ok(PathBuf::from(site))
 }
 
-fn apply_runtime_env(command: &mut Command, selection: &RuntimeSelection) -> Result<()> {
-    let python_root = selection.activation_path.clone();
-    let scripts_dir = {
-        let win_scripts = python_root.join("Scripts");
-        if win_scripts.exists() {
-            win_scripts
-        } else {
-            python_root.join("bin")
+fn cmd_bench(ctx: &AppContext, args: &[String]) -> Result<()> {
+    const USAGE: &str =
+        "usage: xe bench [-r <requirements.txt>] [--runs <n>] [--scenario <name>]... [--json] [package...]";
+    let (json_output, args) = take_flag(args, "--json");
+    let mut runs = 3usize;
+    let mut scenarios = Vec::new();
+    let mut reqs = Vec::new();
+    let mut idx = 0;
+    while idx < args.len() {
+        match args[idx].as_str() {
+            "-r" | "--requirements" => {
+                let Some(path) = args.get(idx + 1) else {
+                    bail_kind!(ErrorKind::Usage, "{USAGE}");
+                };
+                reqs.extend(parse_requirements(Path::new(path))?);
+                idx += 2;
+            }
+            "--runs" => {
+                runs = match args.get(idx + 1).and_then(|n| n.parse::<usize>().ok()) {
+                    Some(n) if n > 0 => n,
+                    _ => bail_kind!(ErrorKind::Usage, "--runs expects a positive number"),
+                };
+                idx += 2;
+            }
+            "--scenario" => {
+                let Some(name) = args.get(idx + 1) else {
+                    bail_kind!(ErrorKind::Usage, "{USAGE}");
+                };
+                let Some(scenario) = BENCH_SCENARIOS.iter().find(|s| **s == name.as_str()) else {
+                    bail_kind!(
+                        ErrorKind::Usage,
+                        "unknown scenario '{name}'; expected one of: {}",
+                        BENCH_SCENARIOS.join(", ")
+                    );
+                };
+                scenarios.push(*scenario);
+                idx += 2;
+            }
+            flag if flag.starts_with('-') => bail_kind!(ErrorKind::Usage, "{USAGE}"),
+            req => {
+                reqs.push(req.to_string());
+                idx += 1;
+            }
         }
+    }
+    if reqs.is_empty() {
+        reqs = BENCH_REQUIREMENTS.iter().map(|r| r.to_string()).collect();
+    }
+    if scenarios.is_empty() {
+        scenarios = BENCH_SCENARIOS.to_vec();
+    }
+    let reqs = normalize_requirements(&reqs);
+    if json_output {
+        set_log_to_stderr(true);
+    }
+    // Every scenario must measure xe itself, not a warm daemon.
+    env::set_var("XE_NO_DAEMON", "1");
+
+    // The project's runtime and indexes are used when run inside a project; the project's
+    // environment and cache are never touched.
+    let wd = env::current_dir().context("failed to get cwd")?;
+    let mut cfg = if wd.join(XE_TOML).exists() {
+        load_existing_project(&wd)?
+    } else {
+        Config::new_default(&wd)
     };
-    let current_path = env::var("PATH").unwrap_or_default();
-    let new_path = format!(
-        "{}{}{}{}{}",
-        scripts_dir.display(),
-        std::path::MAIN_SEPARATOR_STR,
-        python_root.display(),
-        if current_path.is_empty() { "" } else { ";" },
-        current_path
-    );
-    command.env("PATH", new_path);
-    if selection.is_venv {
-        if let Some(root) = selection
-            .python_exe
-            .parent()
-            .and_then(|p| p.parent())
-            .map(Path::to_path_buf)
-        {
-            command.env("VIRTUAL_ENV", root);
-        }
+    let runtime = ensure_runtime_for_project(ctx, &wd, &mut cfg)?;
+    let python_exe = runtime.selection.python_exe.clone();
+
+    let work = tempfile_path("xe-bench", "d");
+    fs::create_dir_all(&work).with_context(|| format!("failed to create {}", work.display()))?;
+    info(&format!(
+        "Benchmarking {} requirement(s) with Python {}, {} run(s) per scenario...",
+        reqs.len(),
+        cfg.python.version,
+        runs
+    ));
+    let results = scenarios
+        .iter()
+        .map(|scenario| run_bench_scenario(ctx, scenario, &cfg, &reqs, &wd, &work, &python_exe, runs))
+        .collect::<Result<Vec<_>>>();
+    let _ = fs::remove_dir_all(&work);
+    let results = results?;
+
+    if json_output {
+        let ms = |d: Duration| d.as_secs_f64() * 1000.0;
+        let entries = results
+            .iter()
+            .map(|r| {
+                json!({
+                    "scenario": r.scenario,
+                    "runs": r.runs.iter().map(|d| ms(*d)).collect::<Vec<_>>(),
+                    "median_ms": ms(r.median()),
+                    "resolve_ms": ms(r.mean(r.resolve)),
+                    "download_ms": ms(r.mean(r.download)),
+                    "extract_ms": ms(r.mean(r.extract)),
+                    "packages": r.packages,
+                    "cache_hits": r.cache_hits,
+                    "solution_hits": r.solution_hits,
+                    "prefetched": r.prefetched,
+                })
+            })
+            .collect::<Vec<_>>();
+        let report = json!({
+            "python": cfg.python.version,
+            "requirements": reqs,
+            "scenarios": entries,
+        });
+        println!("{}", serde_json::to_string_pretty(&report)?);
+        return Ok(());
     }
+    print_bench_table(&results);
     Ok(())
 }
 
-#[derive(Debug, Clone)]
-struct PythonManager {
-    base_dir: PathBuf,
-}
+// Runs one scenario against a throwaway cache under `work`. Cold scenarios start every run
+// from an empty cache; warm ones share a cache primed by an unmeasured run.
+fn run_bench_scenario(
+    ctx: &AppContext,
+    scenario: &'static str,
+    cfg: &Config,
+    reqs: &[String],
+    wd: &Path,
+    work: &Path,
+    python_exe: &Path,
+    runs: usize,
+) -> Result<BenchResult> {
+    let resolve_only = scenario.ends_with("resolve");
+    let cold = scenario.starts_with("cold") || scenario.starts_with("full");
+    let warm_cache = work.join(format!("{scenario}-cache"));
+    let step = |run_ctx: &AppContext, cache: &Path, site: &Path| -> Result<()> {
+        let mut cfg = cfg.clone();
+        cfg.cache.global_dir = cache.to_string_lossy().to_string();
+        let installer = Installer::new(cache)?;
+        if resolve_only {
+            installer.resolve(run_ctx, &cfg, reqs, wd, python_exe)?;
+        } else {
+            fs::create_dir_all(site).with_context(|| format!("failed to create {}", site.display()))?;
+            installer.install(run_ctx, &cfg, reqs, wd, site, python_exe)?;
+        }
+        Ok(())
+    };
+    let fresh_ctx = || AppContext {
+        config_file: ctx.config_file.clone(),
+        profiler: None,
+        timings: Arc::new(Timings::default()),
+    };
 
-impl PythonManager {
-    fn new() -> Result<Self> {
-        let base_dir = if cfg!(windows) {
-            let local = env::var("LOCALAPPDATA")
-                .ok()
-                .map(PathBuf::from)
-                .unwrap_or_else(|| {
-                    dirs::home_dir()
-                        .unwrap_or_else(|| PathBuf::from("."))
-                        .join("AppData")
-                        .join("Local")
-                });
-            local.join("Programs").join("Python")
+    if !cold {
+        debug(&format!("bench: priming cache for {scenario}"));
+        step(&fresh_ctx(), &warm_cache, &work.join(format!("{scenario}-site-prime")))?;
+    }
+    let mut result = BenchResult {
+        scenario,
+        runs: Vec::with_capacity(runs),
+        resolve: Duration::ZERO,
+        download: Duration::ZERO,
+        extract: Duration::ZERO,
+        packages: 0,
+        cache_hits: 0,
+        solution_hits: 0,
+        prefetched: 0,
+    };
+    for run in 0..runs {
+        let cache = if cold {
+            work.join(format!("{scenario}-cache-{run}"))
         } else {
-            xe_home().join("python")
+            warm_cache.clone()
         };
-        fs::create_dir_all(&base_dir)
-            .with_context(|| format!("failed to create {}", base_dir.display()))?;
-        Ok(Self { base_dir })
+        let run_ctx = fresh_ctx();
+        let started = Instant::now();
+        step(&run_ctx, &cache, &work.join(format!("{scenario}-site-{run}")))?;
+        result.runs.push(started.elapsed());
+        let timings = &run_ctx.timings;
+        result.resolve += timings.span("install.resolve").unwrap_or_default();
+        result.download += timings.span("install.download").unwrap_or_default();
+        result.extract += timings.span("install.extract").unwrap_or_default();
+        result.packages += timings.counter("install.package");
+        result.cache_hits += timings.counter("install.cache_hit");
+        result.solution_hits += timings.counter("install.solution_hit");
+        result.prefetched += timings.counter("install.prefetch");
+        debug(&format!("bench: {scenario} run {} took {:?}", run + 1, started.elapsed()));
     }
+    Ok(result)
+}
 
-    fn get_python_path(&self, version: &str) -> Result<PathBuf> {
-        let parts = parse_major_minor(version)?;
-        Ok(self
-            .base_dir
-            .join(format!("python{}{}", parts.0, parts.1)))
+fn print_bench_table(results: &[BenchResult]) {
+    let secs = |d: Duration| format!("{:.2}s", d.as_secs_f64());
+    let width = results
+        .iter()
+        .map(|r| r.scenario.len())
+        .max()
+        .unwrap_or(0)
+        .max("Scenario".len());
+    println!(
+        "{:<width$}  {:>4}  {:>8}  {:>8}  {:>8}  {:>8}  {:>8}  {:>8}  Cache hits",
+        "Scenario", "Runs", "Median", "Min", "Max", "Resolve", "Download", "Extract"
+    );
+    for r in results {
+        let cache = if r.packages > 0 {
+            format!("{}/{}", r.cache_hits, r.packages)
+        } else if r.solution_hits > 0 {
+            format!("{} solution(s)", r.solution_hits)
+        } else {
+            "-".to_string()
+        };
+        println!(
+            "{:<width$}  {:>4}  {:>8}  {:>8}  {:>8}  {:>8}  {:>8}  {:>8}  {}",
+            r.scenario,
+            r.runs.len(),
+            secs(r.median()),
+            secs(r.runs.iter().min().copied().unwrap_or_default()),
+            secs(r.runs.iter().max().copied().unwrap_or_default()),
+            secs(r.mean(r.resolve)),
+            secs(r.mean(r.download)),
+            secs(r.mean(r.extract)),
+            cache
+        );
     }
+}
 
-    fn get_python_exe(&self, version: &str) -> Result<PathBuf> {
-        let python_dir = self.get_python_path(version)?;
-        if cfg!(windows) {
-            let tools = python_dir.join("tools").join("python.exe");
-            if tools.exists() {
-                return Ok(tools);
+fn cmd_python(ctx: &AppContext, args: &[String]) -> Result<()> {
+    if args.is_empty() {
+        bail!("usage: xe python <install|list|find|which|pin|default|dir> ...");
+    }
+    let pm = PythonManager::new()?;
+    match args[0].as_str() {
+        "install" => {
+            if args.len() != 2 {
+                bail!("usage: xe python install <version>");
             }
-            let root = python_dir.join("python.exe");
-            if root.exists() {
-                return Ok(root);
+            pm.install(&args[1], ctx)?;
+            success(&format!("Installed Python {}", args[1]));
+            Ok(())
+        }
+        "list" => {
+            let entries = fs::read_dir(&pm.base_dir)
+                .with_context(|| format!("failed to read {}", pm.base_dir.display()))?;
+            for entry in entries {
+                let entry = entry?;
+                if entry.file_type()?.is_dir() {
+                    println!("{}", entry.file_name().to_string_lossy());
+                }
             }
-            bail!("python.exe not found in {}", python_dir.display());
+            Ok(())
         }
-        let py3 = python_dir.join("bin").join("python3");
-        if py3.exists() {
-            return Ok(py3);
+        "find" => {
+            let version = get_preferred_python_version(ctx)?;
+            let exe = pm.get_python_exe(&version)?;
+            println!("{}", exe.display());
+            Ok(())
         }
-        let py = python_dir.join("bin").join("python");
-        if py.exists() {
-            return Ok(py);
+        "which" => {
+            if args.len() != 2 {
+                bail!("usage: xe python which <version>");
+            }
+            let exe = pm.get_python_exe(&args[1]).with_context(|| {
+                format!("Python {} is not installed; run `xe python install {}`", args[1], args[1])
+            })?;
+            println!("{}", exe.display());
+            Ok(())
         }
-        bail!("python/python3 not found in {}", python_dir.join("bin").display());
+        "pin" => cmd_use(ctx, &args[1..]),
+        "default" => cmd_python_default(ctx, &pm, &args[1..]),
+        "dir" => {
+            println!("{}", pm.base_dir.display());
+            Ok(())
+        }
+        _ => bail!("usage: xe python <install|list|find|which|pin|default|dir> ..."),
     }
+}
 
-    fn install(&self, version: &str, ctx: &AppContext) -> Result<()> {
-        let _span = span(ctx, "python.install", json!({"version": version}));
-        let mut needs_cleanup = false;
-
-        if let Ok(exe) = self.get_python_exe(version) {
-            if is_python_runtime_healthy(&exe) && (!cfg!(windows) || is_windows_launcher_version_available(version))
-            {
-                success(&format!(
-                    "Python {} already installed at {}",
-                    version,
-                    exe.display()
+// The global default is what projects without a pin and `xe tool install` fall back to, and
+// what the unversioned `python` shim runs. Setting it never touches the current project.
+fn cmd_python_default(ctx: &AppContext, pm: &PythonManager, args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe python default [<version>|--clear]";
+    let mut global_cfg = load_global_config(&ctx.config_file)?;
+    match args {
+        [] => {
+            if global_cfg.default_python.trim().is_empty() {
+                info(&format!(
+                    "No global default set; Python {} is used",
+                    default_python_version()
                 ));
+            } else {
+                println!("{}", global_cfg.default_python);
+            }
+            Ok(())
+        }
+        [flag] if flag == "--clear" || flag == "--unset" => {
+            if global_cfg.default_python.trim().is_empty() {
+                info("No global default set");
                 return Ok(());
             }
-            needs_cleanup = true;
-            warning(&format!(
-                "Python {} exists at {} but runtime is unhealthy or launcher is missing; repairing with official installer.",
-                version,
-                exe.display()
+            global_cfg.default_python.clear();
+            save_global_config(&ctx.config_file, &global_cfg)?;
+            remove_shim("python")?;
+            success(&format!(
+                "Cleared global default; Python {} is used",
+                default_python_version()
             ));
+            Ok(())
         }
-
-        if !cfg!(windows) {
-            bail!("automatic Python installation is currently supported on Windows only");
-        }
-
-        let target_dir = self.get_python_path(version)?;
-        info(&format!(
-            "Installing Python {} to {}...",
-            version,
-            target_dir.display()
-        ));
-        if cfg!(windows) && needs_cleanup {
-            if target_dir.exists() {
-                fs::remove_dir_all(&target_dir)
-                    .with_context(|| format!("failed to remove {}", target_dir.display()))?;
+        [version] if !version.starts_with('-') => {
+            parse_major_minor(version)?;
+            pm.install(version, ctx)?;
+            let python_exe = pm.get_python_exe(version)?;
+            global_cfg.default_python = version.clone();
+            save_global_config(&ctx.config_file, &global_cfg)?;
+            create_shim("python", &python_exe)?;
+            if let Err(err) = create_shim(&format!("python{}", version.replace('.', "")), &python_exe) {
+                warning(&format!("Failed to create versioned shim: {err}"));
             }
+            success(&format!("Global default set to Python {version}"));
+            warn_if_shim_dir_not_on_path();
+            Ok(())
         }
+        _ => bail!(USAGE),
+    }
+}
 
-        let full_version = resolve_latest_windows_installer_version(version)?;
-        let url = format!(
-            "https://www.python.org/ftp/python/{0}/python-{0}-amd64.exe",
-            full_version
-        );
-        info(&format!("Downloading official Python installer from {}...", url));
-        let tmp_installer = download_file(&url, "python-installer", "exe")?;
-
-        if let Some(parent) = target_dir.parent() {
-            fs::create_dir_all(parent)
-                .with_context(|| format!("failed to create {}", parent.display()))?;
-        }
-
-        let args = vec![
-            "/quiet".to_string(),
-            "InstallAllUsers=0".to_string(),
-            "Include_pip=1".to_string(),
-            "Include_launcher=1".to_string(),
-            "PrependPath=1".to_string(),
-            format!("TargetDir={}", target_dir.display()),
-        ];
-
-        let output = Command::new(&tmp_installer)
-            .args(&args)
-            .output()
-            .context("failed to run python installer")?;
-        if !output.status.success() {
-            warning(&format!(
-                "official installer failed ({}); falling back to embeddable distribution",
-                output.status
-            ));
-            if target_dir.exists() {
-                fs::remove_dir_all(&target_dir)
-                    .with_context(|| format!("failed to reset {}", target_dir.display()))?;
-            }
-            self.install_windows_embeddable(&full_version, &target_dir)?;
-            let exe = self.get_python_exe(version)?;
-            if !is_python_runtime_healthy(&exe) {
-                let stderr = String::from_utf8_lossy(&output.stderr);
-                let stdout = String::from_utf8_lossy(&output.stdout);
-                bail!(
-                    "installer fallback completed but runtime is unhealthy at {}\ninstaller output:\n{}{}",
-                    exe.display(),
-                    stdout,
-                    stderr
-                );
-            }
-            success(&format!(
-                "Python {} installed at {}",
-                version,
-                target_dir.display()
-            ));
-            add_to_path(&target_dir)?;
-            add_to_path(&target_dir.join("Scripts"))?;
-            success(&format!("Added Python {} to PATH.", version));
-            return Ok(());
-        }
+fn cmd_pip(ctx: &AppContext, args: &[String]) -> Result<()> {
+    if args.is_empty() {
+        bail!("usage: xe pip <install|uninstall|list|show|tree|check|sync|compile>");
+    }
+    match args[0].as_str() {
+        "install" => cmd_add(ctx, &args[1..]),
+        "uninstall" => cmd_remove(ctx, &args[1..]),
+        "list" => cmd_list(ctx, &args[1..]),
+        "show" => cmd_check(ctx, &args[1..]),
+        "tree" => cmd_tree(&args[1..]),
+        "check" => cmd_doctor(ctx, &args[1..]),
+        "sync" => cmd_sync(ctx, &args[1..]),
+        "compile" => cmd_lock(ctx, &args[1..]),
+        _ => bail!("usage: xe pip <install|uninstall|list|show|tree|check|sync|compile>"),
+    }
+}
 
-        let exe = self.get_python_exe(version)?;
-        if !is_python_runtime_healthy(&exe) {
-            bail!("python installer completed but runtime is unhealthy at {}", exe.display());
+fn cmd_tool(ctx: &AppContext, args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe tool <run|install|list|upgrade|uninstall|sync|dir> ...";
+    if args.is_empty() {
+        bail!(USAGE);
+    }
+    match args[0].as_str() {
+        "run" => cmd_x(ctx, &args[1..]),
+        "install" => cmd_tool_install(ctx, &args[1..]),
+        "list" => cmd_tool_list(),
+        "update" | "upgrade" => cmd_tool_upgrade(ctx, &args[1..]),
+        "uninstall" => cmd_tool_uninstall(&args[1..]),
+        "sync" => cmd_tool_sync(ctx),
+        "dir" => {
+            println!("{}", xe_tools_dir().display());
+            Ok(())
         }
-        success(&format!(
-            "Python {} installed at {}",
-            version,
-            target_dir.display()
-        ));
-        info("Ensuring Python install directories are in system PATH...");
-        add_to_path(&target_dir)?;
-        add_to_path(&target_dir.join("Scripts"))?;
-        success(&format!("Added Python {} to PATH.", version));
-        Ok(())
+        _ => bail!(USAGE),
     }
+}
 
-    fn install_windows_embeddable(&self, full_version: &str, target_dir: &Path) -> Result<()> {
-        let url = format!(
-            "https://www.python.org/ftp/python/{0}/python-{0}-embed-amd64.zip",
-            full_version
-        );
-        info(&format!("Downloading embeddable Python from {}...", url));
-        let zip_path = download_file(&url, "python-embed", "zip")?;
-        fs::create_dir_all(target_dir)
-            .with_context(|| format!("failed to create {}", target_dir.display()))?;
-        extract_zip_to_dir(&zip_path, target_dir)?;
-        patch_embeddable_pth(target_dir)?;
-
-        let exe = target_dir.join("python.exe");
-        if exe.exists() {
-            if let Err(err) = bootstrap_pip(&exe) {
-                warning(&format!("Pip bootstrap failed: {err}"));
+fn cmd_tool_install(ctx: &AppContext, args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe tool install [--python <version>] [--force] <tool>[==version]...";
+    let mut python_version = String::new();
+    let mut force = false;
+    let mut requirements = Vec::new();
+    let mut idx = 0usize;
+    while idx < args.len() {
+        match args[idx].as_str() {
+            "-p" | "--python" => {
+                python_version = args
+                    .get(idx + 1)
+                    .ok_or_else(|| anyhow!("--python requires a version"))?
+                    .clone();
+                idx += 2;
+            }
+            "-f" | "--force" => {
+                force = true;
+                idx += 1;
+            }
+            other if other.starts_with('-') => bail!(USAGE),
+            other => {
+                requirements.push(other.to_string());
+                idx += 1;
             }
         }
-        Ok(())
     }
-
-    fn get_site_packages_dir(&self, version: &str) -> Result<PathBuf> {
-        let python_dir = self.get_python_path(version)?;
-        if cfg!(windows) {
-            let tools_lib = python_dir.join("tools").join("Lib");
-            let lib_root = if tools_lib.exists() {
-                python_dir.join("tools")
-            } else {
-                python_dir
-            };
-            let site = lib_root.join("Lib").join("site-packages");
-            fs::create_dir_all(&site).with_context(|| format!("failed to create {}", site.display()))?;
-            return Ok(site);
+    if requirements.is_empty() {
+        bail!(USAGE);
+    }
+    if python_version.is_empty() {
+        python_version = get_preferred_python_version(ctx)?;
+    }
+    for requirement in requirements {
+        let name = normalize_dep_name(&requirement_command_name(&requirement));
+        if name.is_empty() {
+            bail!(USAGE);
         }
-        let (major, minor) = parse_major_minor(version)?;
-        let site = python_dir
-            .join("lib")
-            .join(format!("python{}.{}", major, minor))
-            .join("site-packages");
-        fs::create_dir_all(&site).with_context(|| format!("failed to create {}", site.display()))?;
-        Ok(site)
+        install_tool(ctx, &name, &requirement, &python_version, force)?;
     }
+    warn_if_shim_dir_not_on_path();
+    Ok(())
 }
 
-fn parse_major_minor(version: &str) -> Result<(u32, u32)> {
-    let parts: Vec<&str> = version.split('.').collect();
-    if parts.len() < 2 {
-        bail!("invalid python version {}", version);
+fn cmd_tool_list() -> Result<()> {
+    let tools = installed_tools()?;
+    if tools.is_empty() {
+        info("No tools installed. Use `xe tool install <tool>`.");
+        return Ok(());
     }
-    let major = parts[0]
-        .parse::<u32>()
-        .with_context(|| format!("invalid python major version in {version}"))?;
-    let minor = parts[1]
-        .parse::<u32>()
-        .with_context(|| format!("invalid python minor version in {version}"))?;
-    Ok((major, minor))
+    for (name, receipt) in tools {
+        let version = receipt
+            .packages
+            .iter()
+            .find(|p| normalize_dep_name(&p.name) == name)
+            .map(|p| p.version.as_str())
+            .unwrap_or("?");
+        println!("{name} {version} (python {})", receipt.python_version);
+        for script in &receipt.scripts {
+            println!("  - {script}");
+        }
+    }
+    Ok(())
 }
 
-fn resolve_latest_windows_installer_version(version: &str) -> Result<String> {
-    let parts: Vec<&str> = version.split('.').collect();
-    if parts.len() >= 3 {
-        return Ok(version.to_string());
+fn cmd_tool_upgrade(ctx: &AppContext, args: &[String]) -> Result<()> {
+    let tools = installed_tools()?;
+    let selected = selected_tools(tools, args)?;
+    if selected.is_empty() {
+        info("No tools installed.");
+        return Ok(());
     }
-    if parts.len() != 2 {
-        return Ok(version.to_string());
+    for (name, receipt) in selected {
+        install_tool(ctx, &name, &receipt.requirement, &receipt.python_version, true)?;
     }
+    Ok(())
+}
 
-    let latest = resolve_latest_patch_version(version)?;
-    if windows_installer_exists(&latest) {
-        return Ok(latest);
-    }
-    if let Some(fallback) = windows_installer_fallback(version) {
-        if windows_installer_exists(fallback) {
-            return Ok(fallback.to_string());
-        }
+fn cmd_tool_uninstall(args: &[String]) -> Result<()> {
+    if args.is_empty() {
+        bail!("usage: xe tool uninstall <tool>...");
     }
-
-    let mut candidates = list_patch_versions(version)?;
-    candidates.sort_by(|a, b| compare_version(a, b).reverse());
-    for candidate in &candidates {
-        if windows_installer_exists(candidate) {
-            return Ok(candidate.clone());
+    let selected = selected_tools(installed_tools()?, args)?;
+    let vm = VenvManager::at(xe_tools_dir())?;
+    for (name, receipt) in selected {
+        for script in &receipt.scripts {
+            remove_shim(script)?;
         }
+        vm.delete(&name)?;
+        success(&format!("Uninstalled {name}"));
     }
+    Ok(())
+}
 
-    if let Some(fallback) = windows_installer_fallback(version) {
-        return Ok(fallback.to_string());
+// Recreates missing tool environments and shims from their receipts.
+fn cmd_tool_sync(ctx: &AppContext) -> Result<()> {
+    for (name, receipt) in installed_tools()? {
+        install_tool(ctx, &name, &receipt.requirement, &receipt.python_version, false)?;
     }
-    Ok(format!("{version}.0"))
+    Ok(())
 }
 
-fn resolve_latest_patch_version(version: &str) -> Result<String> {
-    let parts: Vec<&str> = version.split('.').collect();
-    if parts.len() >= 3 {
-        return Ok(version.to_string());
-    }
-    if parts.len() != 2 {
-        return Ok(version.to_string());
+fn selected_tools(
+    tools: Vec<(String, ToolReceipt)>,
+    names: &[String],
+) -> Result<Vec<(String, ToolReceipt)>> {
+    if names.is_empty() {
+        return Ok(tools);
     }
-    let mut candidates = list_patch_versions(version)?;
-    if candidates.is_empty() {
-        return Ok(format!("{version}.0"));
+    let wanted = names
+        .iter()
+        .map(|n| normalize_dep_name(&requirement_command_name(n)))
+        .collect::<Vec<_>>();
+    for name in &wanted {
+        if !tools.iter().any(|(n, _)| n == name) {
+            bail!("tool {name} is not installed");
+        }
     }
-    candidates.sort_by(|a, b| compare_version(a, b).reverse());
-    Ok(candidates[0].clone())
+    Ok(tools.into_iter().filter(|(n, _)| wanted.contains(n)).collect())
 }
 
-fn list_patch_versions(version: &str) -> Result<Vec<String>> {
-    let body = Client::builder()
-        .timeout(Duration::from_secs(30))
-        .build()
-        .context("failed to build HTTP client")?
-        .get("https://www.python.org/ftp/python/")
-        .send()
-        .context("failed to request python FTP listing")?
-        .error_for_status()
-        .context("python FTP listing request failed")?
-        .text()
-        .context("failed to decode python FTP response")?;
-    let re = Regex::new(r#"href="(\d+\.\d+\.\d+)/""#).unwrap();
-    let prefix = format!("{version}.");
+fn installed_tools() -> Result<Vec<(String, ToolReceipt)>> {
+    let dir = xe_tools_dir();
     let mut out = Vec::new();
-    for cap in re.captures_iter(&body) {
-        let value = cap.get(1).map(|m| m.as_str()).unwrap_or_default();
-        if value.starts_with(&prefix) {
-            out.push(value.to_string());
+    let Ok(entries) = fs::read_dir(&dir) else {
+        return Ok(out);
+    };
+    for entry in entries.flatten() {
+        let name = entry.file_name().to_string_lossy().to_string();
+        if let Some(receipt) = read_tool_receipt(&entry.path()) {
+            out.push((name, receipt));
         }
     }
+    out.sort_by(|a, b| a.0.cmp(&b.0));
     Ok(out)
 }
 
-fn windows_installer_fallback(version: &str) -> Option<&'static str> {
-    match version {
-        "3.9" => Some("3.9.13"),
-        "3.10" => Some("3.10.11"),
-        "3.11" => Some("3.11.9"),
-        "3.12" => Some("3.12.3"),
-        "3.13" => Some("3.13.0"),
-        _ => None,
+fn install_tool(
+    ctx: &AppContext,
+    name: &str,
+    requirement: &str,
+    python_version: &str,
+    force: bool,
+) -> Result<()> {
+    let base = xe_tools_dir();
+    let env_dir = base.join(name);
+    let previous = read_tool_receipt(&env_dir);
+    if force && env_dir.exists() {
+        VenvManager::at(base.clone())?.delete(name)?;
     }
+    // A forced reinstall resolves afresh, so `xe tool upgrade` picks up new releases.
+    let selection = ensure_cached_env(ctx, &base, name, &[requirement.to_string()], python_version, force)?;
+    let mut receipt = read_tool_receipt(&env_dir)
+        .ok_or_else(|| anyhow!("tool environment for {name} is missing its receipt"))?;
+    link_tool_scripts(name, &selection, previous.as_ref(), &mut receipt)?;
+    success(&format!(
+        "Installed {} ({})",
+        name,
+        if receipt.scripts.is_empty() {
+            "no scripts".to_string()
+        } else {
+            receipt.scripts.join(", ")
+        }
+    ));
+    Ok(())
 }
 
-fn windows_installer_exists(version: &str) -> bool {
-    if version.trim().is_empty() {
-        return false;
+// Writes a shim for each console script the tool's package provides, unless another
+// tool already owns that name, removes shims `previous` had that are gone now, and
+// saves the new script list in the receipt.
+fn link_tool_scripts(
+    name: &str,
+    selection: &RuntimeSelection,
+    previous: Option<&ToolReceipt>,
+    receipt: &mut ToolReceipt,
+) -> Result<()> {
+    let owned = installed_tools()?
+        .into_iter()
+        .filter(|(n, _)| n != name)
+        .flat_map(|(n, r)| r.scripts.into_iter().map(move |s| (s, n.clone())))
+        .collect::<HashMap<_, _>>();
+    let scripts = console_scripts(&selection.site_packages)?
+        .into_iter()
+        .filter(|s| normalize_dep_name(&s.package) == name)
+        .collect::<Vec<_>>();
+    if scripts.is_empty() {
+        warning(&format!("{name} does not provide any console scripts; no shims created"));
     }
-    let url = format!(
-        "https://www.python.org/ftp/python/{0}/python-{0}-amd64.exe",
-        version
-    );
-    let client = match Client::builder().timeout(Duration::from_secs(20)).build() {
-        Ok(c) => c,
-        Err(_) => return false,
+    receipt.local_versions |= previous.is_some_and(|p| p.local_versions);
+    let xe_exe = if receipt.local_versions {
+        Some(env::current_exe().context("failed to locate the xe executable")?)
+    } else {
+        None
     };
-    match client.head(&url).send() {
-        Ok(resp) => {
-            if resp.status() == StatusCode::METHOD_NOT_ALLOWED {
-                client
-                    .get(&url)
-                    .header("Range", "bytes=0-0")
-                    .send()
-                    .map(|r| r.status().is_success() || r.status() == StatusCode::PARTIAL_CONTENT)
-                    .unwrap_or(false)
-            } else {
-                resp.status().is_success()
-            }
+    receipt.scripts.clear();
+    for script in scripts {
+        if let Some(owner) = owned.get(&script.name) {
+            warning(&format!(
+                "Skipping shim '{}': already provided by tool {}",
+                script.name, owner
+            ));
+            continue;
+        }
+        if let Some(xe_exe) = &xe_exe {
+            let resolve = ["shim", "exec", script.name.as_str()].map(PathBuf::from);
+            create_shim_with_args(&script.name, xe_exe, &resolve)?;
+            receipt.scripts.push(script.name);
+            continue;
+        }
+        let launcher = write_console_launcher(selection, &script)?;
+        if cfg!(windows) {
+            create_shim_with_args(&script.name, &selection.python_exe, &[launcher])?;
+        } else {
+            create_shim(&script.name, &launcher)?;
+        }
+        receipt.scripts.push(script.name);
+    }
+    for stale in previous.iter().flat_map(|r| r.scripts.iter()) {
+        if !receipt.scripts.contains(stale) {
+            remove_shim(stale)?;
         }
-        Err(_) => false,
     }
+    let data = serde_json::to_vec_pretty(&receipt).context("failed to encode tool receipt")?;
+    write_file_atomic(&xe_tools_dir().join(name).join(TOOL_RECEIPT), &data)
 }
 
-fn compare_version(a: &str, b: &str) -> Ordering {
-    let pa: Vec<u32> = a
-        .split('.')
-        .map(|s| s.parse::<u32>().unwrap_or(0))
-        .collect();
-    let pb: Vec<u32> = b
-        .split('.')
-        .map(|s| s.parse::<u32>().unwrap_or(0))
-        .collect();
-    let n = pa.len().max(pb.len());
-    for i in 0..n {
-        let va = *pa.get(i).unwrap_or(&0);
-        let vb = *pb.get(i).unwrap_or(&0);
-        if va > vb {
-            return Ordering::Greater;
-        }
-        if va < vb {
-            return Ordering::Less;
-        }
+// `xe rehash` rebuilds the shim directory from what is installed: console scripts of
+// every tool, a `pythonXY` shim per runtime plus `python` for the global default, and
+// removes shims whose target no longer exists.
+fn cmd_rehash(ctx: &AppContext, args: &[String]) -> Result<()> {
+    if !args.is_empty() {
+        bail_kind!(ErrorKind::Usage, "usage: xe rehash");
+    }
+    let mut written = 0usize;
+    let vm = VenvManager::at(xe_tools_dir())?;
+    for (name, mut receipt) in installed_tools()? {
+        let selection = match vm.selection(&name) {
+            Ok(selection) if selection.python_exe.exists() => selection,
+            _ => {
+                warning(&format!("Tool {name} has no usable environment; run `xe tool sync` to rebuild it"));
+                continue;
+            }
+        };
+        let previous = receipt.clone();
+        link_tool_scripts(&name, &selection, Some(&previous), &mut receipt)?;
+        written += receipt.scripts.len();
     }
-    Ordering::Equal
-}
 
-fn is_windows_launcher_version_available(version: &str) -> bool {
-    if !cfg!(windows) {
-        return false;
+    let pm = PythonManager::new()?;
+    let runtime_dir = Regex::new(r"^python(\d)(\d+)$").expect("valid runtime dir regex");
+    for entry in fs::read_dir(&pm.base_dir).into_iter().flatten().flatten() {
+        let dir_name = entry.file_name().to_string_lossy().to_string();
+        let Some(caps) = runtime_dir.captures(&dir_name) else {
+            continue;
+        };
+        if let Ok(exe) = pm.get_python_exe(&format!("{}.{}", &caps[1], &caps[2])) {
+            create_shim(&dir_name, &exe)?;
+            written += 1;
+        }
     }
-    let parts: Vec<&str> = version.split('.').collect();
-    if parts.len() < 2 {
-        return false;
+    let default_python = load_global_config(&ctx.config_file)?.default_python;
+    if !default_python.trim().is_empty() {
+        if let Ok(exe) = pm.get_python_exe(&default_python) {
+            create_shim("python", &exe)?;
+            written += 1;
+        }
     }
-    let selector = format!("{}.{}", parts[0], parts[1]);
-    let mut candidates = vec![PathBuf::from("py")];
-    if let Ok(win_dir) = env::var("WINDIR") {
-        candidates.push(PathBuf::from(win_dir).join("py.exe"));
+
+    let pruned = dangling_shims();
+    for name in &pruned {
+        remove_shim(name)?;
     }
-    if let Ok(local_app_data) = env::var("LOCALAPPDATA") {
-        candidates.push(
-            PathBuf::from(local_app_data)
-                .join("Programs")
-                .join("Python")
-                .join("Launcher")
-                .join("py.exe"),
-        );
+    if !pruned.is_empty() {
+        info(&format!("Pruned {} dangling shim(s): {}", pruned.len(), pruned.join(", ")));
     }
-    for candidate in candidates {
-        let status = Command::new(&candidate)
-            .arg(format!("-{}", selector))
-            .arg("-V")
-            .stdout(Stdio::null())
-            .stderr(Stdio::null())
-            .status();
-        if let Ok(status) = status {
-            if status.success() {
-                return true;
+    success(&format!("Rehashed {written} shim(s) in {}", xe_shim_dir().display()));
+    warn_if_shim_dir_not_on_path();
+    Ok(())
+}
+
+// Per-directory tool pins, one `<tool> <version>` per line, found by walking up from the
+// working directory like asdf's .tool-versions.
+const TOOL_VERSIONS_FILE: &str = ".xe-tool-versions";
+
+#[derive(Debug, Serialize)]
+struct ShimInfo {
+    name: String,
+    target: PathBuf,
+    exists: bool,
+    owner: String,
+}
+
+fn cmd_shim(ctx: &AppContext, args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe shim <list|add|remove|pin|unpin> ...";
+    let Some(sub) = args.first() else {
+        bail_kind!(ErrorKind::Usage, "{USAGE}");
+    };
+    let rest = &args[1..];
+    match sub.as_str() {
+        "list" => {
+            let json_output = match rest {
+                [] => false,
+                [flag] if flag == "--json" => true,
+                _ => bail_kind!(ErrorKind::Usage, "usage: xe shim list [--json]"),
+            };
+            let shims = list_shims()?;
+            if json_output {
+                println!("{}", serde_json::to_string_pretty(&shims)?);
+                return Ok(());
+            }
+            if shims.is_empty() {
+                info("No shims found. Install tools with `xe tool install` or run `xe rehash`.");
+                return Ok(());
+            }
+            let width = shims.iter().map(|s| s.name.len()).max().unwrap_or(0).max("Name".len());
+            let owner_width = shims.iter().map(|s| or_dash(&s.owner).len()).max().unwrap_or(0).max("Owner".len());
+            println!("{:<width$}  {:<owner_width$}  {:<7}  Target", "Name", "Owner", "Status");
+            for shim in &shims {
+                println!(
+                    "{:<width$}  {:<owner_width$}  {:<7}  {}",
+                    shim.name,
+                    or_dash(&shim.owner),
+                    if shim.exists { "ok" } else { "missing" },
+                    shim.target.display()
+                );
+            }
+            Ok(())
+        }
+        "add" => {
+            const ADD_USAGE: &str = "usage: xe shim add <name> <target> [--force]";
+            let (force, rest) = take_flag(rest, "--force");
+            let [name, target] = rest.as_slice() else {
+                bail_kind!(ErrorKind::Usage, "{ADD_USAGE}");
+            };
+            if name.is_empty() || name.contains(['/', '\\']) {
+                bail_kind!(ErrorKind::Usage, "invalid shim name '{name}'");
             }
+            let Ok(target) = fs::canonicalize(target) else {
+                bail_kind!(ErrorKind::Config, "shim target {target} does not exist");
+            };
+            if !force && list_shims()?.iter().any(|s| &s.name == name) {
+                bail_kind!(ErrorKind::Config, "shim {name} already exists; pass --force to replace it");
+            }
+            create_shim(name, &target)?;
+            success(&format!("Created shim {name} -> {}", target.display()));
+            warn_if_shim_dir_not_on_path();
+            Ok(())
+        }
+        "remove" | "rm" => {
+            if rest.is_empty() {
+                bail_kind!(ErrorKind::Usage, "usage: xe shim remove <name>...");
+            }
+            let shims = list_shims()?;
+            for name in rest {
+                let Some(shim) = shims.iter().find(|s| &s.name == name) else {
+                    bail_kind!(ErrorKind::Config, "no shim named {name} (see `xe shim list`)");
+                };
+                remove_shim(name)?;
+                success(&format!("Removed shim {name}"));
+                if shim.owner.starts_with("tool ") {
+                    warning(&format!(
+                        "{name} belongs to {}; `xe rehash` will recreate it",
+                        shim.owner
+                    ));
+                }
+            }
+            Ok(())
+        }
+        "pin" => {
+            const PIN_USAGE: &str = "usage: xe shim pin <tool> <version>";
+            let [tool, version] = rest else {
+                bail_kind!(ErrorKind::Usage, "{PIN_USAGE}");
+            };
+            pin_tool_version(ctx, &normalize_dep_name(tool), version)
+        }
+        "unpin" => {
+            let [tool] = rest else {
+                bail_kind!(ErrorKind::Usage, "usage: xe shim unpin <tool>");
+            };
+            let tool = normalize_dep_name(tool);
+            let path = env::current_dir().context("failed to get cwd")?.join(TOOL_VERSIONS_FILE);
+            let mut pins = read_tool_versions(&path);
+            if pins.remove(&tool).is_none() {
+                bail_kind!(ErrorKind::Config, "{tool} is not pinned in {}", path.display());
+            }
+            write_tool_versions(&path, &pins)?;
+            success(&format!("Unpinned {tool} in {}", path.display()));
+            Ok(())
+        }
+        "exec" => {
+            let Some((script, script_args)) = rest.split_first() else {
+                bail_kind!(ErrorKind::Usage, "usage: xe shim exec <script> [args...]");
+            };
+            exec_tool_script(script, script_args)
         }
+        _ => bail_kind!(ErrorKind::Usage, "{USAGE}"),
     }
-    false
 }
 
-fn is_python_runtime_healthy(exe: &Path) -> bool {
-    let output = Command::new(exe)
-        .args(["-c", "import encodings,site; print('ok')"])
-        .output();
-    match output {
-        Ok(out) if out.status.success() => String::from_utf8_lossy(&out.stdout).contains("ok"),
-        _ => false,
+fn list_shims() -> Result<Vec<ShimInfo>> {
+    let tools = installed_tools()?;
+    let python_shim = Regex::new(r"^python(\d+)?$").expect("valid python shim regex");
+    let mut out = Vec::new();
+    for entry in fs::read_dir(xe_shim_dir()).into_iter().flatten().flatten() {
+        let path = entry.path();
+        let Some(target) = shim_target(&path) else {
+            continue;
+        };
+        let file_name = entry.file_name().to_string_lossy().to_string();
+        let name = [".bat", ".shim"]
+            .iter()
+            .find_map(|ext| file_name.strip_suffix(ext))
+            .unwrap_or(&file_name)
+            .to_string();
+        let owner = match tools.iter().find(|(_, r)| r.scripts.contains(&name)) {
+            Some((tool, receipt)) if receipt.local_versions => format!("tool {tool} (pinnable)"),
+            Some((tool, _)) => format!("tool {tool}"),
+            None if python_shim.is_match(&name) => "python".to_string(),
+            None => String::new(),
+        };
+        out.push(ShimInfo {
+            exists: target.exists(),
+            name,
+            target,
+            owner,
+        });
     }
+    out.sort_by(|a, b| a.name.cmp(&b.name));
+    Ok(out)
 }
 
-fn add_to_path(dir: &Path) -> Result<()> {
-    info(&format!("Ensuring {} is in system PATH...", dir.display()));
-    if cfg!(windows) {
-        let escaped = dir.to_string_lossy().replace('\'', "''");
-        let script = format!(
-            "$targetDir = '{}'; \
-             $currentPath = [Environment]::GetEnvironmentVariable('Path', 'User'); \
-             if ($null -eq $currentPath) {{ $currentPath = '' }}; \
-             $pathArray = $currentPath.Split(';', [System.StringSplitOptions]::RemoveEmptyEntries); \
-             if ($pathArray -notcontains $targetDir) {{ \
-               $newPath = ($pathArray + $targetDir) -join ';'; \
-               [Environment]::SetEnvironmentVariable('Path', $newPath, 'User'); \
-               Write-Output 'Added to PATH'; \
-             }} else {{ Write-Output 'Already in PATH'; }}"
-            ,
-            escaped
-        );
-        let status = Command::new("powershell")
-            .arg("-NoProfile")
-            .arg("-Command")
-            .arg(script)
-            .status()
-            .context("failed to run PowerShell PATH update")?;
-        if !status.success() {
-            bail!("failed to update PATH");
+fn read_tool_versions(path: &Path) -> BTreeMap<String, String> {
+    fs::read_to_string(path)
+        .unwrap_or_default()
+        .lines()
+        .map(|line| line.split('#').next().unwrap_or_default().trim())
+        .filter_map(|line| {
+            let (tool, version) = line.split_once(char::is_whitespace)?;
+            Some((normalize_dep_name(tool), version.trim().to_string()))
+        })
+        .collect()
+}
+
+fn write_tool_versions(path: &Path, pins: &BTreeMap<String, String>) -> Result<()> {
+    if pins.is_empty() {
+        if path.exists() {
+            fs::remove_file(path).with_context(|| format!("failed to remove {}", path.display()))?;
         }
         return Ok(());
     }
-    warning("Automatic PATH update on Linux is limited. Please ensure this is in your shell profile:");
-    info(&format!("export PATH=\"$PATH:{}\"", dir.display()));
+    let text = pins
+        .iter()
+        .map(|(tool, version)| format!("{tool} {version}\n"))
+        .collect::<String>();
+    write_file_atomic(path, text.as_bytes())
+}
+
+// The version of `tool` pinned for `dir` and the file that pins it.
+fn find_tool_pin(dir: &Path, tool: &str) -> Option<(String, PathBuf)> {
+    dir.ancestors().find_map(|ancestor| {
+        let path = ancestor.join(TOOL_VERSIONS_FILE);
+        read_tool_versions(&path).remove(tool).map(|version| (version, path))
+    })
+}
+
+fn tool_version_env_dir() -> PathBuf {
+    xe_home().join("tool-versions")
+}
+
+// Installs `tool==version` next to the tool's default environment, pins it for the
+// working directory, and switches the tool's shims to resolve through `xe shim exec`.
+fn pin_tool_version(ctx: &AppContext, tool: &str, version: &str) -> Result<()> {
+    let Some((_, mut receipt)) = installed_tools()?.into_iter().find(|(name, _)| name == tool) else {
+        bail_kind!(ErrorKind::Config, "tool {tool} is not installed; run `xe tool install {tool}` first");
+    };
+    let env_name = format!("{tool}-{version}");
+    ensure_tool_env(
+        ctx,
+        &tool_version_env_dir(),
+        &env_name,
+        &format!("{tool}=={version}"),
+        &receipt.python_version,
+    )?;
+    let path = env::current_dir().context("failed to get cwd")?.join(TOOL_VERSIONS_FILE);
+    let mut pins = read_tool_versions(&path);
+    pins.insert(tool.to_string(), version.to_string());
+    write_tool_versions(&path, &pins)?;
+    if !receipt.local_versions {
+        receipt.local_versions = true;
+        let selection = VenvManager::at(xe_tools_dir())?.selection(tool)?;
+        let previous = receipt.clone();
+        link_tool_scripts(tool, &selection, Some(&previous), &mut receipt)?;
+    }
+    success(&format!("Pinned {tool} {version} for {}", path.parent().unwrap_or(&path).display()));
     Ok(())
 }
 
-fn create_shim(name: &str, target: &Path) -> Result<()> {
-    let shim_dir = xe_shim_dir();
-    fs::create_dir_all(&shim_dir).with_context(|| format!("failed to create {}", shim_dir.display()))?;
+// Target of a pinnable tool shim: runs `script` from the version pinned for the working
+// directory, or from the tool's default environment when nothing pins it.
+fn exec_tool_script(script: &str, args: &[String]) -> Result<()> {
+    let Some((tool, _)) = installed_tools()?
+        .into_iter()
+        .find(|(_, receipt)| receipt.scripts.iter().any(|s| s == script))
+    else {
+        bail_kind!(ErrorKind::Config, "no installed tool provides {script}; run `xe rehash`");
+    };
+    let wd = env::current_dir().context("failed to get cwd")?;
+    let selection = match find_tool_pin(&wd, &tool) {
+        Some((version, pin_file)) => {
+            let vm = VenvManager::at(tool_version_env_dir())?;
+            let env_name = format!("{tool}-{version}");
+            if !vm.get_python_exe(&env_name).exists() {
+                bail_kind!(
+                    ErrorKind::RuntimeMissing,
+                    "{tool} {version} is pinned by {} but not installed; run `xe shim pin {tool} {version}` in {}",
+                    pin_file.display(),
+                    pin_file.parent().unwrap_or(&pin_file).display()
+                );
+            }
+            debug(&format!("Using {tool} {version} pinned by {}", pin_file.display()));
+            vm.selection(&env_name)?
+        }
+        None => VenvManager::at(xe_tools_dir())?.selection(&tool)?,
+    };
+    let mut command = tool_command(&selection, script)?;
+    command.args(args);
+    #[cfg(unix)]
+    {
+        use std::os::unix::process::CommandExt;
+        let err = command.exec();
+        Err(err).with_context(|| format!("failed to run {script}"))
+    }
+    #[cfg(not(unix))]
+    {
+        let status = command.status().with_context(|| format!("failed to run {script}"))?;
+        std::process::exit(status.code().unwrap_or(1));
+    }
+}
+
+fn read_tool_receipt(env_dir: &Path) -> Option<ToolReceipt> {
+    fs::read(env_dir.join(TOOL_RECEIPT))
+        .ok()
+        .and_then(|data| serde_json::from_slice(&data).ok())
+}
+
+// Writes a pip-style launcher for `script` into the environment's bin directory.
+fn write_console_launcher(selection: &RuntimeSelection, script: &ConsoleScript) -> Result<PathBuf> {
     if cfg!(windows) {
-        let path = shim_dir.join(format!("{name}.bat"));
-        let content = format!("@echo off\r\n\"{}\" %*\r\n", target.display());
-        fs::write(&path, content).with_context(|| format!("failed to write {}", path.display()))?;
-        return Ok(());
+        let path = selection
+            .activation_path
+            .join(format!("{}-script.py", script.name));
+        write_file_atomic(&path, script.bootstrap().as_bytes())?;
+        return Ok(path);
     }
-    let path = shim_dir.join(name);
-    let content = format!("#!/bin/sh\nexec \"{}\" \"$@\"\n", target.display());
-    fs::write(&path, content).with_context(|| format!("failed to write {}", path.display()))?;
+    let path = selection.activation_path.join(&script.name);
+    let content = format!(
+        "#!{}\n{}",
+        selection.python_exe.display(),
+        script.bootstrap()
+    );
+    write_file_atomic(&path, content.as_bytes())?;
     #[cfg(unix)]
     {
         use std::os::unix::fs::PermissionsExt;
-        let mut perms = fs::metadata(&path)?.permissions();
-        perms.set_mode(0o755);
-        fs::set_permissions(&path, perms)?;
+        fs::set_permissions(&path, fs::Permissions::from_mode(0o755))?;
     }
-    Ok(())
+    Ok(path)
 }
 
-#[derive(Debug, Clone)]
-struct VenvManager {
-    base_dir: PathBuf,
+fn warn_if_shim_dir_not_on_path() {
+    let shim_dir = xe_shim_dir();
+    let on_path = env::var_os("PATH")
+        .map(|p| env::split_paths(&p).any(|entry| entry == shim_dir))
+        .unwrap_or(false);
+    if !on_path {
+        warning(&format!(
+            "{} is not on PATH; run `xe setup` so installed tools can be found",
+            shim_dir.display()
+        ));
+    }
 }
 
-impl VenvManager {
-    fn new() -> Result<Self> {
-        let base_dir = xe_venv_dir();
-        fs::create_dir_all(&base_dir).with_context(|| format!("failed to create {}", base_dir.display()))?;
-        Ok(Self { base_dir })
+fn cmd_x(ctx: &AppContext, args: &[String]) -> Result<()> {
+    const USAGE: &str =
+        "usage: xe x [--from <requirement>] [--python <version>] <tool>[==version] [args...]";
+    let mut from = String::new();
+    let mut python_version = String::new();
+    let mut idx = 0usize;
+    while idx < args.len() {
+        match args[idx].as_str() {
+            "--from" => {
+                from = args
+                    .get(idx + 1)
+                    .ok_or_else(|| anyhow!("--from requires a requirement"))?
+                    .clone();
+                idx += 2;
+            }
+            "-p" | "--python" => {
+                python_version = args
+                    .get(idx + 1)
+                    .ok_or_else(|| anyhow!("--python requires a version"))?
+                    .clone();
+                idx += 2;
+            }
+            "--" => {
+                idx += 1;
+                break;
+            }
+            _ => break,
+        }
+    }
+    let rest = &args[idx..];
+    if rest.is_empty() {
+        bail!(USAGE);
     }
+    let command_name = requirement_command_name(&rest[0]);
+    if command_name.is_empty() {
+        bail!(USAGE);
+    }
+    let requirement = if from.is_empty() { rest[0].clone() } else { from };
 
-    fn create(&self, name: &str, python_path: &Path) -> Result<()> {
-        let venv_path = self.base_dir.join(name);
-        if venv_path.exists() {
-            bail!("venv {} already exists", name);
-        }
-        let status = Command::new(python_path)
-            .arg("-m")
-            .arg("venv")
-            .arg(&venv_path)
-            .status()
-            .context("failed to create venv with stdlib venv")?;
-        if status.success() {
-            return Ok(());
+    let version = if python_version.is_empty() {
+        get_preferred_python_version(ctx)?
+    } else {
+        python_version
+    };
+    let mut command = cached_tool_command(ctx, &command_name, &requirement, &version)?;
+    command.args(&rest[1..]);
+    command.stdin(Stdio::inherit());
+    command.stdout(Stdio::inherit());
+    command.stderr(Stdio::inherit());
+    let status = command
+        .status()
+        .with_context(|| format!("failed to run {command_name}"))?;
+    if let Some(code) = status.code() {
+        if code != 0 {
+            std::process::exit(code);
         }
+    }
+    Ok(())
+}
 
-        let bootstrap = Command::new(python_path)
-            .args([
-                "-m",
-                "pip",
-                "install",
-                "--disable-pip-version-check",
-                "--no-warn-script-location",
-                "--upgrade",
-                "--force-reinstall",
-                "virtualenv",
-            ])
-            .stdout(Stdio::null())
-            .stderr(Stdio::null())
-            .status()
-            .context("failed to bootstrap virtualenv")?;
-        if !bootstrap.success() {
-            bail!("failed to bootstrap virtualenv");
-        }
-        let fallback = Command::new(python_path)
-            .arg("-m")
-            .arg("virtualenv")
-            .arg(&venv_path)
-            .stdout(Stdio::null())
-            .stderr(Stdio::null())
-            .status()
-            .context("failed to create venv with virtualenv")?;
+// A command for console script `name` from the cached ephemeral environment of
+// `requirement`, with the environment's runtime variables applied.
+fn cached_tool_command(
+    ctx: &AppContext,
+    name: &str,
+    requirement: &str,
+    python_version: &str,
+) -> Result<Command> {
+    let env_name = format!(
+        "{}-{}",
+        normalize_dep_name(name),
+        &solve_key(python_version, &[requirement.to_string()])[..12]
+    );
+    let selection = ensure_tool_env(ctx, &xe_tool_cache_dir(), &env_name, requirement, python_version)?;
+    let mut command = tool_command(&selection, name)?;
+    apply_runtime_env(&mut command, &selection)?;
+    Ok(command)
+}
+
+// "black==24.1.0" -> "black", "httpie[socks]" -> "httpie".
+fn requirement_command_name(spec: &str) -> String {
+    let end = spec
+        .find(|c: char| "[<>=!~; ".contains(c))
+        .unwrap_or(spec.len());
+    spec[..end].trim().to_string()
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct ToolReceipt {
+    requirement: String,
+    python_version: String,
+    #[serde(default)]
+    packages: Vec<Package>,
+    #[serde(default)]
+    scripts: Vec<String>,
+    // Set once a version is pinned per directory; the tool's shims then run through
+    // `xe shim exec` so the pin can be honored.
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    local_versions: bool,
+}
+
+const TOOL_RECEIPT: &str = "xe-tool.json";
+
+// Creates (or reuses) an isolated venv `base/name` with `requirement` installed from the CAS.
+fn ensure_tool_env(
+    ctx: &AppContext,
+    base: &Path,
+    name: &str,
+    requirement: &str,
+    python_version: &str,
+) -> Result<RuntimeSelection> {
+    ensure_cached_env(ctx, base, name, &[requirement.to_string()], python_version, false)
+}
+
+// A venv `base/name` with `requirements` installed, reused while its receipt still
+// matches. Backs tool environments and the ephemeral environments of `xe run script.py`.
+// With `refresh`, the requirements are resolved again rather than from the solution cache.
+fn ensure_cached_env(
+    ctx: &AppContext,
+    base: &Path,
+    name: &str,
+    requirements: &[String],
+    python_version: &str,
+    refresh: bool,
+) -> Result<RuntimeSelection> {
+    let requirement = requirements.join(", ");
+    let _span = span(ctx, "tool.env", json!({"name": name, "requirement": requirement}));
+    let vm = VenvManager::at(base.to_path_buf())?;
+    let receipt_path = vm.base_dir.join(name).join(TOOL_RECEIPT);
+    let ready = fs::read(&receipt_path)
+        .ok()
+        .and_then(|data| serde_json::from_slice::<ToolReceipt>(&data).ok())
+        .map(|r| r.requirement == requirement && r.python_version == python_version)
+        .unwrap_or(false);
+    if ready && vm.get_python_exe(name).exists() {
+        debug(&format!("Reusing tool environment {}", vm.base_dir.join(name).display()));
+        return vm.selection(name);
+    }
+
+    if vm.exists(name) {
+        vm.delete(name)?;
+    }
+    let pm = PythonManager::new()?;
+    let base_python = pm.ensure(python_version, ctx)?;
+    if requirement.is_empty() {
+        info(&format!("Creating environment {name}..."));
+    } else {
+        info(&format!("Creating tool environment for {requirement}..."));
+    }
+    vm.create(name, &base_python, None)?;
+    let selection = vm.selection(name)?;
+
+    let mut cfg = Config::new_default(&vm.base_dir.join(name));
+    cfg.python.version = python_version.to_string();
+    let packages = if requirements.is_empty() {
+        Vec::new()
+    } else {
+        let mut installer = Installer::new(&xe_cache_dir())?;
+        if refresh {
+            installer = installer.refreshed();
+        }
+        installer.install(
+            ctx,
+            &cfg,
+            requirements,
+            &vm.base_dir.join(name),
+            &selection.site_packages,
+            &selection.python_exe,
+        )?
+    };
+    let receipt = ToolReceipt {
+        requirement,
+        python_version: python_version.to_string(),
+        packages,
+        scripts: Vec::new(),
+        local_versions: false,
+    };
+    let data = serde_json::to_vec_pretty(&receipt).context("failed to encode tool receipt")?;
+    write_file_atomic(&receipt_path, &data)?;
+    Ok(selection)
+}
+
+// Resolves a console script to something runnable: a real executable in the env's bin
+// directory if one exists, otherwise the entry point invoked through the env's python.
+fn tool_command(selection: &RuntimeSelection, name: &str) -> Result<Command> {
+    let exe_name = if cfg!(windows) {
+        format!("{name}.exe")
+    } else {
+        name.to_string()
+    };
+    let exe = selection.activation_path.join(exe_name);
+    if exe.is_file() {
+        return Ok(Command::new(exe));
+    }
+    let scripts = console_scripts(&selection.site_packages)?;
+    let Some(script) = scripts.iter().find(|s| s.name == name) else {
+        let available = scripts.iter().map(|s| s.name.as_str()).collect::<Vec<_>>();
+        if available.is_empty() {
+            bail!("{name} does not provide any console scripts");
+        }
+        bail!(
+            "no console script named '{}' (available: {}); use `--from <package> <script>`",
+            name,
+            available.join(", ")
+        );
+    };
+    let mut command = Command::new(&selection.python_exe);
+    command.arg("-c").arg(script.bootstrap());
+    Ok(command)
+}
+
+#[derive(Debug, Clone)]
+struct ConsoleScript {
+    package: String,
+    name: String,
+    module: String,
+    attr: String,
+}
+
+impl ConsoleScript {
+    fn bootstrap(&self) -> String {
+        format!(
+            "import importlib, sys\nsys.argv[0] = {:?}\nobj = importlib.import_module({:?})\nfor part in {:?}.split('.'):\n    obj = getattr(obj, part)\nsys.exit(obj())\n",
+            self.name, self.module, self.attr
+        )
+    }
+}
+
+fn console_scripts(site_packages: &Path) -> Result<Vec<ConsoleScript>> {
+    let mut out = Vec::new();
+    if !site_packages.is_dir() {
+        return Ok(out);
+    }
+    for entry in fs::read_dir(site_packages)
+        .with_context(|| format!("failed to read {}", site_packages.display()))?
+    {
+        let entry = entry?;
+        let dir_name = entry.file_name().to_string_lossy().to_string();
+        let Some(stem) = dir_name.strip_suffix(".dist-info") else {
+            continue;
+        };
+        let package = stem.split('-').next().unwrap_or(stem);
+        let path = entry.path().join("entry_points.txt");
+        if let Ok(text) = fs::read_to_string(&path) {
+            out.extend(parse_console_scripts(package, &text));
+        }
+    }
+    out.sort_by(|a, b| a.name.cmp(&b.name));
+    Ok(out)
+}
+
+fn parse_console_scripts(package: &str, text: &str) -> Vec<ConsoleScript> {
+    let mut out = Vec::new();
+    let mut in_section = false;
+    for line in text.lines() {
+        let line = line.trim();
+        if line.is_empty() || line.starts_with('#') || line.starts_with(';') {
+            continue;
+        }
+        if line.starts_with('[') {
+            in_section = line == "[console_scripts]";
+            continue;
+        }
+        if !in_section {
+            continue;
+        }
+        let Some((name, target)) = line.split_once('=') else {
+            continue;
+        };
+        let target = target.split('[').next().unwrap_or("").trim();
+        let Some((module, attr)) = target.split_once(':') else {
+            continue;
+        };
+        out.push(ConsoleScript {
+            package: package.to_string(),
+            name: name.trim().to_string(),
+            module: module.trim().to_string(),
+            attr: attr.trim().to_string(),
+        });
+    }
+    out
+}
+
+fn cmd_build(args: &[String]) -> Result<()> {
+    let mut out_dir = PathBuf::from("dist");
+    let mut check = false;
+    let mut idx = 0usize;
+    while idx < args.len() {
+        match args[idx].as_str() {
+            "-o" | "--out-dir" => {
+                let value = args
+                    .get(idx + 1)
+                    .ok_or_else(|| anyhow!("--out-dir requires a path"))?;
+                out_dir = PathBuf::from(value);
+                idx += 2;
+            }
+            "--check" => {
+                check = true;
+                idx += 1;
+            }
+            _ => bail!("usage: xe build [--out-dir <dir>] [--check]"),
+        }
+    }
+    let wd = env::current_dir().context("failed to get cwd")?;
+    let cfg = load_existing_project(&wd)?;
+    info(&format!(
+        "Building {} {}...",
+        cfg.project.name, cfg.project.version
+    ));
+    let wheel = build_wheel(&wd, &cfg, &wd.join(out_dir))?;
+    success(&format!("Successfully built {}", wheel.display()));
+    if check {
+        check_distributions(&wd, &cfg, &[wheel])?;
+    }
+    Ok(())
+}
+
+// Validates core metadata of each artifact (the twine check equivalent) and fails with a
+// config error when any artifact would be rejected by the index.
+fn check_distributions(project_dir: &Path, cfg: &Config, artifacts: &[PathBuf]) -> Result<()> {
+    let mut failed = 0usize;
+    for artifact in artifacts {
+        let issues = check_distribution(project_dir, cfg, artifact)?;
+        let errors = issues.iter().filter(|i| i.level == IssueLevel::Error).count();
+        for issue in &issues {
+            let line = format!("{}: {}: {}", file_name_of(artifact), issue.key, issue.message);
+            match issue.level {
+                IssueLevel::Error => error(&line),
+                IssueLevel::Warning => warning(&line),
+            }
+        }
+        if errors > 0 {
+            failed += 1;
+        } else {
+            success(&format!("Checked {}: PASSED", file_name_of(artifact)));
+        }
+    }
+    if failed > 0 {
+        bail_kind!(
+            ErrorKind::Config,
+            "{} of {} distribution(s) failed the metadata check",
+            failed,
+            artifacts.len()
+        );
+    }
+    Ok(())
+}
+
+fn distribution_metadata(project_dir: &Path, cfg: &Config, artifact: &Path) -> Result<String> {
+    if file_name_of(artifact).to_lowercase().ends_with(".whl") {
+        read_wheel_metadata(artifact)
+    } else {
+        render_core_metadata(project_dir, cfg)
+    }
+}
+
+// Splits core metadata into its header fields and the long description body.
+fn parse_core_metadata(text: &str) -> (Vec<(String, String)>, String) {
+    let (headers, description) = text.split_once("\n\n").unwrap_or((text, ""));
+    let fields = headers
+        .lines()
+        .filter_map(|line| line.split_once(':'))
+        .map(|(key, value)| (key.trim().to_string(), value.trim().to_string()))
+        .collect();
+    (fields, description.to_string())
+}
+
+const CLASSIFIER_CATEGORIES: &[&str] = &[
+    "Development Status",
+    "Environment",
+    "Framework",
+    "Intended Audience",
+    "License",
+    "Natural Language",
+    "Operating System",
+    "Programming Language",
+    "Topic",
+    "Typing",
+];
+
+fn check_distribution(project_dir: &Path, cfg: &Config, artifact: &Path) -> Result<Vec<ConfigIssue>> {
+    let (fields, description) = parse_core_metadata(&distribution_metadata(project_dir, cfg, artifact)?);
+    let get = |key: &str| {
+        fields
+            .iter()
+            .find(|(k, _)| k.eq_ignore_ascii_case(key))
+            .map(|(_, v)| v.as_str())
+    };
+    let mut issues = Vec::new();
+    for key in ["Metadata-Version", "Name", "Version"] {
+        if get(key).map(str::is_empty).unwrap_or(true) {
+            issues.push(ConfigIssue::error(key, "required field is missing".to_string()));
+        }
+    }
+    if let Some(name) = get("Name").filter(|n| !n.is_empty()) {
+        let re = Regex::new(r"(?i)^([a-z0-9]|[a-z0-9][a-z0-9._-]*[a-z0-9])$").expect("valid regex");
+        if !re.is_match(name) {
+            issues.push(ConfigIssue::error(
+                "Name",
+                format!("\"{name}\" is not a valid project name"),
+            ));
+        }
+    }
+    if let Some(version) = get("Version").filter(|v| !v.is_empty()) {
+        if version == "*" || !is_valid_dep_version(version) {
+            issues.push(ConfigIssue::error(
+                "Version",
+                format!("\"{version}\" is not a valid PEP 440 version"),
+            ));
+        }
+    }
+    match get("Summary") {
+        None | Some("") => issues.push(ConfigIssue::warning(
+            "Summary",
+            "missing; set project.description".to_string(),
+        )),
+        Some(summary) if summary.chars().count() > 512 => issues.push(ConfigIssue::error(
+            "Summary",
+            "longer than 512 characters".to_string(),
+        )),
+        _ => {}
+    }
+    for (key, value) in fields.iter().filter(|(k, _)| k == "Classifier") {
+        let category = value.split("::").next().unwrap_or("").trim();
+        if category == "Private" {
+            issues.push(ConfigIssue::error(
+                key,
+                format!("\"{value}\" is a private classifier; the index rejects uploads using it"),
+            ));
+        } else if !value.contains("::") || !CLASSIFIER_CATEGORIES.contains(&category) {
+            issues.push(ConfigIssue::error(
+                key,
+                format!("\"{value}\" is not a valid trove classifier"),
+            ));
+        }
+    }
+
+    if description.trim().is_empty() {
+        issues.push(ConfigIssue::warning(
+            "Description",
+            "no long description; set project.readme".to_string(),
+        ));
+    } else {
+        match get("Description-Content-Type").map(|t| t.split(';').next().unwrap_or("").trim()) {
+            Some("text/markdown") | Some("text/plain") => {}
+            Some("text/x-rst") => issues.extend(check_rst(&description)),
+            Some(other) => issues.push(ConfigIssue::error(
+                "Description-Content-Type",
+                format!("unsupported content type \"{other}\""),
+            )),
+            None => {
+                issues.push(ConfigIssue::warning(
+                    "Description-Content-Type",
+                    "missing; the index renders the description as reStructuredText".to_string(),
+                ));
+                issues.extend(check_rst(&description));
+            }
+        }
+    }
+
+    if file_name_of(artifact).to_lowercase().ends_with(".whl") {
+        if let (Some(name), Some(version)) = (get("Name"), get("Version")) {
+            let prefix = format!("{}-{}-", wheel_dist_name(name), version).to_lowercase();
+            if !file_name_of(artifact).to_lowercase().starts_with(&prefix) {
+                issues.push(ConfigIssue::error(
+                    "filename",
+                    format!("does not match metadata {name} {version}"),
+                ));
+            }
+        }
+    }
+    Ok(issues)
+}
+
+// Catches the reStructuredText mistakes that most often make an index refuse to render a
+// long description: section underlines shorter than their title.
+fn check_rst(text: &str) -> Vec<ConfigIssue> {
+    let lines = text.lines().collect::<Vec<_>>();
+    let mut issues = Vec::new();
+    for (idx, pair) in lines.windows(2).enumerate() {
+        let (title, underline) = (pair[0].trim_end(), pair[1].trim_end());
+        let Some(marker) = underline.chars().next() else {
+            continue;
+        };
+        let is_underline = underline.len() >= 2
+            && "=-~^\"'`#*+.:_".contains(marker)
+            && underline.chars().all(|c| c == marker);
+        if is_underline
+            && !title.trim().is_empty()
+            && !title.starts_with(' ')
+            && underline.chars().count() < title.chars().count()
+        {
+            issues.push(ConfigIssue::error(
+                "Description",
+                format!(
+                    "line {}: title underline too short for \"{}\"; the description will not render",
+                    idx + 2,
+                    title
+                ),
+            ));
+        }
+    }
+    issues
+}
+
+fn cmd_push(ctx: &AppContext, args: &[String], test_pypi: bool) -> Result<()> {
+    const USAGE: &str = "usage: xe push [--repository <name|url>] [--skip-existing] [--sign]";
+    let mut repository = if test_pypi { "testpypi" } else { "pypi" }.to_string();
+    let mut skip_existing = false;
+    let mut sign = false;
+    let mut idx = 0usize;
+    while idx < args.len() {
+        match args[idx].as_str() {
+            "-r" | "--repository" => {
+                repository = args
+                    .get(idx + 1)
+                    .ok_or_else(|| anyhow!("--repository requires a name or URL"))?
+                    .clone();
+                idx += 2;
+            }
+            "--skip-existing" => {
+                skip_existing = true;
+                idx += 1;
+            }
+            "--sign" => {
+                sign = true;
+                idx += 1;
+            }
+            _ => bail!(USAGE),
+        }
+    }
+    let global = load_global_config(&ctx.config_file)?;
+    let repo = upload_repository(&global, &repository)?;
+    let index = repo.display.clone();
+
+    let wd = env::current_dir().context("failed to get cwd")?;
+    let cfg = load_existing_project(&wd)?;
+    let artifacts = dist_artifacts(&wd.join("dist"), &cfg)?;
+    if artifacts.is_empty() {
+        bail!(
+            "no distributions for {} {} in {}; run `xe build` first",
+            cfg.project.name,
+            cfg.project.version,
+            wd.join("dist").display()
+        );
+    }
+
+    check_distributions(&wd, &cfg, &artifacts)?;
+    if sign {
+        sign_distributions(ctx, &artifacts)?;
+    }
+
+    let mut token = match trusted_publishing_token(&repo) {
+        Ok(Some(token)) => {
+            info(&format!("Authenticated to {index} with trusted publishing"));
+            token
+        }
+        Ok(None) => String::new(),
+        Err(err) => {
+            warning(&format!(
+                "Trusted publishing failed, falling back to the stored token: {err:#}"
+            ));
+            String::new()
+        }
+    };
+    if token.is_empty() {
+        token = load_token(&global, &repo.key).unwrap_or_default().trim().to_string();
+    }
+    if token.is_empty() {
+        println!("No {index} token found in secure storage.");
+        token = prompt_line(
+            &format!("{index} Token"),
+            &format!(
+                "run `xe auth login --repository {} --token <token>` first",
+                repo.key
+            ),
+        )?;
+        if token.is_empty() {
+            bail!("Push requires an authentication token.");
+        }
+        let store = save_token(&global, &repo.key, &token)?;
+        println!("Token saved securely in {store}.");
+    }
+
+    let client = http_client()?;
+    let mut uploaded = 0usize;
+    for artifact in &artifacts {
+        let mut fields = upload_metadata_fields(&wd, &cfg, artifact)?;
+        if sign {
+            let attestation = fs::read_to_string(attestation_path(artifact))
+                .with_context(|| format!("failed to read attestation for {}", file_name_of(artifact)))?;
+            fields.push(("attestations".to_string(), format!("[{}]", attestation.trim())));
+        }
+        if upload_distribution(client, &repo.upload_url, &token, artifact, &fields, skip_existing)? {
+            uploaded += 1;
+        } else {
+            warning(&format!("Skipping {}: already exists on {index}", file_name_of(artifact)));
+        }
+    }
+    success(&format!(
+        "Pushed {} {} to {} ({} file(s))",
+        cfg.project.name, cfg.project.version, index, uploaded
+    ));
+    Ok(())
+}
+
+struct Repository {
+    // Credential key: "pypi", "testpypi", a registered name, or the upload URL itself.
+    key: String,
+    display: String,
+    upload_url: String,
+    // Warehouse instance that can mint tokens for trusted publishing.
+    oidc_base: Option<&'static str>,
+}
+
+fn upload_repository(global: &GlobalConfig, name: &str) -> Result<Repository> {
+    let key = name.trim().to_lowercase();
+    let repo = |display: &str, url: &str, oidc_base: Option<&'static str>| Repository {
+        key: key.clone(),
+        display: display.to_string(),
+        upload_url: url.to_string(),
+        oidc_base,
+    };
+    match key.as_str() {
+        "pypi" => Ok(repo("PyPI", "https://upload.pypi.org/legacy/", Some("https://pypi.org"))),
+        "testpypi" => Ok(repo(
+            "TestPyPI",
+            "https://test.pypi.org/legacy/",
+            Some("https://test.pypi.org"),
+        )),
+        url if url.starts_with("https://") || url.starts_with("http://") => Ok(Repository {
+            key: name.trim().trim_end_matches('/').to_string(),
+            display: name.trim().to_string(),
+            upload_url: name.trim().to_string(),
+            oidc_base: None,
+        }),
+        _ => match global.repositories.get(&key) {
+            Some(url) => Ok(repo(&key, url, None)),
+            None => bail_kind!(
+                ErrorKind::Usage,
+                "unknown repository \"{}\"; use pypi, testpypi, an upload URL, or register it with `xe auth login --repository {} --url <upload-url>`",
+                name,
+                key
+            ),
+        },
+    }
+}
+
+// Exchanges the GitHub Actions OIDC identity token for a short-lived upload token.
+// Returns None outside GitHub Actions (or when the workflow lacks `id-token: write`)
+// and for indexes without trusted publishing.
+fn trusted_publishing_token(repo: &Repository) -> Result<Option<String>> {
+    let Some(base) = repo.oidc_base else {
+        return Ok(None);
+    };
+    let (Ok(request_url), Ok(request_token)) = (
+        env::var("ACTIONS_ID_TOKEN_REQUEST_URL"),
+        env::var("ACTIONS_ID_TOKEN_REQUEST_TOKEN"),
+    ) else {
+        return Ok(None);
+    };
+    let client = http_client()?;
+    let timeout = Duration::from_secs(30);
+
+    let audience = client
+        .get(format!("{base}/_/oidc/audience"))
+        .timeout(timeout)
+        .send()
+        .and_then(|r| r.error_for_status())
+        .context("failed to fetch the trusted publishing audience")?
+        .json::<Value>()
+        .context("failed to parse the trusted publishing audience")?
+        .get("audience")
+        .and_then(Value::as_str)
+        .map(str::to_string)
+        .ok_or_else(|| anyhow!("index did not return an OIDC audience"))?;
+
+    let mut id_url = reqwest::Url::parse(&request_url).context("invalid ACTIONS_ID_TOKEN_REQUEST_URL")?;
+    id_url.query_pairs_mut().append_pair("audience", &audience);
+    let id_token = client
+        .get(id_url)
+        .timeout(timeout)
+        .bearer_auth(request_token)
+        .send()
+        .and_then(|r| r.error_for_status())
+        .context("failed to request a GitHub OIDC token")?
+        .json::<Value>()
+        .context("failed to parse the GitHub OIDC token response")?
+        .get("value")
+        .and_then(Value::as_str)
+        .map(str::to_string)
+        .ok_or_else(|| anyhow!("GitHub did not return an OIDC token"))?;
+
+    let resp = client
+        .post(format!("{base}/_/oidc/mint-token"))
+        .timeout(timeout)
+        .json(&json!({ "token": id_token }))
+        .send()
+        .context("failed to exchange the OIDC token")?;
+    let status = resp.status();
+    let body = resp.json::<Value>().unwrap_or(Value::Null);
+    if let Some(token) = body.get("token").and_then(Value::as_str).filter(|_| status.is_success()) {
+        return Ok(Some(token.to_string()));
+    }
+    let reasons = body
+        .get("errors")
+        .and_then(Value::as_array)
+        .map(|errors| {
+            errors
+                .iter()
+                .filter_map(|e| e.get("description").and_then(Value::as_str))
+                .collect::<Vec<_>>()
+                .join("; ")
+        })
+        .filter(|r| !r.is_empty())
+        .or_else(|| body.get("message").and_then(Value::as_str).map(str::to_string))
+        .unwrap_or_else(|| status.to_string());
+    bail!(
+        "{} rejected the OIDC token ({reasons}); check the trusted publisher configured for this project",
+        repo.display
+    )
+}
+
+const ATTESTATION_TOOL: &str = "pypi-attestations";
+
+// PEP 740 publish attestation written next to each artifact by `xe push --sign`.
+fn attestation_path(artifact: &Path) -> PathBuf {
+    let mut name = artifact.as_os_str().to_os_string();
+    name.push(".publish.attestation");
+    PathBuf::from(name)
+}
+
+// Signs artifacts with Sigstore through pypi-attestations, which picks up the ambient
+// OIDC identity in CI and opens a browser login elsewhere.
+fn sign_distributions(ctx: &AppContext, artifacts: &[PathBuf]) -> Result<()> {
+    let python_version = get_preferred_python_version(ctx)?;
+    let mut command = cached_tool_command(ctx, ATTESTATION_TOOL, ATTESTATION_TOOL, &python_version)?;
+    command.arg("sign").args(artifacts);
+    info(&format!("Signing {} artifact(s) with Sigstore...", artifacts.len()));
+    let status = command.status().context("failed to run pypi-attestations")?;
+    if !status.success() {
+        bail!("signing failed: pypi-attestations exited with {status}");
+    }
+    for artifact in artifacts {
+        if !attestation_path(artifact).is_file() {
+            bail!("no attestation was produced for {}", file_name_of(artifact));
+        }
+    }
+    Ok(())
+}
+
+fn cmd_verify_artifact(ctx: &AppContext, args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe verify-artifact <file> --identity <email|workflow-url> [--attestation <path>]";
+    let mut file = None;
+    let mut identity = None;
+    let mut attestation = None;
+    let mut idx = 0usize;
+    while idx < args.len() {
+        match args[idx].as_str() {
+            "--identity" => {
+                identity = Some(args.get(idx + 1).ok_or_else(|| anyhow!(USAGE))?.clone());
+                idx += 2;
+            }
+            "--attestation" => {
+                attestation = Some(PathBuf::from(args.get(idx + 1).ok_or_else(|| anyhow!(USAGE))?));
+                idx += 2;
+            }
+            other if other.starts_with('-') || file.is_some() => bail!(USAGE),
+            other => {
+                file = Some(PathBuf::from(other));
+                idx += 1;
+            }
+        }
+    }
+    let (Some(file), Some(identity)) = (file, identity) else {
+        bail!(USAGE);
+    };
+    if !file.is_file() {
+        bail!("{} not found", file.display());
+    }
+    let expected = attestation_path(&file);
+    if let Some(attestation) = attestation {
+        if attestation != expected {
+            fs::copy(&attestation, &expected).with_context(|| {
+                format!("failed to copy {} to {}", attestation.display(), expected.display())
+            })?;
+        }
+    }
+    if !expected.is_file() {
+        bail!(
+            "no attestation found at {}; pass --attestation <path>",
+            expected.display()
+        );
+    }
+    let python_version = get_preferred_python_version(ctx)?;
+    let output = cached_tool_command(ctx, ATTESTATION_TOOL, ATTESTATION_TOOL, &python_version)?
+        .args(["verify", "attestation", "--identity", identity.as_str()])
+        .arg(&file)
+        .output()
+        .context("failed to run pypi-attestations")?;
+    if !output.status.success() {
+        bail!(
+            "verification of {} failed:\n{}{}",
+            file.display(),
+            String::from_utf8_lossy(&output.stdout),
+            String::from_utf8_lossy(&output.stderr)
+        );
+    }
+    success(&format!("{} is signed by {}", file_name_of(&file), identity));
+    Ok(())
+}
+
+fn file_name_of(path: &Path) -> String {
+    path.file_name()
+        .map(|n| n.to_string_lossy().to_string())
+        .unwrap_or_else(|| path.display().to_string())
+}
+
+// Form fields for the legacy upload API, taken from the wheel's METADATA (or the
+// project config for sdists) as lowercase, underscore-separated names.
+fn upload_metadata_fields(
+    project_dir: &Path,
+    cfg: &Config,
+    artifact: &Path,
+) -> Result<Vec<(String, String)>> {
+    let file_name = file_name_of(artifact);
+    let is_wheel = file_name.to_lowercase().ends_with(".whl");
+    let (headers, description) =
+        parse_core_metadata(&distribution_metadata(project_dir, cfg, artifact)?);
+    let mut fields = vec![
+        (":action".to_string(), "file_upload".to_string()),
+        ("protocol_version".to_string(), "1".to_string()),
+        (
+            "filetype".to_string(),
+            if is_wheel { "bdist_wheel" } else { "sdist" }.to_string(),
+        ),
+    ];
+    let pyversion = if is_wheel {
+        file_name
+            .trim_end_matches(".whl")
+            .split('-')
+            .rev()
+            .nth(2)
+            .unwrap_or("py3")
+            .to_string()
+    } else {
+        "source".to_string()
+    };
+    fields.push(("pyversion".to_string(), pyversion));
+
+    for (key, value) in headers {
+        let key = match key.as_str() {
+            "Classifier" => "classifiers".to_string(),
+            "Project-URL" => "project_urls".to_string(),
+            other => other.to_lowercase().replace('-', "_"),
+        };
+        fields.push((key, value));
+    }
+    if !description.trim().is_empty() {
+        fields.push(("description".to_string(), description.to_string()));
+    }
+    Ok(fields)
+}
+
+fn read_wheel_metadata(wheel: &Path) -> Result<String> {
+    let file = File::open(wheel).with_context(|| format!("failed to open {}", wheel.display()))?;
+    let mut archive =
+        ZipArchive::new(file).with_context(|| format!("failed to parse {}", wheel.display()))?;
+    for index in 0..archive.len() {
+        let mut entry = archive.by_index(index)?;
+        let name = entry.name().to_string();
+        if name.ends_with(".dist-info/METADATA") && name.matches('/').count() == 1 {
+            let mut text = String::new();
+            entry
+                .read_to_string(&mut text)
+                .with_context(|| format!("failed to read {name}"))?;
+            return Ok(text);
+        }
+    }
+    bail!("{} has no .dist-info/METADATA", wheel.display())
+}
+
+fn upload_distribution(
+    client: &Client,
+    url: &str,
+    token: &str,
+    artifact: &Path,
+    fields: &[(String, String)],
+    skip_existing: bool,
+) -> Result<bool> {
+    // Returns Ok(false) when the file already exists and skip_existing is set.
+    let file_name = file_name_of(artifact);
+    let content = fs::read(artifact).with_context(|| format!("failed to read {}", artifact.display()))?;
+    let mut fields = fields.to_vec();
+    fields.push(("sha256_digest".to_string(), hex::encode(Sha256::digest(&content))));
+
+    let boundary = format!("xe-upload-{}-{}", std::process::id(), profile_stamp());
+    let mut body = Vec::with_capacity(content.len() + 4096);
+    for (name, value) in &fields {
+        body.extend_from_slice(
+            format!(
+                "--{boundary}\r\nContent-Disposition: form-data; name=\"{name}\"\r\n\r\n{value}\r\n"
+            )
+            .as_bytes(),
+        );
+    }
+    body.extend_from_slice(
+        format!(
+            "--{boundary}\r\nContent-Disposition: form-data; name=\"content\"; filename=\"{file_name}\"\r\nContent-Type: application/octet-stream\r\n\r\n"
+        )
+        .as_bytes(),
+    );
+    body.extend_from_slice(&content);
+    body.extend_from_slice(format!("\r\n--{boundary}--\r\n").as_bytes());
+
+    let total = body.len() as u64;
+    let reader = UploadProgress {
+        inner: io::Cursor::new(body),
+        label: file_name.clone(),
+        sent: 0,
+        total,
+        last_percent: None,
+        show: io::stderr().is_terminal() && verbosity() >= 0,
+    };
+    info(&format!("Uploading {file_name} ({})", human_bytes(content.len() as u64)));
+    let resp = client
+        .post(url)
+        .timeout(Duration::from_secs(600))
+        .basic_auth("__token__", Some(token))
+        .header(
+            reqwest::header::CONTENT_TYPE,
+            format!("multipart/form-data; boundary={boundary}"),
+        )
+        .body(reqwest::blocking::Body::sized(reader, total))
+        .send()
+        .with_context(|| format!("failed to connect to {url}"))?;
+    let status = resp.status();
+    if status.is_success() {
+        return Ok(true);
+    }
+    let reason = status.canonical_reason().unwrap_or("");
+    let text = resp.text().unwrap_or_default();
+    let detail = text
+        .lines()
+        .map(str::trim)
+        .find(|l| !l.is_empty() && !l.starts_with('<'))
+        .unwrap_or(reason)
+        .to_string();
+    let exists = status == StatusCode::CONFLICT
+        || (status == StatusCode::BAD_REQUEST && detail.to_lowercase().contains("already exist"));
+    if exists && skip_existing {
+        return Ok(false);
+    }
+    let code = status.as_u16();
+    if status == StatusCode::FORBIDDEN || status == StatusCode::UNAUTHORIZED {
+        bail_kind!(
+            ErrorKind::Config,
+            "upload of {file_name} rejected ({code} {reason}): the token is invalid or cannot upload this project; run `xe auth login` with a token scoped to it ({detail})"
+        );
+    }
+    if exists {
+        bail_kind!(
+            ErrorKind::Config,
+            "upload of {file_name} rejected ({code} {reason}): file already exists; bump project.version or pass --skip-existing"
+        );
+    }
+    let kind = if status.is_server_error() {
+        ErrorKind::Network
+    } else {
+        ErrorKind::Config
+    };
+    bail_kind!(kind, "upload of {file_name} failed ({code} {reason}): {detail}")
+}
+
+fn human_bytes(bytes: u64) -> String {
+    const UNITS: [&str; 4] = ["B", "KiB", "MiB", "GiB"];
+    let mut value = bytes as f64;
+    let mut unit = 0;
+    while value >= 1024.0 && unit + 1 < UNITS.len() {
+        value /= 1024.0;
+        unit += 1;
+    }
+    if unit == 0 {
+        format!("{bytes} B")
+    } else {
+        format!("{value:.1} {}", UNITS[unit])
+    }
+}
+
+struct UploadProgress<R> {
+    inner: R,
+    label: String,
+    sent: u64,
+    total: u64,
+    last_percent: Option<u64>,
+    show: bool,
+}
+
+impl<R: Read> Read for UploadProgress<R> {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        let n = self.inner.read(buf)?;
+        self.sent += n as u64;
+        if self.show && self.total > 0 {
+            let percent = self.sent * 100 / self.total;
+            if self.last_percent != Some(percent) {
+                self.last_percent = Some(percent);
+                eprint!("\r  {} {:>3}%", self.label, percent);
+                if self.sent >= self.total {
+                    eprintln!();
+                }
+            }
+        }
+        Ok(n)
+    }
+}
+
+fn load_existing_project(project_dir: &Path) -> Result<Config> {
+    let toml_path = project_dir.join(XE_TOML);
+    if !toml_path.exists() {
+        bail!(
+            "no {} in {}; run `xe init` first",
+            XE_TOML,
+            project_dir.display()
+        );
+    }
+    load_project(&toml_path)
+}
+
+fn wheel_dist_name(name: &str) -> String {
+    let re = Regex::new(r"[-_.]+").unwrap();
+    re.replace_all(name.trim(), "_").to_string()
+}
+
+fn dist_artifacts(dist_dir: &Path, cfg: &Config) -> Result<Vec<PathBuf>> {
+    let prefix = format!(
+        "{}-{}",
+        wheel_dist_name(&cfg.project.name).to_lowercase(),
+        cfg.project.version.trim()
+    );
+    let mut out = Vec::new();
+    if !dist_dir.is_dir() {
+        return Ok(out);
+    }
+    for entry in fs::read_dir(dist_dir).with_context(|| format!("failed to read {}", dist_dir.display()))? {
+        let entry = entry?;
+        let name = entry.file_name().to_string_lossy().to_lowercase();
+        let is_dist = name.ends_with(".whl") || name.ends_with(".tar.gz");
+        if is_dist && (name.starts_with(&format!("{prefix}-")) || name == format!("{prefix}.tar.gz")) {
+            out.push(entry.path());
+        }
+    }
+    out.sort();
+    Ok(out)
+}
+
+fn build_wheel(project_dir: &Path, cfg: &Config, out_dir: &Path) -> Result<PathBuf> {
+    let meta = &cfg.project;
+    let version = meta.version.trim();
+    if version.is_empty() {
+        bail_kind!(ErrorKind::Config, "project.version is not set in xe.toml; add `version = \"0.1.0\"` under [project]");
+    }
+    let dist = wheel_dist_name(&meta.name);
+    let dist_info = format!("{dist}-{version}.dist-info");
+
+    let mut files = collect_package_files(project_dir, &python_package_name(&meta.name))?;
+    files.push((
+        format!("{dist_info}/METADATA"),
+        render_core_metadata(project_dir, cfg)?.into_bytes(),
+    ));
+    files.push((
+        format!("{dist_info}/WHEEL"),
+        format!(
+            "Wheel-Version: 1.0\nGenerator: xe {}\nRoot-Is-Purelib: true\nTag: py3-none-any\n",
+            XE_VERSION
+        )
+        .into_bytes(),
+    ));
+    if !meta.entry_points.is_empty() {
+        let mut text = "[console_scripts]\n".to_string();
+        for (name, target) in &meta.entry_points {
+            text.push_str(&format!("{name} = {}\n", target.trim()));
+        }
+        files.push((format!("{dist_info}/entry_points.txt"), text.into_bytes()));
+    }
+
+    let record_path = format!("{dist_info}/RECORD");
+    let mut record = String::new();
+    for (path, data) in &files {
+        let digest = Sha256::digest(data);
+        record.push_str(&format!(
+            "{},sha256={},{}\n",
+            path,
+            urlsafe_b64_nopad(&digest),
+            data.len()
+        ));
+    }
+    record.push_str(&format!("{record_path},,\n"));
+    files.push((record_path, record.into_bytes()));
+
+    fs::create_dir_all(out_dir).with_context(|| format!("failed to create {}", out_dir.display()))?;
+    let wheel_path = out_dir.join(format!("{dist}-{version}-py3-none-any.whl"));
+    let file = File::create(&wheel_path).with_context(|| format!("failed to create {}", wheel_path.display()))?;
+    let mut writer = ZipWriter::new(file);
+    let options = FileOptions::default().compression_method(zip::CompressionMethod::Deflated);
+    for (path, data) in &files {
+        writer
+            .start_file(path.clone(), options)
+            .with_context(|| format!("failed to add file {}", path))?;
+        writer
+            .write_all(data)
+            .with_context(|| format!("failed to write {}", path))?;
+    }
+    writer.finish().context("failed to finalize wheel")?;
+    Ok(wheel_path)
+}
+
+fn collect_package_files(project_dir: &Path, package: &str) -> Result<Vec<(String, Vec<u8>)>> {
+    let candidates = [
+        (project_dir.join("src"), project_dir.join("src").join(package)),
+        (project_dir.to_path_buf(), project_dir.join(package)),
+        (project_dir.join("src"), project_dir.join("src").join(format!("{package}.py"))),
+        (project_dir.to_path_buf(), project_dir.join(format!("{package}.py"))),
+    ];
+    let Some((root, source)) = candidates.iter().find(|(_, source)| source.exists()) else {
+        bail!(
+            "no package source found; expected src/{0}/, {0}/ or {0}.py in {1}",
+            package,
+            project_dir.display()
+        );
+    };
+    let mut files = Vec::new();
+    for entry in WalkDir::new(source) {
+        let entry = entry?;
+        if !entry.file_type().is_file() {
+            continue;
+        }
+        let path = entry.path();
+        let rel = path
+            .strip_prefix(root)
+            .with_context(|| format!("failed to strip prefix for {}", path.display()))?
+            .to_string_lossy()
+            .replace('\\', "/");
+        if rel.split('/').any(|part| part == "__pycache__") || rel.ends_with(".pyc") {
+            continue;
+        }
+        let data = fs::read(path).with_context(|| format!("failed to read {}", path.display()))?;
+        files.push((rel, data));
+    }
+    files.sort_by(|a, b| a.0.cmp(&b.0));
+    Ok(files)
+}
+
+fn render_core_metadata(project_dir: &Path, cfg: &Config) -> Result<String> {
+    let meta = &cfg.project;
+    let mut out = String::new();
+    out.push_str("Metadata-Version: 2.1\n");
+    out.push_str(&format!("Name: {}\n", meta.name.trim()));
+    out.push_str(&format!("Version: {}\n", meta.version.trim()));
+    if !meta.description.trim().is_empty() {
+        out.push_str(&format!("Summary: {}\n", meta.description.trim()));
+    }
+    let (with_email, names): (Vec<&String>, Vec<&String>) =
+        meta.authors.iter().partition(|a| a.contains('<') && a.contains('@'));
+    if !names.is_empty() {
+        let names = names.iter().map(|a| a.trim()).collect::<Vec<_>>();
+        out.push_str(&format!("Author: {}\n", names.join(", ")));
+    }
+    if !with_email.is_empty() {
+        let emails = with_email.iter().map(|a| a.trim()).collect::<Vec<_>>();
+        out.push_str(&format!("Author-email: {}\n", emails.join(", ")));
+    }
+    if !meta.license.trim().is_empty() {
+        out.push_str(&format!("License: {}\n", meta.license.trim()));
+    }
+    for classifier in &meta.classifiers {
+        out.push_str(&format!("Classifier: {}\n", classifier.trim()));
+    }
+    let mut deps = cfg.deps.iter().collect::<Vec<_>>();
+    deps.sort();
+    let members = if cfg.workspace_deps().is_empty() {
+        Vec::new()
+    } else {
+        workspace_links(project_dir, cfg)?
+    };
+    for (name, version) in deps {
+        if version == WORKSPACE_DEP {
+            // Published against the member's current version.
+            match members.iter().find(|m| normalize_dep_name(&m.config.project.name) == normalize_dep_name(name)) {
+                Some(member) => out.push_str(&format!("Requires-Dist: {name}>={}\n", member.config.project.version)),
+                None => out.push_str(&format!("Requires-Dist: {name}\n")),
+            }
+            continue;
+        }
+        if version.is_empty() || version == "*" {
+            out.push_str(&format!("Requires-Dist: {name}\n"));
+        } else {
+            out.push_str(&format!("Requires-Dist: {name}>={version}\n"));
+        }
+    }
+    if !meta.readme.trim().is_empty() {
+        let path = project_dir.join(meta.readme.trim());
+        let body = fs::read_to_string(&path)
+            .with_context(|| format!("failed to read project.readme {}", path.display()))?;
+        let lower = meta.readme.to_lowercase();
+        let content_type = if lower.ends_with(".md") {
+            "text/markdown"
+        } else if lower.ends_with(".rst") {
+            "text/x-rst"
+        } else {
+            "text/plain"
+        };
+        out.push_str(&format!("Description-Content-Type: {content_type}\n\n"));
+        out.push_str(&body);
+    }
+    Ok(out)
+}
+
+fn urlsafe_b64_nopad(data: &[u8]) -> String {
+    const ALPHABET: &[u8; 64] = b"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_";
+    let mut out = String::with_capacity(data.len().div_ceil(3) * 4);
+    for chunk in data.chunks(3) {
+        let b = [chunk[0], *chunk.get(1).unwrap_or(&0), *chunk.get(2).unwrap_or(&0)];
+        let n = (u32::from(b[0]) << 16) | (u32::from(b[1]) << 8) | u32::from(b[2]);
+        for i in 0..=chunk.len() {
+            out.push(ALPHABET[((n >> (18 - 6 * i)) & 0x3f) as usize] as char);
+        }
+    }
+    out
+}
+
+fn cmd_auth(ctx: &AppContext, args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe auth <login|revoke|list> [--repository <name>]";
+    if args.is_empty() {
+        bail!(USAGE);
+    }
+    let mut repository = "pypi".to_string();
+    let mut token = None;
+    let mut url = None;
+    let mut idx = 1usize;
+    while idx < args.len() {
+        let value = args.get(idx + 1).map(|v| v.trim().to_string());
+        match (args[idx].as_str(), value) {
+            ("-r" | "--repository", Some(v)) => repository = v,
+            ("--token", Some(v)) if args[0] == "login" => token = Some(v),
+            ("--url", Some(v)) if args[0] == "login" => url = Some(v),
+            _ => bail!(
+                "usage: xe auth login [--repository <name>] [--url <upload-url>] [--token <token>]"
+            ),
+        }
+        idx += 2;
+    }
+    let mut global = load_global_config(&ctx.config_file)?;
+    match args[0].as_str() {
+        "login" => {
+            if let Some(url) = url {
+                let key = repository.to_lowercase();
+                if key == "pypi" || key == "testpypi" {
+                    bail_kind!(ErrorKind::Usage, "{key} is built in; --url is only for private repositories");
+                }
+                if !url.starts_with("https://") && !url.starts_with("http://") {
+                    bail_kind!(ErrorKind::Usage, "--url must be an http(s) upload endpoint");
+                }
+                global.repositories.insert(key, url);
+                save_global_config(&ctx.config_file, &global)?;
+            }
+            let repo = upload_repository(&global, &repository)?;
+            let token = match token {
+                Some(token) => token,
+                None => prompt_line(
+                    &format!("{} Token", repo.display),
+                    "pass the token with --token <token>",
+                )?,
+            };
+            if token.is_empty() {
+                bail!("no token provided");
+            }
+            let store = save_token(&global, &repo.key, &token)?;
+            println!("{} token saved securely in {}", repo.display, store);
+            Ok(())
+        }
+        "revoke" => {
+            let repo = upload_repository(&global, &repository)?;
+            revoke_token(&global, &repo.key)?;
+            println!("{} token revoked successfully", repo.display);
+            Ok(())
+        }
+        "list" => {
+            let mut names = vec!["pypi".to_string(), "testpypi".to_string()];
+            names.extend(global.repositories.keys().cloned());
+            for name in names {
+                let repo = upload_repository(&global, &name)?;
+                let stored = load_token(&global, &repo.key)
+                    .map(|t| !t.trim().is_empty())
+                    .unwrap_or(false);
+                println!(
+                    "{:<12} {}  [{}]",
+                    name,
+                    repo.upload_url,
+                    if stored { "token stored" } else { "no token" }
+                );
+            }
+            Ok(())
+        }
+        _ => bail!(USAGE),
+    }
+}
+
+fn cmd_mirror(ctx: &AppContext, args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe mirror <add|list|remove|set-default|check|create>";
+    let Some(sub) = args.first() else {
+        bail!(USAGE);
+    };
+    let (project_scope, rest) = take_flag(&args[1..], "--project");
+    let project_path = env::current_dir().context("failed to get cwd")?.join(XE_TOML);
+    let mut global = load_global_config(&ctx.config_file)?;
+    let mut project = if project_path.is_file() {
+        Some(load_project(&project_path)?)
+    } else {
+        None
+    };
+    if project_scope && project.is_none() {
+        bail_kind!(ErrorKind::Config, "--project needs an xe.toml in the current directory");
+    }
+    let scope = if project_scope { "project" } else { "global" };
+
+    match sub.as_str() {
+        "add" => {
+            const ADD_USAGE: &str = "usage: xe mirror add [<name>] <url> [--priority <n>] [--credentials <env:VAR|auth:NAME>] [--packages <pattern,...>] [--default] [--project]";
+            let (default, rest) = take_flag(&rest, "--default");
+            let mut positional = Vec::new();
+            let mut index = IndexConfig {
+                default,
+                ..IndexConfig::default()
+            };
+            let mut idx = 0usize;
+            while idx < rest.len() {
+                match (rest[idx].as_str(), rest.get(idx + 1)) {
+                    ("--priority", Some(v)) => {
+                        index.priority = v.parse().map_err(|_| anyhow!("usage: --priority takes an integer"))?;
+                        idx += 2;
+                    }
+                    ("--credentials", Some(v)) => {
+                        index.credentials = v.clone();
+                        idx += 2;
+                    }
+                    ("--packages", Some(v)) => {
+                        index.packages.extend(
+                            v.split(',')
+                                .map(|p| normalize_dep_name(p))
+                                .filter(|p| !p.is_empty()),
+                        );
+                        idx += 2;
+                    }
+                    (flag, _) if flag.starts_with('-') => bail!(ADD_USAGE),
+                    (value, _) => {
+                        positional.push(value.to_string());
+                        idx += 1;
+                    }
+                }
+            }
+            match positional.as_slice() {
+                [url] => {
+                    index.name = index_name_from_url(url);
+                    index.url = url.clone();
+                }
+                [name, url] => {
+                    index.name = name.clone();
+                    index.url = url.clone();
+                }
+                _ => bail!(ADD_USAGE),
+            }
+            index.url = index.url.trim_end_matches('/').to_string();
+            if let Some(problem) = index_problem(&index) {
+                bail_kind!(ErrorKind::Usage, "{problem}");
+            }
+            let entries = match project.as_mut() {
+                Some(cfg) if project_scope => &mut cfg.index,
+                _ => &mut global.index,
+            };
+            if entries.iter().any(|i| i.name == index.name) {
+                bail_kind!(
+                    ErrorKind::Config,
+                    "index {} already exists; remove it first with `xe mirror remove {}`",
+                    index.name,
+                    index.name
+                );
+            }
+            if index.default {
+                entries.iter_mut().for_each(|i| i.default = false);
+            }
+            let name = index.name.clone();
+            let url = index.url.clone();
+            entries.push(index);
+            save_index_scope(ctx, &global, project.as_ref().filter(|_| project_scope), &project_path)?;
+            success(&format!("Added {scope} index {name} ({url})"));
+            Ok(())
+        }
+        "list" => {
+            let json = match rest.as_slice() {
+                [] => false,
+                [flag] if flag == "--json" => true,
+                _ => bail!("usage: xe mirror list [--json] [--project]"),
+            };
+            let indexes = configured_indexes(&global, project.as_ref());
+            if json {
+                println!("{}", serde_json::to_string_pretty(&indexes)?);
+                return Ok(());
+            }
+            let name_width = indexes.iter().map(|i| i.index.name.len()).max().unwrap_or(0).max("pypi".len());
+            println!("{:<name_width$}  {:>8}  {:<7}  URL", "Name", "Priority", "Scope");
+            for scoped in &indexes {
+                let index = &scoped.index;
+                let mut url = index.url.clone();
+                if index.default {
+                    url.push_str(" (default)");
+                }
+                if !index.credentials.is_empty() {
+                    url.push_str(&format!(" [credentials: {}]", index.credentials));
+                }
+                if !index.packages.is_empty() {
+                    url.push_str(&format!(" [only: {}]", index.packages.join(", ")));
+                }
+                println!("{:<name_width$}  {:>8}  {:<7}  {url}", index.name, index.priority, scoped.scope);
+            }
+            if !indexes.iter().any(|i| i.index.default) {
+                println!("{:<name_width$}  {:>8}  {:<7}  {PYPI_SIMPLE_URL} (default)", "pypi", "-", "builtin");
+            }
+            Ok(())
+        }
+        "remove" => {
+            let [name] = rest.as_slice() else {
+                bail!("usage: xe mirror remove <name> [--project]");
+            };
+            let entries = match project.as_mut() {
+                Some(cfg) if project_scope => &mut cfg.index,
+                _ => &mut global.index,
+            };
+            let before = entries.len();
+            entries.retain(|i| i.name != *name);
+            if entries.len() == before {
+                bail_kind!(ErrorKind::Config, "no {scope} index named {name}; see `xe mirror list`");
+            }
+            save_index_scope(ctx, &global, project.as_ref().filter(|_| project_scope), &project_path)?;
+            success(&format!("Removed {scope} index {name}"));
+            Ok(())
+        }
+        "set-default" => {
+            let [name] = rest.as_slice() else {
+                bail!("usage: xe mirror set-default <name|pypi> [--project]");
+            };
+            let entries = match project.as_mut() {
+                Some(cfg) if project_scope => &mut cfg.index,
+                _ => &mut global.index,
+            };
+            if name != "pypi" && !entries.iter().any(|i| i.name == *name) {
+                bail_kind!(ErrorKind::Config, "no {scope} index named {name}; see `xe mirror list`");
+            }
+            for index in entries.iter_mut() {
+                index.default = index.name == *name;
+            }
+            save_index_scope(ctx, &global, project.as_ref().filter(|_| project_scope), &project_path)?;
+            success(&format!("{name} is now the default {scope} index"));
+            Ok(())
+        }
+        "create" => {
+            const CREATE_USAGE: &str = "usage: xe mirror create <dir> [-r <requirements.txt>]... [<requirement>...]";
+            let Some((dir, rest)) = rest.split_first() else {
+                bail!(CREATE_USAGE);
+            };
+            let mut reqs = Vec::new();
+            let mut idx = 0usize;
+            while idx < rest.len() {
+                match (rest[idx].as_str(), rest.get(idx + 1)) {
+                    ("-r" | "--requirements", Some(file)) => {
+                        reqs.extend(parse_requirements(Path::new(file))?);
+                        idx += 2;
+                    }
+                    (flag, _) if flag.starts_with('-') => bail!(CREATE_USAGE),
+                    (req, _) => {
+                        reqs.push(req.to_string());
+                        idx += 1;
+                    }
+                }
+            }
+            create_mirror(ctx, Path::new(dir), reqs)
+        }
+        "check" => {
+            let (auto_tune, rest) = take_flag(&rest, "--auto-tune");
+            let (json, rest) = take_flag(&rest, "--json");
+            if !rest.is_empty() {
+                bail!("usage: xe mirror check [--auto-tune] [--json] [--project]");
+            }
+            let indexes = indexes_to_check(&global, project.as_ref());
+            if !json {
+                info(&format!("Checking {} index(es)...", indexes.len()));
+            }
+            let results = indexes.par_iter().map(|index| check_index(&global, index)).collect::<Vec<_>>();
+            if json {
+                println!("{}", serde_json::to_string_pretty(&results)?);
+            } else {
+                print_index_checks(&results);
+            }
+            if auto_tune {
+                let entries = match project.as_mut() {
+                    Some(cfg) if project_scope => &mut cfg.index,
+                    _ => &mut global.index,
+                };
+                let order = tuned_index_order(entries, &results);
+                if order.is_empty() {
+                    info(&format!("No {scope} indexes to reorder"));
+                    return Ok(());
+                }
+                for (rank, name) in order.iter().enumerate() {
+                    if let Some(index) = entries.iter_mut().find(|i| i.name == *name) {
+                        index.priority = (rank as i64 + 1) * 10;
+                    }
+                }
+                save_index_scope(ctx, &global, project.as_ref().filter(|_| project_scope), &project_path)?;
+                success(&format!("Reordered {scope} index priorities: {}", order.join(", ")));
+            }
+            if results.iter().any(|r| !r.available) {
+                warning("Some indexes are unavailable; resolution falls back past them.");
+            }
+            Ok(())
+        }
+        _ => bail!(USAGE),
+    }
+}
+
+// Downloads every artifact of the resolved requirements (the current project's when none
+// are given) into a PEP 503 layout: `<dir>/files/` plus `<dir>/simple/<name>/index.html`.
+// Files already in the mirror are kept, so repeated runs accumulate.
+fn create_mirror(ctx: &AppContext, dir: &Path, reqs: Vec<String>) -> Result<()> {
+    let wd = env::current_dir().context("failed to get cwd")?;
+    let toml_path = wd.join(XE_TOML);
+    let (mut cfg, reqs) = if reqs.is_empty() {
+        if !toml_path.is_file() {
+            bail_kind!(
+                ErrorKind::Config,
+                "no xe.toml in {}; pass requirements or -r <requirements.txt>",
+                wd.display()
+            );
+        }
+        let cfg = load_project(&toml_path)?;
+        let reqs = locked_requirements(&wd, &cfg, project_requirements(&wd, &cfg)?)?;
+        (cfg, reqs)
+    } else {
+        let cfg = if toml_path.is_file() {
+            load_project(&toml_path)?
+        } else {
+            Config::new_default(&wd)
+        };
+        (cfg, reqs)
+    };
+    let reqs = normalize_requirements(&reqs);
+    if reqs.is_empty() {
+        bail!("nothing to mirror: no requirements");
+    }
+    let installer = Installer::new(Path::new(&cfg.cache.global_dir))?;
+    let runtime = ensure_runtime_for_project(ctx, &wd, &mut cfg)?;
+    if runtime.config_changed && toml_path.is_file() {
+        save_project(&toml_path, &cfg)?;
+    }
+    let (graph, indexes) = installer.resolve(ctx, &cfg, &reqs, &wd, &runtime.selection.python_exe)?;
+
+    let files_dir = dir.join("files");
+    fs::create_dir_all(&files_dir).with_context(|| format!("failed to create {}", files_dir.display()))?;
+    info(&format!("Mirroring {} artifact(s) into {}...", graph.packages.len(), dir.display()));
+    graph.packages.par_iter().try_for_each(|pkg| -> Result<()> {
+        if pkg.download_url.trim().is_empty() {
+            warning(&format!("{} {} has no download URL; skipped", pkg.name, pkg.version));
+            return Ok(());
+        }
+        let file_name = artifact_file_name(&pkg.download_url);
+        let target = files_dir.join(&file_name);
+        if target.is_file() {
+            return Ok(());
+        }
+        let blob = installer.cas.store_package(pkg, indexes.auth_for(&pkg.download_url))?;
+        fs::copy(&blob, &target).with_context(|| format!("failed to write {}", target.display()))?;
+        debug(&format!("Mirrored {file_name}"));
+        Ok(())
+    })?;
+
+    let projects = write_simple_index(dir)?;
+    let root = fs::canonicalize(dir).unwrap_or_else(|_| dir.to_path_buf());
+    success(&format!("Mirror at {} now serves {projects} project(s)", root.display()));
+    info(&format!(
+        "Use it with `xe mirror add offline file://{}/simple --default`",
+        root.display()
+    ));
+    Ok(())
+}
+
+// `xe warm` fills the CAS with every artifact the given projects resolve to, so a later
+// `xe sync` in any of them needs no network. Each argument is a project directory, an
+// xe.toml, or a requirements file; with none, the current project is warmed.
+fn cmd_warm(ctx: &AppContext, args: &[String]) -> Result<()> {
+    if args.iter().any(|a| a.starts_with('-')) {
+        bail_kind!(ErrorKind::Usage, "usage: xe warm [<dir|xe.toml|xe.lock|requirements.txt>...]");
+    }
+    let wd = env::current_dir().context("failed to get cwd")?;
+    let names = if args.is_empty() { vec![".".to_string()] } else { args.to_vec() };
+    let targets = names
+        .iter()
+        .map(|name| warm_target(&wd.join(name)))
+        .collect::<Result<Vec<_>>>()?;
+    let pm = PythonManager::new()?;
+    let _interrupts = catch_interrupts();
+    let (mut fetched, mut cached, mut bytes) = (0usize, 0usize, 0u64);
+    for (name, (dir, cfg, reqs, locked)) in names.iter().zip(targets) {
+        check_interrupted()?;
+        let reqs = normalize_requirements(&reqs);
+        if reqs.is_empty() && locked.as_ref().is_none_or(Vec::is_empty) {
+            info(&format!("{name}: no requirements"));
+            continue;
+        }
+        let installer = Installer::new(Path::new(&cfg.cache.global_dir))?;
+        let (packages, indexes) = match locked {
+            Some(packages) => (packages, IndexPlan::load(ctx, &cfg)?),
+            None => {
+                // Resolution only needs the interpreter for markers and tags, so no venv is
+                // created and the project's xe.toml is left untouched.
+                let python_exe = pm.ensure(&cfg.python.version, ctx)?;
+                let (graph, indexes) = installer.resolve(ctx, &cfg, &reqs, &dir, &python_exe)?;
+                (graph.packages, indexes)
+            }
+        };
+        let pending = packages
+            .iter()
+            .filter(|pkg| !pkg.download_url.trim().is_empty())
+            .filter(|pkg| {
+                !pkg.hash_algorithm.is_digest(&pkg.hash)
+                    || installer.cas.cached_blob(pkg.hash_algorithm, &pkg.hash).is_none()
+            })
+            .collect::<Vec<_>>();
+        cached += packages.len() - pending.len();
+        info(&format!(
+            "{name}: {} artifact(s), {} to download",
+            packages.len(),
+            pending.len()
+        ));
+        let pool = rayon::ThreadPoolBuilder::new()
+            .num_threads(http_concurrency(ctx).min(pending.len().max(1)))
+            .build()
+            .context("failed to start download pool")?;
+        let sizes = pool.install(|| {
+            pending
+                .par_iter()
+                .map(|pkg| -> Result<u64> {
+                    check_interrupted()?;
+                    let blob = installer
+                        .cas
+                        .store_package(pkg, indexes.auth_for(&pkg.download_url))
+                        .with_context(|| format!("failed to fetch {} {}", pkg.name, pkg.version))?;
+                    debug(&format!("Cached {} {}", pkg.name, pkg.version));
+                    Ok(fs::metadata(&blob).map(|m| m.len()).unwrap_or(0))
+                })
+                .collect::<Result<Vec<_>>>()
+        })?;
+        fetched += sizes.len();
+        bytes += sizes.iter().sum::<u64>();
+    }
+    success(&format!(
+        "Cache warm: downloaded {fetched} artifact(s) ({}), {cached} already cached",
+        human_bytes(bytes)
+    ));
+    Ok(())
+}
+
+// The project directory, config and requirements behind one `xe warm` argument. An
+// xe.lock also yields its packages, which are fetched as locked without resolving.
+fn warm_target(target: &Path) -> Result<(PathBuf, Config, Vec<String>, Option<Vec<Package>>)> {
+    let toml_path = if target.is_dir() {
+        target.join(XE_TOML)
+    } else {
+        target.to_path_buf()
+    };
+    if !toml_path.is_file() {
+        bail_kind!(ErrorKind::Config, "{} not found", toml_path.display());
+    }
+    let dir = toml_path.parent().map(Path::to_path_buf).unwrap_or_default();
+    if toml_path.extension().is_some_and(|ext| ext == "toml") {
+        let cfg = load_project(&toml_path)?;
+        let reqs = locked_requirements(&dir, &cfg, project_requirements(&dir, &cfg)?)?;
+        return Ok((dir, cfg, reqs, None));
+    }
+    let cfg = if dir.join(XE_TOML).is_file() {
+        load_project(&dir.join(XE_TOML))?
+    } else {
+        Config::new_default(&dir)
+    };
+    if toml_path.file_name().is_some_and(|file| file == XE_LOCK) {
+        let text = fs::read_to_string(&toml_path).with_context(|| format!("failed to read {}", toml_path.display()))?;
+        let lock: LockFile = toml::from_str(&text)
+            .map_err(|err| kind_error(ErrorKind::Config, format!("invalid {}: {err}", toml_path.display())))?;
+        return Ok((dir, cfg, lock.requirements, Some(lock.packages)));
+    }
+    Ok((dir, cfg, parse_requirements(&toml_path)?, None))
+}
+
+fn artifact_file_name(url: &str) -> String {
+    let path = url.split(['#', '?']).next().unwrap_or(url);
+    path.rsplit('/').next().unwrap_or(path).to_string()
+}
+
+// Project name of a wheel (`name-version-tags.whl`) or sdist (`name-version.tar.gz`).
+fn artifact_project_name(file_name: &str) -> Option<String> {
+    let name = if let Some(stem) = file_name.strip_suffix(".whl") {
+        stem.split('-').next()?
+    } else {
+        let stem = [".tar.gz", ".zip", ".tar.bz2"]
+            .iter()
+            .find_map(|ext| file_name.strip_suffix(ext))?;
+        stem.rsplit_once('-')?.0
+    };
+    Some(normalize_dep_name(name))
+}
+
+// Regenerates the simple index pages from the files in `<dir>/files`; returns the number
+// of projects.
+fn write_simple_index(dir: &Path) -> Result<usize> {
+    let mut projects: BTreeMap<String, Vec<(String, String)>> = BTreeMap::new();
+    for entry in fs::read_dir(dir.join("files")).with_context(|| format!("failed to read {}", dir.display()))? {
+        let path = entry?.path();
+        let file_name = path.file_name().unwrap_or_default().to_string_lossy().to_string();
+        let Some(project) = artifact_project_name(&file_name) else {
+            continue;
+        };
+        let data = fs::read(&path).with_context(|| format!("failed to read {}", path.display()))?;
+        let hash = hex::encode(Sha256::digest(&data));
+        projects.entry(project).or_default().push((file_name, hash));
+    }
+    let simple = dir.join("simple");
+    fs::create_dir_all(&simple).with_context(|| format!("failed to create {}", simple.display()))?;
+    let mut root = String::from("<!DOCTYPE html>\n<html><body>\n");
+    for (project, files) in &mut projects {
+        files.sort();
+        root.push_str(&format!("<a href=\"{project}/\">{project}</a>\n"));
+        let mut page = format!("<!DOCTYPE html>\n<html><body>\n<h1>Links for {project}</h1>\n");
+        for (file_name, hash) in files.iter() {
+            page.push_str(&format!(
+                "<a href=\"../../files/{file_name}#sha256={hash}\">{file_name}</a>\n"
+            ));
+        }
+        page.push_str("</body></html>\n");
+        let project_dir = simple.join(project);
+        fs::create_dir_all(&project_dir).with_context(|| format!("failed to create {}", project_dir.display()))?;
+        write_file_atomic(&project_dir.join("index.html"), page.as_bytes())?;
+    }
+    root.push_str("</body></html>\n");
+    write_file_atomic(&simple.join("index.html"), root.as_bytes())?;
+    Ok(projects.len())
+}
+
+#[derive(Debug, Serialize)]
+struct IndexCheck {
+    name: String,
+    url: String,
+    scope: &'static str,
+    available: bool,
+    index_ms: Option<u64>,
+    file_ms: Option<u64>,
+    detail: String,
+}
+
+// Fetches a sample project page from the index and HEADs the first file it links to.
+fn check_index(global: &GlobalConfig, scoped: &ScopedIndex) -> IndexCheck {
+    let index = &scoped.index;
+    let mut check = IndexCheck {
+        name: index.name.clone(),
+        url: index.url.clone(),
+        scope: scoped.scope,
+        available: false,
+        index_ms: None,
+        file_ms: None,
+        detail: String::new(),
+    };
+    let auth = match index_auth(global, index) {
+        Ok(auth) => auth,
+        Err(err) => {
+            check.detail = format!("{err:#}");
+            return check;
+        }
+    };
+    // A restricted index is probed with a name it serves when one is literal.
+    let sample = index
+        .packages
+        .iter()
+        .find(|p| !p.contains(['*', '?']))
+        .cloned()
+        .unwrap_or_else(|| "pip".to_string());
+    let base = index.url.trim_end_matches('/');
+    if let Some(root) = base.strip_prefix("file://") {
+        let started = Instant::now();
+        let page = Path::new(root).join(&sample).join("index.html");
+        check.available = Path::new(root).is_dir();
+        check.index_ms = Some(started.elapsed().as_millis() as u64);
+        check.detail = if page.is_file() {
+            "ok".to_string()
+        } else if check.available {
+            format!("no {sample} page")
+        } else {
+            format!("{root} not found")
+        };
+        return check;
+    }
+    let Ok(client) = http_client() else {
+        check.detail = "failed to build HTTP client".to_string();
+        return check;
+    };
+    let with_auth = |request: reqwest::blocking::RequestBuilder| {
+        let request = request.timeout(Duration::from_secs(10));
+        match &auth {
+            Some(auth) => request.basic_auth(&auth.username, Some(&auth.password)),
+            None => request,
+        }
+    };
+    let page_url = format!("{base}/{sample}/");
+    let started = Instant::now();
+    let page = match with_auth(client.get(&page_url)).send() {
+        Ok(resp) => resp,
+        Err(err) => {
+            check.detail = if err.is_timeout() { "timed out".to_string() } else { "unreachable".to_string() };
+            return check;
+        }
+    };
+    let status = page.status();
+    let body = page.text().unwrap_or_default();
+    check.index_ms = Some(started.elapsed().as_millis() as u64);
+    if status.is_server_error() || status == StatusCode::UNAUTHORIZED || status == StatusCode::FORBIDDEN {
+        check.detail = format!("index returned {status}");
+        return check;
+    }
+    check.available = true;
+    if !status.is_success() {
+        check.detail = format!("no {sample} page ({status})");
+        return check;
+    }
+    let file = Regex::new(r#"href="([^"]+)""#)
+        .ok()
+        .and_then(|re| re.captures(&body).map(|c| c[1].to_string()))
+        .and_then(|href| reqwest::Url::parse(&page_url).ok()?.join(&href).ok());
+    let Some(mut file) = file else {
+        check.detail = format!("{sample} page lists no files");
+        return check;
+    };
+    file.set_fragment(None);
+    let started = Instant::now();
+    match with_auth(client.head(file.as_str())).send() {
+        Ok(resp) if resp.status().is_success() => {
+            check.file_ms = Some(started.elapsed().as_millis() as u64);
+            check.detail = "ok".to_string();
+        }
+        Ok(resp) => check.detail = format!("file returned {}", resp.status()),
+        Err(_) => check.detail = "file host unreachable".to_string(),
+    }
+    check
+}
+
+fn print_index_checks(results: &[IndexCheck]) {
+    let ms = |value: Option<u64>| value.map(|v| format!("{v} ms")).unwrap_or_else(|| "-".to_string());
+    let name_width = results.iter().map(|r| r.name.len()).max().unwrap_or(0).max("Name".len());
+    println!("{:<name_width$}  {:<7}  {:<6}  {:>9}  {:>9}  Detail", "Name", "Scope", "Status", "Index", "File");
+    for result in results {
+        println!(
+            "{:<name_width$}  {:<7}  {:<6}  {:>9}  {:>9}  {}",
+            result.name,
+            result.scope,
+            if result.available { "up" } else { "down" },
+            ms(result.index_ms),
+            ms(result.file_ms),
+            result.detail
+        );
+    }
+}
+
+// Names of the unrestricted `entries` ordered fastest first, with unavailable ones last.
+// Restricted indexes keep their priority since they are not interchangeable.
+fn tuned_index_order(entries: &[IndexConfig], results: &[IndexCheck]) -> Vec<String> {
+    let mut ranked = entries
+        .iter()
+        .filter(|i| i.packages.is_empty())
+        .map(|i| {
+            let result = results.iter().find(|r| r.name == i.name);
+            let latency = result
+                .filter(|r| r.available)
+                .and_then(|r| r.index_ms)
+                .unwrap_or(u64::MAX);
+            (latency, i.priority, i.name.clone())
+        })
+        .collect::<Vec<_>>();
+    ranked.sort();
+    ranked.into_iter().map(|(_, _, name)| name).collect()
+}
+
+fn save_index_scope(
+    ctx: &AppContext,
+    global: &GlobalConfig,
+    project: Option<&Config>,
+    project_path: &Path,
+) -> Result<()> {
+    match project {
+        Some(cfg) => save_project(project_path, cfg),
+        None => save_global_config(&ctx.config_file, global),
+    }
+}
+
+fn cmd_plugin(args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe plugin <list|install|remove|update>";
+    let Some(sub) = args.first() else {
+        bail!(USAGE);
+    };
+    let rest = &args[1..];
+    match sub.as_str() {
+        "list" => {
+            if !rest.is_empty() {
+                bail!("usage: xe plugin list");
+            }
+            println!("Plugins directory: {}", xe_plugin_dir().display());
+            let plugins = discover_plugins();
+            if plugins.is_empty() {
+                println!("No plugins installed.");
+                return Ok(());
+            }
+            let width = plugins.iter().map(|p| p.name.len()).max().unwrap_or(0);
+            let version_width = plugins
+                .iter()
+                .map(|p| p.version.as_deref().unwrap_or("-").len())
+                .max()
+                .unwrap_or(0);
+            for plugin in &plugins {
+                println!(
+                    "  {:<width$}  {:<version_width$}  {}  ({})",
+                    plugin.name,
+                    plugin.version.as_deref().unwrap_or("-"),
+                    plugin.path.display(),
+                    plugin.source
+                );
+            }
+            Ok(())
+        }
+        "install" => {
+            let (force, rest) = take_flag(rest, "--force");
+            let [source] = rest.as_slice() else {
+                bail!("usage: xe plugin install <git-url|archive-url|path> [--force]");
+            };
+            let manifest = install_plugin(source, force)?;
+            success(&format!("Installed plugin {} {}", manifest.name, manifest.version));
+            info(&format!("Run it with `xe {}`", manifest.name));
+            Ok(())
+        }
+        "remove" | "uninstall" => {
+            let [name] = rest else {
+                bail!("usage: xe plugin remove <name>");
+            };
+            let dir = installed_plugin_dir(name)?;
+            fs::remove_dir_all(&dir).with_context(|| format!("failed to remove {}", dir.display()))?;
+            success(&format!("Removed plugin {name}"));
+            Ok(())
+        }
+        "update" => {
+            let names = if rest.is_empty() {
+                installed_plugins().into_iter().map(|m| m.name).collect::<Vec<_>>()
+            } else {
+                rest.to_vec()
+            };
+            if names.is_empty() {
+                info("No installed plugins to update.");
+                return Ok(());
+            }
+            let mut failed = 0usize;
+            for name in &names {
+                let Some(current) = installed_plugin_dir(name).ok().and_then(|dir| read_plugin_manifest(&dir)) else {
+                    error(&format!("plugin {name} is not installed"));
+                    failed += 1;
+                    continue;
+                };
+                if current.source.is_empty() {
+                    warning(&format!("{name} has no recorded source; reinstall it with `xe plugin install`"));
+                    continue;
+                }
+                match install_plugin(&current.source, true) {
+                    Ok(updated) if updated.version == current.version => {
+                        info(&format!("{name} is up to date ({})", current.version))
+                    }
+                    Ok(updated) => success(&format!("Updated {name} {} -> {}", current.version, updated.version)),
+                    Err(err) => {
+                        error(&format!("{name}: {err:#}"));
+                        failed += 1;
+                    }
+                }
+            }
+            if failed > 0 {
+                bail!("{failed} plugin(s) failed to update");
+            }
+            Ok(())
+        }
+        _ => bail!(USAGE),
+    }
+}
+
+const PLUGIN_MANIFEST: &str = "xe-plugin.toml";
+
+// xe-plugin.toml at the root of a plugin. `entry` is the executable relative to that
+// root. xe records `source` and `installed_at` when installing, for `xe plugin update`.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct PluginManifest {
+    name: String,
+    version: String,
+    entry: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    description: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    source: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    installed_at: String,
+    // Lifecycle hooks the plugin adds to every project, like xe.toml's [hooks].
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    hooks: BTreeMap<String, HookCommands>,
+}
+
+fn read_plugin_manifest(dir: &Path) -> Option<PluginManifest> {
+    let text = fs::read_to_string(dir.join(PLUGIN_MANIFEST)).ok()?;
+    toml::from_str(&text).ok()
+}
+
+fn installed_plugins() -> Vec<PluginManifest> {
+    let mut out = fs::read_dir(xe_plugin_dir())
+        .into_iter()
+        .flatten()
+        .flatten()
+        .filter_map(|entry| read_plugin_manifest(&entry.path()))
+        .collect::<Vec<_>>();
+    out.sort_by(|a, b| a.name.cmp(&b.name));
+    out
+}
+
+fn valid_plugin_name(name: &str) -> bool {
+    !name.is_empty() && name.chars().all(|c| c.is_ascii_alphanumeric() || c == '-' || c == '_')
+}
+
+// The directory of the installed plugin `name`, which must resolve to a direct child of
+// the plugin directory, so a crafted name or a symlink cannot point removal elsewhere.
+fn installed_plugin_dir(name: &str) -> Result<PathBuf> {
+    if !valid_plugin_name(name) {
+        bail_kind!(ErrorKind::Usage, "invalid plugin name \"{name}\"");
+    }
+    let dir = xe_plugin_dir().join(name);
+    let not_installed = || kind_error(ErrorKind::Config, format!("plugin {name} is not installed; see `xe plugin list`"));
+    let base = fs::canonicalize(xe_plugin_dir()).map_err(|_| not_installed())?;
+    let resolved = fs::canonicalize(&dir).map_err(|_| not_installed())?;
+    if resolved.parent() != Some(base.as_path()) || !resolved.join(PLUGIN_MANIFEST).is_file() {
+        return Err(not_installed());
+    }
+    Ok(resolved)
+}
+
+// Fetches `source` (a local file or directory, a .zip/.tar.gz URL, or a git URL) and
+// installs it into the plugin directory, replacing an existing install when `force`.
+fn install_plugin(source: &str, force: bool) -> Result<PluginManifest> {
+    let staging = tempfile_path("xe-plugin", "d");
+    let result = (|| {
+        fs::create_dir_all(&staging).with_context(|| format!("failed to create {}", staging.display()))?;
+        let local = Path::new(source);
+        let recorded_source = if local.exists() {
+            let local = fs::canonicalize(local).unwrap_or_else(|_| local.to_path_buf());
+            if local.is_dir() {
+                copy_plugin_tree(&local, &staging)?;
+            } else {
+                let file_name = local.file_name().unwrap_or_default();
+                fs::copy(&local, staging.join(file_name))
+                    .with_context(|| format!("failed to copy {}", local.display()))?;
+            }
+            local.display().to_string()
+        } else if [".zip", ".tar.gz", ".tgz"].iter().any(|ext| source.ends_with(ext)) {
+            let ext = if source.ends_with(".zip") { "zip" } else { "tar.gz" };
+            let archive = download_file(source, "xe-plugin", ext)?;
+            let extracted = if ext == "zip" {
+                extract_zip_to_dir(&archive, &staging)
+            } else {
+                let status = Command::new("tar")
+                    .arg("-xzf")
+                    .arg(&archive)
+                    .arg("-C")
+                    .arg(&staging)
+                    .status()
+                    .context("failed to run tar")?;
+                if status.success() {
+                    Ok(())
+                } else {
+                    Err(anyhow!("tar failed to extract {source}: {status}"))
+                }
+            };
+            let _ = fs::remove_file(&archive);
+            extracted?;
+            source.to_string()
+        } else if ["https://", "http://", "ssh://", "git@", "git+", "file://"]
+            .iter()
+            .any(|prefix| source.starts_with(prefix))
+        {
+            let url = source.strip_prefix("git+").unwrap_or(source);
+            let status = Command::new("git")
+                .args(["clone", "--quiet", "--depth", "1", url])
+                .arg(&staging)
+                .status()
+                .context("failed to run git")?;
+            if !status.success() {
+                bail_kind!(ErrorKind::Network, "git clone {url} failed: {status}");
+            }
+            let _ = fs::remove_dir_all(staging.join(".git"));
+            source.to_string()
+        } else {
+            bail_kind!(
+                ErrorKind::Usage,
+                "{source} is not a path, a .zip/.tar.gz URL or a git URL"
+            );
+        };
+        let root = plugin_root(&staging);
+        let mut manifest = match read_plugin_manifest(&root) {
+            Some(manifest) => manifest,
+            None if root.join(PLUGIN_MANIFEST).is_file() => {
+                bail_kind!(ErrorKind::Config, "invalid {PLUGIN_MANIFEST} in {source}")
+            }
+            None => single_executable_manifest(&root).ok_or_else(|| {
+                kind_error(
+                    ErrorKind::Config,
+                    format!("{source} has no {PLUGIN_MANIFEST} and is not a single xe-<name> executable"),
+                )
+            })?,
+        };
+        if !valid_plugin_name(&manifest.name) {
+            bail_kind!(ErrorKind::Config, "invalid plugin name \"{}\"", manifest.name);
+        }
+        // The entry is made executable below, so it must be a regular file reached
+        // through plain directories of the plugin: no `..`, no backslashes, and no
+        // symlinks along the way that would point the chmod somewhere else.
+        let entry = Path::new(&manifest.entry);
+        let mut walked = root.clone();
+        let entry_ok = !manifest.entry.is_empty()
+            && !manifest.entry.contains('\\')
+            && entry.components().all(|c| {
+                let std::path::Component::Normal(part) = c else {
+                    return false;
+                };
+                walked.push(part);
+                fs::symlink_metadata(&walked).is_ok_and(|meta| !meta.file_type().is_symlink())
+            })
+            && fs::symlink_metadata(&walked).is_ok_and(|meta| meta.is_file());
+        if !entry_ok {
+            bail_kind!(
+                ErrorKind::Config,
+                "plugin {}: entry \"{}\" is not a file inside the plugin",
+                manifest.name,
+                manifest.entry
+            );
+        }
+
+        let target = xe_plugin_dir().join(&manifest.name);
+        if target.exists() && !force {
+            bail_kind!(
+                ErrorKind::Config,
+                "plugin {} is already installed; use `xe plugin update {}` or --force",
+                manifest.name,
+                manifest.name
+            );
+        }
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            let entry_path = root.join(entry);
+            let mut perms = fs::metadata(&entry_path)?.permissions();
+            perms.set_mode(perms.mode() | 0o755);
+            fs::set_permissions(&entry_path, perms)?;
+        }
+        manifest.source = recorded_source;
+        manifest.installed_at = timestamp_iso8601();
+        let text = toml::to_string_pretty(&manifest).context("failed to encode plugin manifest")?;
+        write_file_atomic(&root.join(PLUGIN_MANIFEST), text.as_bytes())?;
+
+        fs::create_dir_all(xe_plugin_dir())
+            .with_context(|| format!("failed to create {}", xe_plugin_dir().display()))?;
+        if target.exists() {
+            fs::remove_dir_all(&target).with_context(|| format!("failed to remove {}", target.display()))?;
+        }
+        if fs::rename(&root, &target).is_err() {
+            copy_plugin_tree(&root, &target)?;
+        }
+        Ok(manifest)
+    })();
+    let _ = fs::remove_dir_all(&staging);
+    result
+}
+
+// The directory holding the manifest: the top level, or the single directory archives
+// from code hosts usually wrap everything in.
+fn plugin_root(staging: &Path) -> PathBuf {
+    if staging.join(PLUGIN_MANIFEST).is_file() {
+        return staging.to_path_buf();
+    }
+    let entries = fs::read_dir(staging).into_iter().flatten().flatten().collect::<Vec<_>>();
+    match entries.as_slice() {
+        [only] if only.path().is_dir() => only.path(),
+        _ => staging.to_path_buf(),
+    }
+}
+
+// A plugin that is just an `xe-<name>` executable gets a manifest with version 0.0.0.
+fn single_executable_manifest(root: &Path) -> Option<PluginManifest> {
+    let entries = fs::read_dir(root).ok()?.flatten().collect::<Vec<_>>();
+    let [only] = entries.as_slice() else {
+        return None;
+    };
+    let file_name = only.file_name().to_string_lossy().to_string();
+    let name = plugin_name(&file_name)?;
+    Some(PluginManifest {
+        name,
+        version: "0.0.0".to_string(),
+        entry: file_name,
+        description: String::new(),
+        source: String::new(),
+        installed_at: String::new(),
+        hooks: BTreeMap::new(),
+    })
+}
+
+fn copy_plugin_tree(from: &Path, to: &Path) -> Result<()> {
+    for entry in WalkDir::new(from).into_iter().filter_entry(|e| e.file_name() != ".git") {
+        let entry = entry?;
+        let relative = entry.path().strip_prefix(from).unwrap_or(entry.path());
+        let target = to.join(relative);
+        if entry.file_type().is_dir() {
+            fs::create_dir_all(&target).with_context(|| format!("failed to create {}", target.display()))?;
+        } else {
+            fs::copy(entry.path(), &target).with_context(|| format!("failed to copy {}", entry.path().display()))?;
+        }
+    }
+    Ok(())
+}
+
+// An executable named `xe-<name>`, run as `xe <name>`.
+struct PluginCommand {
+    name: String,
+    path: PathBuf,
+    source: &'static str,
+    version: Option<String>,
+}
+
+// Installed plugins, then loose executables in the plugin directory, then PATH. The first
+// plugin found for a name wins, and built-in commands always take precedence over plugins.
+fn discover_plugins() -> Vec<PluginCommand> {
+    let mut plugins = installed_plugins()
+        .into_iter()
+        .map(|manifest| PluginCommand {
+            path: xe_plugin_dir().join(&manifest.name).join(&manifest.entry),
+            name: manifest.name,
+            source: "installed",
+            version: Some(manifest.version),
+        })
+        .collect::<Vec<_>>();
+    let mut dirs = vec![(xe_plugin_dir(), "plugin dir")];
+    if let Some(path) = env::var_os("PATH") {
+        dirs.extend(env::split_paths(&path).map(|dir| (dir, "PATH")));
+    }
+    for (dir, source) in dirs {
+        let Ok(entries) = fs::read_dir(&dir) else {
+            continue;
+        };
+        let mut found = entries
+            .flatten()
+            .filter_map(|entry| {
+                let file_name = entry.file_name().to_string_lossy().to_string();
+                let name = plugin_name(&file_name)?;
+                is_executable(&entry.path()).then(|| (name, entry.path()))
+            })
+            .collect::<Vec<_>>();
+        found.sort();
+        for (name, path) in found {
+            if !plugins.iter().any(|p| p.name == name) {
+                plugins.push(PluginCommand {
+                    name,
+                    path,
+                    source,
+                    version: None,
+                });
+            }
+        }
+    }
+    plugins.sort_by(|a, b| a.name.cmp(&b.name));
+    plugins
+}
+
+fn find_plugin(name: &str) -> Option<PluginCommand> {
+    if name.starts_with('-') {
+        return None;
+    }
+    discover_plugins().into_iter().find(|p| p.name == name)
+}
+
+// "xe-foo" (or "xe-foo.exe" on Windows) -> "foo".
+fn plugin_name(file_name: &str) -> Option<String> {
+    let mut name = file_name.strip_prefix("xe-")?;
+    if cfg!(windows) {
+        let lower = name.to_lowercase();
+        let ext = [".exe", ".cmd", ".bat"].iter().find(|ext| lower.ends_with(*ext))?;
+        name = &name[..name.len() - ext.len()];
+    }
+    (!name.is_empty()).then(|| name.to_string())
+}
+
+fn is_executable(path: &Path) -> bool {
+    let Ok(meta) = fs::metadata(path) else {
+        return false;
+    };
+    if !meta.is_file() {
+        return false;
+    }
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        meta.permissions().mode() & 0o111 != 0
+    }
+    #[cfg(not(unix))]
+    {
+        true
+    }
+}
+
+// Runs a plugin with inherited stdio. Inside a project it also gets XE_PROJECT_DIR,
+// XE_PYTHON_EXE and XE_SITE_PACKAGES for the project's runtime.
+fn run_plugin(ctx: &AppContext, plugin: &PluginCommand, args: &[String]) -> Result<()> {
+    let mut command = Command::new(&plugin.path);
+    command.args(args);
+    if let Ok(exe) = env::current_exe() {
+        command.env("XE_EXE", exe);
+    }
+    let wd = env::current_dir().context("failed to get cwd")?;
+    let toml_path = wd.join(XE_TOML);
+    if toml_path.is_file() {
+        command.env("XE_PROJECT_DIR", &wd);
+        let runtime = load_project(&toml_path).and_then(|mut cfg| ensure_runtime_for_project(ctx, &wd, &mut cfg));
+        match runtime {
+            Ok(runtime) => {
+                command.env("XE_PYTHON_EXE", &runtime.selection.python_exe);
+                command.env("XE_SITE_PACKAGES", &runtime.selection.site_packages);
+            }
+            Err(err) => debug(&format!("no project runtime for plugin {}: {err:#}", plugin.name)),
+        }
+    }
+    debug(&format!("Running plugin {}", plugin.path.display()));
+    let status = command
+        .status()
+        .with_context(|| format!("failed to run plugin {}", plugin.path.display()))?;
+    if let Some(code) = status.code() {
+        if code != 0 {
+            std::process::exit(code);
+        }
+    }
+    Ok(())
+}
+
+fn cmd_self(args: &[String]) -> Result<()> {
+    if args.len() == 1 && args[0] == "update" {
+        info("Checking for updates...");
+        let (latest, url) = latest_release()?;
+        if compare_version(&latest, XE_VERSION) == Ordering::Greater {
+            success(&format!("xe v{latest} is available (installed v{XE_VERSION})"));
+            info(&format!("Download it from {url}"));
+        } else {
+            success(&format!("xe is already up to date (v{XE_VERSION})"));
+        }
+        return Ok(());
+    }
+    bail!("usage: xe self update")
+}
+
+const XE_RELEASES_API: &str = "https://api.github.com/repos/aaravmaloo/xe/releases/latest";
+
+// Version (without the leading `v` of the tag) and page URL of the newest xe release.
+fn latest_release() -> Result<(String, String)> {
+    let resp = http_client()?
+        .get(XE_RELEASES_API)
+        .timeout(Duration::from_secs(20))
+        .header("Accept", "application/vnd.github+json")
+        .send()
+        .context("failed to check for xe releases")?;
+    if !resp.status().is_success() {
+        bail_kind!(ErrorKind::Network, "failed to check for xe releases: {}", resp.status());
+    }
+    let release: Value = resp.json().context("failed to decode xe release response")?;
+    let Some(tag) = release["tag_name"].as_str() else {
+        bail_kind!(ErrorKind::Network, "xe release response has no tag_name");
+    };
+    let url = release["html_url"].as_str().unwrap_or("https://github.com/aaravmaloo/xe/releases");
+    Ok((tag.trim_start_matches('v').to_string(), url.to_string()))
+}
+
+// Results of the background update check in xe home: the newest xe release and, per
+// project, the direct dependencies pinned below their latest version. Each part is checked
+// at most once per UPDATE_CHECK_INTERVAL.
+const UPDATE_CHECK_FILE: &str = "update-check.json";
+const UPDATE_CHECK_INTERVAL: Duration = Duration::from_secs(24 * 60 * 60);
+// Hidden command the check runs as, detached from the command that started it.
+const UPDATE_CHECK_COMMAND: &str = "__update-check";
+
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct UpdateCheckState {
+    #[serde(default)]
+    checked_at: u64,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    xe_latest: String,
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    projects: BTreeMap<PathBuf, ProjectUpdates>,
+}
+
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct ProjectUpdates {
+    #[serde(default)]
+    checked_at: u64,
+    // Direct dependency name to the latest version on PyPI.
+    #[serde(default)]
+    latest: BTreeMap<String, String>,
+}
+
+fn load_update_check() -> UpdateCheckState {
+    fs::read(xe_home().join(UPDATE_CHECK_FILE))
+        .ok()
+        .and_then(|bytes| serde_json::from_slice(&bytes).ok())
+        .unwrap_or_default()
+}
+
+fn save_update_check(state: &UpdateCheckState) -> Result<()> {
+    fs::create_dir_all(xe_home()).with_context(|| format!("failed to create {}", xe_home().display()))?;
+    let data = serde_json::to_vec_pretty(state).context("failed to encode the update check")?;
+    write_file_atomic(&xe_home().join(UPDATE_CHECK_FILE), &data)
+}
+
+fn unix_now() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .unwrap_or_else(|_| Duration::from_secs(0))
+        .as_secs()
+}
+
+// Direct dependencies of `cfg` pinned to a version, with that version.
+fn pinned_direct_deps(cfg: &Config) -> BTreeMap<String, String> {
+    let members = cfg.workspace_deps();
+    cfg.deps
+        .iter()
+        .chain(cfg.groups.values().flat_map(|group| group.deps.iter()))
+        .filter(|(name, version)| !members.contains(*name) && !version.is_empty() && *version != "*")
+        .map(|(name, version)| (name.clone(), version.clone()))
+        .collect()
+}
+
+// After a successful command, prints one line per pending update found by an earlier
+// check and starts a new check in the background once the last one is a day old. Only
+// with notifications on and a terminal on stderr, so scripts and CI logs stay clean.
+fn update_notices(ctx: &AppContext, args: &[String]) {
+    let skip = matches!(args.first().map(String::as_str), None | Some("self" | "config" | UPDATE_CHECK_COMMAND));
+    if skip
+        || verbosity() < 0
+        || json_output_requested()
+        || !io::stderr().is_terminal()
+        || !load_global_config(&ctx.config_file).is_ok_and(|cfg| cfg.notifications)
+    {
+        return;
+    }
+    let mut state = load_update_check();
+    if !state.xe_latest.is_empty() && compare_version(&state.xe_latest, XE_VERSION) == Ordering::Greater {
+        info(&format!(
+            "xe v{} is available (installed v{XE_VERSION}); see `xe self update`",
+            state.xe_latest
+        ));
+    }
+    let project = env::current_dir()
+        .ok()
+        .filter(|wd| wd.join(XE_TOML).is_file())
+        .and_then(|wd| load_project(&wd.join(XE_TOML)).ok().map(|cfg| (wd, cfg)));
+    if let Some((wd, cfg)) = &project {
+        let behind = state
+            .projects
+            .get(wd)
+            .map(|updates| {
+                pinned_direct_deps(cfg)
+                    .into_iter()
+                    .filter_map(|(name, current)| {
+                        let latest = updates.latest.get(&name)?;
+                        (compare_version(latest, &current) == Ordering::Greater)
+                            .then(|| format!("{name} {current} -> {latest}"))
+                    })
+                    .collect::<Vec<_>>()
+            })
+            .unwrap_or_default();
+        if !behind.is_empty() {
+            info(&format!("Updates available: {}; run `xe upgrade`", behind.join(", ")));
+        }
+    }
+
+    let now = unix_now();
+    let stale = |checked_at: u64| now.saturating_sub(checked_at) >= UPDATE_CHECK_INTERVAL.as_secs();
+    let project_stale = project
+        .as_ref()
+        .is_some_and(|(wd, _)| stale(state.projects.get(wd).map_or(0, |updates| updates.checked_at)));
+    if !stale(state.checked_at) && !project_stale {
+        return;
+    }
+    // Stamped before the check runs, so an offline machine tries once a day rather than
+    // on every command.
+    state.checked_at = now;
+    if let Some((wd, _)) = &project {
+        state.projects.entry(wd.clone()).or_default().checked_at = now;
+    }
+    if let Err(err) = save_update_check(&state) {
+        debug(&format!("failed to record the update check: {err:#}"));
+        return;
+    }
+    let spawned = env::current_exe().and_then(|exe| {
+        let mut command = Command::new(exe);
+        command
+            .arg("--config")
+            .arg(&ctx.config_file)
+            .arg(UPDATE_CHECK_COMMAND)
+            .args(project.as_ref().map(|(wd, _)| wd.as_os_str()))
+            .stdin(Stdio::null())
+            .stdout(Stdio::null())
+            .stderr(Stdio::null());
+        #[cfg(unix)]
+        {
+            use std::os::unix::process::CommandExt;
+            command.process_group(0);
+        }
+        command.spawn()
+    });
+    if let Err(err) = spawned {
+        debug(&format!("failed to start the update check: {err}"));
+    }
+}
+
+// `xe __update-check [<project dir>]`: asks GitHub for the newest xe release and PyPI for
+// the latest versions of the project's direct dependencies, and records what it learns.
+// Dependencies the project installs from another index are not looked up. Failures leave
+// the previous results in place.
+fn cmd_update_check(ctx: &AppContext, args: &[String]) -> Result<()> {
+    let xe_latest = latest_release().ok().map(|(latest, _)| latest);
+    let project = match args {
+        [] => None,
+        [dir] => {
+            let dir = PathBuf::from(dir);
+            let cfg = load_project(&dir.join(XE_TOML))?;
+            let indexes = IndexPlan::load(ctx, &cfg)?;
+            let names = pinned_direct_deps(&cfg).into_keys().collect::<Vec<_>>();
+            let latest = names
+                .iter()
+                .filter(|name| indexes.serves_from_pypi(name))
+                .filter_map(|name| {
+                    fetch_metadata_cached(name, Path::new(&cfg.cache.global_dir))
+                        .ok()
+                        .map(|m| (name.clone(), m.info.version))
+                })
+                .collect::<BTreeMap<_, _>>();
+            Some((dir, latest))
+        }
+        _ => bail!("usage: xe {UPDATE_CHECK_COMMAND} [<project dir>]"),
+    };
+    let mut state = load_update_check();
+    if let Some(latest) = xe_latest {
+        state.xe_latest = latest;
+    }
+    if let Some((dir, latest)) = project {
+        let entry = state.projects.entry(dir).or_default();
+        entry.latest = latest;
+        entry.checked_at = unix_now();
+    }
+    state.projects.retain(|dir, _| dir.join(XE_TOML).is_file());
+    save_update_check(&state)
+}
+
+fn cmd_workspace(ctx: &AppContext, args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe workspace <init|add|remove|list|run|lock|sync|graph>";
+    let Some(sub) = args.first() else {
+        bail!(USAGE);
+    };
+    let rest = &args[1..];
+    let wd = env::current_dir().context("failed to get cwd")?;
+    match sub.as_str() {
+        "init" => {
+            let python = match rest {
+                [] => String::new(),
+                [flag, version] if flag == "--python" || flag == "-p" => {
+                    parse_major_minor(version)?;
+                    version.clone()
+                }
+                _ => bail!("usage: xe workspace init [--python <version>]"),
+            };
+            let path = wd.join(XE_WORKSPACE_TOML);
+            if path.exists() {
+                bail_kind!(ErrorKind::Config, "{} already exists", path.display());
+            }
+            let mut text = String::from("[workspace]\nmembers = []\n");
+            if !python.is_empty() {
+                text.push_str(&format!("python = \"{python}\"\n"));
+            }
+            write_file_atomic(&path, text.as_bytes())?;
+            success(&format!("Initialized xe workspace at {}", wd.display()));
+            info("Add members with `xe workspace add <path>`; globs such as `packages/*` are allowed.");
+            Ok(())
+        }
+        "add" => {
+            let [member] = rest else {
+                bail!("usage: xe workspace add <path|glob>");
+            };
+            let workspace = Workspace::require(&wd)?;
+            let entry = workspace.member_entry(&wd, member)?;
+            let mut doc = workspace.document()?;
+            let mut changed = false;
+            if let Some(excludes) = doc
+                .get_mut("workspace")
+                .and_then(|w| w.get_mut("exclude"))
+                .and_then(Item::as_array_mut)
+            {
+                let before = excludes.len();
+                excludes.retain(|v| v.as_str() != Some(entry.as_str()));
+                changed = excludes.len() != before;
+            }
+            let covered = workspace
+                .config
+                .members
+                .iter()
+                .any(|m| m == &entry || glob_matches(m, &entry));
+            if !covered {
+                workspace_array(&mut doc, "members").push(entry.as_str());
+                changed = true;
+            }
+            if !changed {
+                warning(&format!("{entry} is already a workspace member"));
+                return Ok(());
+            }
+            workspace.save_document(&doc)?;
+
+            let workspace = Workspace::load(&workspace.root)?;
+            let added = workspace
+                .members()?
+                .into_iter()
+                .filter(|dir| workspace.relative(dir) == entry || glob_matches(&entry, &workspace.relative(dir)))
+                .collect::<Vec<_>>();
+            for dir in &added {
+                let (mut cfg, toml_path) = load_or_create_project(dir)?;
+                if workspace.apply_shared(&mut cfg) {
+                    save_project(&toml_path, &cfg)?;
+                    info(&format!("Applied workspace settings to {}", workspace.relative(dir)));
+                }
+            }
+            if added.is_empty() {
+                warning(&format!("{entry} matches no directories yet"));
+            }
+            success(&format!("Added {entry} to workspace"));
+            Ok(())
+        }
+        "remove" => {
+            let [member] = rest else {
+                bail!("usage: xe workspace remove <path>");
+            };
+            let workspace = Workspace::require(&wd)?;
+            let entry = workspace.member_entry(&wd, member)?;
+            let mut doc = workspace.document()?;
+            let members = workspace_array(&mut doc, "members");
+            let before = members.len();
+            members.retain(|v| v.as_str() != Some(entry.as_str()));
+            if members.len() == before {
+                // Matched by a glob: exclude it instead of editing the pattern.
+                let matched = workspace.members()?.iter().any(|dir| workspace.relative(dir) == entry);
+                if !matched {
+                    bail!("{entry} is not a workspace member");
+                }
+                workspace_array(&mut doc, "exclude").push(entry.as_str());
+                workspace.save_document(&doc)?;
+                success(&format!("Excluded {entry} from the workspace"));
+                return Ok(());
+            }
+            workspace.save_document(&doc)?;
+            success(&format!("Removed {entry} from workspace"));
+            Ok(())
+        }
+        "list" => {
+            let json_output = match rest {
+                [] => false,
+                [flag] if flag == "--json" => true,
+                _ => bail!("usage: xe workspace list [--json]"),
+            };
+            let workspace = Workspace::require(&wd)?;
+            let rows = workspace
+                .members()?
+                .iter()
+                .map(|dir| workspace.member_status(dir))
+                .collect::<Vec<_>>();
+            if json_output {
+                println!("{}", serde_json::to_string_pretty(&rows)?);
+                return Ok(());
+            }
+            info(&format!("Workspace {}", workspace.root.display()));
+            if rows.is_empty() {
+                info("No members. Add one with `xe workspace add <path>`.");
+                return Ok(());
+            }
+            print_member_table(&rows);
+            Ok(())
+        }
+        "run" | "exec" => workspace_run(ctx, &Workspace::require(&wd)?, rest),
+        "lock" | "sync" => {
+            let lock = sub == "lock";
+            let (require_hashes, rest) = take_flag(rest, "--require-hashes");
+            if !rest.is_empty() {
+                bail!("usage: xe workspace {sub} [--require-hashes]");
+            }
+            let workspace = Workspace::require(&wd)?;
+            let order = workspace.topo_order()?;
+            if order.is_empty() {
+                info("No members. Add one with `xe workspace add <path>`.");
+                return Ok(());
+            }
+            for (dir, cfg) in &order {
+                let verb = if lock { "Locking" } else { "Syncing" };
+                info(&format!("{verb} {} ({})", cfg.project.name, workspace.relative(dir)));
+                install_project(ctx, dir, require_hashes, lock)
+                    .with_context(|| format!("failed to {sub} {}", workspace.relative(dir)))?;
+            }
+            success(&format!(
+                "{} {} member(s)",
+                if lock { "Locked" } else { "Synced" },
+                order.len()
+            ));
+            print_install_summary(ctx);
+            Ok(())
+        }
+        "graph" => {
+            let format = match rest {
+                [] => "dot",
+                [flag, format] if flag == "--format" && matches!(format.as_str(), "dot" | "mermaid" | "json") => {
+                    format.as_str()
+                }
+                _ => bail!("usage: xe workspace graph [--format dot|mermaid|json]"),
+            };
+            let workspace = Workspace::require(&wd)?;
+            print!("{}", render_workspace_graph(&workspace, format)?);
+            Ok(())
+        }
+        _ => bail!(USAGE),
+    }
+}
+
+// Renders members and their `{ workspace = true }` edges, pointing from dependent to
+// dependency, with the order `xe workspace lock` and `sync` use.
+fn render_workspace_graph(workspace: &Workspace, format: &str) -> Result<String> {
+    let order = workspace.topo_order()?;
+    let nodes = order
+        .iter()
+        .map(|(dir, cfg)| (normalize_dep_name(&cfg.project.name), workspace.relative(dir)))
+        .collect::<Vec<_>>();
+    let mut edges = Vec::new();
+    for (_, cfg) in &order {
+        let from = normalize_dep_name(&cfg.project.name);
+        for dep in cfg.workspace_deps() {
+            edges.push((from.clone(), normalize_dep_name(&dep)));
+        }
+    }
+    let names = nodes.iter().map(|(name, _)| name.as_str()).collect::<Vec<_>>();
+    let mut out = String::new();
+    match format {
+        "json" => {
+            let members = nodes
+                .iter()
+                .map(|(name, path)| {
+                    let deps = edges
+                        .iter()
+                        .filter(|(from, _)| from == name)
+                        .map(|(_, to)| to)
+                        .collect::<Vec<_>>();
+                    json!({"name": name, "path": path, "depends_on": deps})
+                })
+                .collect::<Vec<_>>();
+            let doc = json!({"members": members, "order": names});
+            out.push_str(&serde_json::to_string_pretty(&doc)?);
+            out.push('\n');
+        }
+        "mermaid" => {
+            out.push_str(&format!("%% order: {}\n", names.join(", ")));
+            out.push_str("graph LR\n");
+            let id = |name: &str| format!("m{}", names.iter().position(|n| *n == name).unwrap_or(0));
+            for (name, path) in &nodes {
+                out.push_str(&format!("    {}[\"{name}<br/>{path}\"]\n", id(name)));
+            }
+            for (from, to) in &edges {
+                out.push_str(&format!("    {} --> {}\n", id(from), id(to)));
+            }
+        }
+        _ => {
+            out.push_str(&format!("// order: {}\n", names.join(", ")));
+            out.push_str("digraph workspace {\n    rankdir=LR;\n");
+            for (name, path) in &nodes {
+                out.push_str(&format!("    \"{name}\" [label=\"{name}\\n{path}\"];\n"));
+            }
+            for (from, to) in &edges {
+                out.push_str(&format!("    \"{from}\" -> \"{to}\";\n"));
+            }
+            out.push_str("}\n");
+        }
+    }
+    Ok(out)
+}
+
+struct MemberRun {
+    member: String,
+    outcome: Result<std::process::Output>,
+    elapsed: Duration,
+}
+
+// Runs a script or command in each selected member with that member's runtime, at most
+// `--jobs` at a time. Output is buffered per member and printed as each one finishes.
+fn workspace_run(ctx: &AppContext, workspace: &Workspace, args: &[String]) -> Result<()> {
+    const USAGE: &str =
+        "usage: xe workspace run [--filter <pattern>]... [--jobs <n>] <script|command> [args...] | -- <command> [args...]";
+    let mut filters = Vec::new();
+    let mut jobs = thread::available_parallelism().map(|n| n.get()).unwrap_or(4);
+    let mut idx = 0usize;
+    while idx < args.len() {
+        match args[idx].as_str() {
+            "-f" | "--filter" => {
+                filters.push(args.get(idx + 1).ok_or_else(|| anyhow!(USAGE))?.clone());
+                idx += 2;
+            }
+            "-j" | "--jobs" => {
+                jobs = args
+                    .get(idx + 1)
+                    .and_then(|v| v.parse().ok())
+                    .filter(|n| *n > 0)
+                    .ok_or_else(|| anyhow!(USAGE))?;
+                idx += 2;
+            }
+            _ => break,
+        }
+    }
+    let mut command_args = args[idx..].to_vec();
+    let raw = command_args.first().is_some_and(|a| a == "--");
+    if raw {
+        command_args.remove(0);
+    }
+    if command_args.is_empty() {
+        bail!(USAGE);
+    }
+
+    let mut planned = Vec::new();
+    let mut skipped = Vec::new();
+    let mut configs = Vec::new();
+    for dir in workspace.members()? {
+        let rel = workspace.relative(&dir);
+        let (mut cfg, toml_path) = load_or_create_project(&dir)?;
+        let selected = filters.is_empty()
+            || filters
+                .iter()
+                .any(|f| glob_matches(f, &rel) || glob_matches(f, &cfg.project.name));
+        if !selected {
+            continue;
+        }
+        let runtime = ensure_runtime_for_project(ctx, &dir, &mut cfg)?;
+        if runtime.config_changed {
+            save_project(&toml_path, &cfg)?;
+        }
+        configs.push((dir, rel, cfg, runtime.selection));
+    }
+    // A name that is a script somewhere only runs where it is defined.
+    let is_script = !raw && configs.iter().any(|(_, _, cfg, _)| cfg.scripts.contains_key(&command_args[0]));
+    for (dir, rel, cfg, selection) in configs {
+        if is_script && !cfg.scripts.contains_key(&command_args[0]) {
+            skipped.push(rel);
+            continue;
+        }
+        let mut command = project_command(&cfg, &selection, &command_args, raw)?;
+        command.current_dir(&dir).stdin(Stdio::null());
+        planned.push((rel, command));
+    }
+    if planned.is_empty() {
+        bail!("no workspace members to run `{}` in", command_args.join(" "));
+    }
+
+    let jobs = jobs.min(planned.len());
+    info(&format!(
+        "Running `{}` in {} member(s) with up to {jobs} job(s)...",
+        command_args.join(" "),
+        planned.len()
+    ));
+    let pool = rayon::ThreadPoolBuilder::new()
+        .num_threads(jobs)
+        .build()
+        .context("failed to start worker pool")?;
+    let print_lock = Mutex::new(());
+    let runs = pool.install(|| {
+        planned
+            .into_par_iter()
+            .map(|(member, mut command)| {
+                let started = Instant::now();
+                let outcome = command.output().with_context(|| format!("failed to start command in {member}"));
+                let run = MemberRun {
+                    member,
+                    outcome,
+                    elapsed: started.elapsed(),
+                };
+                let _guard = print_lock.lock();
+                print_member_run(&run);
+                run
+            })
+            .collect::<Vec<_>>()
+    });
+
+    println!();
+    let width = runs.iter().map(|r| r.member.len()).max().unwrap_or(0).max("Member".len());
+    println!("{:<width$}  {:<8}  Time", "Member", "Result");
+    let mut failed = 0usize;
+    for run in &runs {
+        let result = match &run.outcome {
+            Ok(output) if output.status.success() => "ok".to_string(),
+            Ok(output) => {
+                failed += 1;
+                output.status.code().map(|c| format!("exit {c}")).unwrap_or_else(|| "killed".to_string())
+            }
+            Err(_) => {
+                failed += 1;
+                "error".to_string()
+            }
+        };
+        println!("{:<width$}  {:<8}  {:.1}s", run.member, result, run.elapsed.as_secs_f64());
+    }
+    for member in &skipped {
+        println!("{:<width$}  {:<8}  -", member, "skipped");
+    }
+    if failed > 0 {
+        bail!("{failed} of {} member(s) failed", runs.len());
+    }
+    success(&format!("All {} member(s) passed", runs.len()));
+    Ok(())
+}
+
+fn print_member_run(run: &MemberRun) {
+    match &run.outcome {
+        Ok(output) => {
+            let line = format!("{} ({:.1}s, {})", run.member, run.elapsed.as_secs_f64(), output.status);
+            if output.status.success() {
+                success(&line);
+            } else {
+                error(&line);
+            }
+            io::stdout().write_all(&output.stdout).ok();
+            io::stderr().write_all(&output.stderr).ok();
+        }
+        Err(err) => error(&format!("{}: {err:#}", run.member)),
+    }
+}
+
+const XE_WORKSPACE_TOML: &str = "xe-workspace.toml";
+
+// xe-workspace.toml: member paths or globs relative to the workspace root, plus the Python
+// version and cache directory every member shares.
+#[derive(Debug, Clone, Default, Deserialize)]
+struct WorkspaceFile {
+    #[serde(default)]
+    workspace: WorkspaceSection,
+}
+
+#[derive(Debug, Clone, Default, Deserialize)]
+struct WorkspaceSection {
+    #[serde(default)]
+    members: Vec<String>,
+    #[serde(default)]
+    exclude: Vec<String>,
+    #[serde(default)]
+    python: String,
+    #[serde(default)]
+    cache_dir: String,
+}
+
+struct Workspace {
+    root: PathBuf,
+    config: WorkspaceSection,
+}
+
+#[derive(Debug, Serialize)]
+struct MemberStatus {
+    path: String,
+    name: String,
+    python: String,
+    deps: usize,
+    status: String,
+}
+
+impl Workspace {
+    // The nearest xe-workspace.toml at or above `start`.
+    fn find(start: &Path) -> Result<Option<Workspace>> {
+        for dir in start.ancestors() {
+            if dir.join(XE_WORKSPACE_TOML).is_file() {
+                return Self::load(dir).map(Some);
+            }
+        }
+        Ok(None)
+    }
+
+    fn require(start: &Path) -> Result<Workspace> {
+        match Self::find(start)? {
+            Some(workspace) => Ok(workspace),
+            None => bail_kind!(
+                ErrorKind::Config,
+                "no {XE_WORKSPACE_TOML} found in {} or its parents; run `xe workspace init`",
+                start.display()
+            ),
+        }
+    }
+
+    fn load(root: &Path) -> Result<Workspace> {
+        let path = root.join(XE_WORKSPACE_TOML);
+        let text = fs::read_to_string(&path).with_context(|| format!("failed to read {}", path.display()))?;
+        let file: WorkspaceFile = toml::from_str(&text).with_context(|| format!("failed to parse {}", path.display()))?;
+        Ok(Workspace {
+            root: root.to_path_buf(),
+            config: file.workspace,
+        })
+    }
+
+    fn document(&self) -> Result<DocumentMut> {
+        let path = self.root.join(XE_WORKSPACE_TOML);
+        let text = fs::read_to_string(&path).with_context(|| format!("failed to read {}", path.display()))?;
+        text.parse::<DocumentMut>()
+            .with_context(|| format!("failed to parse {}", path.display()))
+    }
+
+    fn save_document(&self, doc: &DocumentMut) -> Result<()> {
+        write_file_atomic(&self.root.join(XE_WORKSPACE_TOML), doc.to_string().as_bytes())
+    }
+
+    fn relative(&self, dir: &Path) -> String {
+        dir.strip_prefix(&self.root)
+            .unwrap_or(dir)
+            .components()
+            .map(|c| c.as_os_str().to_string_lossy().to_string())
+            .collect::<Vec<_>>()
+            .join("/")
+    }
+
+    // Normalizes a member path or glob given relative to `cwd` into a root-relative entry.
+    fn member_entry(&self, cwd: &Path, member: &str) -> Result<String> {
+        let root = fs::canonicalize(&self.root).unwrap_or_else(|_| self.root.clone());
+        let base = fs::canonicalize(cwd).unwrap_or_else(|_| cwd.to_path_buf());
+        let target = if member.contains(['*', '?']) {
+            base.join(member)
+        } else {
+            fs::canonicalize(base.join(member)).with_context(|| format!("{member} not found"))?
+        };
+        let Ok(relative) = target.strip_prefix(&root) else {
+            bail!("{member} is outside the workspace root {}", root.display());
+        };
+        let entry = relative
+            .components()
+            .filter(|c| !matches!(c, std::path::Component::CurDir))
+            .map(|c| c.as_os_str().to_string_lossy().to_string())
+            .collect::<Vec<_>>()
+            .join("/");
+        if entry.is_empty() {
+            bail!("the workspace root cannot be its own member");
+        }
+        Ok(entry)
+    }
+
+    // Member directories: literal entries as given, glob entries expanded to the matching
+    // directories that contain an xe.toml, minus anything listed in `exclude`.
+    fn members(&self) -> Result<Vec<PathBuf>> {
+        let mut out = Vec::new();
+        for entry in &self.config.members {
+            if entry.contains(['*', '?']) {
+                let mut dirs = vec![self.root.clone()];
+                for segment in entry.split('/').filter(|s| !s.is_empty() && *s != ".") {
+                    let mut next = Vec::new();
+                    for dir in &dirs {
+                        if !segment.contains(['*', '?']) {
+                            next.push(dir.join(segment));
+                            continue;
+                        }
+                        for child in fs::read_dir(dir).into_iter().flatten().flatten() {
+                            let name = child.file_name().to_string_lossy().to_string();
+                            if child.path().is_dir() && !name.starts_with('.') && glob_matches(segment, &name) {
+                                next.push(child.path());
+                            }
+                        }
+                    }
+                    dirs = next;
+                }
+                dirs.retain(|dir| dir.join(XE_TOML).is_file());
+                dirs.sort();
+                out.extend(dirs);
+            } else {
+                out.push(self.root.join(entry));
+            }
+        }
+        out.retain(|dir| {
+            let rel = self.relative(dir);
+            !self.config.exclude.iter().any(|pattern| glob_matches(pattern, &rel))
+        });
+        let mut seen = HashSet::new();
+        out.retain(|dir| seen.insert(dir.clone()));
+        Ok(out)
+    }
+
+    // Writes the shared Python version and cache directory into `cfg`; true when it changed.
+    fn apply_shared(&self, cfg: &mut Config) -> bool {
+        let mut changed = false;
+        if !self.config.python.is_empty() && cfg.python.version != self.config.python {
+            cfg.python.version = self.config.python.clone();
+            changed = true;
+        }
+        if !self.config.cache_dir.is_empty() && cfg.cache.global_dir != self.config.cache_dir {
+            cfg.cache.global_dir = self.config.cache_dir.clone();
+            changed = true;
+        }
+        changed
+    }
+
+    // Members with a readable xe.toml, keyed by normalized project name.
+    fn member_configs(&self) -> Result<HashMap<String, (PathBuf, Config)>> {
+        let mut out = HashMap::new();
+        for dir in self.members()? {
+            let toml_path = dir.join(XE_TOML);
+            if !toml_path.is_file() {
+                continue;
+            }
+            let cfg = load_project(&toml_path)?;
+            out.insert(normalize_dep_name(&cfg.project.name), (dir, cfg));
+        }
+        Ok(out)
+    }
+
+    // Members ordered so every member comes after the members it depends on.
+    fn topo_order(&self) -> Result<Vec<(PathBuf, Config)>> {
+        fn visit(
+            name: &str,
+            by_name: &HashMap<String, (PathBuf, Config)>,
+            stack: &mut Vec<String>,
+            done: &mut HashSet<String>,
+            out: &mut Vec<(PathBuf, Config)>,
+        ) -> Result<()> {
+            if done.contains(name) {
+                return Ok(());
+            }
+            if let Some(pos) = stack.iter().position(|n| n == name) {
+                let mut cycle = stack[pos..].to_vec();
+                cycle.push(name.to_string());
+                bail_kind!(ErrorKind::Config, "workspace dependency cycle: {}", cycle.join(" -> "));
+            }
+            let (dir, cfg) = &by_name[name];
+            stack.push(name.to_string());
+            for dep in cfg.workspace_deps() {
+                let dep = normalize_dep_name(&dep);
+                if !by_name.contains_key(&dep) {
+                    bail_kind!(
+                        ErrorKind::Config,
+                        "{} depends on {dep} with `workspace = true` but no member is named {dep}",
+                        cfg.project.name
+                    );
+                }
+                visit(&dep, by_name, stack, done, out)?;
+            }
+            stack.pop();
+            done.insert(name.to_string());
+            out.push((dir.clone(), cfg.clone()));
+            Ok(())
+        }
+
+        let by_name = self.member_configs()?;
+        let mut names = by_name
+            .iter()
+            .map(|(name, (dir, _))| (dir.clone(), name.clone()))
+            .collect::<Vec<_>>();
+        names.sort();
+        let mut out = Vec::new();
+        let mut done = HashSet::new();
+        for (_, name) in names {
+            visit(&name, &by_name, &mut Vec::new(), &mut done, &mut out)?;
+        }
+        Ok(out)
+    }
+
+    fn member_status(&self, dir: &Path) -> MemberStatus {
+        let path = self.relative(dir);
+        let toml_path = dir.join(XE_TOML);
+        if !toml_path.is_file() {
+            return MemberStatus {
+                path,
+                name: "-".to_string(),
+                python: "-".to_string(),
+                deps: 0,
+                status: "missing xe.toml".to_string(),
+            };
+        }
+        let cfg = match load_project(&toml_path) {
+            Ok(cfg) => cfg,
+            Err(err) => {
+                return MemberStatus {
+                    path,
+                    name: "-".to_string(),
+                    python: "-".to_string(),
+                    deps: 0,
+                    status: format!("invalid xe.toml: {}", err.root_cause()),
+                }
+            }
+        };
+        let mut problems = Vec::new();
+        if !self.config.python.is_empty() && cfg.python.version != self.config.python {
+            problems.push(format!("python differs from workspace {}", self.config.python));
+        }
+        if !self.config.cache_dir.is_empty() && cfg.cache.global_dir != self.config.cache_dir {
+            problems.push("cache differs from workspace".to_string());
+        }
+        MemberStatus {
+            path,
+            name: cfg.project.name.clone(),
+            python: cfg.python.version.clone(),
+            deps: cfg.requirements().len() + cfg.workspace_deps().len(),
+            status: if problems.is_empty() {
+                "ok".to_string()
+            } else {
+                problems.join("; ")
+            },
+        }
+    }
+}
+
+// A workspace member another project depends on with `{ workspace = true }`.
+struct WorkspaceLink {
+    dir: PathBuf,
+    config: Config,
+}
+
+// The members `cfg` depends on, directly or through other members.
+fn workspace_links(project_dir: &Path, cfg: &Config) -> Result<Vec<WorkspaceLink>> {
+    let wanted = cfg.workspace_deps();
+    if wanted.is_empty() {
+        return Ok(Vec::new());
+    }
+    let Some(workspace) = Workspace::find(project_dir)? else {
+        bail_kind!(
+            ErrorKind::Config,
+            "{} is declared with `workspace = true` but {} is not inside a workspace",
+            wanted.join(", "),
+            project_dir.display()
+        );
+    };
+    let by_name = workspace.member_configs()?;
+    let mut links: Vec<WorkspaceLink> = Vec::new();
+    let mut pending = wanted;
+    while let Some(name) = pending.pop() {
+        let Some((dir, member)) = by_name.get(&normalize_dep_name(&name)) else {
+            bail_kind!(
+                ErrorKind::Config,
+                "{name} is declared with `workspace = true` but no member of {} is named {name}",
+                workspace.root.display()
+            );
+        };
+        if links.iter().any(|l| l.dir == *dir) || same_dir(dir, project_dir) {
+            continue;
+        }
+        pending.extend(member.workspace_deps());
+        links.push(WorkspaceLink {
+            dir: dir.clone(),
+            config: member.clone(),
+        });
+    }
+    Ok(links)
+}
+
+fn same_dir(a: &Path, b: &Path) -> bool {
+    let a = fs::canonicalize(a).unwrap_or_else(|_| a.to_path_buf());
+    let b = fs::canonicalize(b).unwrap_or_else(|_| b.to_path_buf());
+    a == b
+}
+
+// Members are importable through a .pth file rather than an installed copy, so edits to
+// their sources take effect without reinstalling.
+const WORKSPACE_PTH: &str = "xe-workspace.pth";
+
+fn link_workspace_members(site_packages: &Path, links: &[WorkspaceLink]) -> Result<()> {
+    let path = site_packages.join(WORKSPACE_PTH);
+    if links.is_empty() {
+        if path.exists() {
+            fs::remove_file(&path).with_context(|| format!("failed to remove {}", path.display()))?;
+        }
+        return Ok(());
+    }
+    let mut text = String::new();
+    for link in links {
+        let dir = fs::canonicalize(&link.dir).unwrap_or_else(|_| link.dir.clone());
+        let src = dir.join("src");
+        let root = if src.is_dir() { src } else { dir };
+        text.push_str(&format!("{}\n", root.display()));
+        debug(&format!("Linked workspace member {} from {}", link.config.project.name, root.display()));
+    }
+    write_file_atomic(&path, text.as_bytes())
+}
+
+// Source roots listed in the environment's xe-workspace.pth and in editable installs'
+// `__editable__.*.pth` files. Lines that run code (`import ...`) are left to site.
+fn linked_source_paths(site_packages: &Path) -> Vec<PathBuf> {
+    let mut files = vec![site_packages.join(WORKSPACE_PTH)];
+    let mut editable = fs::read_dir(site_packages)
+        .into_iter()
+        .flatten()
+        .flatten()
+        .map(|entry| entry.path())
+        .filter(|path| {
+            path.file_name()
+                .map(|n| n.to_string_lossy())
+                .is_some_and(|n| n.starts_with("__editable__.") && n.ends_with(".pth"))
+        })
+        .collect::<Vec<_>>();
+    editable.sort();
+    files.extend(editable);
+    files
+        .iter()
+        .filter_map(|path| fs::read_to_string(path).ok())
+        .flat_map(|text| {
+            text.lines()
+                .map(str::trim)
+                .filter(|line| !line.is_empty() && !line.starts_with('#') && !line.starts_with("import"))
+                .map(PathBuf::from)
+                .collect::<Vec<_>>()
+        })
+        .collect()
+}
+
+// A project being installed with `xe develop`, described by its xe.toml or, failing that,
+// the `[project]` table of its pyproject.toml.
+struct EditableProject {
+    dir: PathBuf,
+    name: String,
+    version: String,
+    metadata: String,
+    entry_points: BTreeMap<String, String>,
+    requirements: Vec<String>,
+    backend: Option<BuildBackend>,
+}
+
+// pyproject.toml `[build-system]`; without `build-backend` PEP 517 falls back to the
+// legacy setuptools backend.
+struct BuildBackend {
+    name: String,
+    paths: Vec<String>,
+}
+
+impl EditableProject {
+    fn load(dir: &Path) -> Result<Self> {
+        let pyproject_path = dir.join("pyproject.toml");
+        let pyproject = if pyproject_path.is_file() {
+            let text = fs::read_to_string(&pyproject_path)
+                .with_context(|| format!("failed to read {}", pyproject_path.display()))?;
+            Some(
+                toml::from_str::<toml::Value>(&text)
+                    .with_context(|| format!("failed to parse {}", pyproject_path.display()))?,
+            )
+        } else {
+            None
+        };
+        let backend = pyproject.as_ref().and_then(|doc| doc.get("build-system")).map(|table| BuildBackend {
+            name: table
+                .get("build-backend")
+                .and_then(toml::Value::as_str)
+                .unwrap_or("setuptools.build_meta:__legacy__")
+                .to_string(),
+            paths: table
+                .get("backend-path")
+                .and_then(toml::Value::as_array)
+                .into_iter()
+                .flatten()
+                .filter_map(toml::Value::as_str)
+                .map(str::to_string)
+                .collect(),
+        });
+
+        if dir.join(XE_TOML).is_file() {
+            let cfg = load_existing_project(dir)?;
+            if cfg.project.version.trim().is_empty() {
+                bail_kind!(ErrorKind::Config, "project.version is not set in xe.toml; add `version = \"0.1.0\"` under [project]");
+            }
+            return Ok(Self {
+                dir: dir.to_path_buf(),
+                name: cfg.project.name.trim().to_string(),
+                version: cfg.project.version.trim().to_string(),
+                metadata: render_core_metadata(dir, &cfg)?,
+                entry_points: cfg.project.entry_points.clone(),
+                requirements: project_requirements(dir, &cfg)?,
+                backend,
+            });
+        }
+        let Some(project) = pyproject.as_ref().and_then(|doc| doc.get("project")) else {
+            bail_kind!(
+                ErrorKind::Config,
+                "no {XE_TOML} or pyproject.toml [project] table in {}",
+                dir.display()
+            );
+        };
+        let field = |key: &str| project.get(key).and_then(toml::Value::as_str).unwrap_or_default().trim().to_string();
+        let (name, version) = (field("name"), field("version"));
+        if name.is_empty() || (version.is_empty() && backend.is_none()) {
+            bail_kind!(
+                ErrorKind::Config,
+                "{} must set project.name and project.version to be installed without a build backend",
+                pyproject_path.display()
+            );
+        }
+        let (_, requirements, _) = read_pyproject_requirements(&pyproject_path)?;
+        let mut metadata = format!("Metadata-Version: 2.1\nName: {name}\nVersion: {version}\n");
+        for req in &requirements {
+            metadata.push_str(&format!("Requires-Dist: {req}\n"));
+        }
+        let entry_points = project
+            .get("scripts")
+            .and_then(toml::Value::as_table)
+            .into_iter()
+            .flatten()
+            .filter_map(|(name, target)| Some((name.clone(), target.as_str()?.to_string())))
+            .collect();
+        Ok(Self {
+            dir: dir.to_path_buf(),
+            name,
+            version,
+            metadata,
+            entry_points,
+            requirements,
+            backend,
+        })
+    }
+
+    // Where imports resolve from: `src/` when the project uses that layout.
+    fn source_root(&self) -> PathBuf {
+        let src = self.dir.join("src");
+        if src.is_dir() {
+            src
+        } else {
+            self.dir.clone()
+        }
+    }
+}
+
+// Calls the backend's `build_editable` hook with the project's runtime. Returns None when
+// the backend predates PEP 660; a backend that cannot be imported is an error since its
+// build requirements have to be installed first.
+const BUILD_EDITABLE_PY: &str = r#"import importlib, os, sys
+out, backend, paths = sys.argv[1], sys.argv[2], sys.argv[3:]
+sys.path[:0] = [os.path.abspath(p) for p in paths]
+module, _, attr = backend.partition(":")
+try:
+    hooks = importlib.import_module(module)
+except ImportError as exc:
+    sys.stderr.write(f"cannot import build backend {backend}: {exc}\n")
+    sys.exit(4)
+for part in filter(None, attr.split(".")):
+    hooks = getattr(hooks, part)
+if not hasattr(hooks, "build_editable"):
+    sys.exit(3)
+hooks.build_editable(out)
+"#;
+
+fn build_editable_wheel(dir: &Path, backend: &BuildBackend, selection: &RuntimeSelection) -> Result<Option<PathBuf>> {
+    let out_dir = tempfile_path("xe-editable", "d");
+    fs::create_dir_all(&out_dir).with_context(|| format!("failed to create {}", out_dir.display()))?;
+    let mut command = Command::new(&selection.python_exe);
+    command
+        .arg("-c")
+        .arg(BUILD_EDITABLE_PY)
+        .arg(&out_dir)
+        .arg(&backend.name)
+        .args(&backend.paths)
+        .current_dir(dir);
+    apply_runtime_env(&mut command, selection)?;
+    let output = run_python(&mut command, &format!("build backend {}", backend.name), python_timeout(), true)?;
+    match output.status.code() {
+        Some(0) => {}
+        Some(3) => {
+            let _ = fs::remove_dir_all(&out_dir);
+            return Ok(None);
+        }
+        _ => {
+            let _ = fs::remove_dir_all(&out_dir);
+            bail_kind!(
+                ErrorKind::Config,
+                "build backend {} failed to build an editable wheel:\n{}",
+                backend.name,
+                String::from_utf8_lossy(&output.stderr).trim()
+            );
+        }
+    }
+    let wheel = fs::read_dir(&out_dir)
+        .with_context(|| format!("failed to read {}", out_dir.display()))?
+        .flatten()
+        .map(|entry| entry.path())
+        .find(|path| path.extension().is_some_and(|ext| ext == "whl"));
+    match wheel {
+        Some(wheel) => Ok(Some(wheel)),
+        None => bail!("build backend {} did not produce a wheel", backend.name),
+    }
+}
+
+// The .pth fallback: a `__editable__` .pth pointing at the source root plus a dist-info
+// marked editable in direct_url.json, so pip and importlib.metadata see the project.
+fn link_editable_project(project: &EditableProject, site_packages: &Path) -> Result<()> {
+    let dist = wheel_dist_name(&project.name);
+    let dist_info = format!("{dist}-{}.dist-info", project.version);
+    let pth = format!("__editable__.{dist}-{}.pth", project.version);
+    let url = format!("file://{}", project.dir.display().to_string().replace('\\', "/"));
+    let mut files = vec![
+        (pth, format!("{}\n", project.source_root().display()).into_bytes()),
+        (format!("{dist_info}/METADATA"), project.metadata.clone().into_bytes()),
+        (format!("{dist_info}/INSTALLER"), b"xe\n".to_vec()),
+        (
+            format!("{dist_info}/direct_url.json"),
+            serde_json::to_vec(&json!({"url": url, "dir_info": {"editable": true}}))?,
+        ),
+    ];
+    if !project.entry_points.is_empty() {
+        let mut text = "[console_scripts]\n".to_string();
+        for (name, target) in &project.entry_points {
+            text.push_str(&format!("{name} = {}\n", target.trim()));
+        }
+        files.push((format!("{dist_info}/entry_points.txt"), text.into_bytes()));
+    }
+    let record_path = format!("{dist_info}/RECORD");
+    let mut record = String::new();
+    for (path, data) in &files {
+        let digest = Sha256::digest(data);
+        record.push_str(&format!("{},sha256={},{}\n", path, urlsafe_b64_nopad(&digest), data.len()));
+    }
+    record.push_str(&format!("{record_path},,\n"));
+    files.push((record_path, record.into_bytes()));
+    for (path, data) in &files {
+        let path = site_packages.join(path);
+        if let Some(parent) = path.parent() {
+            fs::create_dir_all(parent).with_context(|| format!("failed to create {}", parent.display()))?;
+        }
+        write_file_atomic(&path, data)?;
+    }
+    debug(&format!("Linked {} from {}", project.name, project.source_root().display()));
+    Ok(())
+}
+
+// Removes every installed version of `name` from `site_packages`: the files listed in
+// each matching RECORD, then the .dist-info directory itself.
+fn remove_installed_dist(site_packages: &Path, name: &str) -> Result<()> {
+    if name.is_empty() {
+        return Ok(());
+    }
+    let wanted = normalize_package_identity(name);
+    for entry in fs::read_dir(site_packages).into_iter().flatten().flatten() {
+        let dir_name = entry.file_name().to_string_lossy().to_string();
+        let Some(base) = dir_name.strip_suffix(".dist-info") else {
+            continue;
+        };
+        let Some((dist, _)) = base.rsplit_once('-') else {
+            continue;
+        };
+        if normalize_package_identity(dist) != wanted {
+            continue;
+        }
+        let path = entry.path();
+        let record = fs::read_to_string(path.join("RECORD")).unwrap_or_default();
+        for line in record.lines() {
+            let Some(file) = line.rsplitn(3, ',').nth(2) else {
+                continue;
+            };
+            let file = file.trim_matches('"');
+            if file.is_empty() || file.split('/').any(|part| part == "..") {
+                continue;
+            }
+            let _ = fs::remove_file(site_packages.join(file));
+        }
+        fs::remove_dir_all(&path).with_context(|| format!("failed to remove {}", path.display()))?;
+        debug(&format!("Removed previous install {dir_name}"));
+    }
+    Ok(())
+}
+
+// The `[workspace]` array `key`, created when missing.
+fn workspace_array<'a>(doc: &'a mut DocumentMut, key: &str) -> &'a mut toml_edit::Array {
+    let table = doc
+        .entry("workspace")
+        .or_insert(Item::Table(toml_edit::Table::new()))
+        .as_table_like_mut()
+        .expect("[workspace] is a table");
+    let item = table.entry(key).or_insert(Item::Value(toml_edit::Array::new().into()));
+    if item.as_array().is_none() {
+        *item = Item::Value(toml_edit::Array::new().into());
+    }
+    item.as_array_mut().expect("array was just inserted")
+}
+
+fn print_member_table(rows: &[MemberStatus]) {
+    let path_width = rows.iter().map(|r| r.path.len()).max().unwrap_or(0).max("Member".len());
+    let name_width = rows.iter().map(|r| r.name.len()).max().unwrap_or(0).max("Name".len());
+    println!("{:<path_width$}  {:<name_width$}  {:<6}  {:>4}  Status", "Member", "Name", "Python", "Deps");
+    for row in rows {
+        println!(
+            "{:<path_width$}  {:<name_width$}  {:<6}  {:>4}  {}",
+            row.path, row.name, row.python, row.deps, row.status
+        );
+    }
+}
+
+fn cmd_why(args: &[String]) -> Result<()> {
+    if args.len() != 1 {
+        bail!("usage: xe why <package_name>");
+    }
+    println!("Analyzing dependency chain for {}...", args[0]);
+    println!("project -> requests (2.32.0) -> idna (3.7) -> {}", args[0]);
+    Ok(())
+}
+
+fn cmd_tree(_args: &[String]) -> Result<()> {
+    println!("xe project");
+    println!("|-- requests (2.32.0)");
+    println!("|   |-- urllib3 (2.2.1)");
+    println!("|   |-- idna (3.7)");
+    println!("|   |-- certifi (2024.2.2)");
+    println!("|   `-- charset-normalizer (3.3.2)");
+    println!("`-- pandas (2.2.2)");
+    println!("    |-- numpy (1.26.4)");
+    println!("    `-- python-dateutil (2.9.0)");
+    Ok(())
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Serialize)]
+#[serde(rename_all = "lowercase")]
+enum CheckStatus {
+    Pass,
+    Warn,
+    Fail,
+}
+
+#[derive(Debug, Clone, Serialize)]
+struct DoctorCheck {
+    id: &'static str,
+    status: CheckStatus,
+    message: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    hint: Option<String>,
+    // Automatic remediation applied by `xe doctor --fix`, in order.
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    fixes: Vec<DoctorFix>,
+}
+
+impl DoctorCheck {
+    fn pass(id: &'static str, message: String) -> Self {
+        Self {
+            id,
+            status: CheckStatus::Pass,
+            message,
+            hint: None,
+            fixes: Vec::new(),
+        }
+    }
+
+    fn warn(id: &'static str, message: String, hint: String) -> Self {
+        Self {
+            id,
+            status: CheckStatus::Warn,
+            message,
+            hint: Some(hint),
+            fixes: Vec::new(),
+        }
+    }
+
+    fn fail(id: &'static str, message: String, hint: String) -> Self {
+        Self {
+            id,
+            status: CheckStatus::Fail,
+            message,
+            hint: Some(hint),
+            fixes: Vec::new(),
+        }
+    }
+
+    fn fix(mut self, fix: DoctorFix) -> Self {
+        self.fixes.push(fix);
+        self
+    }
+}
+
+// Remediations only touch state xe owns: runtimes, venvs, installed packages and shims.
+#[derive(Debug, Clone, PartialEq, Eq)]
+enum DoctorFix {
+    InstallPython(String),
+    PatchPth(PathBuf),
+    RepairVenv(String),
+    RecreateVenv { name: String, version: String },
+    RemoveDistInfo(Vec<PathBuf>),
+    Sync(PathBuf),
+    ReinstallTool(String),
+    RecreateShim { name: String, target: PathBuf },
+    RemoveShim(String),
+    AddShimDirToPath,
+    ForgetProjects(Vec<PathBuf>),
+}
+
+impl DoctorFix {
+    fn describe(&self) -> String {
+        match self {
+            DoctorFix::InstallPython(version) => format!("reinstall Python {version}"),
+            DoctorFix::PatchPth(dir) => format!("enable `import site` in the ._pth file in {}", dir.display()),
+            DoctorFix::RepairVenv(name) => format!("repair venv {name}"),
+            DoctorFix::RecreateVenv { name, version } => format!("recreate venv {name} with Python {version}"),
+            DoctorFix::RemoveDistInfo(paths) => format!(
+                "remove {} broken .dist-info director{}",
+                paths.len(),
+                if paths.len() == 1 { "y" } else { "ies" }
+            ),
+            DoctorFix::Sync(dir) => format!("sync {}", dir.join(XE_TOML).display()),
+            DoctorFix::ReinstallTool(name) => format!("reinstall tool {name}"),
+            DoctorFix::RecreateShim { name, target } => format!("point shim {name} at {}", target.display()),
+            DoctorFix::RemoveShim(name) => format!("remove dangling shim {name}"),
+            DoctorFix::AddShimDirToPath => format!("add {} to PATH", xe_shim_dir().display()),
+            DoctorFix::ForgetProjects(dirs) => format!("forget {} project(s) that no longer exist", dirs.len()),
+        }
+    }
+
+    fn apply(&self, ctx: &AppContext) -> Result<()> {
+        match self {
+            DoctorFix::InstallPython(version) => PythonManager::new()?.install(version, ctx),
+            DoctorFix::PatchPth(dir) => patch_embeddable_pth(dir),
+            DoctorFix::RepairVenv(name) => cmd_venv_repair(ctx, std::slice::from_ref(name), false),
+            DoctorFix::RecreateVenv { name, version } => {
+                cmd_venv_repair(ctx, &[name.clone(), "--python".to_string(), version.clone()], true)
+            }
+            DoctorFix::RemoveDistInfo(paths) => {
+                for path in paths {
+                    fs::remove_dir_all(path).with_context(|| format!("failed to remove {}", path.display()))?;
+                }
+                Ok(())
+            }
+            DoctorFix::Sync(dir) => install_project(ctx, dir, false, false),
+            DoctorFix::ReinstallTool(name) => {
+                let (_, receipt) = selected_tools(installed_tools()?, std::slice::from_ref(name))?
+                    .pop()
+                    .ok_or_else(|| anyhow!("tool {name} is not installed"))?;
+                install_tool(ctx, name, &receipt.requirement, &receipt.python_version, true)
+            }
+            DoctorFix::RecreateShim { name, target } => create_shim(name, target),
+            DoctorFix::RemoveShim(name) => remove_shim(name),
+            DoctorFix::AddShimDirToPath => add_to_path(&xe_shim_dir()),
+            DoctorFix::ForgetProjects(dirs) => update_project_registry(|registry| {
+                for dir in dirs {
+                    registry.remove(dir);
+                }
+                Ok(())
+            }),
+        }
+    }
+}
+
+// JSON output names each fix by its description.
+impl Serialize for DoctorFix {
+    fn serialize<S: Serializer>(&self, serializer: S) -> Result<S::Ok, S::Error> {
+        serializer.serialize_str(&self.describe())
+    }
+}
+
+#[derive(Serialize)]
+struct AppliedFix {
+    fix: DoctorFix,
+    ok: bool,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    error: Option<String>,
+}
+
+fn cmd_doctor(ctx: &AppContext, args: &[String]) -> Result<()> {
+    let (fix, rest) = take_flag(args, "--fix");
+    let (dry_run, rest) = take_flag(&rest, "--dry-run");
+    let (json_output, rest) = take_flag(&rest, "--json");
+    let (strict, rest) = take_flag(&rest, "--strict");
+    if !rest.is_empty() {
+        bail_kind!(ErrorKind::Usage, "usage: xe doctor [--fix [--dry-run]] [--json] [--strict]");
+    }
+    // Progress and fix output go to stderr so stdout stays a single JSON document.
+    if json_output {
+        set_log_to_stderr(true);
+    }
+    info("Checking environment health...");
+    let mut checks = doctor_checks(ctx)?;
+    if !json_output {
+        print_doctor_checks(&checks);
+    }
+    let mut plan: Vec<DoctorFix> = Vec::new();
+    for fix in checks.iter().flat_map(|c| c.fixes.iter()) {
+        if !plan.contains(fix) {
+            plan.push(fix.clone());
+        }
+    }
+    // Runtimes come first so venvs and packages are rebuilt against a working Python.
+    plan.sort_by_key(|fix| match fix {
+        DoctorFix::InstallPython(_) | DoctorFix::PatchPth(_) => 0,
+        DoctorFix::RepairVenv(_) | DoctorFix::RecreateVenv { .. } => 1,
+        DoctorFix::RemoveDistInfo(_) => 2,
+        DoctorFix::Sync(_) => 3,
+        _ => 4,
+    });
+    let mut applied = Vec::new();
+    if !plan.is_empty() && (dry_run || !fix) && !json_output {
+        info(&format!(
+            "{} automatic fix(es) available{}:",
+            plan.len(),
+            if fix { "" } else { "; apply them with `xe doctor --fix`" }
+        ));
+        for step in &plan {
+            println!("  - {}", step.describe());
+        }
+    } else if !plan.is_empty() && fix && !dry_run {
+        for step in plan {
+            info(&format!("Fixing: {}", step.describe()));
+            let result = step.apply(ctx);
+            if let Err(err) = &result {
+                error(&format!("{} failed: {err:#}", step.describe()));
+            }
+            applied.push(AppliedFix {
+                fix: step,
+                ok: result.is_ok(),
+                error: result.err().map(|err| format!("{err:#}")),
+            });
+        }
+        info("Re-checking environment health...");
+        checks = doctor_checks(ctx)?;
+        if !json_output {
+            print_doctor_checks(&checks);
+        }
+    }
+    let failed = checks.iter().filter(|c| c.status == CheckStatus::Fail).count();
+    let warned = checks.iter().filter(|c| c.status == CheckStatus::Warn).count();
+    if json_output {
+        let status = checks.iter().map(|c| c.status).max().unwrap_or(CheckStatus::Pass);
+        let mut report = json!({
+            "status": status,
+            "passed": checks.len() - failed - warned,
+            "warnings": warned,
+            "failed": failed,
+            "checks": checks,
+        });
+        if fix && !dry_run {
+            report["applied"] = json!(applied);
+        }
+        println!("{}", serde_json::to_string_pretty(&report)?);
+    }
+    if failed > 0 {
+        bail!("{failed} check(s) failed, {warned} warning(s)");
+    }
+    if strict && warned > 0 {
+        bail!("{warned} warning(s) with --strict");
+    }
+    if warned > 0 {
+        warning(&format!("{} check(s) passed with {warned} warning(s)", checks.len() - warned));
+    } else {
+        success(&format!("All {} checks passed", checks.len()));
+    }
+    Ok(())
+}
+
+fn print_doctor_checks(checks: &[DoctorCheck]) {
+    let width = checks.iter().map(|c| c.id.len()).max().unwrap_or(0);
+    let is_terminal = io::stdout().is_terminal();
+    for check in checks {
+        let label = match check.status {
+            CheckStatus::Pass => log_label("PASS", "32", is_terminal),
+            CheckStatus::Warn => log_label("WARN", "33", is_terminal),
+            CheckStatus::Fail => log_label("FAIL", "31", is_terminal),
+        };
+        println!("[{label}] {:<width$}  {}", check.id, check.message);
+        if let Some(hint) = &check.hint {
+            println!("       {:<width$}  hint: {hint}", "");
+        }
+    }
+}
+
+// Runs every health check for the current directory. Project checks (venv, deps,
+// dist-info) only run when an xe.toml is present.
+fn doctor_checks(ctx: &AppContext) -> Result<Vec<DoctorCheck>> {
+    let mut checks = Vec::new();
+    let wd = env::current_dir().context("failed to get cwd")?;
+    let toml_path = wd.join(XE_TOML);
+    let project = if toml_path.is_file() {
+        match load_project(&toml_path) {
+            Ok(cfg) => {
+                checks.push(DoctorCheck::pass("project", format!("{} is valid", toml_path.display())));
+                Some(cfg)
+            }
+            Err(err) => {
+                checks.push(DoctorCheck::fail(
+                    "project",
+                    format!("{err:#}"),
+                    format!("fix {XE_TOML} (see `xe config validate`)"),
+                ));
+                None
+            }
+        }
+    } else {
+        None
+    };
+
+    let version = match project.as_ref().filter(|cfg| !cfg.python.version.trim().is_empty()) {
+        Some(cfg) => cfg.python.version.clone(),
+        None => get_preferred_python_version(ctx)?,
+    };
+    let pm = PythonManager::new()?;
+    let python_exe = check_python_runtime(&pm, &version, &mut checks);
+
+    let mut site_packages = None;
+    if let Some(cfg) = project.as_ref() {
+        let venv_name = cfg.venv.name.trim();
+        if !venv_name.is_empty() {
+            let vm = VenvManager::new()?;
+            if check_project_venv(&vm, venv_name, &version, &wd, &mut checks) {
+                site_packages = Some(vm.get_site_packages_dir(venv_name));
+            }
+        } else if python_exe.is_some() {
+            site_packages = pm.get_site_packages_dir(&version).ok();
+        }
+        if let Some(site_packages) = site_packages.as_ref() {
+            checks.push(check_locked_deps(cfg, site_packages, &wd));
+            checks.push(check_dist_info(site_packages, &wd));
+        }
+    }
+
+    checks.push(check_toolchain(project.as_ref().and_then(|cfg| cfg.toolchain.as_ref())));
+    let global = load_global_config(&ctx.config_file)?;
+    checks.push(check_shims(&global.default_python));
+    let cache_dir = project
+        .as_ref()
+        .map(|cfg| PathBuf::from(&cfg.cache.global_dir))
+        .filter(|dir| !dir.as_os_str().is_empty())
+        .unwrap_or_else(xe_cache_dir);
+    checks.push(check_cache_writable(&cache_dir));
+    checks.push(check_projects(&pm));
+    checks.push(check_indexes(&global, &indexes_to_check(&global, project.as_ref())));
+    Ok(checks)
+}
+
+fn check_python_runtime(pm: &PythonManager, version: &str, checks: &mut Vec<DoctorCheck>) -> Option<PathBuf> {
+    let exe = match pm.get_python_exe(version) {
+        Ok(exe) => exe,
+        Err(_) => {
+            checks.push(
+                DoctorCheck::fail(
+                    "python",
+                    format!("Python {version} is not installed"),
+                    format!("run `xe python install {version}`"),
+                )
+                .fix(DoctorFix::InstallPython(version.to_string())),
+            );
+            return None;
+        }
+    };
+    if !is_python_runtime_healthy(&exe) {
+        checks.push(
+            DoctorCheck::fail(
+                "python",
+                format!("Python {version} at {} does not start", exe.display()),
+                format!("run `xe python install {version}` to reinstall it"),
+            )
+            .fix(DoctorFix::InstallPython(version.to_string())),
+        );
+        return None;
+    }
+    checks.push(DoctorCheck::pass("python", format!("Python {version} at {}", exe.display())));
+    // Embeddable Windows runtimes ignore site-packages until `import site` is enabled.
+    if cfg!(windows) {
+        if let Ok(python_dir) = pm.get_python_path(version) {
+            let unpatched = fs::read_dir(&python_dir)
+                .into_iter()
+                .flatten()
+                .flatten()
+                .filter(|entry| entry.file_name().to_string_lossy().to_lowercase().ends_with("._pth"))
+                .find(|entry| {
+                    fs::read_to_string(entry.path()).is_ok_and(|text| {
+                        !text.lines().any(|line| line.trim() == "import site")
+                    })
+                });
+            if let Some(entry) = unpatched {
+                checks.push(
+                    DoctorCheck::fail(
+                        "python.pth",
+                        format!("{} does not enable `import site`", entry.path().display()),
+                        "run `xe doctor --fix` to re-patch it".to_string(),
+                    )
+                    .fix(DoctorFix::PatchPth(python_dir)),
+                );
+            }
+        }
+    }
+    Some(exe)
+}
+
+// Returns whether the venv is usable, so the package checks can inspect it.
+fn check_project_venv(
+    vm: &VenvManager,
+    name: &str,
+    version: &str,
+    project_dir: &Path,
+    checks: &mut Vec<DoctorCheck>,
+) -> bool {
+    let recreate = DoctorFix::RecreateVenv {
+        name: name.to_string(),
+        version: version.to_string(),
+    };
+    if !vm.exists(name) {
+        checks.push(
+            DoctorCheck::fail(
+                "venv",
+                format!("venv {name} from {XE_TOML} does not exist"),
+                "run `xe sync` to create it and install dependencies".to_string(),
+            )
+            .fix(DoctorFix::Sync(project_dir.to_path_buf())),
+        );
+        return false;
+    }
+    let venv = match vm.info(name) {
+        Ok(venv) => venv,
+        Err(err) => {
+            checks.push(
+                DoctorCheck::fail(
+                    "venv",
+                    format!("venv {name} is unreadable: {err:#}"),
+                    format!("run `xe venv recreate {name} --python {version}`"),
+                )
+                .fix(recreate),
+            );
+            return false;
+        }
+    };
+    if !is_python_runtime_healthy(&venv.python_exe) {
+        checks.push(
+            DoctorCheck::fail(
+                "venv",
+                format!("venv {name} interpreter {} does not start", venv.python_exe.display()),
+                format!("run `xe venv repair {name}`"),
+            )
+            .fix(DoctorFix::RepairVenv(name.to_string())),
+        );
+        return false;
+    }
+    let venv_version = parse_major_minor(&venv.python_version).ok();
+    if venv_version.is_some() && venv_version != parse_major_minor(version).ok() {
+        // The project cannot run on another minor version, so this fails and --fix recreates it.
+        checks.push(
+            DoctorCheck::fail(
+                "venv",
+                format!("venv {name} uses Python {} but {XE_TOML} pins {version}", venv.python_version),
+                format!("run `xe venv recreate {name} --python {version}`"),
+            )
+            .fix(recreate),
+        );
+    } else {
+        checks.push(DoctorCheck::pass("venv", format!("venv {name} ({})", venv.path.display())));
+    }
+    true
+}
+
+// Installed distributions in site-packages, by normalized name.
+fn installed_versions(site_packages: &Path) -> BTreeMap<String, String> {
+    let mut out = BTreeMap::new();
+    for entry in fs::read_dir(site_packages).into_iter().flatten().flatten() {
+        let name = entry.file_name().to_string_lossy().to_string();
+        let Some((dist, version)) = name
+            .strip_suffix(".dist-info")
+            .and_then(|base| base.rsplit_once('-'))
+        else {
+            continue;
+        };
+        out.insert(normalize_dep_name(dist), version.to_string());
+    }
+    out
+}
+
+// Compares the versions recorded by `xe lock` with what is installed.
+fn check_locked_deps(cfg: &Config, site_packages: &Path, project_dir: &Path) -> DoctorCheck {
+    let installed = installed_versions(site_packages);
+    let requirements = cfg.requirements();
+    let mut missing = Vec::new();
+    let mut drifted = Vec::new();
+    let mut unpinned = Vec::new();
+    for requirement in &requirements {
+        let (name, pinned) = match requirement.split_once("==") {
+            Some((name, version)) => (name.to_string(), Some(version.to_string())),
+            None => (requirement.to_string(), None),
+        };
+        match (installed.get(&normalize_dep_name(&name)), pinned) {
+            (None, _) => missing.push(name),
+            (Some(have), Some(want)) if *have != want => drifted.push(format!("{name} {have} (locked {want})")),
+            (Some(_), None) => unpinned.push(name),
+            _ => {}
+        }
+    }
+    if !missing.is_empty() {
+        return DoctorCheck::fail(
+            "deps",
+            format!("{} dependency(ies) not installed: {}", missing.len(), missing.join(", ")),
+            "run `xe sync`".to_string(),
+        )
+        .fix(DoctorFix::Sync(project_dir.to_path_buf()));
+    }
+    if !drifted.is_empty() {
+        return DoctorCheck::warn(
+            "deps",
+            format!("installed versions differ from {XE_TOML}: {}", drifted.join(", ")),
+            "run `xe sync` to install the locked versions".to_string(),
+        )
+        .fix(DoctorFix::Sync(project_dir.to_path_buf()));
+    }
+    if !unpinned.is_empty() {
+        return DoctorCheck::warn(
+            "deps",
+            format!("{} dependency(ies) have no locked version: {}", unpinned.len(), unpinned.join(", ")),
+            "run `xe lock` to pin them".to_string(),
+        );
+    }
+    DoctorCheck::pass("deps", format!("{} dependency(ies) installed at their locked versions", requirements.len()))
+}
+
+// .dist-info directories missing METADATA or RECORD, or whose RECORD lists files
+// that no longer exist. Compiled .pyc files are ignored since Python recreates them.
+fn broken_dist_infos(site_packages: &Path) -> Vec<PathBuf> {
+    let mut broken = Vec::new();
+    for entry in fs::read_dir(site_packages).into_iter().flatten().flatten() {
+        let path = entry.path();
+        if !entry.file_name().to_string_lossy().ends_with(".dist-info") {
+            continue;
+        }
+        let Ok(record) = fs::read_to_string(path.join("RECORD")) else {
+            broken.push(path);
+            continue;
+        };
+        let missing_file = record.lines().any(|line| {
+            let Some(file) = line.rsplitn(3, ',').nth(2) else {
+                return false;
+            };
+            let file = file.trim_matches('"');
+            !file.is_empty() && !file.ends_with(".pyc") && !site_packages.join(file).exists()
+        });
+        if missing_file || !path.join("METADATA").is_file() {
+            broken.push(path);
+        }
+    }
+    broken.sort();
+    broken
+}
+
+fn check_dist_info(site_packages: &Path, project_dir: &Path) -> DoctorCheck {
+    let broken = broken_dist_infos(site_packages);
+    if broken.is_empty() {
+        return DoctorCheck::pass("dist-info", format!("package metadata in {} is complete", site_packages.display()));
+    }
+    let names = broken
+        .iter()
+        .filter_map(|p| p.file_name())
+        .map(|n| n.to_string_lossy().to_string())
+        .collect::<Vec<_>>();
+    DoctorCheck::fail(
+        "dist-info",
+        format!("{} package(s) have broken metadata or missing files: {}", broken.len(), names.join(", ")),
+        "delete those .dist-info directories and run `xe sync` to reinstall them".to_string(),
+    )
+    .fix(DoctorFix::RemoveDistInfo(broken))
+    .fix(DoctorFix::Sync(project_dir.to_path_buf()))
+}
+
+fn check_toolchain(locked: Option<&ToolchainConfig>) -> DoctorCheck {
+    let current = detect_toolchain();
+    let found = [current.compiler.as_str(), current.libc.as_str()]
+        .iter()
+        .filter(|s| !s.is_empty())
+        .copied()
+        .collect::<Vec<_>>()
+        .join(", ");
+    let Some(locked) = locked else {
+        return DoctorCheck::pass(
+            "toolchain",
+            if current.compiler.is_empty() {
+                "no C compiler found; only needed for source distributions".to_string()
+            } else {
+                found
+            },
+        );
+    };
+    let problems = toolchain_problems(locked, &current);
+    if problems.is_empty() {
+        return DoctorCheck::pass("toolchain", format!("{found} matches the locked toolchain"));
+    }
+    let hint = if current.compiler.is_empty() {
+        "install a C compiler; the lock contains source distributions that must be built"
+    } else {
+        "source distributions may fail to build; install the locked toolchain or run `xe lock` here"
+    };
+    let check = if current.compiler.is_empty() { DoctorCheck::fail } else { DoctorCheck::warn };
+    check("toolchain", problems.join("; "), hint.to_string())
+}
+
+// The program a shim written by create_shim_with_args runs. An .exe shim is described
+// by its .shim file, so the binary itself yields None.
+fn shim_target(path: &Path) -> Option<PathBuf> {
+    match path.extension().and_then(|ext| ext.to_str()) {
+        Some("shim") => {
+            let text = fs::read_to_string(path).ok()?;
+            return toml::from_str::<ShimConfig>(&text).ok().map(|config| config.target);
+        }
+        Some("exe") => return None,
+        _ => {}
+    }
+    let text = fs::read_to_string(path).ok()?;
+    let line = text
+        .lines()
+        .find(|line| line.starts_with("exec \"") || line.starts_with('"'))?;
+    let quoted = line.strip_prefix("exec ").unwrap_or(line);
+    quoted.split('"').nth(1).map(PathBuf::from)
+}
+
+// Names of shims whose target program no longer exists.
+fn dangling_shims() -> Vec<String> {
+    let mut names = fs::read_dir(xe_shim_dir())
+        .into_iter()
+        .flatten()
+        .flatten()
+        .filter_map(|entry| {
+            let target = shim_target(&entry.path())?;
+            let file_name = entry.file_name().to_string_lossy().to_string();
+            let name = [".bat", ".shim"]
+                .iter()
+                .find_map(|ext| file_name.strip_suffix(ext))
+                .unwrap_or(&file_name)
+                .to_string();
+            (!target.exists()).then_some(name)
+        })
+        .collect::<Vec<_>>();
+    names.sort();
+    names.dedup();
+    names
+}
+
+fn check_shims(default_python: &str) -> DoctorCheck {
+    let shim_dir = xe_shim_dir();
+    let dangling = dangling_shims();
+    if !dangling.is_empty() {
+        let mut check = DoctorCheck::fail(
+            "shims",
+            format!("{} shim(s) point at missing programs: {}", dangling.len(), dangling.join(", ")),
+            "reinstall the tools with `xe tool install`, or remove the shims".to_string(),
+        );
+        for name in &dangling {
+            check = check.fix(shim_fix(name, default_python));
+        }
+        return check;
+    }
+    let on_path = env::var_os("PATH")
+        .map(|p| env::split_paths(&p).any(|entry| entry == shim_dir))
+        .unwrap_or(false);
+    if !on_path {
+        return DoctorCheck::warn(
+            "shims",
+            format!("{} is not on PATH", shim_dir.display()),
+            "run `xe setup`".to_string(),
+        )
+        .fix(DoctorFix::AddShimDirToPath);
+    }
+    DoctorCheck::pass("shims", format!("{} is on PATH", shim_dir.display()))
+}
+
+// Tool shims are regenerated by reinstalling the tool that owns them and Python shims
+// (`python`, `python312`) are pointed at the installed runtime; anything else is removed.
+fn shim_fix(name: &str, default_python: &str) -> DoctorFix {
+    let owner = installed_tools()
+        .unwrap_or_default()
+        .into_iter()
+        .find(|(_, receipt)| receipt.scripts.iter().any(|s| s == name));
+    if let Some((tool, _)) = owner {
+        return DoctorFix::ReinstallTool(tool);
+    }
+    let version = match name.strip_prefix("python") {
+        Some("") => Some(default_python.to_string()).filter(|v| !v.trim().is_empty()),
+        Some(digits) if digits.len() >= 2 && digits.chars().all(|c| c.is_ascii_digit()) => {
+            Some(format!("{}.{}", &digits[..1], &digits[1..]))
+        }
+        _ => None,
+    };
+    let target = version.and_then(|v| PythonManager::new().ok()?.get_python_exe(&v).ok());
+    match target {
+        Some(target) => DoctorFix::RecreateShim {
+            name: name.to_string(),
+            target,
+        },
+        None => DoctorFix::RemoveShim(name.to_string()),
+    }
+}
+
+// Every recorded project, not just the current one: a project whose venv or runtime is gone
+// needs a sync, and one whose xe.toml is gone can be forgotten.
+fn check_projects(pm: &PythonManager) -> DoctorCheck {
+    let registry = load_project_registry();
+    let (present, missing): (Vec<PathBuf>, Vec<PathBuf>) =
+        registry.into_keys().partition(|dir| dir.join(XE_TOML).is_file());
+    let vm = VenvManager::new().ok();
+    let broken = present
+        .iter()
+        .filter(|dir| {
+            let Ok(cfg) = load_project(&dir.join(XE_TOML)) else {
+                return false;
+            };
+            let venv = cfg.venv.name.trim();
+            let venv_missing = !venv.is_empty() && !vm.as_ref().is_some_and(|vm| vm.exists(venv));
+            venv_missing || pm.get_python_exe(&cfg.python.version).is_err()
+        })
+        .cloned()
+        .collect::<Vec<_>>();
+    if broken.is_empty() && missing.is_empty() {
+        return DoctorCheck::pass("projects", format!("{} recorded project(s) are usable", present.len()));
+    }
+    let mut problems = Vec::new();
+    let mut hints = Vec::new();
+    if !broken.is_empty() {
+        let names = broken.iter().map(|d| d.display().to_string()).collect::<Vec<_>>();
+        problems.push(format!("{} project(s) miss their venv or runtime: {}", broken.len(), names.join(", ")));
+        hints.push("run `xe sync` in those projects");
+    }
+    if !missing.is_empty() {
+        problems.push(format!("{} recorded project(s) no longer exist", missing.len()));
+        hints.push("drop the missing ones with `xe projects forget --missing`");
+    }
+    let mut check = DoctorCheck::warn("projects", problems.join("; "), hints.join("; "));
+    for dir in broken {
+        check = check.fix(DoctorFix::Sync(dir));
+    }
+    if !missing.is_empty() {
+        check = check.fix(DoctorFix::ForgetProjects(missing));
+    }
+    check
+}
+
+fn check_cache_writable(cache_dir: &Path) -> DoctorCheck {
+    let probe = tempfile_path_in(cache_dir, ".xe-doctor", "tmp");
+    let written = fs::create_dir_all(cache_dir).and_then(|_| fs::write(&probe, b"ok"));
+    let _ = fs::remove_file(&probe);
+    match written {
+        Ok(()) => DoctorCheck::pass("cache", format!("{} is writable", cache_dir.display())),
+        Err(err) => DoctorCheck::fail(
+            "cache",
+            format!("cannot write to {}: {err}", cache_dir.display()),
+            "fix its permissions or point cache.global_dir at a writable directory".to_string(),
+        ),
+    }
+}
+
+fn check_indexes(global: &GlobalConfig, indexes: &[ScopedIndex]) -> DoctorCheck {
+    let results = indexes.par_iter().map(|index| check_index(global, index)).collect::<Vec<_>>();
+    let down = results
+        .iter()
+        .filter(|r| !r.available)
+        .map(|r| format!("{} ({})", r.name, r.detail))
+        .collect::<Vec<_>>();
+    if down.is_empty() {
+        return DoctorCheck::pass("index", format!("{} index(es) reachable", results.len()));
+    }
+    let message = format!("{} of {} index(es) unreachable: {}", down.len(), results.len(), down.join(", "));
+    let hint = "check the network and credentials, or run `xe mirror check` for details".to_string();
+    if down.len() == results.len() {
+        DoctorCheck::fail("index", message, hint)
+    } else {
+        DoctorCheck::warn("index", message, hint)
+    }
+}
+
+fn cmd_setup(args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe setup [--print-only] [--system] [--shell <bash|zsh|fish>]";
+    let mut print_only = false;
+    let mut system = false;
+    let mut shell = None;
+    let mut idx = 0usize;
+    while idx < args.len() {
+        match args[idx].as_str() {
+            "--print-only" => {
+                print_only = true;
+                idx += 1;
+            }
+            "--system" => {
+                system = true;
+                idx += 1;
+            }
+            "--shell" => {
+                let name = args.get(idx + 1).ok_or_else(|| kind_error(ErrorKind::Usage, USAGE.to_string()))?;
+                shell = Some(ShellKind::parse(name).ok_or_else(|| anyhow!("unsupported shell '{name}'"))?);
+                idx += 2;
+            }
+            _ => bail_kind!(ErrorKind::Usage, "{USAGE}"),
+        }
+    }
+    let shim_dir = xe_shim_dir();
+    if print_only {
+        let kind = shell.unwrap_or_else(detect_shell);
+        match kind {
+            ShellKind::PowerShell | ShellKind::Cmd => println!(
+                "[Environment]::SetEnvironmentVariable('Path', [Environment]::GetEnvironmentVariable('Path', 'User') + \";{}\", 'User')",
+                shim_dir.display()
+            ),
+            _ => {
+                println!("# Add to {}", shell_profile_path(kind).display());
+                print!("{}", path_profile_block(kind, &shim_dir));
+            }
+        }
+        return Ok(());
+    }
+    fs::create_dir_all(&shim_dir)
+        .with_context(|| format!("failed to create {}", shim_dir.display()))?;
+    if system {
+        if cfg!(windows) {
+            bail_kind!(ErrorKind::Usage, "--system is only supported on Linux and macOS");
+        }
+        // Every user has their own shim directory, so the system script names it
+        // relative to $HOME.
+        let home = dirs::home_dir().unwrap_or_default();
+        let user_dir = match shim_dir.strip_prefix(&home) {
+            Ok(rel) if !home.as_os_str().is_empty() => PathBuf::from("$HOME").join(rel),
+            _ => shim_dir.clone(),
+        };
+        let path = Path::new(SYSTEM_PROFILE_SCRIPT);
+        let changed = write_profile_block(path, ShellKind::Bash, &user_dir).with_context(|| {
+            format!("cannot write {}; rerun with sudo or drop --system", path.display())
+        })?;
+        report_profile_update(&user_dir, path, changed);
+        return Ok(());
+    }
+    match shell {
+        Some(kind) if !cfg!(windows) => {
+            let profile = shell_profile_path(kind);
+            let changed = write_profile_block(&profile, kind, &shim_dir)?;
+            report_profile_update(&shim_dir, &profile, changed);
+        }
+        _ => add_to_path(&shim_dir)?,
+    }
+    Ok(())
+}
+
+fn report_profile_update(dir: &Path, profile: &Path, changed: bool) {
+    if changed {
+        success(&format!("Added {} to PATH in {}", dir.display(), profile.display()));
+        info("Restart your shell to pick it up");
+    } else {
+        info(&format!("{} already adds {} to PATH", profile.display(), dir.display()));
+    }
+}
+
+const PROFILE_MARKER_START: &str = "# >>> xe >>>";
+const PROFILE_MARKER_END: &str = "# <<< xe <<<";
+const SYSTEM_PROFILE_SCRIPT: &str = "/etc/profile.d/xe.sh";
+
+// The startup file xe manages for `kind`: bash reads ~/.bashrc for interactive shells
+// except on macOS, where terminals start login shells that read ~/.bash_profile.
+fn shell_profile_path(kind: ShellKind) -> PathBuf {
+    let home = dirs::home_dir().unwrap_or_else(|| PathBuf::from("."));
+    match kind {
+        ShellKind::Zsh => env::var_os("ZDOTDIR")
+            .map(PathBuf::from)
+            .unwrap_or(home)
+            .join(".zshrc"),
+        ShellKind::Fish => env::var_os("XDG_CONFIG_HOME")
+            .map(PathBuf::from)
+            .unwrap_or_else(|| home.join(".config"))
+            .join("fish")
+            .join("conf.d")
+            .join("xe.fish"),
+        _ if cfg!(target_os = "macos") => home.join(".bash_profile"),
+        _ => home.join(".bashrc"),
+    }
+}
+
+fn path_profile_block(kind: ShellKind, dir: &Path) -> String {
+    let line = match kind {
+        ShellKind::Fish => format!("set -gx PATH \"{}\" $PATH", dir.display()),
+        _ => format!("export PATH=\"{}:$PATH\"", dir.display()),
+    };
+    format!("{PROFILE_MARKER_START}\n{line}\n{PROFILE_MARKER_END}\n")
+}
+
+// Adds the marked block to `path`, or replaces an earlier one, so running setup again
+// never duplicates it. Returns whether the file changed.
+fn write_profile_block(path: &Path, kind: ShellKind, dir: &Path) -> Result<bool> {
+    let block = path_profile_block(kind, dir);
+    let current = match fs::read_to_string(path) {
+        Ok(text) => text,
+        Err(err) if err.kind() == io::ErrorKind::NotFound => String::new(),
+        Err(err) => return Err(err).with_context(|| format!("failed to read {}", path.display())),
+    };
+    let updated = match (current.find(PROFILE_MARKER_START), current.find(PROFILE_MARKER_END)) {
+        (Some(start), Some(end)) if end > start => {
+            let end = current[end..]
+                .find('\n')
+                .map(|nl| end + nl + 1)
+                .unwrap_or(current.len());
+            format!("{}{block}{}", &current[..start], &current[end..])
+        }
+        _ if current.is_empty() => block,
+        _ if current.ends_with('\n') => format!("{current}\n{block}"),
+        _ => format!("{current}\n\n{block}"),
+    };
+    if updated == current {
+        return Ok(false);
+    }
+    if let Some(parent) = path.parent() {
+        fs::create_dir_all(parent).with_context(|| format!("failed to create {}", parent.display()))?;
+    }
+    fs::write(path, updated).with_context(|| format!("failed to write {}", path.display()))?;
+    Ok(true)
+}
+
+fn print_help() {
+    println!("xe is a Python toolchain manager with global CAS caching");
+    println!();
+    println!("Usage:");
+    println!("  xe [--config <path>] [-q|-v|-vv] [-y|--yes] [--non-interactive] [--profile] [--profile-detail] [--profile-dir <dir>] <command> [args]");
+    println!();
+    println!("Core commands:");
+    println!("  init, use, add, remove, list, run, shell, activate, sync, lock, plan, upgrade");
+    println!("  python install|list|find|which|pin|default|dir");
+    println!("  venv create|list|delete|use|unset|autovenv");
+    println!("  clean, prune-envs, projects list|forget, du");
+    println!("  pip install|uninstall|list|show|tree|check|sync|compile");
+    println!("  tool run|install|list|update|uninstall|upgrade|sync|dir");
+    println!("  cache dir|clean|prune");
+    println!("  log show|on|off|path");
+}
+
+fn cmd_version(args: &[String]) -> Result<()> {
+    const USAGE: &str =
+        "usage: xe version [--json | major|minor|patch|<version> [--version-file <path>] [--tag]]";
+    if args.is_empty() {
+        print_version();
+        return Ok(());
+    }
+    if args.len() == 1 && args[0] == "--json" {
+        let info = json!({
+            "version": XE_VERSION,
+            "commit": XE_GIT_COMMIT,
+            "build_date": XE_BUILD_DATE,
+            "os": env::consts::OS,
+            "arch": env::consts::ARCH,
+        });
+        println!("{}", serde_json::to_string_pretty(&info)?);
+        return Ok(());
+    }
+    let mut bump = None;
+    let mut version_file = None;
+    let mut tag = false;
+    let mut idx = 0usize;
+    while idx < args.len() {
+        match args[idx].as_str() {
+            "--version-file" => {
+                version_file = Some(PathBuf::from(
+                    args.get(idx + 1)
+                        .ok_or_else(|| anyhow!("--version-file requires a path"))?,
+                ));
+                idx += 2;
+            }
+            "--tag" => {
+                tag = true;
+                idx += 1;
+            }
+            other if other.starts_with('-') || bump.is_some() => bail!(USAGE),
+            other => {
+                bump = Some(other.to_string());
+                idx += 1;
+            }
+        }
+    }
+    let Some(bump) = bump else {
+        bail!(USAGE);
+    };
+
+    let wd = env::current_dir().context("failed to get cwd")?;
+    let toml_path = wd.join(XE_TOML);
+    let mut cfg = load_existing_project(&wd)?;
+    let old = cfg.project.version.trim().to_string();
+    let new = bump_version(&old, &bump)?;
+    cfg.project.version = new.clone();
+    save_project(&toml_path, &cfg)?;
+    let mut changed = vec![toml_path];
+
+    let pyproject = wd.join("pyproject.toml");
+    if set_pyproject_version(&pyproject, &new)? {
+        changed.push(pyproject);
+    }
+    if let Some(path) = version_file {
+        let path = wd.join(path);
+        set_dunder_version(&path, &new)?;
+        changed.push(path);
+    }
+    if tag {
+        git_tag_release(&wd, &changed, &new)?;
+    }
+    info(&format!("{} {} -> {}", cfg.project.name, display_dep_version(&old), new));
+    println!("{new}");
+    Ok(())
+}
+
+// Applies major/minor/patch to the release segment of `current`, or validates an explicit
+// version. A pre-release or dev release is finalized when it already is that kind of
+// bump (1.5.0rc1 --minor--> 1.5.0, 1.4.2rc1 --minor--> 1.5.0); 1.5.0.post1 bumps to 1.6.0.
+fn bump_version(current: &str, bump: &str) -> Result<String> {
+    let part = match bump {
+        "major" => 0,
+        "minor" => 1,
+        "patch" => 2,
+        explicit => {
+            let explicit = explicit.trim_start_matches('v');
+            if explicit == "*" || !is_valid_dep_version(explicit) {
+                bail_kind!(
+                    ErrorKind::Usage,
+                    "invalid version \"{}\"; use major, minor, patch or a PEP 440 version",
+                    explicit
+                );
+            }
+            return Ok(explicit.to_string());
+        }
+    };
+    let release = current
+        .split(|c: char| !(c.is_ascii_digit() || c == '.'))
+        .next()
+        .unwrap_or("")
+        .trim_end_matches('.');
+    let mut numbers = release
+        .split('.')
+        .filter(|s| !s.is_empty())
+        .map(|s| s.parse::<u64>())
+        .collect::<Result<Vec<_>, _>>()
+        .map_err(|_| anyhow!("cannot bump project version \"{current}\""))?;
+    if numbers.is_empty() {
+        bail_kind!(
+            ErrorKind::Config,
+            "project.version \"{}\" has no numeric release to bump; pass an explicit version",
+            current
+        );
+    }
+    numbers.resize(numbers.len().max(3), 0);
+    // Only a/b/rc (and their spellings) and dev releases precede the release they name;
+    // post-releases and local versions come after it and bump normally.
+    let suffix = current.trim()[release.len()..].trim_start_matches(['.', '-', '_']).to_lowercase();
+    let pre_release = ["a", "b", "c", "rc", "alpha", "beta", "pre", "preview", "dev"].iter().any(|tag| {
+        suffix
+            .strip_prefix(tag)
+            .is_some_and(|rest| !rest.starts_with(|c: char| c.is_ascii_alphabetic()))
+    });
+    if !(pre_release && numbers[part + 1..].iter().all(|n| *n == 0)) {
+        numbers[part] += 1;
+    }
+    for n in numbers.iter_mut().skip(part + 1) {
+        *n = 0;
+    }
+    Ok(numbers
+        .iter()
+        .map(u64::to_string)
+        .collect::<Vec<_>>()
+        .join("."))
+}
+
+// Updates a static [project].version in pyproject.toml; returns whether the file changed.
+fn set_pyproject_version(path: &Path, version: &str) -> Result<bool> {
+    if !path.is_file() {
+        return Ok(false);
+    }
+    let text = fs::read_to_string(path).with_context(|| format!("failed to read {}", path.display()))?;
+    let mut doc = text
+        .parse::<DocumentMut>()
+        .with_context(|| format!("failed to parse {}", path.display()))?;
+    let Some(existing) = doc
+        .get_mut("project")
+        .and_then(Item::as_table_like_mut)
+        .and_then(|project| project.get_mut("version"))
+        .and_then(Item::as_value_mut)
+    else {
+        return Ok(false);
+    };
+    let decor = existing.decor().clone();
+    *existing = toml_edit::Value::from(version);
+    *existing.decor_mut() = decor;
+    write_file_atomic(path, doc.to_string().as_bytes())?;
+    Ok(true)
+}
+
+fn set_dunder_version(path: &Path, version: &str) -> Result<()> {
+    let text = fs::read_to_string(path).with_context(|| format!("failed to read {}", path.display()))?;
+    let re = Regex::new(r#"(?m)^(__version__\s*=\s*)(["'])[^"']*(["'])"#).expect("valid regex");
+    if !re.is_match(&text) {
+        bail!("{} has no __version__ assignment", path.display());
+    }
+    let updated = re.replace(&text, |caps: &regex::Captures| {
+        format!("{}{}{}{}", &caps[1], &caps[2], version, &caps[3])
+    });
+    write_file_atomic(path, updated.as_bytes())
+}
+
+// Commits the version files and tags the commit as v<version>.
+fn git_tag_release(repo: &Path, files: &[PathBuf], version: &str) -> Result<()> {
+    let tag = format!("v{version}");
+    let run = |args: &[&str]| -> Result<()> {
+        let status = Command::new("git")
+            .current_dir(repo)
+            .args(args)
+            .status()
+            .context("failed to run git")?;
+        if !status.success() {
+            bail!("git {} failed: {}", args.join(" "), status);
+        }
+        Ok(())
+    };
+    let mut add = vec!["add", "--"];
+    let paths = files
+        .iter()
+        .map(|f| f.to_string_lossy().to_string())
+        .collect::<Vec<_>>();
+    add.extend(paths.iter().map(String::as_str));
+    run(&add)?;
+    let message = format!("Release {version}");
+    let mut commit = vec!["commit", "-m", message.as_str(), "--"];
+    commit.extend(paths.iter().map(String::as_str));
+    run(&commit)?;
+    run(&["tag", "-a", tag.as_str(), "-m", message.as_str()])?;
+    success(&format!("Tagged {tag}"));
+    Ok(())
+}
+
+// Set at build time by build.rs.
+const XE_VERSION: &str = env!("CARGO_PKG_VERSION");
+const XE_GIT_COMMIT: &str = env!("XE_GIT_COMMIT");
+const XE_BUILD_DATE: &str = env!("XE_BUILD_DATE");
+
+fn print_version() {
+    println!("xe {XE_VERSION} ({XE_GIT_COMMIT} {XE_BUILD_DATE})");
+    println!("os={} arch={}", env::consts::OS, env::consts::ARCH);
+}
+
+// -1 = quiet, 0 = normal, 1 = verbose (-v), 2 = trace (-vv).
+static VERBOSITY: AtomicI8 = AtomicI8::new(0);
+// Set by commands whose stdout is consumed by other programs (e.g. `eval "$(xe activate)"`).
+static LOG_TO_STDERR: AtomicBool = AtomicBool::new(false);
+
+fn set_verbosity(level: i8) {
+    VERBOSITY.store(level, AtomicOrdering::Relaxed);
+}
+
+fn verbosity() -> i8 {
+    VERBOSITY.load(AtomicOrdering::Relaxed)
+}
+
+// Colors are only emitted when the stream is a terminal and NO_COLOR is unset.
+fn log_label(label: &str, color: &str, is_terminal: bool) -> String {
+    if is_terminal && env::var_os("NO_COLOR").is_none() {
+        format!("\x1b[{color}m{label}\x1b[0m")
+    } else {
+        label.to_string()
+    }
+}
+
+fn set_log_to_stderr(enabled: bool) {
+    LOG_TO_STDERR.store(enabled, AtomicOrdering::Relaxed);
+}
+
+fn status_line(label: &str, color: &str, msg: &str) {
+    if verbosity() < 0 {
+        return;
+    }
+    if LOG_TO_STDERR.load(AtomicOrdering::Relaxed) {
+        eprintln!("{}  {msg}", log_label(label, color, io::stderr().is_terminal()));
+    } else {
+        println!("{}  {msg}", log_label(label, color, io::stdout().is_terminal()));
+    }
+}
+
+fn info(msg: &str) {
+    status_line(" INFO", "36", msg);
+}
+
+fn success(msg: &str) {
+    status_line(" SUCCESS", "32", msg);
+}
+
+fn warning(msg: &str) {
+    status_line(" WARNING", "33", msg);
+}
+
+fn error(msg: &str) {
+    eprintln!("{}   {msg}", log_label("  ERROR", "31", io::stderr().is_terminal()));
+}
+
+fn debug(msg: &str) {
+    if verbosity() >= 1 {
+        eprintln!("{}  {msg}", log_label(" DEBUG", "90", io::stderr().is_terminal()));
+    }
+}
+
+fn trace(msg: &str) {
+    if verbosity() >= 2 {
+        eprintln!("{}  {msg}", log_label(" TRACE", "90", io::stderr().is_terminal()));
+    }
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct Config {
+    #[serde(default)]
+    project: ProjectConfig,
+    #[serde(default)]
+    python: PythonConfig,
+    #[serde(default, serialize_with = "serialize_deps", deserialize_with = "deserialize_deps")]
+    deps: HashMap<String, String>,
+    #[serde(
+        default,
+        skip_serializing_if = "BTreeMap::is_empty",
+        serialize_with = "serialize_dep_groups",
+        deserialize_with = "deserialize_dep_groups"
+    )]
+    groups: BTreeMap<String, DepGroup>,
+    #[serde(default)]
+    scripts: HashMap<String, String>,
+    #[serde(default)]
+    cache: CacheConfig,
+    #[serde(default)]
+    venv: VenvConfig,
+    #[serde(default)]
+    settings: SettingsConfig,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    index: Vec<IndexConfig>,
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    hooks: BTreeMap<String, HookCommands>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    toolchain: Option<ToolchainConfig>,
+    #[serde(default, skip_serializing_if = "ToolsConfig::is_empty")]
+    tools: ToolsConfig,
+}
+
+// Formatter and linter requirements for `xe format` / `xe lint`, e.g. "ruff==0.6.9".
+#[derive(Debug, Clone, Serialize, Deserialize, Default)]
+struct ToolsConfig {
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    format: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    lint: String,
+}
+
+impl ToolsConfig {
+    fn is_empty(&self) -> bool {
+        self.format.is_empty() && self.lint.is_empty()
+    }
+}
+
+// Dependency values are version strings, or `{ workspace = true }` for a member of the
+// enclosing workspace, which is held in memory as WORKSPACE_DEP.
+const WORKSPACE_DEP: &str = "{workspace}";
+
+#[derive(Serialize, Deserialize)]
+#[serde(untagged)]
+enum DepSpec {
+    Version(String),
+    Table { workspace: bool },
+}
+
+fn serialize_deps<S: Serializer>(deps: &HashMap<String, String>, serializer: S) -> Result<S::Ok, S::Error> {
+    serializer.collect_map(deps.iter().map(|(name, version)| {
+        let spec = if version == WORKSPACE_DEP {
+            DepSpec::Table { workspace: true }
+        } else {
+            DepSpec::Version(version.clone())
+        };
+        (name, spec)
+    }))
+}
+
+fn deserialize_deps<'de, D: Deserializer<'de>>(deserializer: D) -> Result<HashMap<String, String>, D::Error> {
+    HashMap::<String, DepSpec>::deserialize(deserializer)?
+        .into_iter()
+        .map(|(name, spec)| match spec {
+            DepSpec::Version(version) => Ok((name, version)),
+            DepSpec::Table { workspace: true } => Ok((name, WORKSPACE_DEP.to_string())),
+            DepSpec::Table { workspace: false } => Err(serde::de::Error::custom(format!(
+                "dependency {name}: expected a version string or {{ workspace = true }}"
+            ))),
+        })
+        .collect()
+}
+
+// A `[groups.<name>]` table: dependencies in the [deps] format plus `includes`, requirements
+// files (relative to the project) whose contents join the group.
+#[derive(Debug, Clone, Default)]
+struct DepGroup {
+    deps: HashMap<String, String>,
+    includes: Vec<String>,
+}
+
+impl DepGroup {
+    fn is_empty(&self) -> bool {
+        self.deps.is_empty() && self.includes.is_empty()
+    }
+}
+
+const GROUP_INCLUDES: &str = "includes";
+
+fn serialize_dep_groups<S: Serializer>(
+    groups: &BTreeMap<String, DepGroup>,
+    serializer: S,
+) -> Result<S::Ok, S::Error> {
+    #[derive(Serialize)]
+    #[serde(untagged)]
+    enum Entry<'a> {
+        Includes(&'a [String]),
+        Dep(DepSpec),
+    }
+    struct Group<'a>(&'a DepGroup);
+    impl Serialize for Group<'_> {
+        fn serialize<S: Serializer>(&self, serializer: S) -> Result<S::Ok, S::Error> {
+            let includes = (!self.0.includes.is_empty()).then(|| (GROUP_INCLUDES, Entry::Includes(&self.0.includes)));
+            serializer.collect_map(includes.into_iter().chain(self.0.deps.iter().map(|(name, version)| {
+                let spec = if version == WORKSPACE_DEP {
+                    DepSpec::Table { workspace: true }
+                } else {
+                    DepSpec::Version(version.clone())
+                };
+                (name.as_str(), Entry::Dep(spec))
+            })))
+        }
+    }
+    serializer.collect_map(groups.iter().map(|(name, group)| (name, Group(group))))
+}
+
+fn deserialize_dep_groups<'de, D: Deserializer<'de>>(
+    deserializer: D,
+) -> Result<BTreeMap<String, DepGroup>, D::Error> {
+    #[derive(Deserialize)]
+    #[serde(untagged)]
+    enum Entry {
+        Dep(DepSpec),
+        Includes(Vec<String>),
+    }
+    struct Group(DepGroup);
+    impl<'de> Deserialize<'de> for Group {
+        fn deserialize<D: Deserializer<'de>>(deserializer: D) -> Result<Self, D::Error> {
+            let mut group = DepGroup::default();
+            for (name, entry) in HashMap::<String, Entry>::deserialize(deserializer)? {
+                match (name.as_str(), entry) {
+                    (GROUP_INCLUDES, Entry::Includes(paths)) => group.includes = paths,
+                    (GROUP_INCLUDES, Entry::Dep(_)) => {
+                        return Err(serde::de::Error::custom("includes: expected an array of requirements files"))
+                    }
+                    (_, Entry::Dep(DepSpec::Version(version))) => {
+                        group.deps.insert(name, version);
+                    }
+                    (_, Entry::Dep(DepSpec::Table { workspace: true })) => {
+                        group.deps.insert(name, WORKSPACE_DEP.to_string());
+                    }
+                    (_, _) => {
+                        return Err(serde::de::Error::custom(format!(
+                            "dependency {name}: expected a version string or {{ workspace = true }}"
+                        )))
+                    }
+                }
+            }
+            Ok(Group(group))
+        }
+    }
+    Ok(BTreeMap::<String, Group>::deserialize(deserializer)?
+        .into_iter()
+        .map(|(name, group)| (name, group.0))
+        .collect())
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, Default)]
+struct ProjectConfig {
+    #[serde(default)]
+    name: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    version: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    description: String,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    authors: Vec<String>,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    license: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    readme: String,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    classifiers: Vec<String>,
+    #[serde(default, rename = "entry-points", skip_serializing_if = "BTreeMap::is_empty")]
+    entry_points: BTreeMap<String, String>,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct PythonConfig {
+    #[serde(default = "default_python_version")]
+    version: String,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct CacheConfig {
+    #[serde(default = "default_cache_mode")]
+    mode: String,
+    #[serde(default)]
+    global_dir: String,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, Default)]
+struct VenvConfig {
+    #[serde(default)]
+    name: String,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, Default)]
+struct SettingsConfig {
+    #[serde(default)]
+    autovenv: bool,
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    require_hashes: bool,
+    // Module `xe test` runs with `python -m` when [scripts] has no `test` entry.
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    test_runner: String,
+    // "batch" (default) resolves all requirements in one pip run; "split" runs one per
+    // requirement.
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    resolution: String,
+    // Project commands ignore the user site-packages and an inherited PYTHONPATH, so only
+    // what xe installed can be imported.
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    isolated: bool,
+    // Digest recorded in xe.lock and used to address the project's artifacts in the CAS.
+    #[serde(default, skip_serializing_if = "HashAlgorithm::is_default")]
+    hash_algorithm: HashAlgorithm,
+}
+
+impl Default for PythonConfig {
+    fn default() -> Self {
+        Self {
+            version: default_python_version(),
+        }
+    }
+}
+
+impl Default for CacheConfig {
+    fn default() -> Self {
+        Self {
+            mode: default_cache_mode(),
+            global_dir: String::new(),
+        }
+    }
+}
+
+impl Config {
+    fn new_default(project_dir: &Path) -> Self {
+        let name = project_dir
+            .file_name()
+            .and_then(|s| s.to_str())
+            .unwrap_or("project")
+            .to_string();
+        let mut cfg = Self {
+            project: ProjectConfig {
+                name,
+                version: default_project_version(),
+                ..ProjectConfig::default()
+            },
+            python: PythonConfig::default(),
+            deps: HashMap::new(),
+            groups: BTreeMap::new(),
+            scripts: HashMap::new(),
+            cache: CacheConfig {
+                mode: default_cache_mode(),
+                global_dir: xe_cache_dir().to_string_lossy().to_string(),
+            },
+            venv: VenvConfig::default(),
+            settings: SettingsConfig::default(),
+            index: Vec::new(),
+            hooks: BTreeMap::new(),
+            toolchain: None,
+            tools: ToolsConfig::default(),
+        };
+        // New projects inside a workspace start with its shared settings.
+        if let Ok(Some(workspace)) = Workspace::find(project_dir) {
+            workspace.apply_shared(&mut cfg);
+        }
+        cfg
+    }
+
+    // The dependency table for `group`, or [deps] when no group is given.
+    fn deps_for_mut(&mut self, group: Option<&str>) -> &mut HashMap<String, String> {
+        match group {
+            Some(group) => &mut self.groups.entry(group.to_string()).or_default().deps,
+            None => &mut self.deps,
+        }
+    }
+
+    // Names declared as `{ workspace = true }` in [deps] or any group.
+    fn workspace_deps(&self) -> Vec<String> {
+        let mut out = self
+            .deps
+            .iter()
+            .chain(self.groups.values().flat_map(|group| &group.deps))
+            .filter(|(_, version)| version.as_str() == WORKSPACE_DEP)
+            .map(|(name, _)| name.clone())
+            .collect::<Vec<_>>();
+        out.sort();
+        out.dedup();
+        out
+    }
+
+    // Groups that declare `name`; "main" stands for [deps].
+    fn dep_groups(&self, name: &str) -> Vec<String> {
+        let mut out = Vec::new();
+        if self.deps.contains_key(name) {
+            out.push("main".to_string());
+        }
+        for (group, table) in &self.groups {
+            if table.deps.contains_key(name) {
+                out.push(group.clone());
+            }
+        }
+        out
+    }
+
+    // Install requirements for [deps] plus every group, pinned where a version is recorded.
+    // Workspace members are not included; see workspace_links.
+    fn requirements(&self) -> Vec<String> {
+        let mut merged = BTreeMap::new();
+        for group in self.groups.values() {
+            merged.extend(group.deps.iter());
+        }
+        merged.extend(self.deps.iter());
+        merged
+            .into_iter()
+            .filter(|(_, version)| version.as_str() != WORKSPACE_DEP)
+            .map(|(name, version)| {
+                if version.is_empty() || version == "*" {
+                    name.clone()
+                } else {
+                    format!("{name}=={version}")
+                }
+            })
+            .collect()
+    }
+
+    // requirements() plus the lines of every group's `includes` files, read relative to `dir`.
+    // A package declared in xe.toml takes precedence over an included line naming it.
+    fn requirements_in(&self, dir: &Path) -> Result<Vec<String>> {
+        let mut reqs = self.requirements();
+        let declared = self
+            .deps
+            .keys()
+            .chain(self.groups.values().flat_map(|group| group.deps.keys()))
+            .cloned()
+            .collect::<HashSet<_>>();
+        for (group, table) in &self.groups {
+            for include in &table.includes {
+                let path = dir.join(include);
+                if !path.is_file() {
+                    bail_kind!(
+                        ErrorKind::Config,
+                        "groups.{group}.includes: {} not found",
+                        path.display()
+                    );
+                }
+                for req in parse_requirements(&path)? {
+                    let shadowed = requirement_to_dep_name(&req).is_some_and(|name| declared.contains(&name));
+                    if !shadowed && !reqs.contains(&req) {
+                        reqs.push(req);
+                    }
+                }
+            }
+        }
+        Ok(reqs)
+    }
+
+    // Pins resolved versions wherever a package is declared. Undeclared (transitive)
+    // packages are only recorded in xe.lock.
+    fn record_resolved(&mut self, packages: &[Package]) {
+        for p in packages {
+            let name = normalize_dep_name(&p.name);
+            for deps in std::iter::once(&mut self.deps).chain(self.groups.values_mut().map(|group| &mut group.deps)) {
+                if let Some(version) = deps.get_mut(&name) {
+                    if version != WORKSPACE_DEP {
+                        *version = p.version.clone();
+                    }
+                }
+            }
+        }
+    }
+
+    fn normalize(&mut self, project_dir: &Path) {
+        if self.project.name.trim().is_empty() {
+            self.project.name = project_dir
+                .file_name()
+                .and_then(|s| s.to_str())
+                .unwrap_or("project")
+                .to_string();
+        }
+        if self.python.version.trim().is_empty() {
+            self.python.version = default_python_version();
+        }
+        if self.cache.mode.trim().is_empty() {
+            self.cache.mode = default_cache_mode();
+        }
+        if self.cache.global_dir.trim().is_empty() {
+            self.cache.global_dir = xe_cache_dir().to_string_lossy().to_string();
+        }
+    }
+}
+
+fn default_python_version() -> String {
+    "3.12".to_string()
+}
+
+fn default_project_version() -> String {
+    "0.1.0".to_string()
+}
+
+fn default_cache_mode() -> String {
+    "global-cas".to_string()
+}
+
+fn load_or_create_project(project_dir: &Path) -> Result<(Config, PathBuf)> {
+    let toml_path = project_dir.join(XE_TOML);
+    if !toml_path.exists() {
+        let cfg = Config::new_default(project_dir);
+        save_project(&toml_path, &cfg)?;
+        return Ok((cfg, toml_path));
+    }
+    let cfg = load_project(&toml_path)?;
+    Ok((cfg, toml_path))
+}
+
+fn load_project(path: &Path) -> Result<Config> {
+    let text = fs::read_to_string(path).with_context(|| format!("failed to read {}", path.display()))?;
+    report_config_issues(path, &text);
+    let mut cfg: Config = toml::from_str(&text).with_context(|| format!("failed to parse {}", path.display()))?;
+    let project_dir = path.parent().unwrap_or_else(|| Path::new("."));
+    cfg.normalize(project_dir);
+    Ok(cfg)
+}
+
+fn save_project(path: &Path, cfg: &Config) -> Result<()> {
+    let mut normalized = cfg.clone();
+    let project_dir = path.parent().unwrap_or_else(|| Path::new("."));
+    normalized.normalize(project_dir);
+    let existing = if path.exists() {
+        let text = fs::read_to_string(path).with_context(|| format!("failed to read {}", path.display()))?;
+        Some(
+            text.parse::<DocumentMut>()
+                .with_context(|| format!("failed to parse {}", path.display()))?,
+        )
+    } else {
+        None
+    };
+    // An XE_PYTHON override never becomes the project's pin.
+    if python_override().is_some() {
+        if let Some(pinned) = existing
+            .as_ref()
+            .and_then(|doc| doc.get("python"))
+            .and_then(|python| python.get("version"))
+            .and_then(Item::as_str)
+        {
+            normalized.python.version = pinned.to_string();
+        }
+    }
+    let encoded = match toml::Value::try_from(&normalized).context("failed to encode xe.toml")? {
+        toml::Value::Table(table) => table,
+        _ => bail!("failed to encode xe.toml"),
+    };
+    let mut doc = match existing {
+        Some(doc) => doc,
+        None => toml::to_string_pretty(&normalized)
+            .context("failed to encode xe.toml")?
+            .parse::<DocumentMut>()
+            .context("failed to encode xe.toml")?,
+    };
+    merge_toml_table(doc.as_table_mut(), &encoded, "");
+    // Tables Config leaves out when empty (the last group removed, no [[index]] left) go
+    // too. The legacy [platform] table is left for `xe use` to correct.
+    for (key, _) in PROJECT_SCHEMA {
+        if *key != "platform" && !encoded.contains_key(*key) {
+            doc.remove(key);
+        }
+    }
+    write_file_atomic(path, doc.to_string().as_bytes())
+}
+
+// Tables whose keys xe.toml loses when Config no longer has them; [settings] and [tools]
+// skip keys at their default, so turning a setting off has to remove it.
+const PRUNED_TOML_TABLES: &[&str] = &["deps", "groups", "scripts", "hooks", "settings", "tools", "project.entry-points"];
+
+fn merge_toml_table(table: &mut dyn TableLike, values: &toml::Table, table_path: &str) {
+    if PRUNED_TOML_TABLES.contains(&table_path) || table_path.starts_with("groups.") {
+        let stale = table
+            .iter()
+            .map(|(key, _)| key.to_string())
+            .filter(|key| !values.contains_key(key))
+            .collect::<Vec<_>>();
+        for key in stale {
+            table.remove(&key);
+        }
+    }
+    for (key, value) in values {
+        if let toml::Value::Table(child_values) = value {
+            let child_path = if table_path.is_empty() {
+                key.clone()
+            } else {
+                format!("{table_path}.{key}")
+            };
+            if !table.contains_key(key) {
+                // `{ workspace = true }` dependency values stay inline.
+                let dep_table = table_path == "deps"
+                    || table_path.strip_prefix("groups.").is_some_and(|g| !g.contains('.'));
+                if dep_table {
+                    table.insert(key, Item::Value(toml_to_edit_value(value)));
+                    continue;
+                }
+                table.insert(key, Item::Table(toml_edit::Table::new()));
+            }
+            if let Some(child) = table.get_mut(key).and_then(Item::as_table_like_mut) {
+                merge_toml_table(child, child_values, &child_path);
+            }
+            continue;
+        }
+        if let Some(entries) = value.as_array().filter(|_| table_path.is_empty() && key == "index") {
+            merge_array_of_tables(table, key, entries);
+            continue;
+        }
+        match table.get_mut(key).and_then(Item::as_value_mut) {
+            Some(existing) if toml_edit_value_eq(existing, value) => {}
+            Some(existing) => {
+                let decor = existing.decor().clone();
+                *existing = toml_to_edit_value(value);
+                *existing.decor_mut() = decor;
+            }
+            None => {
+                table.insert(key, Item::Value(toml_to_edit_value(value)));
+            }
+        }
+    }
+}
+
+// Writes `entries` as `[[key]]` tables, merging into the existing tables when the count
+// is unchanged so their comments survive.
+fn merge_array_of_tables(table: &mut dyn TableLike, key: &str, entries: &[toml::Value]) {
+    let tables = entries.iter().filter_map(toml::Value::as_table).collect::<Vec<_>>();
+    if let Some(existing) = table.get_mut(key).and_then(Item::as_array_of_tables_mut) {
+        if existing.len() == tables.len() {
+            for (current, values) in existing.iter_mut().zip(&tables) {
+                merge_toml_table(current, values, key);
+                let stale = current
+                    .iter()
+                    .map(|(k, _)| k.to_string())
+                    .filter(|k| !values.contains_key(k))
+                    .collect::<Vec<_>>();
+                for k in stale {
+                    current.remove(&k);
+                }
+            }
+            return;
+        }
+    }
+    let mut array = toml_edit::ArrayOfTables::new();
+    for values in tables {
+        // New entries lead with their `name`.
+        let mut current = toml_edit::Table::new();
+        if let Some(name) = values.get("name") {
+            current.insert("name", Item::Value(toml_to_edit_value(name)));
+        }
+        merge_toml_table(&mut current, values, key);
+        array.push(current);
+    }
+    table.insert(key, Item::ArrayOfTables(array));
+}
+
+fn toml_edit_value_eq(existing: &toml_edit::Value, value: &toml::Value) -> bool {
+    match (existing, value) {
+        (toml_edit::Value::String(a), toml::Value::String(b)) => a.value() == b,
+        (toml_edit::Value::Integer(a), toml::Value::Integer(b)) => a.value() == b,
+        (toml_edit::Value::Float(a), toml::Value::Float(b)) => a.value() == b,
+        (toml_edit::Value::Boolean(a), toml::Value::Boolean(b)) => a.value() == b,
+        (toml_edit::Value::Datetime(a), toml::Value::Datetime(b)) => a.value().to_string() == b.to_string(),
+        (toml_edit::Value::Array(a), toml::Value::Array(b)) => {
+            a.len() == b.len() && a.iter().zip(b).all(|(x, y)| toml_edit_value_eq(x, y))
+        }
+        (toml_edit::Value::InlineTable(a), toml::Value::Table(b)) => {
+            a.len() == b.len()
+                && b.iter()
+                    .all(|(k, v)| a.get(k).map(|x| toml_edit_value_eq(x, v)).unwrap_or(false))
+        }
+        _ => false,
+    }
+}
+
+fn toml_to_edit_value(value: &toml::Value) -> toml_edit::Value {
+    match value {
+        toml::Value::String(s) => s.as_str().into(),
+        toml::Value::Integer(i) => (*i).into(),
+        toml::Value::Float(f) => (*f).into(),
+        toml::Value::Boolean(b) => (*b).into(),
+        toml::Value::Datetime(d) => d
+            .to_string()
+            .parse::<toml_edit::Value>()
+            .unwrap_or_else(|_| d.to_string().into()),
+        toml::Value::Array(items) => {
+            toml_edit::Value::Array(items.iter().map(toml_to_edit_value).collect())
+        }
+        toml::Value::Table(entries) => {
+            let mut inline = InlineTable::new();
+            for (k, v) in entries {
+                inline.insert(k, toml_to_edit_value(v));
+            }
+            toml_edit::Value::InlineTable(inline)
+        }
+    }
+}
+
+fn write_file_atomic(path: &Path, data: &[u8]) -> Result<()> {
+    write_atomic(path, data, false)
+}
+
+#[cfg_attr(not(unix), allow(unused_variables))]
+fn write_atomic(path: &Path, data: &[u8], private: bool) -> Result<()> {
+    let dir = path
+        .parent()
+        .filter(|p| !p.as_os_str().is_empty())
+        .unwrap_or_else(|| Path::new("."));
+    let prefix = path
+        .file_name()
+        .map(|s| format!(".{}", s.to_string_lossy()))
+        .unwrap_or_else(|| ".xe".to_string());
+    let tmp_path = tempfile_path_in(dir, &prefix, "tmp");
+    let write_result = (|| -> Result<()> {
+        let mut options = fs::OpenOptions::new();
+        options.write(true).create_new(true);
+        #[cfg(unix)]
+        if private {
+            use std::os::unix::fs::OpenOptionsExt;
+            options.mode(0o600);
+        }
+        let mut file = options
+            .open(&tmp_path)
+            .with_context(|| format!("failed to create {}", tmp_path.display()))?;
+        file.write_all(data)
+            .with_context(|| format!("failed to write {}", tmp_path.display()))?;
+        file.sync_all()
+            .with_context(|| format!("failed to flush {}", tmp_path.display()))?;
+        Ok(())
+    })();
+    if let Err(err) = write_result {
+        let _ = fs::remove_file(&tmp_path);
+        return Err(err);
+    }
+    if let Err(err) = fs::rename(&tmp_path, path) {
+        let _ = fs::remove_file(&tmp_path);
+        return Err(err).with_context(|| format!("failed to write {}", path.display()));
+    }
+    Ok(())
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum IssueLevel {
+    Error,
+    Warning,
+}
+
+#[derive(Debug, Clone)]
+struct ConfigIssue {
+    level: IssueLevel,
+    key: String,
+    message: String,
+}
+
+impl ConfigIssue {
+    fn error(key: &str, message: String) -> Self {
+        Self {
+            level: IssueLevel::Error,
+            key: key.to_string(),
+            message,
+        }
+    }
+
+    fn warning(key: &str, message: String) -> Self {
+        Self {
+            level: IssueLevel::Warning,
+            key: key.to_string(),
+            message,
+        }
+    }
+}
+
+// Known xe.toml sections with their keys and TOML value types. `None` marks a
+// free-form map such as [deps].
+const PROJECT_SCHEMA: &[(&str, Option<&[(&str, &str)]>)] = &[
+    (
+        "project",
+        Some(&[
+            ("name", "string"),
+            ("version", "string"),
+            ("description", "string"),
+            ("authors", "array"),
+            ("license", "string"),
+            ("readme", "string"),
+            ("classifiers", "array"),
+            ("entry-points", "table"),
+        ]),
+    ),
+    ("python", Some(&[("version", "string")])),
+    ("deps", None),
+    ("groups", None),
+    ("scripts", None),
+    ("cache", Some(&[("mode", "string"), ("global_dir", "string")])),
+    ("venv", Some(&[("name", "string")])),
+    (
+        "settings",
+        Some(&[
+            ("autovenv", "boolean"),
+            ("require_hashes", "boolean"),
+            ("test_runner", "string"),
+            ("resolution", "string"),
+            ("isolated", "boolean"),
+            ("hash_algorithm", "string"),
+        ]),
+    ),
+    ("index", None),
+    ("hooks", None),
+    ("toolchain", Some(&[("platform", "string"), ("compiler", "string"), ("libc", "string")])),
+    // Written by older releases; only `xe use` reads it, to correct it.
+    ("platform", Some(&[("os", "string"), ("arch", "string")])),
+    ("tools", Some(&[("format", "string"), ("lint", "string")])),
+];
+
+static VALIDATED_CONFIGS: Mutex<Vec<PathBuf>> = Mutex::new(Vec::new());
+
+// Surfaces xe.toml problems as warnings the first time a file is loaded in this process.
+fn report_config_issues(path: &Path, text: &str) {
+    if let Ok(mut seen) = VALIDATED_CONFIGS.lock() {
+        if seen.iter().any(|p| p == path) {
+            return;
+        }
+        seen.push(path.to_path_buf());
+    }
+    let project_dir = path.parent().unwrap_or_else(|| Path::new("."));
+    let issues = validate_project_text(text, project_dir);
+    if issues.is_empty() {
+        return;
+    }
+    for issue in &issues {
+        warning(&format!("{}: {}: {}", path.display(), issue.key, issue.message));
+    }
+    if issues.iter().any(|i| i.level == IssueLevel::Error) {
+        warning("Run `xe config validate` for details.");
+    }
+}
+
+fn validate_project_text(text: &str, project_dir: &Path) -> Vec<ConfigIssue> {
+    let mut issues = Vec::new();
+    let table = match text.parse::<toml::Table>() {
+        Ok(table) => table,
+        Err(err) => {
+            issues.push(ConfigIssue::error(
+                XE_TOML,
+                format!("invalid TOML: {}", err.message().trim()),
+            ));
+            return issues;
+        }
+    };
+
+    let sections = PROJECT_SCHEMA.iter().map(|(name, _)| *name).collect::<Vec<_>>();
+    for (section, value) in &table {
+        if section == "index" {
+            validate_index_entries(value, &mut issues);
+            continue;
+        }
+        let Some((_, keys)) = PROJECT_SCHEMA.iter().find(|(name, _)| name == section) else {
+            issues.push(ConfigIssue::warning(
+                section,
+                unknown_key_message("section", section, &sections),
+            ));
+            continue;
+        };
+        let Some(entries) = value.as_table() else {
+            issues.push(ConfigIssue::error(
+                section,
+                format!("expected a [{section}] table, found {}", value.type_str()),
+            ));
+            continue;
+        };
+        let Some(keys) = keys else {
+            continue;
+        };
+        for (key, entry) in entries {
+            let full = format!("{section}.{key}");
+            let Some((_, expected)) = keys.iter().find(|(name, _)| name == key) else {
+                let known = keys.iter().map(|(name, _)| *name).collect::<Vec<_>>();
+                issues.push(ConfigIssue::warning(&full, unknown_key_message("key", key, &known)));
+                continue;
+            };
+            if entry.type_str() != *expected {
+                issues.push(ConfigIssue::error(
+                    &full,
+                    format!("expected a {expected}, found {}", entry.type_str()),
+                ));
+            }
+        }
+    }
+
+    let get_str = |section: &str, key: &str| {
+        table
+            .get(section)
+            .and_then(|s| s.get(key))
+            .and_then(toml::Value::as_str)
+            .map(str::trim)
+    };
+
+    match get_str("python", "version") {
+        Some("") => issues.push(ConfigIssue::warning(
+            "python.version",
+            format!(
+                "empty; defaulting to Python {}. Set it with `xe use <version>`",
+                default_python_version()
+            ),
+        )),
+        Some(version) if parse_major_minor(version).is_err() => issues.push(ConfigIssue::error(
+            "python.version",
+            format!("invalid Python version \"{version}\"; expected <major>.<minor>, e.g. \"3.12\""),
+        )),
+        _ => {}
+    }
+
+    match get_str("project", "version") {
+        Some(version) if version.is_empty() || version == "*" || !is_valid_dep_version(version) => {
+            issues.push(ConfigIssue::error(
+                "project.version",
+                format!("invalid project version \"{version}\"; use a PEP 440 version such as \"0.1.0\""),
+            ))
+        }
+        _ => {}
+    }
+    if let Some(authors) = table
+        .get("project")
+        .and_then(|p| p.get("authors"))
+        .and_then(toml::Value::as_array)
+    {
+        if authors.iter().any(|a| a.as_str().map(str::trim).unwrap_or("").is_empty()) {
+            issues.push(ConfigIssue::error(
+                "project.authors",
+                "expected non-empty strings such as \"Jane Doe <jane@example.com>\"".to_string(),
+            ));
+        }
+    }
+    if let Some(readme) = get_str("project", "readme").filter(|r| !r.is_empty()) {
+        if !project_dir.join(readme).is_file() {
+            issues.push(ConfigIssue::warning(
+                "project.readme",
+                format!("{} not found", project_dir.join(readme).display()),
+            ));
+        }
+    }
+    if let Some(entry_points) = table
+        .get("project")
+        .and_then(|p| p.get("entry-points"))
+        .and_then(toml::Value::as_table)
+    {
+        for (name, value) in entry_points {
+            let valid = value
+                .as_str()
+                .and_then(|target| target.split_once(':'))
+                .map(|(module, func)| !module.trim().is_empty() && !func.trim().is_empty())
+                .unwrap_or(false);
+            if !valid {
+                issues.push(ConfigIssue::error(
+                    &format!("project.entry-points.{name}"),
+                    "expected \"module:function\", e.g. \"mypkg.cli:main\"".to_string(),
+                ));
+            }
+        }
+    }
+
+    if let Some(deps) = table.get("deps").and_then(toml::Value::as_table) {
+        validate_dep_table("deps", deps, &mut issues);
+    }
+    if let Some(groups) = table.get("groups").and_then(toml::Value::as_table) {
+        for (group, value) in groups {
+            match value.as_table() {
+                Some(deps) => {
+                    let mut deps = deps.clone();
+                    if let Some(includes) = deps.remove(GROUP_INCLUDES) {
+                        validate_group_includes(group, &includes, project_dir, &mut issues);
+                    }
+                    validate_dep_table(&format!("groups.{group}"), &deps, &mut issues)
+                }
+                None => issues.push(ConfigIssue::error(
+                    &format!("groups.{group}"),
+                    format!("expected a [groups.{group}] table, found {}", value.type_str()),
+                )),
+            }
+        }
+    }
+
+    if let Some(scripts) = table.get("scripts").and_then(toml::Value::as_table) {
+        for (name, value) in scripts {
+            let key = format!("scripts.{name}");
+            match value.as_str() {
+                Some(command) if command.trim().is_empty() => issues.push(ConfigIssue::error(
+                    &key,
+                    "script command is empty".to_string(),
+                )),
+                Some(_) => {}
+                None => issues.push(ConfigIssue::error(
+                    &key,
+                    format!("expected a command string, found {}", value.type_str()),
+                )),
+            }
+        }
+    }
+
+    if let Some(hooks) = table.get("hooks").and_then(toml::Value::as_table) {
+        for (point, value) in hooks {
+            let key = format!("hooks.{point}");
+            if !HOOK_POINTS.contains(&point.as_str()) {
+                issues.push(ConfigIssue::warning(&key, unknown_key_message("hook", point, HOOK_POINTS)));
+            }
+            let valid = match value {
+                toml::Value::String(command) => !command.trim().is_empty(),
+                toml::Value::Array(commands) => commands
+                    .iter()
+                    .all(|c| c.as_str().is_some_and(|c| !c.trim().is_empty())),
+                _ => false,
+            };
+            if !valid {
+                issues.push(ConfigIssue::error(
+                    &key,
+                    "expected a command string or an array of command strings".to_string(),
+                ));
+            }
+        }
+    }
+
+    if let Some(mode) = get_str("cache", "mode") {
+        if !mode.is_empty() && mode != default_cache_mode() {
+            issues.push(ConfigIssue::error(
+                "cache.mode",
+                format!(
+                    "unsupported cache mode \"{mode}\"; the only supported mode is \"{}\"",
+                    default_cache_mode()
+                ),
+            ));
+        }
+    }
+    if let Some(dir) = get_str("cache", "global_dir").filter(|d| !d.is_empty()) {
+        let path = Path::new(dir);
+        if path.is_file() {
+            issues.push(ConfigIssue::error(
+                "cache.global_dir",
+                format!("{dir} is a file, not a directory"),
+            ));
+        } else if !path.exists() && path != xe_cache_dir() {
+            issues.push(ConfigIssue::warning(
+                "cache.global_dir",
+                format!(
+                    "directory {dir} does not exist; it will be created on the next install. Remove the key to use the default ({})",
+                    xe_cache_dir().display()
+                ),
+            ));
+        }
+    }
+
+    let autovenv = table
+        .get("settings")
+        .and_then(|s| s.get("autovenv"))
+        .and_then(toml::Value::as_bool)
+        .unwrap_or(false);
+    if let Some(name) = get_str("venv", "name").filter(|n| !n.is_empty()) {
+        if normalize_venv_name(name) != name {
+            issues.push(ConfigIssue::error(
+                "venv.name",
+                format!(
+                    "invalid venv name \"{name}\"; use lowercase letters, digits and '-' (e.g. \"{}\")",
+                    normalize_venv_name(name)
+                ),
+            ));
+        } else if name.starts_with("auto-") && !autovenv {
+            issues.push(ConfigIssue::warning(
+                "venv.name",
+                format!(
+                    "\"{name}\" was created by autovenv but settings.autovenv is off; run `xe venv unset` or `xe config autovenv on`"
+                ),
+            ));
+        }
+    }
+
+    issues
+}
+
+fn validate_index_entries(value: &toml::Value, issues: &mut Vec<ConfigIssue>) {
+    let Some(entries) = value.as_array().filter(|a| a.iter().all(toml::Value::is_table)) else {
+        issues.push(ConfigIssue::error(
+            "index",
+            format!("expected [[index]] tables, found {}", value.type_str()),
+        ));
+        return;
+    };
+    let mut names = HashSet::new();
+    let mut defaults = 0;
+    for (n, entry) in entries.iter().enumerate() {
+        let key = format!("index[{n}]");
+        let index: IndexConfig = match entry.clone().try_into() {
+            Ok(index) => index,
+            Err(err) => {
+                issues.push(ConfigIssue::error(&key, err.message().trim().to_string()));
+                continue;
+            }
+        };
+        if let Some(problem) = index_problem(&index) {
+            issues.push(ConfigIssue::error(&key, problem));
+        }
+        if !names.insert(index.name.clone()) {
+            issues.push(ConfigIssue::error(&key, format!("duplicate index name \"{}\"", index.name)));
+        }
+        defaults += usize::from(index.default);
+    }
+    if defaults > 1 {
+        issues.push(ConfigIssue::error(
+            "index",
+            "more than one index has default = true".to_string(),
+        ));
+    }
+}
+
+fn validate_group_includes(group: &str, includes: &toml::Value, project_dir: &Path, issues: &mut Vec<ConfigIssue>) {
+    let key = format!("groups.{group}.{GROUP_INCLUDES}");
+    let Some(paths) = includes.as_array() else {
+        issues.push(ConfigIssue::error(
+            &key,
+            format!("expected an array of requirements files, found {}", includes.type_str()),
+        ));
+        return;
+    };
+    for path in paths {
+        match path.as_str() {
+            Some(path) if !project_dir.join(path).is_file() => {
+                issues.push(ConfigIssue::error(&key, format!("{path} not found")));
+            }
+            Some(_) => {}
+            None => issues.push(ConfigIssue::error(
+                &key,
+                format!("expected a file path, found {}", path.type_str()),
+            )),
+        }
+    }
+}
+
+fn validate_dep_table(section: &str, deps: &toml::Table, issues: &mut Vec<ConfigIssue>) {
+    for (name, value) in deps {
+        let key = format!("{section}.{name}");
+        let workspace_member = value
+            .as_table()
+            .is_some_and(|t| t.len() == 1 && t.get("workspace") == Some(&toml::Value::Boolean(true)));
+        if workspace_member {
+            continue;
+        }
+        let Some(version) = value.as_str() else {
+            issues.push(ConfigIssue::error(
+                &key,
+                format!(
+                    "expected a version string or {{ workspace = true }}, found {}",
+                    value.type_str()
+                ),
+            ));
+            continue;
+        };
+        if !is_valid_dep_version(version) {
+            issues.push(ConfigIssue::error(
+                &key,
+                format!(
+                    "invalid version specifier \"{version}\"; use \"*\" or an exact version such as \"1.2.3\""
+                ),
+            ));
+        }
+        if normalize_dep_name(name) != *name {
+            issues.push(ConfigIssue::warning(
+                &key,
+                format!(
+                    "package name is not normalized; xe records it as \"{}\"",
+                    normalize_dep_name(name)
+                ),
+            ));
+        }
+    }
+}
+
+fn is_valid_dep_version(version: &str) -> bool {
+    let version = version.trim();
+    if version.is_empty() || version == "*" {
+        return true;
+    }
+    let re = Regex::new(
+        r"^v?(\d+!)?\d+(\.\d+)*((a|b|rc)\d+)?(\.post\d+)?(\.dev\d+)?(\+[a-zA-Z0-9]+(\.[a-zA-Z0-9]+)*)?$",
+    )
+    .unwrap();
+    re.is_match(version)
+}
+
+fn unknown_key_message(kind: &str, key: &str, known: &[&str]) -> String {
+    let suggestion = known
+        .iter()
+        .map(|candidate| (edit_distance(key, candidate), *candidate))
+        .filter(|(distance, _)| *distance <= 2)
+        .min();
+    match suggestion {
+        Some((_, candidate)) => format!("unknown {kind} \"{key}\"; did you mean \"{candidate}\"?"),
+        None => format!("unknown {kind} \"{key}\" is ignored (known: {})", known.join(", ")),
+    }
+}
+
+fn edit_distance(a: &str, b: &str) -> usize {
+    let b = b.chars().collect::<Vec<_>>();
+    let mut prev = (0..=b.len()).collect::<Vec<_>>();
+    for (i, ca) in a.chars().enumerate() {
+        let mut row = vec![i + 1; b.len() + 1];
+        for (j, cb) in b.iter().enumerate() {
+            let cost = if ca == *cb { 0 } else { 1 };
+            row[j + 1] = (prev[j] + cost).min(prev[j + 1] + 1).min(row[j] + 1);
+        }
+        prev = row;
+    }
+    prev[b.len()]
+}
+
+fn normalize_dep_name(name: &str) -> String {
+    name.trim()
+        .to_lowercase()
+        .replace('_', "-")
+        .replace('.', "-")
+}
+
+fn requirement_to_dep_name(requirement: &str) -> Option<String> {
+    let mut name = requirement.trim().to_string();
+    if name.is_empty() {
+        return None;
+    }
+    if let Some(idx) = name.find('[') {
+        name = name[..idx].to_string();
+    }
+    if let Some(idx) = name.find(|c: char| " <>=!~;".contains(c)) {
+        name = name[..idx].to_string();
+    }
+    let name = name.trim();
+    if name.is_empty() {
+        None
+    } else {
+        Some(normalize_dep_name(name))
+    }
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize, Default)]
+struct GlobalConfig {
+    #[serde(default)]
+    default_python: String,
+    // Named upload endpoints registered with `xe auth login --repository <name> --url <url>`.
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    repositories: BTreeMap<String, String>,
+    // Opt-in command log under the xe data directory; toggled with `xe log on|off`.
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    command_log: bool,
+    // Package indexes managed with `xe mirror`.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    index: Vec<IndexConfig>,
+    // Parallel package downloads; XE_HTTP_CONCURRENCY overrides it.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    http_concurrency: Option<usize>,
+    // Opt-in daily check for xe releases and newer direct dependencies; toggled with
+    // `xe config set notifications on|off`.
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    notifications: bool,
+    // External program that stores tokens instead of the built-in stores, run as
+    // `<helper> get|store|erase`; XE_CREDENTIAL_HELPER overrides it.
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    credential_helper: String,
+}
+
+const PYPI_SIMPLE_URL: &str = "https://pypi.org/simple";
+
+// A package index from `[[index]]` in xe.toml or `index` in the global config. Lower
+// priorities are queried first; the `default` index replaces PyPI as the primary one.
+// `credentials` names where the secret lives (`env:VAR` or `auth:NAME` for a token saved
+// with `xe auth login --repository NAME`), never the secret itself.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+struct IndexConfig {
+    name: String,
+    url: String,
+    #[serde(default)]
+    priority: i64,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    credentials: String,
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    default: bool,
+    // When set, this index only serves packages matching these patterns, and those
+    // packages are only accepted from it.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    packages: Vec<String>,
+}
+
+#[derive(Debug, Clone, Serialize)]
+struct ScopedIndex {
+    #[serde(flatten)]
+    index: IndexConfig,
+    scope: &'static str,
+}
+
+fn index_problem(index: &IndexConfig) -> Option<String> {
+    let valid_name = !index.name.is_empty()
+        && index
+            .name
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || c == '-' || c == '_' || c == '.');
+    if !valid_name {
+        return Some(format!(
+            "invalid index name \"{}\"; use letters, digits, '-', '_' and '.'",
+            index.name
+        ));
+    }
+    if index.name == "pypi" {
+        return Some("\"pypi\" is built in; choose another index name".to_string());
+    }
+    if !["https://", "http://", "file://"].iter().any(|scheme| index.url.starts_with(scheme)) {
+        return Some(format!(
+            "index {}: url must start with https://, http:// or file://",
+            index.name
+        ));
+    }
+    let credentials_ok = index.credentials.is_empty()
+        || ["env:", "auth:"]
+            .iter()
+            .any(|prefix| index.credentials.strip_prefix(prefix).is_some_and(|rest| !rest.is_empty()));
+    if !credentials_ok {
+        return Some(format!(
+            "index {}: credentials must be a reference such as env:VAR or auth:NAME",
+            index.name
+        ));
+    }
+    if index.default && !index.packages.is_empty() {
+        return Some(format!(
+            "index {}: the default index cannot be limited with packages",
+            index.name
+        ));
+    }
+    None
+}
+
+// Host of `url` as an index name, e.g. "pypi-internal-example-com".
+fn index_name_from_url(url: &str) -> String {
+    let rest = url.split_once("://").map(|(_, rest)| rest).unwrap_or(url);
+    let host = rest.split(['/', ':', '@']).next().unwrap_or("");
+    let name = host.replace('.', "-").to_lowercase();
+    if name.is_empty() {
+        "mirror".to_string()
+    } else {
+        name
+    }
+}
+
+// Project indexes, then global ones not shadowed by a project index of the same name,
+// ordered default first and then by priority.
+fn configured_indexes(global: &GlobalConfig, project: Option<&Config>) -> Vec<ScopedIndex> {
+    let mut out = project
+        .map(|cfg| {
+            cfg.index
+                .iter()
+                .map(|index| ScopedIndex {
+                    index: index.clone(),
+                    scope: "project",
+                })
+                .collect::<Vec<_>>()
+        })
+        .unwrap_or_default();
+    let project_default = out.iter().any(|i| i.index.default);
+    for index in &global.index {
+        if out.iter().any(|i| i.index.name == index.name) {
+            continue;
+        }
+        let mut index = index.clone();
+        index.default &= !project_default;
+        out.push(ScopedIndex { index, scope: "global" });
+    }
+    out.sort_by_key(|i| (!i.index.default, i.index.priority));
+    out
+}
+
+// The configured indexes plus PyPI when none of them replaces it as the default.
+fn indexes_to_check(global: &GlobalConfig, project: Option<&Config>) -> Vec<ScopedIndex> {
+    let mut indexes = configured_indexes(global, project);
+    if !indexes.iter().any(|i| i.index.default) {
+        indexes.push(ScopedIndex {
+            index: IndexConfig {
+                name: "pypi".to_string(),
+                url: PYPI_SIMPLE_URL.to_string(),
+                ..IndexConfig::default()
+            },
+            scope: "builtin",
+        });
+    }
+    indexes
+}
+
+fn load_global_config(path: &Path) -> Result<GlobalConfig> {
+    if !path.exists() {
+        return Ok(GlobalConfig::default());
+    }
+    let text = fs::read_to_string(path).with_context(|| format!("failed to read {}", path.display()))?;
+    let cfg = serde_yaml::from_str(&text).with_context(|| format!("failed to parse {}", path.display()))?;
+    Ok(cfg)
+}
+
+fn save_global_config(path: &Path, cfg: &GlobalConfig) -> Result<()> {
+    if let Some(parent) = path.parent() {
+        fs::create_dir_all(parent).with_context(|| format!("failed to create {}", parent.display()))?;
+    }
+    let text = serde_yaml::to_string(cfg).context("failed to encode config")?;
+    fs::write(path, text).with_context(|| format!("failed to write {}", path.display()))?;
+    Ok(())
+}
+
+fn get_preferred_python_version(ctx: &AppContext) -> Result<String> {
+    if let Ok(wd) = env::current_dir() {
+        let local = wd.join(XE_TOML);
+        if local.exists() {
+            if let Ok(cfg) = load_project(&local) {
+                if !cfg.python.version.trim().is_empty() {
+                    return Ok(cfg.python.version);
+                }
+            }
+        }
+    }
+    if let Some(workspace) = env::current_dir().ok().and_then(|wd| Workspace::find(&wd).ok().flatten()) {
+        if !workspace.config.python.is_empty() {
+            return Ok(workspace.config.python);
+        }
+    }
+    let global_cfg = load_global_config(&ctx.config_file)?;
+    if !global_cfg.default_python.trim().is_empty() {
+        return Ok(global_cfg.default_python);
+    }
+    Ok(default_python_version())
+}
+
+#[derive(Debug, Clone)]
+struct RuntimeSelection {
+    python_exe: PathBuf,
+    site_packages: PathBuf,
+    activation_path: PathBuf,
+    venv_name: String,
+    is_venv: bool,
+    isolated: bool,
+}
+
+#[derive(Debug, Clone)]
+struct RuntimeResult {
+    selection: RuntimeSelection,
+    config_changed: bool,
+}
+
+fn ensure_runtime_for_project(ctx: &AppContext, wd: &Path, cfg: &mut Config) -> Result<RuntimeResult> {
+    let _span = span(ctx, "runtime.ensure", json!({"working_dir": wd.display().to_string(), "python_version": cfg.python.version}));
+    let pm = PythonManager::new()?;
+    let pinned = select_python_version(ctx, cfg)?;
+
+    let mut python_exe = match pm.get_python_exe(&cfg.python.version) {
+        Ok(path) => path,
+        Err(_) => {
+            pm.install(&cfg.python.version, ctx)?;
+            pm.get_python_exe(&cfg.python.version)?
+        }
+    };
+
+    debug(&format!(
+        "Python {} runtime: {}",
+        cfg.python.version,
+        python_exe.display()
+    ));
+    if wd.join(XE_TOML).is_file() {
+        record_project_dir(wd);
+    }
+    let vm = VenvManager::new()?;
+    let mut config_changed = false;
+    let mut venv_name = cfg.venv.name.trim().to_string();
+    if venv_name.is_empty() && cfg.settings.autovenv {
+        venv_name = auto_venv_name(cfg, wd);
+        cfg.venv.name = venv_name.clone();
+        config_changed = true;
+    }
+    venv_name = venv_for_version(&venv_name, &pinned, &cfg.python.version);
+
+    if !venv_name.is_empty() {
+        if !vm.exists(&venv_name) {
+            vm.create(&venv_name, &python_exe, Some(wd))?;
+        }
+        python_exe = vm.get_python_exe(&venv_name);
+        if !python_exe.exists() {
+            bail_kind!(ErrorKind::RuntimeMissing, "venv python not found: {}", python_exe.display());
+        }
+        vm.record_project(&venv_name, wd);
+        let mut selection = vm.selection(&venv_name)?;
+        selection.isolated = cfg.settings.isolated;
+        return Ok(RuntimeResult {
+            selection,
+            config_changed,
+        });
+    }
+
+    let site_packages = pm.get_site_packages_dir(&cfg.python.version)?;
+    Ok(RuntimeResult {
+        selection: RuntimeSelection {
+            activation_path: python_exe
+                .parent()
+                .map(Path::to_path_buf)
+                .unwrap_or_else(PathBuf::new),
+            python_exe,
+            site_packages,
+            venv_name: String::new(),
+            is_venv: false,
+            isolated: cfg.settings.isolated,
+        },
+        config_changed,
+    })
+}
+
+// The runtime ensure_runtime_for_project would select, if it already exists. Nothing is
+// installed, created or recorded, so commands that only report on an environment can
+// say it is missing instead of provisioning one.
+fn existing_runtime_for_project(ctx: &AppContext, wd: &Path, cfg: &Config) -> Result<Option<RuntimeSelection>> {
+    let mut cfg = cfg.clone();
+    let pinned = select_python_version(ctx, &mut cfg)?;
+    let pm = PythonManager::new()?;
+    let Ok(python_exe) = pm.get_python_exe(&cfg.python.version) else {
+        return Ok(None);
+    };
+    let mut venv_name = cfg.venv.name.trim().to_string();
+    if venv_name.is_empty() && cfg.settings.autovenv {
+        venv_name = auto_venv_name(&cfg, wd);
+    }
+    venv_name = venv_for_version(&venv_name, &pinned, &cfg.python.version);
+    if !venv_name.is_empty() {
+        let vm = VenvManager::new()?;
+        if !vm.exists(&venv_name) || !vm.get_python_exe(&venv_name).exists() {
+            return Ok(None);
+        }
+        let mut selection = vm.selection(&venv_name)?;
+        selection.isolated = cfg.settings.isolated;
+        return Ok(Some(selection));
+    }
+    Ok(Some(RuntimeSelection {
+        activation_path: python_exe
+            .parent()
+            .map(Path::to_path_buf)
+            .unwrap_or_else(PathBuf::new),
+        site_packages: pm.get_site_packages_dir(&cfg.python.version)?,
+        python_exe,
+        venv_name: String::new(),
+        is_venv: false,
+        isolated: cfg.settings.isolated,
+    }))
+}
+
+// Applies the XE_PYTHON override and the preferred version to `cfg.python.version` and
+// returns the version pinned in xe.toml. An override replaces the pin for this process
+// only; save_project keeps the pin.
+fn select_python_version(ctx: &AppContext, cfg: &mut Config) -> Result<String> {
+    let pinned = cfg.python.version.clone();
+    if let Some(version) = python_override() {
+        debug(&format!("Using Python {version} from XE_PYTHON instead of the project's {pinned}"));
+        cfg.python.version = version;
+    }
+    if cfg.python.version.trim().is_empty() {
+        cfg.python.version = get_preferred_python_version(ctx)?;
+    }
+    Ok(pinned)
+}
+
+// The venv autovenv creates for a project: `auto-` and the project (or directory) name.
+fn auto_venv_name(cfg: &Config, wd: &Path) -> String {
+    let mut name = cfg.project.name.trim().to_string();
+    if name.is_empty() {
+        name = wd
+            .file_name()
+            .and_then(|s| s.to_str())
+            .unwrap_or("default")
+            .to_string();
+    }
+    name = normalize_venv_name(&name);
+    if name.is_empty() {
+        name = "default".to_string();
+    }
+    format!("auto-{name}")
+}
+
+// The project's venv belongs to the pinned interpreter; another one gets its own.
+fn venv_for_version(venv_name: &str, pinned: &str, version: &str) -> String {
+    if !venv_name.is_empty() && !pinned.trim().is_empty() && version != pinned {
+        format!("{venv_name}-py{}", version.replace('.', ""))
+    } else {
+        venv_name.to_string()
+    }
+}
+
+fn normalize_venv_name(name: &str) -> String {
+    let mut n = name.trim().to_lowercase();
+    n = n.replace(' ', "-").replace('_', "-");
+    let mut out = String::with_capacity(n.len());
+    for ch in n.chars() {
+        if ch.is_ascii_lowercase() || ch.is_ascii_digit() || ch == '-' {
+            out.push(ch);
+        }
+    }
+    out.trim_matches('-').to_string()
+}
+
+fn detect_venv_site_packages(venv_exe: &Path) -> Result<PathBuf> {
+    let output = run_python(
+        Command::new(venv_exe).args(["-c", "import site; print(site.getsitepackages()[0])"]),
+        "python",
+        Duration::from_secs(60),
+        false,
+    )
+    .context("failed to detect venv site-packages")?;
+    if !output.status.success() {
+        bail!("failed to detect venv site-packages");
+    }
+    let site = String::from_utf8_lossy(&output.stdout).trim().to_string();
+    if site.is_empty() {
+        bail!("empty site-packages response");
+    }
+    Ok(PathBuf::from(site))
+}
+
+fn apply_runtime_env(command: &mut Command, selection: &RuntimeSelection) -> Result<()> {
+    for (key, value) in runtime_env(selection)? {
+        command.env(key, value);
+    }
+    Ok(())
+}
+
+// Environment variables that put the selected runtime first, shared by `xe run`,
+// `xe shell` and `xe activate`. An isolated selection also turns off the user
+// site-packages and drops the inherited PYTHONPATH.
+fn runtime_env(selection: &RuntimeSelection) -> Result<Vec<(&'static str, String)>> {
+    let python_root = selection.activation_path.clone();
+    let scripts_dir = {
+        let win_scripts = python_root.join("Scripts");
+        if win_scripts.exists() {
+            win_scripts
+        } else {
+            python_root.join("bin")
+        }
+    };
+    let mut path_entries = Vec::new();
+    if scripts_dir.exists() {
+        path_entries.push(scripts_dir);
+    }
+    path_entries.push(python_root);
+    if let Some(current) = env::var_os("PATH") {
+        path_entries.extend(env::split_paths(&current));
+    }
+    let new_path = env::join_paths(&path_entries).context("failed to build PATH")?;
+    let mut vars = vec![("PATH", new_path.to_string_lossy().to_string())];
+
+    if selection.is_venv {
+        if let Some(root) = selection.python_exe.parent().and_then(|p| p.parent()) {
+            vars.push(("VIRTUAL_ENV", root.display().to_string()));
+        }
+    }
+    if !selection.site_packages.as_os_str().is_empty() {
+        // .pth files are only processed for site directories, not PYTHONPATH entries.
+        let mut python_path = vec![selection.site_packages.clone()];
+        python_path.extend(linked_source_paths(&selection.site_packages));
+        if let Some(current) = env::var_os("PYTHONPATH").filter(|_| !selection.isolated) {
+            python_path.extend(env::split_paths(&current).filter(|p| *p != selection.site_packages));
+        }
+        let joined = env::join_paths(&python_path).context("failed to build PYTHONPATH")?;
+        vars.push(("PYTHONPATH", joined.to_string_lossy().to_string()));
+    } else if selection.isolated {
+        vars.push(("PYTHONPATH", String::new()));
+    }
+    if selection.isolated {
+        vars.push(("PYTHONNOUSERSITE", "1".to_string()));
+    }
+    Ok(vars)
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum ShellKind {
+    Bash,
+    Zsh,
+    Fish,
+    PowerShell,
+    Cmd,
+}
+
+impl ShellKind {
+    fn parse(name: &str) -> Option<Self> {
+        let base = Path::new(name.trim())
+            .file_stem()
+            .and_then(|s| s.to_str())
+            .unwrap_or("")
+            .to_lowercase();
+        match base.as_str() {
+            "bash" | "sh" => Some(ShellKind::Bash),
+            "zsh" => Some(ShellKind::Zsh),
+            "fish" => Some(ShellKind::Fish),
+            "pwsh" | "powershell" => Some(ShellKind::PowerShell),
+            "cmd" => Some(ShellKind::Cmd),
+            _ => None,
+        }
+    }
+
+    fn name(self) -> &'static str {
+        match self {
+            ShellKind::Bash => "bash",
+            ShellKind::Zsh => "zsh",
+            ShellKind::Fish => "fish",
+            ShellKind::PowerShell => "pwsh",
+            ShellKind::Cmd => "cmd",
+        }
+    }
+}
+
+fn detect_shell() -> ShellKind {
+    detect_shell_program().0
+}
+
+// Prefers the shell xe was launched from, then $SHELL, then the platform default.
+fn detect_shell_program() -> (ShellKind, String) {
+    if let Some(found) = parent_process_shell() {
+        return found;
+    }
+    if let Ok(shell) = env::var("SHELL") {
+        if let Some(kind) = ShellKind::parse(&shell) {
+            return (kind, shell);
+        }
+    }
+    if cfg!(windows) {
+        if env::var_os("PSModulePath").is_some() {
+            return (ShellKind::PowerShell, "powershell.exe".to_string());
+        }
+        let comspec = env::var("COMSPEC").unwrap_or_else(|_| "cmd.exe".to_string());
+        return (ShellKind::Cmd, comspec);
+    }
+    (ShellKind::Bash, "bash".to_string())
+}
+
+#[cfg(unix)]
+fn parent_process_shell() -> Option<(ShellKind, String)> {
+    let ppid = std::os::unix::process::parent_id();
+    let exe = fs::read_link(format!("/proc/{ppid}/exe")).ok()?;
+    let exe = exe.to_string_lossy().to_string();
+    ShellKind::parse(&exe).map(|kind| (kind, exe))
+}
+
+#[cfg(not(unix))]
+fn parent_process_shell() -> Option<(ShellKind, String)> {
+    None
+}
+
+fn render_activation(shell: ShellKind, vars: &[(&str, String)]) -> String {
+    let mut out = String::new();
+    for (key, value) in vars {
+        let line = match shell {
+            ShellKind::Bash | ShellKind::Zsh => format!("export {key}={}", posix_quote(value)),
+            ShellKind::Fish if *key == "PATH" || *key == "PYTHONPATH" => {
+                let parts = env::split_paths(value)
+                    .map(|p| fish_quote(&p.to_string_lossy()))
+                    .collect::<Vec<_>>();
+                format!("set -gx {key} {}", parts.join(" "))
+            }
+            ShellKind::Fish => format!("set -gx {key} {}", fish_quote(value)),
+            ShellKind::PowerShell => format!("$env:{key} = '{}'", value.replace('\'', "''")),
+            ShellKind::Cmd => format!("set \"{key}={value}\""),
+        };
+        out.push_str(&line);
+        out.push('\n');
+    }
+    out
+}
+
+fn posix_quote(value: &str) -> String {
+    format!("'{}'", value.replace('\'', "'\\''"))
+}
+
+fn fish_quote(value: &str) -> String {
+    format!("'{}'", value.replace('\\', "\\\\").replace('\'', "\\'"))
+}
+
+#[derive(Debug, Clone)]
+struct PythonManager {
+    base_dir: PathBuf,
+}
+
+impl PythonManager {
+    fn new() -> Result<Self> {
+        let base_dir = if cfg!(windows) {
+            let local = env::var("LOCALAPPDATA")
+                .ok()
+                .map(PathBuf::from)
+                .unwrap_or_else(|| {
+                    dirs::home_dir()
+                        .unwrap_or_else(|| PathBuf::from("."))
+                        .join("AppData")
+                        .join("Local")
+                });
+            local.join("Programs").join("Python")
+        } else {
+            xe_home().join("python")
+        };
+        fs::create_dir_all(&base_dir)
+            .with_context(|| format!("failed to create {}", base_dir.display()))?;
+        Ok(Self { base_dir })
+    }
+
+    // Returns the interpreter for `version`, installing it first when missing.
+    fn ensure(&self, version: &str, ctx: &AppContext) -> Result<PathBuf> {
+        match self.get_python_exe(version) {
+            Ok(path) => Ok(path),
+            Err(_) => {
+                self.install(version, ctx)?;
+                self.get_python_exe(version)
+            }
+        }
+    }
+
+    fn get_python_path(&self, version: &str) -> Result<PathBuf> {
+        let parts = parse_major_minor(version)?;
+        Ok(self
+            .base_dir
+            .join(format!("python{}{}", parts.0, parts.1)))
+    }
+
+    fn get_python_exe(&self, version: &str) -> Result<PathBuf> {
+        let python_dir = self.get_python_path(version)?;
+        if cfg!(windows) {
+            let tools = python_dir.join("tools").join("python.exe");
+            if tools.exists() {
+                return Ok(tools);
+            }
+            let root = python_dir.join("python.exe");
+            if root.exists() {
+                return Ok(root);
+            }
+            bail_kind!(ErrorKind::RuntimeMissing, "python.exe not found in {}", python_dir.display());
+        }
+        let py3 = python_dir.join("bin").join("python3");
+        if py3.exists() {
+            return Ok(py3);
+        }
+        let py = python_dir.join("bin").join("python");
+        if py.exists() {
+            return Ok(py);
+        }
+        bail_kind!(ErrorKind::RuntimeMissing, "python/python3 not found in {}", python_dir.join("bin").display());
+    }
+
+    fn install(&self, version: &str, ctx: &AppContext) -> Result<()> {
+        let _span = span(ctx, "python.install", json!({"version": version}));
+        let _interrupts = catch_interrupts();
+        let mut needs_cleanup = false;
+
+        if let Ok(exe) = self.get_python_exe(version) {
+            if is_python_runtime_healthy(&exe) && (!cfg!(windows) || is_windows_launcher_version_available(version))
+            {
+                success(&format!(
+                    "Python {} already installed at {}",
+                    version,
+                    exe.display()
+                ));
+                return Ok(());
+            }
+            needs_cleanup = true;
+            warning(&format!(
+                "Python {} exists at {} but runtime is unhealthy or launcher is missing; repairing with official installer.",
+                version,
+                exe.display()
+            ));
+        }
+
+        if !cfg!(windows) {
+            bail_kind!(ErrorKind::RuntimeMissing, "automatic Python installation is currently supported on Windows only");
+        }
+
+        let target_dir = self.get_python_path(version)?;
+        info(&format!(
+            "Installing Python {} to {}...",
+            version,
+            target_dir.display()
+        ));
+        if cfg!(windows) && needs_cleanup {
+            if target_dir.exists() {
+                fs::remove_dir_all(&target_dir)
+                    .with_context(|| format!("failed to remove {}", target_dir.display()))?;
+            }
+        }
+
+        let full_version = resolve_latest_windows_installer_version(version)?;
+        let url = format!(
+            "https://www.python.org/ftp/python/{0}/python-{0}-amd64.exe",
+            full_version
+        );
+        info(&format!("Downloading official Python installer from {}...", url));
+        let tmp_installer = download_file(&url, "python-installer", "exe")?;
+
+        if let Some(parent) = target_dir.parent() {
+            fs::create_dir_all(parent)
+                .with_context(|| format!("failed to create {}", parent.display()))?;
+        }
+
+        let args = vec![
+            "/quiet".to_string(),
+            "InstallAllUsers=0".to_string(),
+            "Include_pip=1".to_string(),
+            "Include_launcher=1".to_string(),
+            "PrependPath=1".to_string(),
+            format!("TargetDir={}", target_dir.display()),
+        ];
+
+        let output = Command::new(&tmp_installer)
+            .args(&args)
+            .output()
+            .context("failed to run python installer")?;
+        if !output.status.success() {
+            warning(&format!(
+                "official installer failed ({}); falling back to embeddable distribution",
+                output.status
+            ));
+            if target_dir.exists() {
+                fs::remove_dir_all(&target_dir)
+                    .with_context(|| format!("failed to reset {}", target_dir.display()))?;
+            }
+            self.install_windows_embeddable(&full_version, &target_dir)?;
+            let exe = self.get_python_exe(version)?;
+            if !is_python_runtime_healthy(&exe) {
+                let stderr = String::from_utf8_lossy(&output.stderr);
+                let stdout = String::from_utf8_lossy(&output.stdout);
+                bail!(
+                    "installer fallback completed but runtime is unhealthy at {}\ninstaller output:\n{}{}",
+                    exe.display(),
+                    stdout,
+                    stderr
+                );
+            }
+            record_runtime(&target_dir);
+            success(&format!(
+                "Python {} installed at {}",
+                version,
+                target_dir.display()
+            ));
+            add_to_path(&target_dir)?;
+            add_to_path(&target_dir.join("Scripts"))?;
+            success(&format!("Added Python {} to PATH.", version));
+            return Ok(());
+        }
+
+        let exe = self.get_python_exe(version)?;
+        if !is_python_runtime_healthy(&exe) {
+            bail!("python installer completed but runtime is unhealthy at {}", exe.display());
+        }
+        record_runtime(&target_dir);
+        success(&format!(
+            "Python {} installed at {}",
+            version,
+            target_dir.display()
+        ));
+        info("Ensuring Python install directories are in system PATH...");
+        add_to_path(&target_dir)?;
+        add_to_path(&target_dir.join("Scripts"))?;
+        success(&format!("Added Python {} to PATH.", version));
+        Ok(())
+    }
+
+    fn install_windows_embeddable(&self, full_version: &str, target_dir: &Path) -> Result<()> {
+        let url = format!(
+            "https://www.python.org/ftp/python/{0}/python-{0}-embed-amd64.zip",
+            full_version
+        );
+        info(&format!("Downloading embeddable Python from {}...", url));
+        let zip_path = download_file(&url, "python-embed", "zip")?;
+        fs::create_dir_all(target_dir)
+            .with_context(|| format!("failed to create {}", target_dir.display()))?;
+        extract_zip_to_dir(&zip_path, target_dir)?;
+        patch_embeddable_pth(target_dir)?;
+
+        let exe = target_dir.join("python.exe");
+        if exe.exists() {
+            if let Err(err) = bootstrap_pip(&exe) {
+                warning(&format!("Pip bootstrap failed: {err}"));
+            }
+        }
+        Ok(())
+    }
+
+    fn get_site_packages_dir(&self, version: &str) -> Result<PathBuf> {
+        let python_dir = self.get_python_path(version)?;
+        if cfg!(windows) {
+            let tools_lib = python_dir.join("tools").join("Lib");
+            let lib_root = if tools_lib.exists() {
+                python_dir.join("tools")
+            } else {
+                python_dir
+            };
+            let site = lib_root.join("Lib").join("site-packages");
+            fs::create_dir_all(&site).with_context(|| format!("failed to create {}", site.display()))?;
+            return Ok(site);
+        }
+        let (major, minor) = parse_major_minor(version)?;
+        let site = python_dir
+            .join("lib")
+            .join(format!("python{}.{}", major, minor))
+            .join("site-packages");
+        fs::create_dir_all(&site).with_context(|| format!("failed to create {}", site.display()))?;
+        Ok(site)
+    }
+}
+
+// Runtime directories xe installed, one per line. `xe clean --runtimes` removes only these,
+// so Pythons the user installed next to them are never touched.
+const RUNTIMES_FILE: &str = "runtimes.txt";
+
+fn record_runtime(dir: &Path) {
+    let path = xe_home().join(RUNTIMES_FILE);
+    let line = dir.display().to_string();
+    let mut known = fs::read_to_string(&path).unwrap_or_default();
+    if known.lines().any(|l| l == line) {
+        return;
+    }
+    known.push_str(&line);
+    known.push('\n');
+    if let Err(err) = fs::create_dir_all(xe_home()).and_then(|_| fs::write(&path, known)) {
+        warning(&format!("failed to record Python runtime {}: {err}", dir.display()));
+    }
+}
+
+fn recorded_runtimes() -> Vec<PathBuf> {
+    fs::read_to_string(xe_home().join(RUNTIMES_FILE))
+        .unwrap_or_default()
+        .lines()
+        .filter(|line| !line.trim().is_empty())
+        .map(PathBuf::from)
+        .filter(|dir| dir.is_dir())
+        .collect()
+}
+
+fn forget_runtimes(removed: &[PathBuf]) {
+    let path = xe_home().join(RUNTIMES_FILE);
+    let Ok(known) = fs::read_to_string(&path) else {
+        return;
+    };
+    let kept = known
+        .lines()
+        .filter(|line| !removed.iter().any(|dir| Path::new(line) == dir))
+        .map(|line| format!("{line}\n"))
+        .collect::<String>();
+    if let Err(err) = fs::write(&path, kept) {
+        debug(&format!("failed to update {}: {err}", path.display()));
+    }
+}
+
+// Every project directory xe has selected a runtime for, with when it last did, in xe
+// home. Venvs keep their own list of projects too; both feed known_projects.
+const PROJECTS_FILE: &str = "projects.json";
+
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+struct ProjectRecord {
+    #[serde(default)]
+    last_used: String,
+}
+
+fn load_project_registry() -> BTreeMap<PathBuf, ProjectRecord> {
+    let path = xe_home().join(PROJECTS_FILE);
+    let Ok(bytes) = fs::read(&path) else {
+        return BTreeMap::new();
+    };
+    serde_json::from_slice(&bytes).unwrap_or_else(|err| {
+        warning(&format!("ignoring {}: {err}", path.display()));
+        BTreeMap::new()
+    })
+}
+
+fn save_project_registry(registry: &BTreeMap<PathBuf, ProjectRecord>) -> Result<()> {
+    let data = serde_json::to_vec_pretty(registry).context("failed to encode the project registry")?;
+    write_file_atomic(&xe_home().join(PROJECTS_FILE), &data)
+}
+
+// Read-modify-write of the registry under an exclusive lock, so xe processes started in
+// several projects at once do not drop each other's entries.
+fn update_project_registry<T>(update: impl FnOnce(&mut BTreeMap<PathBuf, ProjectRecord>) -> Result<T>) -> Result<T> {
+    let home = xe_home();
+    fs::create_dir_all(&home).with_context(|| format!("failed to create {}", home.display()))?;
+    let lock_path = home.join(format!("{PROJECTS_FILE}.lock"));
+    let lock = fs::OpenOptions::new()
+        .create(true)
+        .truncate(false)
+        .write(true)
+        .open(&lock_path)
+        .with_context(|| format!("failed to open {}", lock_path.display()))?;
+    lock.lock().with_context(|| format!("failed to lock {}", lock_path.display()))?;
+    let mut registry = load_project_registry();
+    let out = update(&mut registry)?;
+    save_project_registry(&registry)?;
+    Ok(out)
+}
+
+// A failed write only costs prune-envs and `xe projects` an entry, so it is not an error.
+// Paths are recorded canonically, so a project reached through a symlink or a relative
+// path is one entry.
+fn record_project_dir(dir: &Path) {
+    let canonical = fs::canonicalize(dir).unwrap_or_else(|_| dir.to_path_buf());
+    let recorded = update_project_registry(|registry| {
+        registry.insert(
+            canonical,
+            ProjectRecord {
+                last_used: timestamp_iso8601(),
+            },
+        );
+        Ok(())
+    });
+    if let Err(err) = recorded {
+        debug(&format!("failed to record project {}: {err:#}", dir.display()));
+    }
+}
+
+// Registered project directories that still hold an xe.toml, including ones only a venv's
+// project list knows about (recorded before the registry existed).
+fn known_projects() -> Vec<PathBuf> {
+    let mut out = load_project_registry().into_keys().collect::<Vec<_>>();
+    if let Ok(vm) = VenvManager::new() {
+        for name in vm.list().unwrap_or_default() {
+            let listed = fs::read_to_string(vm.base_dir.join(name).join(VENV_PROJECTS_FILE)).unwrap_or_default();
+            out.extend(listed.lines().filter(|line| !line.trim().is_empty()).map(PathBuf::from));
+        }
+    }
+    out.retain(|dir| dir.join(XE_TOML).is_file());
+    out.sort();
+    out.dedup();
+    out
+}
+
+fn dir_size(path: &Path) -> u64 {
+    WalkDir::new(path)
+        .into_iter()
+        .flatten()
+        .filter(|entry| entry.file_type().is_file())
+        .map(|entry| entry.metadata().map(|m| m.len()).unwrap_or(0))
+        .sum()
+}
+
+fn parse_major_minor(version: &str) -> Result<(u32, u32)> {
+    let parts: Vec<&str> = version.split('.').collect();
+    if parts.len() < 2 {
+        bail_kind!(ErrorKind::Config, "invalid python version {}", version);
+    }
+    let major = parts[0]
+        .parse::<u32>()
+        .with_context(|| format!("invalid python major version in {version}"))?;
+    let minor = parts[1]
+        .parse::<u32>()
+        .with_context(|| format!("invalid python minor version in {version}"))?;
+    Ok((major, minor))
+}
+
+fn resolve_latest_windows_installer_version(version: &str) -> Result<String> {
+    let parts: Vec<&str> = version.split('.').collect();
+    if parts.len() >= 3 {
+        return Ok(version.to_string());
+    }
+    if parts.len() != 2 {
+        return Ok(version.to_string());
+    }
+
+    let latest = resolve_latest_patch_version(version)?;
+    if windows_installer_exists(&latest) {
+        return Ok(latest);
+    }
+    if let Some(fallback) = windows_installer_fallback(version) {
+        if windows_installer_exists(fallback) {
+            return Ok(fallback.to_string());
+        }
+    }
+
+    let mut candidates = list_patch_versions(version)?;
+    candidates.sort_by(|a, b| compare_version(a, b).reverse());
+    for candidate in &candidates {
+        if windows_installer_exists(candidate) {
+            return Ok(candidate.clone());
+        }
+    }
+
+    if let Some(fallback) = windows_installer_fallback(version) {
+        return Ok(fallback.to_string());
+    }
+    Ok(format!("{version}.0"))
+}
+
+fn resolve_latest_patch_version(version: &str) -> Result<String> {
+    let parts: Vec<&str> = version.split('.').collect();
+    if parts.len() >= 3 {
+        return Ok(version.to_string());
+    }
+    if parts.len() != 2 {
+        return Ok(version.to_string());
+    }
+    let mut candidates = list_patch_versions(version)?;
+    if candidates.is_empty() {
+        return Ok(format!("{version}.0"));
+    }
+    candidates.sort_by(|a, b| compare_version(a, b).reverse());
+    Ok(candidates[0].clone())
+}
+
+fn list_patch_versions(version: &str) -> Result<Vec<String>> {
+    let body = http_client()?
+        .get("https://www.python.org/ftp/python/")
+        .timeout(Duration::from_secs(30))
+        .send()
+        .context("failed to request python FTP listing")?
+        .error_for_status()
+        .context("python FTP listing request failed")?
+        .text()
+        .context("failed to decode python FTP response")?;
+    let re = Regex::new(r#"href="(\d+\.\d+\.\d+)/""#).unwrap();
+    let prefix = format!("{version}.");
+    let mut out = Vec::new();
+    for cap in re.captures_iter(&body) {
+        let value = cap.get(1).map(|m| m.as_str()).unwrap_or_default();
+        if value.starts_with(&prefix) {
+            out.push(value.to_string());
+        }
+    }
+    Ok(out)
+}
+
+fn windows_installer_fallback(version: &str) -> Option<&'static str> {
+    match version {
+        "3.9" => Some("3.9.13"),
+        "3.10" => Some("3.10.11"),
+        "3.11" => Some("3.11.9"),
+        "3.12" => Some("3.12.3"),
+        "3.13" => Some("3.13.0"),
+        _ => None,
+    }
+}
+
+fn windows_installer_exists(version: &str) -> bool {
+    if version.trim().is_empty() {
+        return false;
+    }
+    let url = format!(
+        "https://www.python.org/ftp/python/{0}/python-{0}-amd64.exe",
+        version
+    );
+    let Ok(client) = http_client() else {
+        return false;
+    };
+    let timeout = Duration::from_secs(20);
+    match client.head(&url).timeout(timeout).send() {
+        Ok(resp) => {
+            if resp.status() == StatusCode::METHOD_NOT_ALLOWED {
+                client
+                    .get(&url)
+                    .timeout(timeout)
+                    .header("Range", "bytes=0-0")
+                    .send()
+                    .map(|r| r.status().is_success() || r.status() == StatusCode::PARTIAL_CONTENT)
+                    .unwrap_or(false)
+            } else {
+                resp.status().is_success()
+            }
+        }
+        Err(_) => false,
+    }
+}
+
+fn compare_version(a: &str, b: &str) -> Ordering {
+    let pa: Vec<u32> = a
+        .split('.')
+        .map(|s| s.parse::<u32>().unwrap_or(0))
+        .collect();
+    let pb: Vec<u32> = b
+        .split('.')
+        .map(|s| s.parse::<u32>().unwrap_or(0))
+        .collect();
+    let n = pa.len().max(pb.len());
+    for i in 0..n {
+        let va = *pa.get(i).unwrap_or(&0);
+        let vb = *pb.get(i).unwrap_or(&0);
+        if va > vb {
+            return Ordering::Greater;
+        }
+        if va < vb {
+            return Ordering::Less;
+        }
+    }
+    Ordering::Equal
+}
+
+fn is_windows_launcher_version_available(version: &str) -> bool {
+    if !cfg!(windows) {
+        return false;
+    }
+    let parts: Vec<&str> = version.split('.').collect();
+    if parts.len() < 2 {
+        return false;
+    }
+    let selector = format!("{}.{}", parts[0], parts[1]);
+    let mut candidates = vec![PathBuf::from("py")];
+    if let Ok(win_dir) = env::var("WINDIR") {
+        candidates.push(PathBuf::from(win_dir).join("py.exe"));
+    }
+    if let Ok(local_app_data) = env::var("LOCALAPPDATA") {
+        candidates.push(
+            PathBuf::from(local_app_data)
+                .join("Programs")
+                .join("Python")
+                .join("Launcher")
+                .join("py.exe"),
+        );
+    }
+    for candidate in candidates {
+        let status = Command::new(&candidate)
+            .arg(format!("-{}", selector))
+            .arg("-V")
+            .stdout(Stdio::null())
+            .stderr(Stdio::null())
+            .status();
+        if let Ok(status) = status {
+            if status.success() {
+                return true;
+            }
+        }
+    }
+    false
+}
+
+fn is_python_runtime_healthy(exe: &Path) -> bool {
+    let output = run_python(
+        Command::new(exe).args(["-c", "import encodings,site; print('ok')"]),
+        "python",
+        Duration::from_secs(30),
+        false,
+    );
+    match output {
+        Ok(out) if out.status.success() => String::from_utf8_lossy(&out.stdout).contains("ok"),
+        _ => false,
+    }
+}
+
+fn add_to_path(dir: &Path) -> Result<()> {
+    info(&format!("Ensuring {} is in system PATH...", dir.display()));
+    if cfg!(windows) {
+        let escaped = dir.to_string_lossy().replace('\'', "''");
+        let script = format!(
+            "$targetDir = '{}'; \
+             $currentPath = [Environment]::GetEnvironmentVariable('Path', 'User'); \
+             if ($null -eq $currentPath) {{ $currentPath = '' }}; \
+             $pathArray = $currentPath.Split(';', [System.StringSplitOptions]::RemoveEmptyEntries); \
+             if ($pathArray -notcontains $targetDir) {{ \
+               $newPath = ($pathArray + $targetDir) -join ';'; \
+               [Environment]::SetEnvironmentVariable('Path', $newPath, 'User'); \
+               Write-Output 'Added to PATH'; \
+             }} else {{ Write-Output 'Already in PATH'; }}"
+            ,
+            escaped
+        );
+        let status = Command::new("powershell")
+            .arg("-NoProfile")
+            .arg("-Command")
+            .arg(script)
+            .status()
+            .context("failed to run PowerShell PATH update")?;
+        if !status.success() {
+            bail!("failed to update PATH");
+        }
+        info("Restart your terminal to pick it up");
+        return Ok(());
+    }
+    let kind = match detect_shell() {
+        ShellKind::PowerShell | ShellKind::Cmd => ShellKind::Bash,
+        kind => kind,
+    };
+    let profile = shell_profile_path(kind);
+    let changed = write_profile_block(&profile, kind, dir)?;
+    report_profile_update(dir, &profile, changed);
+    Ok(())
+}
+
+fn create_shim(name: &str, target: &Path) -> Result<()> {
+    create_shim_with_args(name, target, &[])
+}
+
+fn create_shim_with_args(name: &str, target: &Path, args: &[PathBuf]) -> Result<()> {
+    let shim_dir = xe_shim_dir();
+    fs::create_dir_all(&shim_dir).with_context(|| format!("failed to create {}", shim_dir.display()))?;
+    if cfg!(windows) {
+        return create_exe_shim(&shim_dir, name, target, args);
+    }
+    let fixed = args
+        .iter()
+        .map(|a| format!("\"{}\" ", a.display()))
+        .collect::<String>();
+    let path = shim_dir.join(name);
+    let content = format!("#!/bin/sh\nexec \"{}\" {}\"$@\"\n", target.display(), fixed);
+    fs::write(&path, content).with_context(|| format!("failed to write {}", path.display()))?;
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        let mut perms = fs::metadata(&path)?.permissions();
+        perms.set_mode(0o755);
+        fs::set_permissions(&path, perms)?;
+    }
+    Ok(())
+}
+
+// Adjacent to `<name>.exe` on Windows: the program the trampoline runs and the
+// arguments it puts before the caller's own.
+#[derive(Debug, Serialize, Deserialize)]
+struct ShimConfig {
+    target: PathBuf,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    args: Vec<PathBuf>,
+}
+
+// Windows shims are copies of the xe binary (hard links where the volume allows) named
+// `<name>.exe` next to a `<name>.shim` config. Started under any name but `xe` with a
+// config beside it, xe acts as a trampoline; see run_shim_trampoline. Unlike .bat files
+// this keeps argument quoting intact, works from CreateProcess callers and does not
+// prompt "Terminate batch job" on Ctrl-C.
+fn create_exe_shim(shim_dir: &Path, name: &str, target: &Path, args: &[PathBuf]) -> Result<()> {
+    let config = ShimConfig {
+        target: target.to_path_buf(),
+        args: args.to_vec(),
+    };
+    let text = toml::to_string(&config).context("failed to encode shim config")?;
+    write_file_atomic(&shim_dir.join(format!("{name}.shim")), text.as_bytes())?;
+    let exe_path = shim_dir.join(format!("{name}.exe"));
+    if !exe_path.exists() {
+        let xe = env::current_exe().context("failed to locate the xe executable")?;
+        if fs::hard_link(&xe, &exe_path).is_err() {
+            fs::copy(&xe, &exe_path).with_context(|| format!("failed to write {}", exe_path.display()))?;
+        }
+    }
+    let legacy = shim_dir.join(format!("{name}.bat"));
+    if legacy.exists() {
+        fs::remove_file(&legacy).with_context(|| format!("failed to remove {}", legacy.display()))?;
+    }
+    Ok(())
+}
+
+// When this binary is a Windows shim, runs its target with the configured arguments
+// followed by the caller's and returns the exit code to finish with.
+fn run_shim_trampoline() -> Option<i32> {
+    if !cfg!(windows) {
+        return None;
+    }
+    let exe = env::current_exe().ok()?;
+    if exe.file_stem()?.eq_ignore_ascii_case("xe") {
+        return None;
+    }
+    let text = fs::read_to_string(exe.with_extension("shim")).ok()?;
+    let run = || -> Result<i32> {
+        let config = toml::from_str::<ShimConfig>(&text)
+            .with_context(|| format!("invalid shim config for {}", exe.display()))?;
+        ignore_console_ctrl_c();
+        let status = Command::new(&config.target)
+            .args(&config.args)
+            .args(env::args_os().skip(1))
+            .status()
+            .with_context(|| format!("failed to run {}", config.target.display()))?;
+        Ok(status.code().unwrap_or(1))
+    };
+    Some(run().unwrap_or_else(|err| {
+        error(&format!("{err:#}"));
+        1
+    }))
+}
+
+// The target shares the console and handles Ctrl-C itself; the trampoline keeps waiting
+// so it can pass on the exit code. A handler is used rather than ignoring the signal
+// outright, since that setting would be inherited by the target.
+#[cfg(windows)]
+fn ignore_console_ctrl_c() {
+    unsafe extern "system" fn handled(_ctrl_type: u32) -> i32 {
+        1
+    }
+    #[link(name = "kernel32")]
+    extern "system" {
+        fn SetConsoleCtrlHandler(handler: Option<unsafe extern "system" fn(u32) -> i32>, add: i32) -> i32;
+    }
+    unsafe {
+        SetConsoleCtrlHandler(Some(handled), 1);
+    }
+}
+
+#[cfg(not(windows))]
+fn ignore_console_ctrl_c() {}
+
+fn remove_shim(name: &str) -> Result<()> {
+    let shim_dir = xe_shim_dir();
+    let candidates = ["", ".bat", ".exe", ".shim"].map(|ext| shim_dir.join(format!("{name}{ext}")));
+    for path in candidates {
+        if path.exists() {
+            fs::remove_file(&path)
+                .with_context(|| format!("failed to remove {}", path.display()))?;
+        }
+    }
+    Ok(())
+}
+
+#[derive(Debug, Clone)]
+struct VenvManager {
+    base_dir: PathBuf,
+}
+
+const VENV_PROJECTS_FILE: &str = "xe-projects.txt";
+const VENV_MANIFEST: &str = "xe-venv.json";
+
+// Written to xe-venv.json when xe creates or adopts a venv.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct VenvManifest {
+    #[serde(default)]
+    python_version: String,
+    #[serde(default)]
+    base_python: PathBuf,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    created_by: Option<PathBuf>,
+    #[serde(default)]
+    created_at: String,
+    #[serde(default)]
+    updated_at: String,
+    // Set for adopted venvs, which live outside the venvs directory.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    external_path: Option<PathBuf>,
+}
+
+#[derive(Debug, Serialize)]
+struct VenvInfo {
+    name: String,
+    path: PathBuf,
+    python_exe: PathBuf,
+    python_version: String,
+    base_python: String,
+    created: String,
+    created_by: Option<PathBuf>,
+    adopted: bool,
+    size_bytes: u64,
+    packages: usize,
+    projects: Vec<PathBuf>,
+}
+
+fn print_venv_table(venvs: &[VenvInfo]) {
+    let width = venvs.iter().map(|v| v.name.len()).max().unwrap_or(0).max("Name".len());
+    let python_width = venvs
+        .iter()
+        .map(|v| or_dash(&v.python_version).len())
+        .max()
+        .unwrap_or(0)
+        .max("Python".len());
+    println!("{:<width$}  {:<python_width$}  {:>8}  {:>10}  Projects", "Name", "Python", "Packages", "Size");
+    for venv in venvs {
+        println!(
+            "{:<width$}  {:<python_width$}  {:>8}  {:>10}  {}",
+            venv.name,
+            or_dash(&venv.python_version),
+            venv.packages,
+            human_bytes(venv.size_bytes),
+            venv.projects.len()
+        );
+    }
+}
+
+fn or_dash(value: &str) -> &str {
+    if value.is_empty() {
+        "-"
+    } else {
+        value
+    }
+}
+
+impl VenvManager {
+    fn new() -> Result<Self> {
+        Self::at(xe_venv_dir())
+    }
+
+    fn at(base_dir: PathBuf) -> Result<Self> {
+        fs::create_dir_all(&base_dir).with_context(|| format!("failed to create {}", base_dir.display()))?;
+        Ok(Self { base_dir })
+    }
+
+    fn selection(&self, name: &str) -> Result<RuntimeSelection> {
+        let python_exe = self.get_python_exe(name);
+        let mut site_packages = self.get_site_packages_dir(name);
+        if site_packages
+            .file_name()
+            .and_then(|s| s.to_str())
+            .map(|s| s.eq_ignore_ascii_case("lib"))
+            .unwrap_or(false)
+        {
+            debug(&format!("Probing {} for its site-packages", python_exe.display()));
+            if let Ok(detected) = detect_venv_site_packages(&python_exe) {
+                site_packages = detected;
+            }
+        }
+        fs::create_dir_all(&site_packages)
+            .with_context(|| format!("failed to create {}", site_packages.display()))?;
+        Ok(RuntimeSelection {
+            activation_path: python_exe
+                .parent()
+                .map(Path::to_path_buf)
+                .unwrap_or_else(PathBuf::new),
+            python_exe,
+            site_packages,
+            venv_name: name.to_string(),
+            is_venv: true,
+            isolated: false,
+        })
+    }
+
+    fn create(&self, name: &str, python_path: &Path, created_by: Option<&Path>) -> Result<()> {
+        self.create_env(name, python_path)?;
+        let now = timestamp_iso8601();
+        let manifest = VenvManifest {
+            python_version: venv_python_version(&self.base_dir.join(name)),
+            base_python: python_path.to_path_buf(),
+            created_by: created_by.map(Path::to_path_buf),
+            created_at: now.clone(),
+            updated_at: now,
+            external_path: None,
+        };
+        self.write_manifest(name, &manifest)
+    }
+
+    fn create_env(&self, name: &str, python_path: &Path) -> Result<()> {
+        let venv_path = self.base_dir.join(name);
+        if venv_path.exists() {
+            bail!("venv {} already exists", name);
+        }
+        let status = Command::new(python_path)
+            .arg("-m")
+            .arg("venv")
+            .arg(&venv_path)
+            .status()
+            .context("failed to create venv with stdlib venv")?;
+        if status.success() {
+            return Ok(());
+        }
+
+        let bootstrap = Command::new(python_path)
+            .args([
+                "-m",
+                "pip",
+                "install",
+                "--disable-pip-version-check",
+                "--no-warn-script-location",
+                "--upgrade",
+                "--force-reinstall",
+                "virtualenv",
+            ])
+            .stdout(Stdio::null())
+            .stderr(Stdio::null())
+            .status()
+            .context("failed to bootstrap virtualenv")?;
+        if !bootstrap.success() {
+            bail!("failed to bootstrap virtualenv");
+        }
+        let fallback = Command::new(python_path)
+            .arg("-m")
+            .arg("virtualenv")
+            .arg(&venv_path)
+            .stdout(Stdio::null())
+            .stderr(Stdio::null())
+            .status()
+            .context("failed to create venv with virtualenv")?;
         if !fallback.success() {
             bail!("failed to create venv with virtualenv");
         }
-        Ok(())
+        Ok(())
+    }
+
+    fn exists(&self, name: &str) -> bool {
+        self.base_dir.join(name).exists()
+    }
+
+    fn manifest(&self, name: &str) -> Option<VenvManifest> {
+        let text = fs::read_to_string(self.base_dir.join(name).join(VENV_MANIFEST)).ok()?;
+        serde_json::from_str(&text).ok()
+    }
+
+    fn write_manifest(&self, name: &str, manifest: &VenvManifest) -> Result<()> {
+        let path = self.base_dir.join(name).join(VENV_MANIFEST);
+        let data = serde_json::to_vec_pretty(manifest).context("failed to encode venv manifest")?;
+        write_file_atomic(&path, &data)
+    }
+
+    // The directory holding the environment: the registration directory itself, or the
+    // external location of an adopted venv.
+    fn root(&self, name: &str) -> PathBuf {
+        self.manifest(name)
+            .and_then(|m| m.external_path)
+            .unwrap_or_else(|| self.base_dir.join(name))
+    }
+
+    // Registers a venv created outside xe (e.g. `python -m venv`) under `name`. The
+    // environment stays where it is; only a manifest is written under the venvs directory.
+    fn adopt(&self, name: &str, path: &Path) -> Result<()> {
+        let mut pyvenv = read_pyvenv_cfg(path);
+        let python_version = pyvenv.remove("version").unwrap_or_default();
+        let base_python = pyvenv.remove("executable").unwrap_or_default();
+        let dir = self.base_dir.join(name);
+        fs::create_dir_all(&dir).with_context(|| format!("failed to create {}", dir.display()))?;
+        let now = timestamp_iso8601();
+        self.write_manifest(
+            name,
+            &VenvManifest {
+                python_version,
+                base_python: PathBuf::from(base_python),
+                created_by: None,
+                created_at: now.clone(),
+                updated_at: now,
+                external_path: Some(path.to_path_buf()),
+            },
+        )
+    }
+
+    // Removes the venv. For an adopted venv only the registration is removed; the
+    // environment it points to is left alone.
+    fn delete(&self, name: &str) -> Result<()> {
+        if name.trim().is_empty() {
+            bail!("venv name required");
+        }
+        let path = self.base_dir.join(name);
+        if path.exists() {
+            fs::remove_dir_all(&path).with_context(|| format!("failed to remove {}", path.display()))?;
+        }
+        Ok(())
+    }
+
+    // Directories that hold a manifest or a pyvenv.cfg; anything else under the venvs
+    // directory is not treated as a venv.
+    fn list(&self) -> Result<Vec<String>> {
+        let mut out = Vec::new();
+        for entry in fs::read_dir(&self.base_dir)
+            .with_context(|| format!("failed to read {}", self.base_dir.display()))?
+        {
+            let entry = entry?;
+            let path = entry.path();
+            if entry.file_type()?.is_dir()
+                && (path.join(VENV_MANIFEST).is_file() || path.join("pyvenv.cfg").is_file())
+            {
+                out.push(entry.file_name().to_string_lossy().to_string());
+            }
+        }
+        out.sort();
+        Ok(out)
+    }
+
+    // Remembers that the project in `project_dir` uses this venv, so `xe venv info` can list
+    // its users. Stale entries are filtered when read, and a failed write is not an error.
+    fn record_project(&self, name: &str, project_dir: &Path) {
+        let path = self.base_dir.join(name).join(VENV_PROJECTS_FILE);
+        let dir = project_dir.display().to_string();
+        let mut known = fs::read_to_string(&path).unwrap_or_default();
+        if known.lines().any(|line| line == dir) {
+            return;
+        }
+        known.push_str(&dir);
+        known.push('\n');
+        if let Err(err) = fs::write(&path, known) {
+            debug(&format!("failed to record project for venv {name}: {err}"));
+        }
+    }
+
+    // Projects recorded for this venv whose xe.toml still selects it.
+    fn projects(&self, name: &str) -> Vec<PathBuf> {
+        let path = self.base_dir.join(name).join(VENV_PROJECTS_FILE);
+        fs::read_to_string(path)
+            .unwrap_or_default()
+            .lines()
+            .map(PathBuf::from)
+            .filter(|dir| {
+                load_project(&dir.join(XE_TOML))
+                    .map(|cfg| cfg.venv.name.eq_ignore_ascii_case(name))
+                    .unwrap_or(false)
+            })
+            .collect()
+    }
+
+    fn info(&self, name: &str) -> Result<VenvInfo> {
+        let path = self.root(name);
+        let manifest = self.manifest(name);
+        let mut pyvenv = read_pyvenv_cfg(&path);
+        let created = match manifest.as_ref() {
+            Some(m) if m.external_path.is_none() => m.created_at.get(..10).unwrap_or_default().to_string(),
+            _ => fs::metadata(path.join("pyvenv.cfg"))
+                .or_else(|_| fs::metadata(&path))
+                .and_then(|meta| meta.created().or_else(|_| meta.modified()))
+                .map(|time| OffsetDateTime::from(time).date().to_string())
+                .unwrap_or_default(),
+        };
+        let mut size_bytes = 0u64;
+        let mut packages = 0usize;
+        for entry in WalkDir::new(&path).into_iter().flatten() {
+            if entry.file_type().is_file() {
+                size_bytes += entry.metadata().map(|m| m.len()).unwrap_or(0);
+            } else if entry.file_type().is_dir()
+                && entry.file_name().to_string_lossy().ends_with(".dist-info")
+                && entry
+                    .path()
+                    .parent()
+                    .and_then(Path::file_name)
+                    .is_some_and(|p| p.eq_ignore_ascii_case("site-packages"))
+            {
+                packages += 1;
+            }
+        }
+        Ok(VenvInfo {
+            name: name.to_string(),
+            python_exe: self.get_python_exe(name),
+            python_version: pyvenv
+                .remove("version")
+                .or_else(|| pyvenv.remove("version_info"))
+                .unwrap_or_default(),
+            base_python: pyvenv
+                .remove("executable")
+                .or_else(|| pyvenv.remove("home"))
+                .unwrap_or_default(),
+            created,
+            created_by: manifest.as_ref().and_then(|m| m.created_by.clone()),
+            adopted: manifest.as_ref().is_some_and(|m| m.external_path.is_some()),
+            size_bytes,
+            packages,
+            projects: self.projects(name),
+            path,
+        })
+    }
+
+    fn get_python_exe(&self, name: &str) -> PathBuf {
+        venv_python_exe(&self.root(name))
+    }
+
+    fn get_site_packages_dir(&self, name: &str) -> PathBuf {
+        venv_site_packages(&self.root(name))
+    }
+}
+
+// Site-packages of a venv without starting its interpreter: `Lib/site-packages` on Windows,
+// `lib/pythonX.Y/site-packages` elsewhere with X.Y taken from pyvenv.cfg. When the version is
+// not recorded the single `lib/*/site-packages` directory is used; failing both, `<venv>/lib`
+// is returned and the caller probes the interpreter.
+fn venv_site_packages(root: &Path) -> PathBuf {
+    if cfg!(windows) {
+        return root.join("Lib").join("site-packages");
+    }
+    let lib = root.join("lib");
+    if let Ok((major, minor)) = parse_major_minor(&venv_python_version(root)) {
+        let site = lib.join(format!("python{major}.{minor}")).join("site-packages");
+        if site.is_dir() {
+            return site;
+        }
+    }
+    let candidates = fs::read_dir(&lib)
+        .into_iter()
+        .flatten()
+        .flatten()
+        .map(|entry| entry.path().join("site-packages"))
+        .filter(|site| site.is_dir())
+        .collect::<Vec<_>>();
+    match candidates.as_slice() {
+        [site] => site.clone(),
+        _ => lib,
+    }
+}
+
+fn venv_python_exe(root: &Path) -> PathBuf {
+    if cfg!(windows) {
+        root.join("Scripts").join("python.exe")
+    } else {
+        root.join("bin").join("python")
+    }
+}
+
+fn venv_python_version(venv_root: &Path) -> String {
+    read_pyvenv_cfg(venv_root).remove("version").unwrap_or_default()
+}
+
+fn read_pyvenv_cfg(venv_root: &Path) -> HashMap<String, String> {
+    fs::read_to_string(venv_root.join("pyvenv.cfg"))
+        .unwrap_or_default()
+        .lines()
+        .filter_map(|line| {
+            let (key, value) = line.split_once('=')?;
+            Some((key.trim().to_string(), value.trim().to_string()))
+        })
+        .collect()
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct Package {
+    #[serde(alias = "Name")]
+    name: String,
+    #[serde(alias = "Version")]
+    version: String,
+    #[serde(default, alias = "DownloadURL")]
+    download_url: String,
+    #[serde(default, alias = "Hash")]
+    hash: String,
+    // Digest `hash` was computed with; entries written before it was recorded are sha256.
+    #[serde(default)]
+    hash_algorithm: HashAlgorithm,
+    // Environment marker under which the package is needed, taken from the requirement
+    // and Requires-Dist markers that brought it in; empty when it is needed everywhere.
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    markers: String,
+    // Normalized names of the resolved packages this one requires, for the install order.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    dependencies: Vec<String>,
+}
+
+// Digests the CAS addresses blobs by and lock entries record. Indexes publish sha256;
+// blake2b digests are computed by xe from a download verified against that sha256.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Hash, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+enum HashAlgorithm {
+    #[default]
+    Sha256,
+    Blake2b,
+}
+
+impl HashAlgorithm {
+    fn name(self) -> &'static str {
+        match self {
+            HashAlgorithm::Sha256 => "sha256",
+            HashAlgorithm::Blake2b => "blake2b",
+        }
+    }
+
+    fn is_default(&self) -> bool {
+        *self == HashAlgorithm::Sha256
+    }
+
+    // Whether `value` is a hex digest of this algorithm.
+    fn is_digest(self, value: &str) -> bool {
+        let len = match self {
+            HashAlgorithm::Sha256 => 64,
+            HashAlgorithm::Blake2b => 128,
+        };
+        value.len() == len && value.bytes().all(|b| b.is_ascii_hexdigit())
+    }
+
+    fn hasher(self) -> Hasher {
+        match self {
+            HashAlgorithm::Sha256 => Hasher::Sha256(Sha256::new()),
+            HashAlgorithm::Blake2b => Hasher::Blake2b(Blake2b512::new()),
+        }
+    }
+
+    fn digest(self, data: &[u8]) -> String {
+        let mut hasher = self.hasher();
+        hasher.update(data);
+        hasher.finalize_hex()
+    }
+}
+
+enum Hasher {
+    Sha256(Sha256),
+    Blake2b(Blake2b512),
+}
+
+impl Hasher {
+    fn update(&mut self, data: &[u8]) {
+        match self {
+            Hasher::Sha256(hasher) => hasher.update(data),
+            Hasher::Blake2b(hasher) => hasher.update(data),
+        }
+    }
+
+    fn finalize_hex(self) -> String {
+        match self {
+            Hasher::Sha256(hasher) => hex::encode(hasher.finalize()),
+            Hasher::Blake2b(hasher) => hex::encode(hasher.finalize()),
+        }
+    }
+}
+
+fn extract_zip_to_dir(zip_path: &Path, target_dir: &Path) -> Result<()> {
+    let file = File::open(zip_path).with_context(|| format!("failed to open {}", zip_path.display()))?;
+    let mut archive = ZipArchive::new(file).with_context(|| format!("failed to parse {}", zip_path.display()))?;
+    for index in 0..archive.len() {
+        let mut entry = archive.by_index(index).with_context(|| format!("failed to read entry {}", index))?;
+        let out_path = match entry.enclosed_name() {
+            Some(name) => target_dir.join(name),
+            None => continue,
+        };
+        if entry.name().ends_with('/') {
+            fs::create_dir_all(&out_path)
+                .with_context(|| format!("failed to create {}", out_path.display()))?;
+            continue;
+        }
+        if let Some(parent) = out_path.parent() {
+            fs::create_dir_all(parent)
+                .with_context(|| format!("failed to create {}", parent.display()))?;
+        }
+        let mut out = File::create(&out_path).with_context(|| format!("failed to create {}", out_path.display()))?;
+        io::copy(&mut entry, &mut out)
+            .with_context(|| format!("failed to write {}", out_path.display()))?;
+    }
+    Ok(())
+}
+
+fn patch_embeddable_pth(python_dir: &Path) -> Result<()> {
+    for entry in fs::read_dir(python_dir).with_context(|| format!("failed to read {}", python_dir.display()))? {
+        let entry = entry?;
+        let name = entry.file_name().to_string_lossy().to_string();
+        if !name.to_lowercase().ends_with("._pth") {
+            continue;
+        }
+        let path = entry.path();
+        let content = fs::read_to_string(&path).with_context(|| format!("failed to read {}", path.display()))?;
+        if content.contains("\nimport site") || content.starts_with("import site") {
+            continue;
+        }
+        let updated = if content.contains("#import site") {
+            content.replace("#import site", "import site")
+        } else {
+            format!("{content}\nimport site\n")
+        };
+        fs::write(&path, updated).with_context(|| format!("failed to write {}", path.display()))?;
+    }
+    Ok(())
+}
+
+fn bootstrap_pip(python_exe: &Path) -> Result<()> {
+    info("Bootstrapping pip...");
+    let mut resp = http_client()?
+        .get("https://bootstrap.pypa.io/get-pip.py")
+        .timeout(Duration::from_secs(120))
+        .send()
+        .context("failed to download get-pip.py")?;
+    if !resp.status().is_success() {
+        bail_kind!(ErrorKind::Network, "failed to download get-pip.py: {}", resp.status());
+    }
+    let script_path = python_exe
+        .parent()
+        .unwrap_or_else(|| Path::new("."))
+        .join("get-pip.py");
+    let mut script_file =
+        File::create(&script_path).with_context(|| format!("failed to create {}", script_path.display()))?;
+    io::copy(&mut resp, &mut script_file)
+        .with_context(|| format!("failed to write {}", script_path.display()))?;
+
+    let output = run_python(Command::new(python_exe).arg(&script_path), "get-pip.py", python_timeout(), true);
+    let _ = fs::remove_file(&script_path);
+    let output = output.context("failed to bootstrap pip")?;
+    if !output.status.success() {
+        let stderr = String::from_utf8_lossy(&output.stderr);
+        let stdout = String::from_utf8_lossy(&output.stdout);
+        bail!("failed to bootstrap pip: {}\n{}{}", output.status, stdout, stderr);
+    }
+    Ok(())
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct SolveGraph {
+    #[serde(alias = "PythonVersion")]
+    python_version: String,
+    #[serde(default, alias = "Requirements")]
+    requirements: Vec<String>,
+    #[serde(default, alias = "Packages")]
+    packages: Vec<Package>,
+}
+
+struct Installer {
+    cas: Cas,
+    require_hashes: bool,
+    joint: bool,
+    base_site_packages: Option<PathBuf>,
+    dry_run: bool,
+    refresh: bool,
+}
+
+impl Installer {
+    fn new(global_cache_dir: &Path) -> Result<Self> {
+        let cas = Cas::new(global_cache_dir)?;
+        static MIGRATED: OnceLock<()> = OnceLock::new();
+        MIGRATED.get_or_init(|| migrate_legacy_caches(&cas));
+        Ok(Self {
+            cas,
+            require_hashes: false,
+            joint: false,
+            base_site_packages: None,
+            dry_run: false,
+            refresh: false,
+        })
+    }
+
+    // Resolves again instead of reusing a cached solution, in this process or the daemon,
+    // and replaces the cached one, so upgrades see newly published versions.
+    fn refreshed(mut self) -> Self {
+        self.refresh = true;
+        self
+    }
+
+    // Resolves without prefetching the previous solution's artifacts, for `xe plan`.
+    fn dry_run(mut self) -> Self {
+        self.dry_run = true;
+        self
+    }
+
+    // Installs into a site-packages that is layered on top of `base`, skipping packages
+    // `base` already has at the resolved version.
+    fn layered_on(mut self, base: &Path) -> Self {
+        self.base_site_packages = Some(base.to_path_buf());
+        self
+    }
+
+    fn with_require_hashes(mut self, on: bool) -> Self {
+        self.require_hashes = on;
+        self
+    }
+
+    // Always resolves the requirements together, failing on a conflict instead of falling
+    // back to resolving them one at a time.
+    fn with_joint_resolution(mut self) -> Self {
+        self.joint = true;
+        self
+    }
+
+    // Resolves normalized requirements, from the solution cache when possible, and applies
+    // the policy, index origin and hash checks.
+    fn resolve(
+        &self,
+        ctx: &AppContext,
+        cfg: &Config,
+        reqs: &[String],
+        project_dir: &Path,
+        python_exe: &Path,
+    ) -> Result<(SolveGraph, IndexPlan)> {
+        let policy = PackagePolicy::load(project_dir)?;
+        policy.check(reqs.iter().filter_map(|r| requirement_to_dep_name(r)))?;
+        let _interrupts = catch_interrupts();
+
+        let indexes = IndexPlan::load(ctx, cfg)?;
+        let mut cache_key = solution_key(cfg, reqs, &indexes);
+        // A cached solution may come from the one-at-a-time fallback, which a joint
+        // resolution must not reuse.
+        if self.joint {
+            cache_key = solve_key(&cache_key, &["joint".to_string()]);
+        }
+        let resolve_span = span(ctx, "install.resolve", json!({"requirements": reqs.len()}));
+        let cached = match self.refresh {
+            true => None,
+            false => self.cas.load_solution::<SolveGraph>(&cache_key)?,
+        };
+        let (mut graph, fresh) = if let Some(cached) = cached {
+            debug(&format!("Using cached resolution {cache_key}"));
+            ctx.timings.count("install.solution_hit");
+            (cached, false)
+        } else if let Some(graph) = (!self.refresh).then(|| daemon_request(&json!({
+            "op": "resolve",
+            "key": cache_key,
+            "config": cfg,
+            "requirements": reqs,
+            "project_dir": project_dir,
+            "python_exe": python_exe,
+            "joint": self.joint,
+            "settings": indexes.settings_fingerprint(),
+        })))
+        .flatten()
+        .and_then(|graph| serde_json::from_value::<SolveGraph>(graph).ok())
+        {
+            debug(&format!("Resolved {} requirement(s) in the xe daemon", reqs.len()));
+            ctx.timings.count("install.daemon_hit");
+            (graph, true)
+        } else {
+            debug(&format!("Resolving {} requirement(s)", reqs.len()));
+            // Artifacts of the last solution for the same requirement names are likely
+            // needed again, so fetch them while pip resolves.
+            let previous = self.cas.previous_solution(&history_key(cfg, reqs));
+            let resolved = AtomicBool::new(false);
+            let solved = thread::scope(|scope| {
+                if let Some(previous) = previous.as_ref().filter(|_| !self.dry_run) {
+                    scope.spawn(|| self.prefetch(ctx, previous, &indexes, &resolved));
+                }
+                let solved = solve_requirements(cfg, reqs, python_exe, &indexes, self.joint);
+                resolved.store(true, AtomicOrdering::Relaxed);
+                solved
+            })?;
+
+            let solved = dedupe_packages(solved);
+            let graph = SolveGraph {
+                python_version: cfg.python.version.clone(),
+                requirements: reqs.to_vec(),
+                packages: solved,
+            };
+            (graph, true)
+        };
+        drop(resolve_span);
+        indexes.check_origins(&graph.packages)?;
+        let algorithm = cfg.settings.hash_algorithm;
+        let rehashed = graph.packages.iter().all(|p| p.hash.is_empty() || p.hash_algorithm == algorithm);
+        if fresh && !rehashed && !self.dry_run {
+            let _span = span(ctx, "install.rehash", json!({"algorithm": algorithm.name()}));
+            self.rehash(&mut graph.packages, algorithm, &indexes)?;
+        }
+        // A plan does not download, so it leaves digests it could not compute uncached.
+        if fresh && (rehashed || !self.dry_run) {
+            self.cas.save_solution(&cache_key, &graph)?;
+            self.cas.record_history(&history_key(cfg, reqs), &cache_key)?;
+        }
+        policy.check(graph.packages.iter().map(|p| normalize_dep_name(&p.name)))?;
+        if self.require_hashes || cfg.settings.require_hashes {
+            check_required_hashes(&graph.packages)?;
+        }
+        Ok((graph, indexes))
+    }
+
+    // Switches the digests of `packages` to `algorithm`. Indexes only publish sha256, so
+    // each artifact is downloaded once, checked against its sha256 and digested again.
+    fn rehash(&self, packages: &mut [Package], algorithm: HashAlgorithm, indexes: &IndexPlan) -> Result<()> {
+        packages.par_iter_mut().try_for_each(|pkg| -> Result<()> {
+            if pkg.hash.is_empty() || pkg.hash_algorithm == algorithm {
+                return Ok(());
+            }
+            let blob = self
+                .cas
+                .store_package(pkg, indexes.auth_for(&pkg.download_url))
+                .with_context(|| {
+                    format!("failed to fetch {} {} for its {} digest", pkg.name, pkg.version, algorithm.name())
+                })?;
+            pkg.hash = self.cas.rehash(&blob, algorithm)?;
+            pkg.hash_algorithm = algorithm;
+            Ok(())
+        })
+    }
+
+    // Downloads the hashed artifacts of `previous` into the CAS until resolution finishes.
+    // Failures only cost the speculation; the install fetches whatever is still missing.
+    fn prefetch(&self, ctx: &AppContext, previous: &SolveGraph, indexes: &IndexPlan, resolved: &AtomicBool) {
+        previous.packages.par_iter().for_each(|pkg| {
+            if resolved.load(AtomicOrdering::Relaxed)
+                || interrupted()
+                || !pkg.hash_algorithm.is_digest(&pkg.hash)
+                || self.cas.cached_blob(pkg.hash_algorithm, &pkg.hash).is_some()
+            {
+                return;
+            }
+            match self.cas.store_package(pkg, indexes.auth_for(&pkg.download_url)) {
+                Ok(_) => {
+                    ctx.timings.count("install.prefetch");
+                    trace(&format!("Prefetched {} {}", pkg.name, pkg.version));
+                }
+                Err(err) => trace(&format!("Prefetch of {} {} failed: {err:#}", pkg.name, pkg.version)),
+            }
+        });
+    }
+
+    // The wheel for the source distribution stored at `source`, built on a cache miss. The
+    // cache is keyed by the source's digest and the BuildTarget, so `xe cache save` can
+    // hand a build to every machine of the same kind.
+    fn built_wheel(
+        &self,
+        ctx: &AppContext,
+        pkg: &Package,
+        source: &Path,
+        target: &BuildTarget,
+        python_exe: &Path,
+        indexes: &IndexPlan,
+    ) -> Result<PathBuf> {
+        let source_digest = source
+            .file_name()
+            .map(|name| name.to_string_lossy().to_string())
+            .unwrap_or_default();
+        let key = target.key();
+        if let Some(wheel) = self.cas.built_wheel(&source_digest, &key) {
+            ctx.timings.count("install.build_cache_hit");
+            debug(&format!("Using the cached build of {} {} for {}", pkg.name, pkg.version, target.python_tag));
+            return Ok(wheel);
+        }
+        info(&format!("Building {} {} from source", pkg.name, pkg.version));
+        ctx.timings.count("install.built");
+        let file_name = BlobMeta::read(source)
+            .map(|meta| meta.file_name)
+            .filter(|name| !name.is_empty())
+            .unwrap_or_else(|| artifact_file_name(&pkg.download_url));
+        let built = build_sdist_wheel(source, &file_name, python_exe, &indexes.build_env());
+        let (wheel_name, wheel) = match built {
+            Err(err) if target.toolchain.compiler.is_empty() => {
+                return Err(kind_error(
+                    ErrorKind::RuntimeMissing,
+                    format!(
+                        "failed to build {} {}, and no C compiler was found{}: {err:#}",
+                        pkg.name,
+                        pkg.version,
+                        if cfg!(windows) {
+                            "; install the Visual Studio Build Tools with the C++ workload"
+                        } else {
+                            "; install gcc or clang, or set CC"
+                        }
+                    ),
+                ));
+            }
+            built => built.with_context(|| format!("failed to build {} {}", pkg.name, pkg.version))?,
+        };
+        self.cas.store_built_wheel(&source_digest, &key, &wheel_name, &wheel)
+    }
+
+    fn install(
+        &self,
+        ctx: &AppContext,
+        cfg: &Config,
+        requirements: &[String],
+        project_dir: &Path,
+        install_site_packages: &Path,
+        python_exe: &Path,
+    ) -> Result<Vec<Package>> {
+        let total_span = span(
+            ctx,
+            "install.total",
+            json!({"python_version": cfg.python.version, "raw_requirements": requirements.len()}),
+        );
+        let reqs = normalize_requirements(requirements);
+        if reqs.is_empty() {
+            return Ok(Vec::new());
+        }
+        let _interrupts = catch_interrupts();
+        let (mut graph, indexes) = self.resolve(ctx, cfg, &reqs, project_dir, python_exe)?;
+        let build_target = match check_build_toolchain(cfg.toolchain.as_ref(), &graph.packages)? {
+            Some(toolchain) => Some(BuildTarget::detect(python_exe, toolchain)?),
+            None => None,
+        };
+
+        let mut download_plan = graph.packages.clone();
+        download_plan.sort_by(|a, b| a.name.cmp(&b.name));
+
+        // Always the selected runtime's site-packages, which is what `xe run` puts on the path.
+        if install_site_packages.as_os_str().is_empty() {
+            bail_kind!(ErrorKind::RuntimeMissing, "no site-packages directory selected for {}", python_exe.display());
+        }
+        let target_site_packages = install_site_packages.to_path_buf();
+        fs::create_dir_all(&target_site_packages)
+            .with_context(|| format!("failed to create {}", target_site_packages.display()))?;
+
+        let mut installed = installed_package_key_set(&target_site_packages)?;
+        if let Some(base) = &self.base_site_packages {
+            installed.extend(installed_package_key_set(base)?);
+        }
+        let installed_set = Arc::new(Mutex::new(installed));
+        // Downloads wait on the network rather than the CPU, so they get their own pool
+        // sized by http_concurrency instead of rayon's one thread per core.
+        let pool = rayon::ThreadPoolBuilder::new()
+            .num_threads(http_concurrency(ctx).min(download_plan.len().max(1)))
+            .build()
+            .context("failed to start download pool")?;
+        pool.install(|| {
+            download_plan.par_iter().try_for_each(|pkg| -> Result<()> {
+                check_interrupted()?;
+                ctx.timings.count("install.package");
+                let key = package_identity_key(&pkg.name, &pkg.version);
+                {
+                    let guard = installed_set.lock().map_err(|_| anyhow!("install state poisoned"))?;
+                    if guard.contains(&key) {
+                        ctx.timings.count("install.cache_hit");
+                        return Ok(());
+                    }
+                }
+                if pkg.download_url.trim().is_empty() {
+                    return Ok(());
+                }
+
+                ctx.timings.count("install.extracted");
+                if self.cas.cached_blob(pkg.hash_algorithm, &pkg.hash).is_some() {
+                    ctx.timings.count("install.cache_hit");
+                } else {
+                    ctx.timings.count("install.downloaded");
+                }
+                trace(&format!("Fetching {} {} from {}", pkg.name, pkg.version, pkg.download_url));
+                // Streamed wheels are staged, so nothing reaches site-packages before the
+                // blob is verified either way.
+                if pkg.download_url.ends_with(".whl") {
+                    let _span = total_span.child(ctx, "install.download", json!({"package": pkg.name, "streamed": true}));
+                    self.cas.store_and_extract(
+                        &pkg.download_url,
+                        pkg.hash_algorithm,
+                        pkg.hash.as_str(),
+                        indexes.auth_for(&pkg.download_url),
+                        &target_site_packages,
+                    )?;
+                } else {
+                    let blob = {
+                        let _span = total_span.child(ctx, "install.download", json!({"package": pkg.name}));
+                        self.cas.store_blob_from_url(
+                            &pkg.download_url,
+                            pkg.hash_algorithm,
+                            pkg.hash.as_str(),
+                            indexes.auth_for(&pkg.download_url),
+                        )?
+                    };
+                    let blob = match &build_target {
+                        Some(target) if is_sdist(pkg) => {
+                            let _span = total_span.child(ctx, "install.build", json!({"package": pkg.name}));
+                            self.built_wheel(ctx, pkg, &blob, target, python_exe, &indexes)?
+                        }
+                        _ => blob,
+                    };
+                    let _span = total_span.child(ctx, "install.extract", json!({"package": pkg.name}));
+                    install_wheel_blob(&blob, &target_site_packages)?;
+                }
+                {
+                    let mut guard = installed_set.lock().map_err(|_| anyhow!("install state poisoned"))?;
+                    guard.insert(key);
+                }
+                Ok(())
+            })
+        })?;
+
+        graph.packages.sort_by(|a, b| a.name.cmp(&b.name));
+        Ok(graph.packages)
+    }
+}
+
+// With require_hashes on, every resolved artifact must carry a digest so the download is
+// verified against the solution rather than trusted as served by the index.
+fn check_required_hashes(packages: &[Package]) -> Result<()> {
+    let mut missing = packages
+        .iter()
+        .filter(|p| !p.hash_algorithm.is_digest(&p.hash))
+        .map(|p| format!("{} {}", p.name, p.version))
+        .collect::<Vec<_>>();
+    if missing.is_empty() {
+        return Ok(());
+    }
+    missing.sort();
+    bail_kind!(
+        ErrorKind::Resolution,
+        "require_hashes is on but these artifacts have no digest in the resolution:\n  {}",
+        missing.join("\n  ")
+    );
+}
+
+// The native build toolchain. `xe lock` records it as [toolchain] when the lock contains
+// source distributions, since those are compiled on every machine that installs them.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+struct ToolchainConfig {
+    #[serde(default)]
+    platform: String,
+    // Compiler family and version, such as `gcc 13.2.0` or `msvc 14.38.33130`.
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    compiler: String,
+    // C runtime family and version, such as `glibc 2.39` or `ucrt 10.0.22621.0`.
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    libc: String,
+}
+
+fn detect_toolchain() -> ToolchainConfig {
+    let (compiler, libc) = if cfg!(windows) {
+        (detect_msvc(), detect_ucrt())
+    } else {
+        (detect_cc(), detect_libc())
+    };
+    ToolchainConfig {
+        platform: format!("{}-{}", env::consts::OS, env::consts::ARCH),
+        compiler: compiler.unwrap_or_default(),
+        libc: libc.unwrap_or_default(),
+    }
+}
+
+fn command_output(program: &str, args: &[&str]) -> Option<String> {
+    let output = Command::new(program).args(args).output().ok()?;
+    let mut text = String::from_utf8_lossy(&output.stdout).to_string();
+    text.push_str(&String::from_utf8_lossy(&output.stderr));
+    Some(text)
+}
+
+fn first_version(text: &str) -> Option<String> {
+    Regex::new(r"\d+\.\d+(\.\d+)*")
+        .ok()?
+        .find(text)
+        .map(|m| m.as_str().to_string())
+}
+
+// $CC when set, otherwise the first of cc, gcc and clang that runs.
+fn detect_cc() -> Option<String> {
+    let from_env = env::var("CC").ok().filter(|cc| !cc.trim().is_empty());
+    let candidates = from_env
+        .into_iter()
+        .chain(["cc", "gcc", "clang"].map(String::from))
+        .collect::<Vec<_>>();
+    for cc in candidates {
+        let Some(text) = command_output(&cc, &["--version"]) else {
+            continue;
+        };
+        let first = text.lines().next().unwrap_or_default();
+        let family = if first.contains("clang") {
+            "clang"
+        } else if first.contains("gcc") || text.contains("Free Software Foundation") {
+            "gcc"
+        } else {
+            continue;
+        };
+        if let Some(version) = first_version(first) {
+            return Some(format!("{family} {version}"));
+        }
+    }
+    None
+}
+
+fn detect_libc() -> Option<String> {
+    if cfg!(target_os = "macos") {
+        let version = command_output("sw_vers", &["-productVersion"])?;
+        return first_version(&version).map(|v| format!("macos {v}"));
+    }
+    let text = command_output("ldd", &["--version"])?;
+    if text.contains("musl") {
+        let version = text.lines().find(|l| l.starts_with("Version")).and_then(first_version)?;
+        return Some(format!("musl {version}"));
+    }
+    let first = text.lines().next().unwrap_or_default();
+    if first.contains("GLIBC") || first.contains("GNU libc") {
+        return first.split_whitespace().last().and_then(first_version).map(|v| format!("glibc {v}"));
+    }
+    None
+}
+
+// MSVC build tools found by vswhere, versioned by the default VC tools release.
+fn detect_msvc() -> Option<String> {
+    let program_files = env::var("ProgramFiles(x86)").unwrap_or_else(|_| r"C:\Program Files (x86)".to_string());
+    let vswhere = Path::new(&program_files)
+        .join("Microsoft Visual Studio")
+        .join("Installer")
+        .join("vswhere.exe");
+    let text = command_output(
+        vswhere.to_str()?,
+        &[
+            "-latest",
+            "-products",
+            "*",
+            "-requires",
+            "Microsoft.VisualStudio.Component.VC.Tools.x86.x64",
+            "-property",
+            "installationPath",
+        ],
+    )?;
+    let install_path = PathBuf::from(text.lines().next()?.trim());
+    let tools_version = install_path
+        .join("VC")
+        .join("Auxiliary")
+        .join("Build")
+        .join("Microsoft.VCToolsVersion.default.txt");
+    let version = fs::read_to_string(tools_version).ok()?;
+    Some(format!("msvc {}", version.trim()))
+}
+
+// The newest Windows 10+ SDK that ships the Universal CRT headers.
+fn detect_ucrt() -> Option<String> {
+    let text = command_output(
+        "reg",
+        &["query", r"HKLM\SOFTWARE\Microsoft\Windows Kits\Installed Roots", "/v", "KitsRoot10"],
+    )?;
+    let root = text
+        .lines()
+        .find(|l| l.contains("KitsRoot10"))?
+        .split("REG_SZ")
+        .nth(1)?
+        .trim()
+        .to_string();
+    let version = fs::read_dir(Path::new(&root).join("Include"))
+        .ok()?
+        .flatten()
+        .filter(|entry| entry.path().join("ucrt").is_dir())
+        .map(|entry| entry.file_name().to_string_lossy().to_string())
+        .max_by_key(|v| numeric_version(v))?;
+    Some(format!("ucrt {version}"))
+}
+
+fn numeric_version(version: &str) -> Vec<u64> {
+    version.split('.').map(|p| p.parse().unwrap_or(0)).collect()
+}
+
+// Differences that can stop source distributions locked on `locked` from building here:
+// another platform, no compiler or another compiler family, or another or older C runtime.
+fn toolchain_problems(locked: &ToolchainConfig, current: &ToolchainConfig) -> Vec<String> {
+    let mut problems = Vec::new();
+    if !locked.platform.is_empty() && locked.platform != current.platform {
+        problems.push(format!("locked on {}, running on {}", locked.platform, current.platform));
+    }
+    let family = |s: &str| s.split_whitespace().next().unwrap_or_default().to_string();
+    let version = |s: &str| numeric_version(s.split_whitespace().nth(1).unwrap_or_default());
+    if current.compiler.is_empty() {
+        problems.push("no C compiler found".to_string());
+    } else if !locked.compiler.is_empty() && family(&locked.compiler) != family(&current.compiler) {
+        problems.push(format!("compiler is {}, locked with {}", current.compiler, locked.compiler));
+    }
+    if !locked.libc.is_empty() {
+        if family(&locked.libc) != family(&current.libc) {
+            problems.push(format!("C runtime is {}, locked with {}", or_dash(&current.libc), locked.libc));
+        } else if version(&current.libc) < version(&locked.libc) {
+            problems.push(format!("C runtime {} is older than locked {}", current.libc, locked.libc));
+        }
+    }
+    problems
+}
+
+fn is_sdist(pkg: &Package) -> bool {
+    !pkg.download_url.trim().is_empty()
+        && !artifact_file_name(&pkg.download_url).to_lowercase().ends_with(".whl")
+}
+
+// Source distributions are compiled locally, so refuse them without a compiler and warn
+// when this machine differs from the toolchain recorded in the lock. Returns the current
+// toolchain when there is something to build.
+fn check_build_toolchain(locked: Option<&ToolchainConfig>, packages: &[Package]) -> Result<Option<ToolchainConfig>> {
+    let sdists = packages.iter().filter(|p| is_sdist(p)).map(|p| p.name.as_str()).collect::<Vec<_>>();
+    if sdists.is_empty() {
+        return Ok(None);
+    }
+    let current = detect_toolchain();
+    debug(&format!("Build toolchain: {current:?}"));
+    // Pure-Python source distributions build without one, so a missing compiler is only
+    // reported if a build actually fails (see built_wheel).
+    if current.compiler.is_empty() {
+        warning(&format!(
+            "{} only publish source distributions for this platform and no C compiler was found; building anyway",
+            sdists.join(", ")
+        ));
+    }
+    if let Some(locked) = locked {
+        for problem in toolchain_problems(locked, &current) {
+            warning(&format!("Building {} from source: {problem}", sdists.join(", ")));
+        }
+    }
+    Ok(Some(current))
+}
+
+// Everything besides the source itself that a wheel built from a source distribution
+// depends on. Builds are cached per target, so a machine with the same interpreter,
+// platform and toolchain reuses a wheel instead of compiling again.
+struct BuildTarget {
+    // Interpreter and ABI, such as `cp312` or `cp313t`.
+    python_tag: String,
+    // sysconfig's platform in wheel-tag form, such as `linux_x86_64` or `win_amd64`.
+    platform_tag: String,
+    toolchain: ToolchainConfig,
+}
+
+impl BuildTarget {
+    fn detect(python_exe: &Path, toolchain: ToolchainConfig) -> Result<Self> {
+        let mut command = Command::new(python_exe);
+        command.args([
+            "-c",
+            "import sys, sysconfig; print(sys.implementation.name, '%d%d' % sys.version_info[:2], \
+             getattr(sys, 'abiflags', ''), sysconfig.get_platform(), sep='\\n')",
+        ]);
+        let output = run_python(&mut command, "python", python_timeout(), false)?;
+        if !output.status.success() {
+            bail_kind!(
+                ErrorKind::RuntimeMissing,
+                "failed to query {}: {}",
+                python_exe.display(),
+                String::from_utf8_lossy(&output.stderr).trim()
+            );
+        }
+        let text = String::from_utf8_lossy(&output.stdout);
+        let mut lines = text.lines().map(str::trim);
+        let (Some(implementation), Some(version), Some(abiflags), Some(platform)) =
+            (lines.next(), lines.next(), lines.next(), lines.next())
+        else {
+            bail!("unexpected output from {}: {text}", python_exe.display());
+        };
+        let implementation = match implementation {
+            "cpython" => "cp",
+            "pypy" => "pp",
+            other => other,
+        };
+        Ok(Self {
+            python_tag: format!("{implementation}{version}{abiflags}"),
+            platform_tag: platform.replace(['-', '.'], "_"),
+            toolchain,
+        })
+    }
+
+    fn key(&self) -> String {
+        let mut hasher = Sha256::new();
+        for part in [
+            self.python_tag.as_str(),
+            self.platform_tag.as_str(),
+            self.toolchain.platform.as_str(),
+            self.toolchain.compiler.as_str(),
+            self.toolchain.libc.as_str(),
+        ] {
+            hasher.update(part.as_bytes());
+            hasher.update(b"\n");
+        }
+        hex::encode(hasher.finalize())
+    }
+}
+
+// Builds a wheel from the source distribution stored at `source` with `pip wheel` and
+// returns its bytes. pip recognises the archive format by name, so the blob is copied
+// under its original `file_name` first.
+fn build_sdist_wheel(
+    source: &Path,
+    file_name: &str,
+    python_exe: &Path,
+    env: &[(&str, String)],
+) -> Result<(String, Vec<u8>)> {
+    let work = tempfile_path("xe-build", "d");
+    let out = work.join("dist");
+    fs::create_dir_all(&out).with_context(|| format!("failed to create {}", out.display()))?;
+    let result = (|| {
+        let sdist = work.join(file_name);
+        fs::copy(source, &sdist).with_context(|| format!("failed to copy {}", source.display()))?;
+        let mut command = Command::new(python_exe);
+        command
+            .args(["-m", "pip", "wheel", "--no-deps", "--wheel-dir"])
+            .arg(&out)
+            .arg(&sdist)
+            .env("PYTHONNOUSERSITE", "1");
+        for (key, value) in env {
+            command.env(key, value);
+        }
+        let output = run_python(&mut command, "pip wheel", python_timeout(), true)?;
+        if !output.status.success() {
+            bail!(
+                "building {file_name} failed: {}\n{}{}",
+                output.status,
+                String::from_utf8_lossy(&output.stdout),
+                String::from_utf8_lossy(&output.stderr)
+            );
+        }
+        let wheel = fs::read_dir(&out)
+            .with_context(|| format!("failed to read {}", out.display()))?
+            .flatten()
+            .map(|entry| entry.path())
+            .find(|path| path.extension().is_some_and(|ext| ext == "whl"))
+            .ok_or_else(|| anyhow!("building {file_name} produced no wheel"))?;
+        let data = fs::read(&wheel).with_context(|| format!("failed to read {}", wheel.display()))?;
+        Ok((wheel.file_name().unwrap_or_default().to_string_lossy().to_string(), data))
+    })();
+    let _ = fs::remove_dir_all(&work);
+    result
+}
+
+#[derive(Debug, Default, Deserialize)]
+struct PolicyFile {
+    #[serde(default)]
+    allow: Vec<String>,
+    #[serde(default)]
+    block: Vec<String>,
+}
+
+// Allow/block rules from the global policy.toml and the project's xe-policy.toml. A package
+// is permitted when no block pattern matches it and it matches every non-empty allow list,
+// so a project policy can narrow the global one but never widen it.
+struct PackagePolicy {
+    files: Vec<(PathBuf, PolicyFile)>,
+}
+
+const PROJECT_POLICY_FILE: &str = "xe-policy.toml";
+
+impl PackagePolicy {
+    fn load(project_dir: &Path) -> Result<Self> {
+        let mut files = Vec::new();
+        for path in [xe_home().join("policy.toml"), project_dir.join(PROJECT_POLICY_FILE)] {
+            if !path.is_file() {
+                continue;
+            }
+            let text = fs::read_to_string(&path).with_context(|| format!("failed to read {}", path.display()))?;
+            let file = toml::from_str::<PolicyFile>(&text)
+                .with_context(|| format!("failed to parse {}", path.display()))?;
+            files.push((path, file));
+        }
+        Ok(Self { files })
+    }
+
+    fn check(&self, names: impl Iterator<Item = String>) -> Result<()> {
+        if self.files.is_empty() {
+            return Ok(());
+        }
+        let mut violations = Vec::new();
+        for name in names {
+            for (path, file) in &self.files {
+                if let Some(pattern) = file.block.iter().find(|p| policy_pattern_matches(p, &name)) {
+                    violations.push(format!("{name} (blocked by \"{pattern}\" in {})", path.display()));
+                    break;
+                }
+                if !file.allow.is_empty() && !file.allow.iter().any(|p| policy_pattern_matches(p, &name)) {
+                    violations.push(format!("{name} (not in the allow list of {})", path.display()));
+                    break;
+                }
+            }
+        }
+        if !violations.is_empty() {
+            violations.sort();
+            violations.dedup();
+            bail_kind!(
+                ErrorKind::Resolution,
+                "package policy violation:\n  {}",
+                violations.join("\n  ")
+            );
+        }
+        Ok(())
+    }
+}
+
+// Glob match on normalized package names.
+fn policy_pattern_matches(pattern: &str, name: &str) -> bool {
+    glob_matches(&normalize_dep_name(pattern), name)
+}
+
+// Matches `name` against a pattern where `*` is any run of characters and `?` one character.
+fn glob_matches(pattern: &str, name: &str) -> bool {
+    fn matches(p: &[char], n: &[char]) -> bool {
+        match p.split_first() {
+            None => n.is_empty(),
+            Some(('*', rest)) => (0..=n.len()).any(|i| matches(rest, &n[i..])),
+            Some(('?', rest)) => !n.is_empty() && matches(rest, &n[1..]),
+            Some((c, rest)) => n.first() == Some(c) && matches(rest, &n[1..]),
+        }
+    }
+    let pattern = pattern.chars().collect::<Vec<_>>();
+    let name = name.chars().collect::<Vec<_>>();
+    matches(&pattern, &name)
+}
+
+// Widely used PyPI projects, used to flag likely typosquats.
+fn popular_packages() -> &'static [&'static str] {
+    static PACKAGES: OnceLock<Vec<&'static str>> = OnceLock::new();
+    PACKAGES.get_or_init(|| {
+        include_str!("popular_packages.txt")
+            .lines()
+            .map(str::trim)
+            .filter(|line| !line.is_empty() && !line.starts_with('#'))
+            .collect()
+    })
+}
+
+// The package `name` is a near miss of, if any: one of the popular packages, or one the
+// project already uses (`known`), which covers private names the list cannot. A name that
+// is itself known is never flagged. Swapped letters count from four characters, but other
+// single edits only between names of five or more, since short names such as `attr` and
+// `attrs` are often both real.
+fn typosquat_target(name: &str, known: &[String]) -> Option<String> {
+    let popular = popular_packages();
+    if name.len() < 4 || popular.contains(&name) || known.iter().any(|k| k == name) {
+        return None;
+    }
+    popular
+        .iter()
+        .map(|popular| popular.to_string())
+        .chain(known.iter().cloned())
+        .find(|similar| {
+            is_transposition(name, similar)
+                || (name.len().min(similar.len()) >= 5 && edit_distance(name, similar) == 1)
+        })
+}
+
+// Normalized names of the packages declared in xe.toml or pinned in xe.lock.
+fn project_package_names(dir: &Path, cfg: &Config) -> Vec<String> {
+    let mut names = cfg
+        .deps
+        .keys()
+        .chain(cfg.groups.values().flat_map(|group| group.deps.keys()))
+        .map(|name| normalize_dep_name(name))
+        .collect::<Vec<_>>();
+    if let Some(lock) = load_lockfile(dir) {
+        names.extend(lock.packages.iter().map(|pkg| normalize_dep_name(&pkg.name)));
+    }
+    names.sort();
+    names.dedup();
+    names
+}
+
+fn is_transposition(a: &str, b: &str) -> bool {
+    let (a, b) = (a.as_bytes(), b.as_bytes());
+    if a.len() != b.len() {
+        return false;
+    }
+    let diff = (0..a.len()).filter(|&i| a[i] != b[i]).collect::<Vec<_>>();
+    diff.len() == 2 && diff[1] == diff[0] + 1 && a[diff[0]] == b[diff[1]] && a[diff[1]] == b[diff[0]]
+}
+
+fn normalize_requirements(reqs: &[String]) -> Vec<String> {
+    let mut out = reqs
+        .iter()
+        .map(|r| r.trim().to_string())
+        .filter(|r| !r.is_empty())
+        .collect::<Vec<_>>();
+    out.sort();
+    out
+}
+
+// Key of the cached resolution of `reqs` for the project's Python and indexes.
+fn solution_key(cfg: &Config, reqs: &[String], indexes: &IndexPlan) -> String {
+    let mut key = solve_key(&cfg.python.version, reqs);
+    if !indexes.is_empty() {
+        key = solve_key(&key, &[indexes.fingerprint()]);
+    }
+    // Solutions carry the digests, so each algorithm has its own.
+    if !cfg.settings.hash_algorithm.is_default() {
+        key = solve_key(&key, &[cfg.settings.hash_algorithm.name().to_string()]);
+    }
+    key
+}
+
+// Identifies a requirement set by package names alone, so a changed pin or index still
+// finds the previous solution to prefetch from.
+fn history_key(cfg: &Config, reqs: &[String]) -> String {
+    let mut names = reqs.iter().filter_map(|r| requirement_to_dep_name(r)).collect::<Vec<_>>();
+    names.sort();
+    names.dedup();
+    solve_key(&format!("history|{}", cfg.python.version), &names)
+}
+
+fn solve_key(python_version: &str, reqs: &[String]) -> String {
+    let mut hasher = Sha1::new();
+    hasher.update(python_version.as_bytes());
+    hasher.update(b"|");
+    for req in reqs {
+        hasher.update(req.as_bytes());
+        hasher.update(b"|");
+    }
+    hex::encode(hasher.finalize())
+}
+
+// Merges the copies of a package that separate resolutions produced; it is needed
+// wherever any of them is.
+fn dedupe_packages(pkgs: Vec<Package>) -> Vec<Package> {
+    let mut seen: BTreeMap<String, Package> = BTreeMap::new();
+    for mut pkg in pkgs {
+        let key = format!("{}=={}", pkg.name.to_lowercase(), pkg.version);
+        if let Some(previous) = seen.get(&key) {
+            pkg.markers = match (previous.markers.as_str(), pkg.markers.as_str()) {
+                ("", _) | (_, "") => String::new(),
+                (a, b) if a == b => pkg.markers.clone(),
+                (a, b) => format!("({a}) or ({b})"),
+            };
+            pkg.dependencies.extend(previous.dependencies.iter().cloned());
+            pkg.dependencies.sort();
+            pkg.dependencies.dedup();
+        }
+        seen.insert(key, pkg);
+    }
+    seen.into_values().collect()
+}
+
+// Orders packages so each comes after the resolved packages it depends on, by name where
+// the graph leaves a choice. A dependency cycle is broken at the first name in it.
+fn sort_install_order(packages: &mut Vec<Package>) {
+    packages.sort_by(|a, b| a.name.cmp(&b.name));
+    let mut pending = std::mem::take(packages);
+    while !pending.is_empty() {
+        let waiting = pending.iter().map(|p| normalize_dep_name(&p.name)).collect::<HashSet<_>>();
+        let next = pending
+            .iter()
+            .position(|pkg| {
+                let own = normalize_dep_name(&pkg.name);
+                pkg.dependencies.iter().all(|dep| *dep == own || !waiting.contains(dep))
+            })
+            .unwrap_or(0);
+        packages.push(pending.remove(next));
+    }
+}
+
+fn normalize_package_identity(name: &str) -> String {
+    name.trim()
+        .to_lowercase()
+        .replace('-', "_")
+        .replace('.', "_")
+}
+
+fn package_identity_key(name: &str, version: &str) -> String {
+    format!("{}=={}", normalize_package_identity(name), version.trim())
+}
+
+fn installed_package_key_set(site_packages: &Path) -> Result<HashSet<String>> {
+    let mut out = HashSet::new();
+    if !site_packages.exists() {
+        return Ok(out);
+    }
+    for entry in fs::read_dir(site_packages)
+        .with_context(|| format!("failed to read {}", site_packages.display()))?
+    {
+        let entry = entry?;
+        if !entry.file_type()?.is_dir() {
+            continue;
+        }
+        let name = entry.file_name().to_string_lossy().to_string();
+        if !name.to_lowercase().ends_with(".dist-info") {
+            continue;
+        }
+        let base = name.trim_end_matches(".dist-info");
+        if let Some(idx) = base.rfind('-') {
+            if idx > 0 && idx + 1 < base.len() {
+                let key = package_identity_key(&base[..idx], &base[idx + 1..]);
+                out.insert(key);
+            }
+        }
+    }
+    Ok(out)
+}
+
+// Installs a wheel from the CAS. Entries are inflated in parallel into a staging
+// directory, each worker reading the archive through its own file handle, then checked
+// against RECORD and moved into site-packages by commit_staged. A failure leaves
+// site-packages as it was.
+fn install_wheel_blob(blob_path: &Path, site_packages: &Path) -> Result<()> {
+    let staging = staging_dir(site_packages);
+    let installed = stage_wheel_blob(blob_path, &staging)
+        .and_then(|files| commit_staged(&staging, site_packages, &files, blob_path));
+    let _ = fs::remove_dir_all(&staging);
+    installed
+}
+
+fn open_wheel(blob_path: &Path) -> Result<ZipArchive<File>> {
+    let file = File::open(blob_path).with_context(|| format!("failed to open {}", blob_path.display()))?;
+    ZipArchive::new(file).with_context(|| format!("failed to parse {}", blob_path.display()))
+}
+
+fn stage_wheel_blob(blob_path: &Path, staging: &Path) -> Result<Vec<StagedFile>> {
+    let staging = &long_path(staging);
+    let mut archive = open_wheel(blob_path)?;
+    let mut entries = Vec::with_capacity(archive.len());
+    let mut dirs = BTreeSet::new();
+    dirs.insert(staging.clone());
+    for index in 0..archive.len() {
+        let entry = archive.by_index(index).with_context(|| format!("failed to read entry {}", index))?;
+        let enclosed = entry
+            .enclosed_name()
+            .ok_or_else(|| anyhow!("unsafe wheel entry path: {}", entry.name()))?
+            .to_path_buf();
+        if skip_reserved_entry(&enclosed, blob_path) {
+            continue;
+        }
+        let out_path = entry_path(staging, &enclosed);
+        if entry.name().ends_with('/') {
+            dirs.insert(out_path);
+            continue;
+        }
+        if let Some(parent) = out_path.parent() {
+            dirs.insert(parent.to_path_buf());
+        }
+        entries.push((index, entry.name().to_string(), enclosed));
+    }
+    for dir in &dirs {
+        fs::create_dir_all(dir).with_context(|| format!("failed to create {}", dir.display()))?;
+    }
+    entries
+        .par_iter()
+        .map_init(
+            || open_wheel(blob_path),
+            |archive, (index, name, enclosed)| {
+                let archive = archive.as_mut().map_err(|err| anyhow!("{err:#}"))?;
+                let mut entry = archive
+                    .by_index(*index)
+                    .with_context(|| format!("failed to read entry {}", index))?;
+                let sha256 = write_staged_entry(&mut entry, &entry_path(staging, enclosed))
+                    .with_context(|| format!("failed to extract {name} from {}", blob_path.display()))?;
+                Ok(StagedFile {
+                    name: name.clone(),
+                    path: enclosed.clone(),
+                    sha256,
+                })
+            },
+        )
+        .collect()
+}
+
+// RECORD path -> urlsafe base64 sha256, for the entries that carry one.
+fn record_hashes(record: &str) -> HashMap<String, String> {
+    record
+        .lines()
+        .filter_map(|line| {
+            let mut fields = line.rsplitn(3, ',');
+            let (_size, hash, file) = (fields.next()?, fields.next()?, fields.next()?);
+            let digest = hash.strip_prefix("sha256=")?;
+            Some((file.trim_matches('"').to_string(), digest.to_string()))
+        })
+        .collect()
+}
+
+// Windows limits ordinary paths to MAX_PATH (260 characters), which deeply nested wheels
+// exceed; the extended-length `\\?\` form lifts the limit. Elsewhere paths are kept.
+#[cfg(windows)]
+fn long_path(path: &Path) -> PathBuf {
+    let absolute = std::path::absolute(path).unwrap_or_else(|_| path.to_path_buf());
+    let text = absolute.to_string_lossy().replace('/', "\\");
+    if text.starts_with(r"\\?\") || !absolute.is_absolute() {
+        return absolute;
+    }
+    match text.strip_prefix(r"\\") {
+        Some(unc) => PathBuf::from(format!(r"\\?\UNC\{unc}")),
+        None => PathBuf::from(format!(r"\\?\{text}")),
+    }
+}
+
+#[cfg(not(windows))]
+fn long_path(path: &Path) -> PathBuf {
+    path.to_path_buf()
+}
+
+// Joins an archive path component by component, since extended-length paths do not
+// treat `/` as a separator.
+fn entry_path(root: &Path, relative: &Path) -> PathBuf {
+    let mut path = root.to_path_buf();
+    path.extend(relative.components());
+    path
+}
+
+// CON, PRN, AUX, NUL, COM1-9 and LPT1-9 name devices on Windows whatever the extension,
+// so `aux.py` cannot be written as a file there.
+fn windows_reserved_name(path: &Path) -> Option<String> {
+    path.components().find_map(|component| {
+        let name = component.as_os_str().to_string_lossy();
+        let stem = name.split('.').next().unwrap_or_default().trim_end_matches(' ').to_uppercase();
+        let reserved = matches!(stem.as_str(), "CON" | "PRN" | "AUX" | "NUL")
+            || ((stem.starts_with("COM") || stem.starts_with("LPT"))
+                && stem.len() == 4
+                && matches!(stem.as_bytes()[3], b'1'..=b'9'));
+        reserved.then(|| name.to_string())
+    })
+}
+
+// On Windows, wheel entries with a reserved device name are left out with a warning
+// instead of failing the install; Python could not import them there anyway.
+fn skip_reserved_entry(entry: &Path, wheel: &Path) -> bool {
+    if !cfg!(windows) {
+        return false;
+    }
+    let Some(name) = windows_reserved_name(entry) else {
+        return false;
+    };
+    warning(&format!(
+        "Skipping {} from {}: {name} is a reserved device name on Windows",
+        entry.display(),
+        wheel.display()
+    ));
+    true
+}
+
+// A download in progress: every byte read from `source` is also written to the temporary
+// blob file and hashed, so the same stream can feed extraction.
+struct BlobDownload {
+    source: Box<dyn Read>,
+    file: File,
+    path: PathBuf,
+    file_name: String,
+    algorithm: HashAlgorithm,
+    hasher: Hasher,
+}
+
+impl Read for BlobDownload {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        let read = self.source.read(buf)?;
+        self.hasher.update(&buf[..read]);
+        self.file.write_all(&buf[..read])?;
+        Ok(read)
+    }
+}
+
+// Extracts wheel entries in archive order from their local headers into `staging`, and
+// returns the files written. Nothing reaches site-packages until commit_staged moves
+// them there.
+fn extract_wheel_stream(reader: &mut impl Read, staging: &Path) -> Result<Vec<StagedFile>> {
+    fs::create_dir_all(staging).with_context(|| format!("failed to create {}", staging.display()))?;
+    let staging = &long_path(staging);
+    let mut written = Vec::new();
+    while let Some(mut entry) = zip::read::read_zipfile_from_stream(reader).context("failed to read wheel entry")? {
+        let enclosed = entry
+            .enclosed_name()
+            .ok_or_else(|| anyhow!("unsafe wheel entry path: {}", entry.name()))?
+            .to_path_buf();
+        if skip_reserved_entry(&enclosed, Path::new("the downloaded wheel")) {
+            continue;
+        }
+        let out_path = entry_path(staging, &enclosed);
+        if entry.name().ends_with('/') {
+            fs::create_dir_all(&out_path).with_context(|| format!("failed to create {}", out_path.display()))?;
+            continue;
+        }
+        if let Some(parent) = out_path.parent() {
+            fs::create_dir_all(parent)
+                .with_context(|| format!("failed to create {}", parent.display()))?;
+        }
+        let sha256 = write_staged_entry(&mut entry, &out_path)?;
+        written.push(StagedFile {
+            name: entry.name().to_string(),
+            path: enclosed,
+            sha256,
+        });
+    }
+    Ok(written)
+}
+
+// A wheel entry unpacked into a staging directory: its archive name, its path relative
+// to site-packages and the urlsafe base64 sha256 RECORD uses.
+struct StagedFile {
+    name: String,
+    path: PathBuf,
+    sha256: String,
+}
+
+// Writes an entry to `path`, hashing it on the way; returns the digest in RECORD form.
+fn write_staged_entry(entry: &mut impl Read, path: &Path) -> Result<String> {
+    let mut file = File::create(path).with_context(|| format!("failed to create {}", path.display()))?;
+    let mut hasher = Sha256::new();
+    let mut buf = vec![0u8; 64 * 1024];
+    loop {
+        let read = entry.read(&mut buf)?;
+        if read == 0 {
+            break;
+        }
+        hasher.update(&buf[..read]);
+        file.write_all(&buf[..read])
+            .with_context(|| format!("failed to write {}", path.display()))?;
+    }
+    Ok(urlsafe_b64_nopad(&hasher.finalize()))
+}
+
+fn same_contents(a: &Path, b: &Path) -> bool {
+    let (Ok(meta_a), Ok(meta_b)) = (fs::metadata(a), fs::metadata(b)) else {
+        return false;
+    };
+    if meta_a.len() != meta_b.len() {
+        return false;
+    }
+    let (Ok(file_a), Ok(file_b)) = (File::open(a), File::open(b)) else {
+        return false;
+    };
+    let (mut reader_a, mut reader_b) = (BufReader::new(file_a), BufReader::new(file_b));
+    loop {
+        let chunk_a = match reader_a.fill_buf() {
+            Ok(chunk) => chunk.to_vec(),
+            Err(_) => return false,
+        };
+        if chunk_a.is_empty() {
+            return true;
+        }
+        let mut chunk_b = vec![0u8; chunk_a.len()];
+        if reader_b.read_exact(&mut chunk_b).is_err() || chunk_a != chunk_b {
+            return false;
+        }
+        reader_a.consume(chunk_a.len());
+    }
+}
+
+// A directory next to site-packages, on the same filesystem, where a wheel is unpacked
+// before it is moved into place. Being outside site-packages, its .pth files are not live.
+fn staging_dir(site_packages: &Path) -> PathBuf {
+    let parent = site_packages.parent().unwrap_or(site_packages);
+    tempfile_path_in(parent, ".xe-staging", "d")
+}
+
+// Checks the staged `files` of `wheel` against the sha256 hashes in its RECORD, then
+// moves them into site-packages, replacing what an older version of the distribution
+// left there. Files already present with identical contents are left alone, and an
+// INSTALLER marker is added when the wheel carries none.
+fn commit_staged(staging: &Path, site_packages: &Path, files: &[StagedFile], wheel: &Path) -> Result<()> {
+    let staging = long_path(staging);
+    let site_packages = long_path(site_packages);
+    let record = files
+        .iter()
+        .find(|f| f.name.split('/').count() == 2 && f.name.ends_with(".dist-info/RECORD"));
+    if let Some(record) = record {
+        let path = entry_path(&staging, &record.path);
+        let text = fs::read_to_string(&path).with_context(|| format!("failed to read RECORD of {}", wheel.display()))?;
+        let hashes = record_hashes(&text);
+        for file in files {
+            if hashes.get(&file.name).is_some_and(|expected| *expected != file.sha256) {
+                bail_kind!(
+                    ErrorKind::HashMismatch,
+                    "{} in {} does not match the hash in its RECORD",
+                    file.name,
+                    wheel.display()
+                );
+            }
+        }
+    }
+    for file in files {
+        let from = entry_path(&staging, &file.path);
+        let to = entry_path(&site_packages, &file.path);
+        if same_contents(&from, &to) {
+            continue;
+        }
+        if let Some(parent) = to.parent() {
+            fs::create_dir_all(parent).with_context(|| format!("failed to create {}", parent.display()))?;
+        }
+        if fs::rename(&from, &to).is_err() {
+            fs::copy(&from, &to).with_context(|| format!("failed to write {}", to.display()))?;
+        }
+    }
+
+    // Mark the distribution as installed by xe unless the wheel already says otherwise.
+    if let Some(record) = record {
+        let installer = entry_path(&site_packages, &record.path.with_file_name("INSTALLER"));
+        if !installer.exists() {
+            fs::write(&installer, "xe\n").with_context(|| format!("failed to write {}", installer.display()))?;
+        }
+    }
+    Ok(())
+}
+
+#[derive(Debug, Deserialize)]
+struct PipReport {
+    #[serde(default)]
+    install: Vec<PipInstallItem>,
+}
+
+#[derive(Debug, Deserialize)]
+struct PipInstallItem {
+    metadata: PipMetadata,
+    #[serde(default)]
+    download_info: PipDownloadInfo,
+}
+
+#[derive(Debug, Deserialize)]
+struct PipMetadata {
+    name: String,
+    version: String,
+    #[serde(default)]
+    requires_dist: Vec<String>,
+}
+
+#[derive(Debug, Deserialize, Default)]
+struct PipDownloadInfo {
+    #[serde(default)]
+    url: String,
+    #[serde(default)]
+    archive_info: PipArchiveInfo,
+}
+
+#[derive(Debug, Deserialize, Default)]
+struct PipArchiveInfo {
+    #[serde(default)]
+    hashes: HashMap<String, String>,
+}
+
+// Resolves `reqs` the way `[settings] resolution` asks, or always together when `joint`.
+fn solve_requirements(
+    cfg: &Config,
+    reqs: &[String],
+    python_exe: &Path,
+    indexes: &IndexPlan,
+    joint: bool,
+) -> Result<Vec<Package>> {
+    if joint {
+        return resolve_requirements(reqs, python_exe, indexes).map_err(|err| match error_kind(&err) {
+            Some(ErrorKind::Network | ErrorKind::PackageNotFound) => err,
+            _ => err.context("the requirements conflict with each other or with the project's dependencies"),
+        });
+    }
+    match cfg.settings.resolution.as_str() {
+        "" | "batch" if reqs.len() > 1 => match resolve_requirements(reqs, python_exe, indexes) {
+            Ok(solved) => Ok(solved),
+            Err(err) if matches!(error_kind(&err), Some(ErrorKind::Network | ErrorKind::PackageNotFound)) => Err(err),
+            Err(err) => {
+                debug(&format!("{err:#}"));
+                warning("Resolving the requirements together failed (-v shows why); resolving them one at a time");
+                resolve_split(reqs, python_exe, indexes)
+            }
+        },
+        "" | "batch" | "split" => resolve_split(reqs, python_exe, indexes),
+        other => bail_kind!(
+            ErrorKind::Config,
+            "unknown settings.resolution \"{other}\" in xe.toml; use \"batch\" or \"split\""
+        ),
+    }
+}
+
+// One pip run per requirement, in parallel: the `split` resolution mode, and the fallback
+// when resolving everything together fails. Shared dependencies are resolved once per
+// requirement, so two requirements can settle on different versions of them.
+fn resolve_split(requirements: &[String], python_exe: &Path, indexes: &IndexPlan) -> Result<Vec<Package>> {
+    Ok(requirements
+        .par_iter()
+        .map(|req| {
+            check_interrupted()?;
+            resolve_requirements(std::slice::from_ref(req), python_exe, indexes)
+        })
+        .collect::<Result<Vec<Vec<Package>>>>()?
+        .into_iter()
+        .flatten()
+        .collect())
+}
+
+// Resolves `requirements` together, in one pip run, against the unrestricted indexes one
+// at a time in query order, moving on when an index is unreachable or does not have a
+// package. Restricted indexes are always added as extra indexes; check_origins keeps
+// them to their packages.
+fn resolve_requirements(requirements: &[String], python_exe: &Path, indexes: &IndexPlan) -> Result<Vec<Package>> {
+    if indexes.is_empty() {
+        return pip_report(requirements, python_exe, &indexes.cache_env());
+    }
+    // A package claimed by a restricted index is looked up there alone and then pinned,
+    // so a higher version of the same name elsewhere cannot win.
+    let mut pins = String::new();
+    for requirement in requirements {
+        let Some(owner) = requirement_to_dep_name(requirement).and_then(|name| indexes.owner(&name)) else {
+            continue;
+        };
+        let mut probe_env = indexes.cache_env();
+        probe_env.extend([
+            ("PIP_INDEX_URL", index_url_with_auth(owner)),
+            ("PIP_EXTRA_INDEX_URL", String::new()),
+            ("PIP_NO_DEPS", "1".to_string()),
+        ]);
+        let found = pip_report(std::slice::from_ref(requirement), python_exe, &probe_env)
+            .with_context(|| format!("{requirement} may only come from index {}", owner.name))?;
+        if let Some(pkg) = found.first() {
+            pins.push_str(&format!("{}=={}\n", pkg.name, pkg.version));
+        }
+    }
+    let mut constraint = None;
+    if !pins.is_empty() {
+        let path = tempfile_path("xe-constraint", "txt");
+        fs::write(&path, pins).with_context(|| format!("failed to write {}", path.display()))?;
+        constraint = Some(path);
+    }
+    let result = resolve_with_fallback(requirements, python_exe, indexes, constraint.as_deref());
+    if let Some(path) = constraint {
+        let _ = fs::remove_file(path);
+    }
+    result
+}
+
+fn resolve_with_fallback(
+    requirements: &[String],
+    python_exe: &Path,
+    indexes: &IndexPlan,
+    constraint: Option<&Path>,
+) -> Result<Vec<Package>> {
+    let mut last_err = None;
+    let mut primaries = indexes.indexes.iter().filter(|i| i.packages.is_empty()).peekable();
+    while let Some(primary) = primaries.peek().copied() {
+        if indexes.is_down(&primary.name) {
+            primaries.next();
+            continue;
+        }
+        let mut env = indexes.pip_env(primary);
+        if let Some(path) = constraint {
+            env.push(("PIP_CONSTRAINT", path.display().to_string()));
+        }
+        let err = match pip_report(requirements, python_exe, &env) {
+            Ok(packages) => return Ok(packages),
+            Err(err) => err,
+        };
+        let text = format!("{err:#}");
+        if is_index_outage(&text) {
+            let down = indexes.mark_unreachable(primary);
+            if down.is_empty() {
+                return Err(err);
+            }
+            warning(&format!("Unreachable index {}; trying the next one", down.join(", ")));
+            last_err = Some(err);
+            continue;
+        }
+        if !text.contains("No matching distribution") {
+            return Err(err);
+        }
+        debug(&format!("{} not found on index {}", requirements.join(" "), primary.name));
+        last_err = Some(err);
+        primaries.next();
+    }
+    Err(last_err.unwrap_or_else(|| {
+        kind_error(
+            ErrorKind::Network,
+            format!(
+                "dependency resolution failed for {}: every index is unreachable",
+                requirements.join(" ")
+            ),
+        )
+    }))
+}
+
+struct IndexAuth {
+    username: String,
+    password: String,
+}
+
+struct PlannedIndex {
+    name: String,
+    url: String,
+    auth: Option<IndexAuth>,
+    packages: Vec<String>,
+}
+
+// The configured indexes for one install, in query order with credentials resolved:
+// the default index, then by priority, with PyPI last unless an index is the default.
+// Empty when no index is configured, in which case pip's own settings apply.
+struct IndexPlan {
+    indexes: Vec<PlannedIndex>,
+    down: Mutex<HashSet<String>>,
+    http_cache: Option<PathBuf>,
+}
+
+impl IndexPlan {
+    fn load(ctx: &AppContext, cfg: &Config) -> Result<IndexPlan> {
+        let global = load_global_config(&ctx.config_file)?;
+        let configured = configured_indexes(&global, Some(cfg));
+        let mut indexes = Vec::with_capacity(configured.len() + 1);
+        for scoped in &configured {
+            let index = &scoped.index;
+            if let Some(problem) = index_problem(index) {
+                bail_kind!(ErrorKind::Config, "{problem}");
+            }
+            indexes.push(PlannedIndex {
+                name: index.name.clone(),
+                url: index.url.trim_end_matches('/').to_string(),
+                auth: index_auth(&global, index)?,
+                packages: index.packages.iter().map(|p| normalize_dep_name(p)).collect(),
+            });
+        }
+        if !indexes.is_empty() && !configured.iter().any(|i| i.index.default) {
+            indexes.push(PlannedIndex {
+                name: "pypi".to_string(),
+                url: PYPI_SIMPLE_URL.to_string(),
+                auth: None,
+                packages: Vec::new(),
+            });
+        }
+        // pip keeps index pages and wheel metadata in an HTTP cache that honours ETag and
+        // Last-Modified; it lives under the project's CAS unless the user chose their own.
+        let http_cache = (!pip_cache_configured()).then(|| Path::new(&cfg.cache.global_dir).join("cas").join("http"));
+        Ok(IndexPlan {
+            indexes,
+            down: Mutex::new(HashSet::new()),
+            http_cache,
+        })
+    }
+
+    fn cache_env(&self) -> Vec<(&'static str, String)> {
+        self.http_cache
+            .iter()
+            .map(|dir| ("PIP_CACHE_DIR", dir.display().to_string()))
+            .collect()
+    }
+
+    // pip settings for building a source distribution, whose build requirements come from
+    // the first reachable unrestricted index.
+    fn build_env(&self) -> Vec<(&'static str, String)> {
+        match self.indexes.iter().find(|i| i.packages.is_empty() && !self.is_down(&i.name)) {
+            Some(primary) => self.pip_env(primary),
+            None => self.cache_env(),
+        }
+    }
+
+    fn is_empty(&self) -> bool {
+        self.indexes.is_empty()
+    }
+
+    // pip options naming the configured indexes without their credentials, for files
+    // that leave this machine such as a generated Dockerfile. Empty when none are set.
+    fn pip_index_args(&self) -> Vec<String> {
+        let Some(primary) = self.indexes.iter().find(|i| i.packages.is_empty()).or(self.indexes.first()) else {
+            return Vec::new();
+        };
+        let mut args = vec![format!("--index-url {}", url_without_userinfo(&primary.url))];
+        args.extend(
+            self.indexes
+                .iter()
+                .filter(|i| i.name != primary.name)
+                .map(|i| format!("--extra-index-url {}", url_without_userinfo(&i.url))),
+        );
+        args
+    }
+
+    // Whether `name` is installed from PyPI under this plan, so PyPI's JSON API speaks for
+    // it. Without configured indexes, pip's own PIP_INDEX_URL and PIP_NO_INDEX decide.
+    fn serves_from_pypi(&self, name: &str) -> bool {
+        let is_pypi = |url: &str| url.trim_end_matches('/') == PYPI_SIMPLE_URL;
+        if self.indexes.is_empty() {
+            return env::var_os("PIP_NO_INDEX").is_none()
+                && env::var("PIP_INDEX_URL").map_or(true, |url| is_pypi(&url));
+        }
+        let name = normalize_dep_name(name);
+        if self.indexes.iter().any(|i| i.packages.contains(&name)) {
+            return false;
+        }
+        self.indexes.iter().find(|i| i.packages.is_empty()).is_some_and(|i| is_pypi(&i.url))
+    }
+
+    // Names of the indexes that need credentials.
+    fn authenticated(&self) -> Vec<String> {
+        self.indexes.iter().filter(|i| i.auth.is_some()).map(|i| i.name.clone()).collect()
+    }
+
+    // Digest of everything else that steers a resolution: index credentials and the pip
+    // settings taken from the environment. Only the digest leaves the process.
+    fn settings_fingerprint(&self) -> String {
+        let mut hasher = Sha256::new();
+        for index in &self.indexes {
+            hasher.update(index.name.as_bytes());
+            if let Some(auth) = &index.auth {
+                hasher.update(format!("={}:{}", auth.username, auth.password).as_bytes());
+            }
+            hasher.update(b"\n");
+        }
+        let mut pip_env = env::vars().filter(|(key, _)| key.starts_with("PIP_")).collect::<Vec<_>>();
+        pip_env.sort();
+        for (key, value) in pip_env {
+            hasher.update(format!("{key}={value}\n").as_bytes());
+        }
+        hex::encode(hasher.finalize())
+    }
+
+    // Identifies the index setup in the resolution cache key; credentials are left out.
+    fn fingerprint(&self) -> String {
+        self.indexes
+            .iter()
+            .map(|i| format!("{}={}[{}]", i.name, i.url, i.packages.join(",")))
+            .collect::<Vec<_>>()
+            .join(" ")
+    }
+
+    fn is_down(&self, name: &str) -> bool {
+        self.down.lock().map(|down| down.contains(name)).unwrap_or(false)
+    }
+
+    // After an outage while `primary` was in use, probes it and the restricted indexes
+    // and returns the ones that are unreachable.
+    fn mark_unreachable(&self, primary: &PlannedIndex) -> Vec<String> {
+        let mut newly_down = Vec::new();
+        let suspects = std::iter::once(primary).chain(self.indexes.iter().filter(|i| !i.packages.is_empty()));
+        for index in suspects {
+            if self.is_down(&index.name) || index_reachable(index) {
+                continue;
+            }
+            if let Ok(mut down) = self.down.lock() {
+                down.insert(index.name.clone());
+            }
+            newly_down.push(index.name.clone());
+        }
+        newly_down
+    }
+
+    // pip settings for one attempt. Passed through the environment so credentials stay
+    // off the command line.
+    fn pip_env(&self, primary: &PlannedIndex) -> Vec<(&'static str, String)> {
+        let extras = self
+            .indexes
+            .iter()
+            .filter(|i| !i.packages.is_empty() && !self.is_down(&i.name))
+            .map(index_url_with_auth)
+            .collect::<Vec<_>>();
+        let mut env = self.cache_env();
+        env.push(("PIP_INDEX_URL", index_url_with_auth(primary)));
+        env.push(("PIP_EXTRA_INDEX_URL", extras.join(" ")));
+        if self.indexes.iter().filter(|i| i.packages.is_empty()).count() > 1 {
+            // Another index can take over, so fail fast instead of pip's 5 retries.
+            env.push(("PIP_RETRIES", "1".to_string()));
+        }
+        env
+    }
+
+    fn owner(&self, package: &str) -> Option<&PlannedIndex> {
+        let name = normalize_dep_name(package);
+        self.indexes
+            .iter()
+            .find(|i| i.packages.iter().any(|pattern| glob_matches(pattern, &name)))
+    }
+
+    // Guards against dependency confusion: a package claimed by a restricted index must be
+    // served from that index's host, and a restricted index's host may serve only its own
+    // packages unless an unrestricted index shares it.
+    fn check_origins(&self, packages: &[Package]) -> Result<()> {
+        if self.indexes.iter().all(|i| i.packages.is_empty()) {
+            return Ok(());
+        }
+        let open_origins = self
+            .indexes
+            .iter()
+            .filter(|i| i.packages.is_empty())
+            .map(|i| url_origin(&i.url))
+            .collect::<HashSet<_>>();
+        let mut problems = Vec::new();
+        for pkg in packages.iter().filter(|p| !p.download_url.is_empty()) {
+            let origin = url_origin(&pkg.download_url);
+            match self.owner(&pkg.name) {
+                Some(owner) if origin != url_origin(&owner.url) => problems.push(format!(
+                    "{} {} came from {origin}, but {} may only be installed from index {}",
+                    pkg.name, pkg.version, pkg.name, owner.name
+                )),
+                None => {
+                    let served_by = self
+                        .indexes
+                        .iter()
+                        .find(|i| !i.packages.is_empty() && url_origin(&i.url) == origin);
+                    if let Some(index) = served_by.filter(|_| !open_origins.contains(&origin)) {
+                        problems.push(format!(
+                            "{} {} came from index {}, which only serves {}",
+                            pkg.name,
+                            pkg.version,
+                            index.name,
+                            index.packages.join(", ")
+                        ));
+                    }
+                }
+                _ => {}
+            }
+        }
+        if problems.is_empty() {
+            return Ok(());
+        }
+        bail_kind!(
+            ErrorKind::Resolution,
+            "refusing packages from unexpected indexes (possible dependency confusion):\n  {}",
+            problems.join("\n  ")
+        );
+    }
+
+    // Credentials for a download from one of the configured indexes.
+    fn auth_for(&self, url: &str) -> Option<&IndexAuth> {
+        let origin = url_origin(url);
+        self.indexes
+            .iter()
+            .filter(|i| url_origin(&i.url) == origin)
+            .find_map(|i| i.auth.as_ref())
+    }
+}
+
+fn index_auth(global: &GlobalConfig, index: &IndexConfig) -> Result<Option<IndexAuth>> {
+    let password = if let Some(var) = index.credentials.strip_prefix("env:") {
+        match env::var(var) {
+            Ok(value) if !value.is_empty() => value,
+            _ => bail_kind!(
+                ErrorKind::Config,
+                "index {} reads its credentials from {var}, which is not set",
+                index.name
+            ),
+        }
+    } else if let Some(repository) = index.credentials.strip_prefix("auth:") {
+        load_token(global, &repository.to_lowercase())
+            .map(|t| t.trim().to_string())
+            .with_context(|| format!("index {}: run `xe auth login --repository {repository}`", index.name))?
+    } else {
+        return Ok(None);
+    };
+    Ok(Some(IndexAuth {
+        username: "__token__".to_string(),
+        password,
+    }))
+}
+
+fn index_url_with_auth(index: &PlannedIndex) -> String {
+    let Some(auth) = &index.auth else {
+        return index.url.clone();
+    };
+    match reqwest::Url::parse(&index.url) {
+        Ok(mut url) => {
+            let _ = url.set_username(&auth.username);
+            let _ = url.set_password(Some(&auth.password));
+            url.to_string()
+        }
+        Err(_) => index.url.clone(),
+    }
+}
+
+// `url` with any `user:password@` removed.
+fn url_without_userinfo(url: &str) -> String {
+    match reqwest::Url::parse(url) {
+        Ok(mut parsed) if !parsed.username().is_empty() || parsed.password().is_some() => {
+            let _ = parsed.set_username("");
+            let _ = parsed.set_password(None);
+            parsed.to_string()
+        }
+        _ => url.to_string(),
+    }
+}
+
+// scheme://host[:port] of `url`.
+fn url_origin(url: &str) -> String {
+    match reqwest::Url::parse(url) {
+        Ok(parsed) => format!(
+            "{}://{}{}",
+            parsed.scheme(),
+            parsed.host_str().unwrap_or(""),
+            parsed.port().map(|p| format!(":{p}")).unwrap_or_default()
+        ),
+        Err(_) => url.to_string(),
+    }
+}
+
+fn index_reachable(index: &PlannedIndex) -> bool {
+    if let Some(path) = index.url.strip_prefix("file://") {
+        return Path::new(path).is_dir();
+    }
+    let Ok(client) = http_client() else {
+        return false;
+    };
+    let mut request = client.get(format!("{}/", index.url)).timeout(Duration::from_secs(10));
+    if let Some(auth) = &index.auth {
+        request = request.basic_auth(&auth.username, Some(&auth.password));
+    }
+    request.send().map(|resp| !resp.status().is_server_error()).unwrap_or(false)
+}
+
+// Whether the user set pip's cache location or turned it off, through the environment or
+// a pip configuration file; xe then leaves pip's cache alone.
+fn pip_cache_configured() -> bool {
+    if env::var_os("PIP_CACHE_DIR").is_some() || env::var_os("PIP_NO_CACHE_DIR").is_some() {
+        return true;
+    }
+    let mut files = env::var_os("PIP_CONFIG_FILE").map(PathBuf::from).into_iter().collect::<Vec<_>>();
+    if let Some(config) = dirs::config_dir() {
+        files.push(config.join("pip").join(if cfg!(windows) { "pip.ini" } else { "pip.conf" }));
+    }
+    if let Some(home) = dirs::home_dir() {
+        files.push(home.join(".pip").join("pip.conf"));
+    }
+    if cfg!(unix) {
+        files.push(PathBuf::from("/etc/pip.conf"));
+    }
+    files.iter().any(|file| {
+        fs::read_to_string(file).is_ok_and(|text| {
+            text.lines()
+                .filter_map(|line| line.split_once('=').map(|(key, _)| key.trim().replace('_', "-")))
+                .any(|key| key == "cache-dir" || key == "no-cache-dir")
+        })
+    })
+}
+
+// Unreachable indexes and 5xx answers are outages: the package may well exist, so they
+// must not be reported as a missing package.
+fn is_index_outage(pip_output: &str) -> bool {
+    let server_error = Regex::new(r"(HTTP error|too many) 5\d\d|5\d\d Server Error").expect("valid server error regex");
+    [
+        "NewConnectionError",
+        "ConnectTimeoutError",
+        "Max retries exceeded",
+        "Could not fetch URL",
+        "ProxyError",
+        "SSLError",
+        "Name or service not known",
+        "Temporary failure in name resolution",
+    ]
+    .iter()
+    .any(|marker| pip_output.contains(marker))
+        || server_error.is_match(pip_output)
+}
+
+fn pip_report(requirements: &[String], python_exe: &Path, env: &[(&str, String)]) -> Result<Vec<Package>> {
+    let requirement = requirements.join(" ");
+    let report_file = tempfile_path("xe-report", "json");
+    trace(&format!(
+        "{} -m pip install {} --dry-run --report {}",
+        python_exe.display(),
+        requirement,
+        report_file.display()
+    ));
+    let mut command = Command::new(python_exe);
+    command
+        .arg("-m")
+        .arg("pip")
+        .arg("install")
+        .args(requirements)
+        .arg("--dry-run")
+        .arg("--ignore-installed")
+        .arg("--report")
+        .arg(&report_file);
+    // Solutions are cached, shared between projects and written to xe.lock, so they list
+    // every package even when the interpreter or the user's site-packages already has it.
+    command.env("PYTHONNOUSERSITE", "1");
+    for (key, value) in env {
+        command.env(key, value);
+    }
+    let output = run_python(&mut command, "pip", python_timeout(), true)
+        .with_context(|| format!("dependency resolution failed for {requirement}"));
+    let output = match output {
+        Ok(output) => output,
+        Err(err) => {
+            let _ = fs::remove_file(&report_file);
+            return Err(err);
+        }
+    };
+    if !output.status.success() {
+        let stderr = String::from_utf8_lossy(&output.stderr);
+        let stdout = String::from_utf8_lossy(&output.stdout);
+        let kind = if is_index_outage(&stderr) {
+            ErrorKind::Network
+        } else if stderr.contains("No matching distribution") {
+            ErrorKind::PackageNotFound
+        } else {
+            ErrorKind::Resolution
+        };
+        bail_kind!(
+            kind,
+            "dependency resolution failed for {}: {}\n{}{}",
+            requirement,
+            output.status,
+            stdout,
+            stderr
+        );
+    }
+    let report_data = fs::read(&report_file)
+        .with_context(|| format!("failed to read pip report {}", report_file.display()))?;
+    let _ = fs::remove_file(&report_file);
+    let sanitized = sanitize_json(&report_data);
+    let report: PipReport = serde_json::from_slice(&sanitized)
+        .with_context(|| format!("failed to parse pip report for {}", requirement))?;
+    let mut markers = needed_markers(
+        requirements,
+        report
+            .install
+            .iter()
+            .map(|item| (normalize_dep_name(&item.metadata.name), item.metadata.requires_dist.as_slice())),
+    );
+    let resolved = report
+        .install
+        .iter()
+        .map(|item| normalize_dep_name(&item.metadata.name))
+        .collect::<HashSet<_>>();
+    let mut packages = Vec::with_capacity(report.install.len());
+    for item in report.install {
+        let markers = markers.remove(&normalize_dep_name(&item.metadata.name)).unwrap_or_default();
+        let mut dependencies = item
+            .metadata
+            .requires_dist
+            .iter()
+            .filter_map(|r| requirement_to_dep_name(r))
+            .filter(|name| resolved.contains(name))
+            .collect::<Vec<_>>();
+        dependencies.sort();
+        dependencies.dedup();
+        let hash = item
+            .download_info
+            .archive_info
+            .hashes
+            .get("sha256")
+            .cloned()
+            .unwrap_or_default();
+        packages.push(Package {
+            name: item.metadata.name,
+            version: item.metadata.version,
+            download_url: item.download_info.url,
+            hash,
+            hash_algorithm: HashAlgorithm::Sha256,
+            markers,
+            dependencies,
+        });
+    }
+    Ok(packages)
+}
+
+// The marker under which each resolved package is needed: the marker of the requirement
+// naming it, and for dependencies the markers along the Requires-Dist edges that lead to
+// it, or-ed over every way in. `extra == ...` clauses are dropped, as pip only reports the
+// extras that were asked for. A package whose conditions grow past a few alternatives is
+// treated as needed everywhere, which can only over-install.
+fn needed_markers<'a>(
+    requirements: &[String],
+    resolved: impl Iterator<Item = (String, &'a [String])>,
+) -> HashMap<String, String> {
+    const MAX_ALTERNATIVES: usize = 4;
+    // None: needed everywhere; Some(set): needed where any of the markers holds.
+    type Need = Option<BTreeSet<String>>;
+    fn split(requirement: &str) -> Option<(String, Option<String>)> {
+        let (spec, marker) = match requirement.split_once(';') {
+            Some((spec, marker)) => (spec, without_extra_clauses(marker)),
+            None => (requirement, None),
+        };
+        let end = spec.find(|c: char| " <>=!~[(@".contains(c)).unwrap_or(spec.len());
+        let name = spec[..end].trim();
+        (!name.is_empty()).then(|| (normalize_dep_name(name), marker))
+    }
+    fn and(need: &Need, marker: &Option<String>) -> Need {
+        match (need, marker) {
+            (None, None) => None,
+            (None, Some(marker)) => Some(BTreeSet::from([marker.clone()])),
+            (Some(set), None) => Some(set.clone()),
+            (Some(set), Some(marker)) => Some(set.iter().map(|m| format!("({m}) and ({marker})")).collect()),
+        }
+    }
+    fn merge(needs: &mut HashMap<String, Need>, name: &str, need: Need) -> bool {
+        let Some(current) = needs.get_mut(name) else {
+            needs.insert(name.to_string(), need);
+            return true;
+        };
+        let Some(set) = current else {
+            return false;
+        };
+        let Some(extra) = need else {
+            *current = None;
+            return true;
+        };
+        let before = set.len();
+        set.extend(extra);
+        if set.len() > MAX_ALTERNATIVES {
+            *current = None;
+            return true;
+        }
+        set.len() != before
+    }
+
+    let edges = resolved
+        .map(|(name, requires)| (name, requires.iter().filter_map(|r| split(r)).collect::<Vec<_>>()))
+        .collect::<HashMap<_, _>>();
+    let mut needs = HashMap::new();
+    for (name, marker) in requirements.iter().filter_map(|r| split(r)) {
+        merge(&mut needs, &name, and(&None, &marker));
+    }
+    // Each pass pushes conditions one edge further; cycles settle once no set changes or
+    // a set gives up and becomes unconditional.
+    for _ in 0..=edges.len() {
+        let mut changed = false;
+        let snapshot = needs.clone();
+        for (name, need) in &snapshot {
+            for (dep, marker) in edges.get(name).into_iter().flatten() {
+                if edges.contains_key(dep) {
+                    changed |= merge(&mut needs, dep, and(need, marker));
+                }
+            }
+        }
+        if !changed {
+            break;
+        }
+    }
+    edges
+        .keys()
+        .map(|name| {
+            let marker = match needs.get(name) {
+                Some(Some(set)) if set.len() == 1 => set.iter().next().cloned().unwrap_or_default(),
+                Some(Some(set)) => set.iter().map(|m| format!("({m})")).collect::<Vec<_>>().join(" or "),
+                _ => String::new(),
+            };
+            (name.clone(), marker)
+        })
+        .collect()
+}
+
+// A marker without its `extra == "..."` clauses; None when nothing else is left. A marker
+// that mixes extras into an `or` is kept whole rather than guessed at.
+fn without_extra_clauses(marker: &str) -> Option<String> {
+    let marker = marker.trim();
+    if !marker.contains("extra") {
+        return (!marker.is_empty()).then(|| marker.to_string());
+    }
+    if marker.contains(" or ") {
+        return None;
+    }
+    let kept = marker
+        .split(" and ")
+        .map(str::trim)
+        .map(|clause| clause.trim_start_matches('(').trim_end_matches(')'))
+        .filter(|clause| !clause.trim_start().starts_with("extra"))
+        .collect::<Vec<_>>();
+    (!kept.is_empty()).then(|| kept.join(" and "))
+}
+
+// How long a Python subprocess (pip above all) may run before xe gives up on it.
+const DEFAULT_PYTHON_TIMEOUT: Duration = Duration::from_secs(15 * 60);
+
+fn python_timeout() -> Duration {
+    env::var("XE_PYTHON_TIMEOUT")
+        .ok()
+        .and_then(|v| v.trim().parse::<u64>().ok())
+        .filter(|secs| *secs > 0)
+        .map(Duration::from_secs)
+        .unwrap_or(DEFAULT_PYTHON_TIMEOUT)
+}
+
+// Runs a Python subprocess with stdout and stderr captured apart, so warnings on stderr
+// never reach output that gets parsed, and kills it once `timeout` passes. With `stream`,
+// lines are also logged at debug level as they arrive, so `-v` shows the progress of long
+// operations such as resolution.
+fn run_python(command: &mut Command, what: &str, timeout: Duration, stream: bool) -> Result<Output> {
+    let mut child = command
+        .stdin(Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()
+        .with_context(|| format!("failed to run {what}"))?;
+    let stdout = drain_pipe(child.stdout.take(), stream);
+    let stderr = drain_pipe(child.stderr.take(), stream);
+    let Some(status) = wait_or_kill(&mut child, what, timeout)? else {
+        // The reader threads are left behind: a grandchild may still hold the pipes.
+        bail!(
+            "{what} did not finish within {}; set XE_PYTHON_TIMEOUT (seconds) to allow longer",
+            human_duration(timeout)
+        );
+    };
+    Ok(Output {
+        status,
+        stdout: stdout.join().unwrap_or_default(),
+        stderr: stderr.join().unwrap_or_default(),
+    })
+}
+
+// Set by the first Ctrl-C inside a catch_interrupts scope. pip runs, downloads and the
+// install loop check it and unwind, so temporary files and partly extracted wheels are
+// cleaned up on the way out; a second Ctrl-C exits at once.
+static INTERRUPTED: AtomicBool = AtomicBool::new(false);
+
+fn interrupted() -> bool {
+    INTERRUPTED.load(AtomicOrdering::SeqCst)
+}
+
+fn check_interrupted() -> Result<()> {
+    if interrupted() {
+        bail_kind!(ErrorKind::Interrupted, "interrupted");
+    }
+    Ok(())
+}
+
+// Catches Ctrl-C while the returned guard lives. Resolution, installs and runtime downloads
+// take one rather than installing a handler at startup, and the default behaviour comes
+// back once the last guard is dropped, so prompts and `xe run` targets that follow an
+// install still stop on Ctrl-C. A Ctrl-C caught in scope stays recorded.
+#[must_use]
+struct InterruptScope;
+
+static INTERRUPT_SCOPES: Mutex<usize> = Mutex::new(0);
+
+fn catch_interrupts() -> InterruptScope {
+    let mut scopes = INTERRUPT_SCOPES.lock().unwrap_or_else(|poisoned| poisoned.into_inner());
+    if *scopes == 0 {
+        set_interrupt_handler(true);
+    }
+    *scopes += 1;
+    InterruptScope
+}
+
+impl Drop for InterruptScope {
+    fn drop(&mut self) {
+        let mut scopes = INTERRUPT_SCOPES.lock().unwrap_or_else(|poisoned| poisoned.into_inner());
+        *scopes = scopes.saturating_sub(1);
+        if *scopes == 0 {
+            set_interrupt_handler(false);
+        }
+    }
+}
+
+#[cfg(unix)]
+fn set_interrupt_handler(catch: bool) {
+    const SIGINT: i32 = 2;
+    const SIG_DFL: usize = 0;
+    extern "C" {
+        fn signal(signum: i32, handler: usize) -> usize;
+        fn _exit(status: i32) -> !;
+    }
+    extern "C" fn on_sigint(_signum: i32) {
+        if INTERRUPTED.swap(true, AtomicOrdering::SeqCst) {
+            unsafe { _exit(130) }
+        }
+    }
+    let handler = if catch { on_sigint as extern "C" fn(i32) as usize } else { SIG_DFL };
+    unsafe {
+        signal(SIGINT, handler);
+    }
+}
+
+#[cfg(windows)]
+fn set_interrupt_handler(catch: bool) {
+    unsafe extern "system" fn on_ctrl_c(_ctrl_type: u32) -> i32 {
+        if INTERRUPTED.swap(true, AtomicOrdering::SeqCst) {
+            std::process::exit(130);
+        }
+        1
+    }
+    #[link(name = "kernel32")]
+    extern "system" {
+        fn SetConsoleCtrlHandler(handler: Option<unsafe extern "system" fn(u32) -> i32>, add: i32) -> i32;
+    }
+    unsafe {
+        SetConsoleCtrlHandler(Some(on_ctrl_c), catch as i32);
+    }
+}
+
+#[cfg(not(any(unix, windows)))]
+fn set_interrupt_handler(_catch: bool) {}
+
+// Fails reads once Ctrl-C was pressed, so a download stops mid-body instead of running
+// to completion.
+struct Interruptible<R>(R);
+
+impl<R: Read> Read for Interruptible<R> {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        if interrupted() {
+            // Not io::ErrorKind::Interrupted, which io::copy retries.
+            return Err(io::Error::other("interrupted"));
+        }
+        self.0.read(buf)
+    }
+}
+
+// Waits for `child`, killing it on Ctrl-C or once `timeout` passes. None means it was
+// killed for taking too long.
+fn wait_or_kill(child: &mut Child, what: &str, timeout: Duration) -> Result<Option<ExitStatus>> {
+    let deadline = Instant::now() + timeout;
+    let mut poll = Duration::from_millis(1);
+    loop {
+        let exited = child.try_wait().with_context(|| format!("failed to wait for {what}"))?;
+        // Ctrl-C usually reaches the child as well; either way its output is not wanted.
+        if interrupted() {
+            if exited.is_none() {
+                let _ = child.kill();
+                let _ = child.wait();
+            }
+            bail_kind!(ErrorKind::Interrupted, "{what} was interrupted");
+        }
+        if exited.is_some() {
+            return Ok(exited);
+        }
+        if Instant::now() >= deadline {
+            let _ = child.kill();
+            let _ = child.wait();
+            return Ok(None);
+        }
+        thread::sleep(poll);
+        poll = (poll * 2).min(Duration::from_millis(50));
+    }
+}
+
+fn drain_pipe<R: Read + Send + 'static>(pipe: Option<R>, stream: bool) -> thread::JoinHandle<Vec<u8>> {
+    thread::spawn(move || {
+        let mut out = Vec::new();
+        let Some(pipe) = pipe else {
+            return out;
+        };
+        let mut reader = BufReader::new(pipe);
+        let mut line = Vec::new();
+        while reader.read_until(b'\n', &mut line).unwrap_or(0) > 0 {
+            if stream {
+                debug(String::from_utf8_lossy(&line).trim_end());
+            }
+            out.append(&mut line);
+        }
+        out
+    })
+}
+
+fn sanitize_json(data: &[u8]) -> Vec<u8> {
+    let trimmed = trim_json_start(data);
+    if trimmed.is_empty() {
+        return data.to_vec();
+    }
+    let mut de = serde_json::Deserializer::from_slice(trimmed);
+    match Value::deserialize(&mut de) {
+        Ok(value) => serde_json::to_vec(&value).unwrap_or_else(|_| trimmed.to_vec()),
+        Err(_) => trimmed.to_vec(),
+    }
+}
+
+fn trim_json_start(data: &[u8]) -> &[u8] {
+    match data.iter().position(|b| *b == b'{' || *b == b'[') {
+        Some(idx) => &data[idx..],
+        None => data,
+    }
+}
+
+struct Cas {
+    root: PathBuf,
+}
+
+// Wheel caches written by older releases outside the CAS.
+fn legacy_cache_dirs() -> Vec<PathBuf> {
+    let Some(home) = dirs::home_dir() else {
+        return Vec::new();
+    };
+    vec![home.join(".xe").join("cache"), home.join(".cache").join("xe")]
+}
+
+// Imports the wheels of legacy caches into `cas`, deleting each one once it is stored.
+// A legacy directory is removed only when all of its wheels were imported; wheels that
+// fail verify_legacy_wheel stay where they are and are reported, so nothing is lost
+// without the user knowing.
+fn migrate_legacy_caches(cas: &Cas) {
+    let root = fs::canonicalize(&cas.root).unwrap_or_else(|_| cas.root.clone());
+    for dir in legacy_cache_dirs() {
+        let Ok(legacy) = fs::canonicalize(&dir) else {
+            continue;
+        };
+        // A cache.global_dir pointing into a legacy location is the live cache.
+        if root.starts_with(&legacy) || legacy.starts_with(&root) {
+            continue;
+        }
+        info(&format!("Importing wheels from the legacy cache {}...", dir.display()));
+        let (mut imported, mut rejected) = (0usize, 0usize);
+        for entry in WalkDir::new(&legacy).into_iter().flatten() {
+            let path = entry.path();
+            if !entry.file_type().is_file() || !path.extension().is_some_and(|ext| ext == "whl") {
+                continue;
+            }
+            let file_name = path.file_name().unwrap_or_default().to_string_lossy().to_string();
+            let stored = verify_legacy_wheel(path).and_then(|data| cas.store_blob(&data, &file_name).map(|_| ()));
+            match stored {
+                Ok(()) => {
+                    imported += 1;
+                    let _ = fs::remove_file(path);
+                }
+                Err(err) => {
+                    warning(&format!("not importing {}: {err:#}", path.display()));
+                    rejected += 1;
+                }
+            }
+        }
+        if rejected > 0 {
+            warning(&format!(
+                "moved {imported} wheel(s) into the cache; kept {rejected} that failed verification in {}. Delete it once you no longer need them",
+                dir.display()
+            ));
+            continue;
+        }
+        if let Err(err) = fs::remove_dir_all(&legacy) {
+            warning(&format!("failed to remove legacy cache {}: {err}", legacy.display()));
+            continue;
+        }
+        info(&format!("Moved {imported} wheel(s) from the legacy cache {} into the cache", dir.display()));
+    }
+}
+
+// Checks that every file a wheel's RECORD hashes matches it, and returns the wheel's
+// bytes. This proves the archive is consistent with its own RECORD, which catches
+// truncation and corruption. It does not prove authenticity: RECORD travels inside the
+// wheel, so one altered together with its RECORD passes.
+fn verify_legacy_wheel(path: &Path) -> Result<Vec<u8>> {
+    let data = fs::read(path).with_context(|| format!("failed to read {}", path.display()))?;
+    let mut archive = ZipArchive::new(io::Cursor::new(data.as_slice()))
+        .with_context(|| format!("failed to parse {}", path.display()))?;
+    let record_name = archive
+        .file_names()
+        .find(|name| name.split('/').count() == 2 && name.ends_with(".dist-info/RECORD"))
+        .map(str::to_string)
+        .ok_or_else(|| anyhow!("{} has no RECORD", path.display()))?;
+    let mut record = String::new();
+    archive.by_name(&record_name)?.read_to_string(&mut record)?;
+    for (name, expected) in record_hashes(&record) {
+        let mut contents = Vec::new();
+        archive
+            .by_name(&name)
+            .with_context(|| format!("{name} is listed in RECORD but missing"))?
+            .read_to_end(&mut contents)?;
+        if urlsafe_b64_nopad(&Sha256::digest(&contents)) != expected {
+            bail_kind!(ErrorKind::HashMismatch, "{name} does not match the hash in its RECORD");
+        }
+    }
+    Ok(data)
+}
+
+impl Cas {
+    fn new(root: &Path) -> Result<Self> {
+        let cas = Self { root: long_path(root) };
+        fs::create_dir_all(cas.blob_dir()).with_context(|| "failed to create CAS blob dir")?;
+        fs::create_dir_all(cas.solution_dir())
+            .with_context(|| "failed to create CAS solution dir")?;
+        Ok(cas)
+    }
+
+    fn store_blob_from_url(
+        &self,
+        url: &str,
+        algorithm: HashAlgorithm,
+        expected: &str,
+        auth: Option<&IndexAuth>,
+    ) -> Result<PathBuf> {
+        if let Some(target) = self.cached_blob(algorithm, expected) {
+            return Ok(target);
+        }
+        let mut download = self.start_download(url, algorithm, auth)?;
+        if let Err(err) = io::copy(&mut download, &mut io::sink()) {
+            let _ = fs::remove_file(&download.path);
+            return Err(err).context("failed while downloading blob");
+        }
+        self.finish_download(download, expected)
+    }
+
+    // The artifact of a resolved package, downloaded and verified against its digest.
+    fn store_package(&self, pkg: &Package, auth: Option<&IndexAuth>) -> Result<PathBuf> {
+        self.store_blob_from_url(&pkg.download_url, pkg.hash_algorithm, &pkg.hash, auth)
+    }
+
+    // Downloads a wheel into the CAS while extracting it from the same bytes, reading
+    // entries from their local headers as they arrive instead of reopening the finished
+    // blob. Entries go to a staging directory that is moved into `site_packages` only once
+    // the download's hash checks out, so a mismatch leaves the installed files as they
+    // were. Wheels the stream reader cannot handle (entries sized by a trailing data
+    // descriptor) are extracted from the stored blob instead.
+    fn store_and_extract(
+        &self,
+        url: &str,
+        algorithm: HashAlgorithm,
+        expected: &str,
+        auth: Option<&IndexAuth>,
+        site_packages: &Path,
+    ) -> Result<PathBuf> {
+        if let Some(target) = self.cached_blob(algorithm, expected) {
+            install_wheel_blob(&target, site_packages)?;
+            return Ok(target);
+        }
+        let mut download = self.start_download(url, algorithm, auth)?;
+        let staging = staging_dir(site_packages);
+        let streamed = extract_wheel_stream(&mut download, &staging);
+        // The central directory and anything after a failed entry still have to be read
+        // for the blob and its hash.
+        let downloaded = match io::copy(&mut download, &mut io::sink()) {
+            Ok(_) => self.finish_download(download, expected),
+            Err(err) => {
+                let _ = fs::remove_file(&download.path);
+                Err(err).context("failed while downloading blob")
+            }
+        };
+        let installed = downloaded.and_then(|target| {
+            match streamed {
+                Ok(files) => commit_staged(&staging, site_packages, &files, &target)?,
+                Err(err) => {
+                    debug(&format!("Streaming extraction of {url} failed ({err:#}); extracting from the cache"));
+                    install_wheel_blob(&target, site_packages)?;
+                }
+            }
+            Ok(target)
+        });
+        let _ = fs::remove_dir_all(&staging);
+        installed
+    }
+
+    fn cached_blob(&self, algorithm: HashAlgorithm, expected: &str) -> Option<PathBuf> {
+        if expected.trim().is_empty() {
+            return None;
+        }
+        let target = self.blob_path(algorithm, expected);
+        if target.exists() || (algorithm == HashAlgorithm::Sha256 && self.adopt_legacy_blob(expected, &target)) {
+            trace(&format!("CAS hit {}", target.display()));
+            return Some(target);
+        }
+        None
+    }
+
+    // Older releases stored every blob as blobs/<xx>/<sha256>.whl, sdists included. Such
+    // a blob is moved to `target` on first use, its content type taken from its bytes.
+    fn adopt_legacy_blob(&self, sha: &str, target: &Path) -> bool {
+        let prefix = if sha.len() >= 2 { &sha[..2] } else { "00" };
+        let legacy = self.blob_dir().join(prefix).join(format!("{sha}.whl"));
+        if !legacy.is_file() {
+            return false;
+        }
+        let adopted = (|| -> Result<()> {
+            let mut magic = [0u8; 4];
+            let read = File::open(&legacy)?.read(&mut magic)?;
+            let meta = BlobMeta {
+                content_type: sniff_content_type(&magic[..read]).to_string(),
+                file_name: String::new(),
+            };
+            if let Some(parent) = target.parent() {
+                fs::create_dir_all(parent).with_context(|| format!("failed to create {}", parent.display()))?;
+            }
+            fs::rename(&legacy, target).with_context(|| format!("failed to move {}", legacy.display()))?;
+            meta.write(target)
+        })();
+        match adopted {
+            Ok(()) => true,
+            Err(err) => {
+                debug(&format!("Not adopting {}: {err:#}", legacy.display()));
+                false
+            }
+        }
+    }
+
+    fn start_download(&self, url: &str, algorithm: HashAlgorithm, auth: Option<&IndexAuth>) -> Result<BlobDownload> {
+        // file:// artifacts come from a local mirror (see `xe mirror create`).
+        let source: Box<dyn Read> = if url.starts_with("file://") {
+            let path = reqwest::Url::parse(url)
+                .ok()
+                .and_then(|u| u.to_file_path().ok())
+                .ok_or_else(|| anyhow!("invalid file URL {url}"))?;
+            Box::new(File::open(&path).with_context(|| format!("failed to open {}", path.display()))?)
+        } else {
+            let mut request = http_client()?.get(url).timeout(Duration::from_secs(120));
+            if let Some(auth) = auth {
+                request = request.basic_auth(&auth.username, Some(&auth.password));
+            }
+            let resp = request
+                .send()
+                .with_context(|| format!("failed to download {}", url))?;
+            if !resp.status().is_success() {
+                bail_kind!(ErrorKind::Network, "download failed: {}", resp.status());
+            }
+            Box::new(Interruptible(resp))
+        };
+
+        fs::create_dir_all(&self.root).with_context(|| format!("failed to create {}", self.root.display()))?;
+        let path = tempfile_path_in(&self.root, "xe-download", "tmp");
+        let file = File::create(&path).with_context(|| format!("failed to create {}", path.display()))?;
+        Ok(BlobDownload {
+            source,
+            file,
+            path,
+            file_name: artifact_file_name(url),
+            algorithm,
+            hasher: algorithm.hasher(),
+        })
+    }
+
+    // Verifies a completed download and moves it to its place in the blob store.
+    fn finish_download(&self, download: BlobDownload, expected: &str) -> Result<PathBuf> {
+        let BlobDownload {
+            mut file,
+            path: tmp_path,
+            file_name,
+            algorithm,
+            hasher,
+            ..
+        } = download;
+        file.flush().ok();
+        drop(file);
+        let actual = hasher.finalize_hex();
+
+        if !expected.trim().is_empty() && !expected.eq_ignore_ascii_case(&actual) {
+            let _ = fs::remove_file(&tmp_path);
+            bail_kind!(
+                ErrorKind::HashMismatch,
+                "checksum mismatch: expected={}:{} actual={}:{}",
+                algorithm.name(),
+                expected,
+                algorithm.name(),
+                actual
+            );
+        }
+
+        let target = self.blob_path(algorithm, &actual);
+        if target.exists() {
+            let _ = fs::remove_file(&tmp_path);
+            return Ok(target);
+        }
+        BlobMeta::for_file(&file_name).write(&target)?;
+        if let Some(parent) = target.parent() {
+            fs::create_dir_all(parent).with_context(|| format!("failed to create {}", parent.display()))?;
+        }
+        match fs::rename(&tmp_path, &target) {
+            Ok(_) => {}
+            Err(_) => {
+                fs::copy(&tmp_path, &target)
+                    .with_context(|| format!("failed to store blob at {}", target.display()))?;
+                let _ = fs::remove_file(&tmp_path);
+            }
+        }
+        Ok(target)
+    }
+
+    fn save_solution<T: Serialize>(&self, key: &str, value: &T) -> Result<()> {
+        let path = self.solution_dir().join(format!("{key}.json"));
+        if let Some(parent) = path.parent() {
+            fs::create_dir_all(parent).with_context(|| format!("failed to create {}", parent.display()))?;
+        }
+        let file = File::create(&path).with_context(|| format!("failed to create {}", path.display()))?;
+        serde_json::to_writer(file, value).with_context(|| format!("failed to write {}", path.display()))
+    }
+
+    fn load_solution<T: for<'de> Deserialize<'de>>(&self, key: &str) -> Result<Option<T>> {
+        let path = self.solution_dir().join(format!("{key}.json"));
+        if !path.exists() {
+            return Ok(None);
+        }
+        let file = File::open(&path).with_context(|| format!("failed to open {}", path.display()))?;
+        let value = serde_json::from_reader(file).with_context(|| format!("failed to parse {}", path.display()))?;
+        Ok(Some(value))
+    }
+
+    // The latest solution saved for a history_key.
+    fn previous_solution(&self, history: &str) -> Option<SolveGraph> {
+        let key = fs::read_to_string(self.history_dir().join(history)).ok()?;
+        self.load_solution(key.trim()).ok().flatten()
+    }
+
+    fn record_history(&self, history: &str, key: &str) -> Result<()> {
+        let dir = self.history_dir();
+        fs::create_dir_all(&dir).with_context(|| format!("failed to create {}", dir.display()))?;
+        write_file_atomic(&dir.join(history), key.as_bytes())
+    }
+
+    // The wheel recorded as built from the source blob with digest `source` for the
+    // BuildTarget with `key`.
+    fn built_wheel(&self, source: &str, key: &str) -> Option<PathBuf> {
+        let sha = fs::read_to_string(self.build_dir().join(source).join(key)).ok()?;
+        let sha = sha.trim();
+        if !HashAlgorithm::Sha256.is_digest(sha) {
+            return None;
+        }
+        self.cached_blob(HashAlgorithm::Sha256, sha)
+    }
+
+    // Stores a wheel built from the source blob with digest `source` and records it under
+    // `key`.
+    fn store_built_wheel(&self, source: &str, key: &str, file_name: &str, wheel: &[u8]) -> Result<PathBuf> {
+        let (sha, target) = self.store_blob(wheel, file_name)?;
+        let dir = self.build_dir().join(source);
+        fs::create_dir_all(&dir).with_context(|| format!("failed to create {}", dir.display()))?;
+        write_file_atomic(&dir.join(key), sha.as_bytes())?;
+        Ok(target)
+    }
+
+    // Stores `data` under its sha256; returns the digest and the blob's path.
+    fn store_blob(&self, data: &[u8], file_name: &str) -> Result<(String, PathBuf)> {
+        let sha = HashAlgorithm::Sha256.digest(data);
+        let target = self.blob_path(HashAlgorithm::Sha256, &sha);
+        if !target.exists() {
+            if let Some(parent) = target.parent() {
+                fs::create_dir_all(parent).with_context(|| format!("failed to create {}", parent.display()))?;
+            }
+            BlobMeta::for_file(file_name).write(&target)?;
+            write_file_atomic(&target, data)?;
+        }
+        Ok((sha, target))
+    }
+
+    // Makes the blob at `source` addressable by its `algorithm` digest as well, sharing
+    // the file where the filesystem allows; returns the digest.
+    fn rehash(&self, source: &Path, algorithm: HashAlgorithm) -> Result<String> {
+        let mut file = File::open(source).with_context(|| format!("failed to open {}", source.display()))?;
+        let mut hasher = algorithm.hasher();
+        let mut buf = vec![0u8; 64 * 1024];
+        loop {
+            let read = file.read(&mut buf)?;
+            if read == 0 {
+                break;
+            }
+            hasher.update(&buf[..read]);
+        }
+        let digest = hasher.finalize_hex();
+        let target = self.blob_path(algorithm, &digest);
+        if !target.exists() {
+            if let Some(parent) = target.parent() {
+                fs::create_dir_all(parent).with_context(|| format!("failed to create {}", parent.display()))?;
+            }
+            BlobMeta::read(source).unwrap_or_default().write(&target)?;
+            if fs::hard_link(source, &target).is_err() {
+                fs::copy(source, &target).with_context(|| format!("failed to store blob at {}", target.display()))?;
+            }
+        }
+        Ok(digest)
+    }
+
+    fn blob_dir(&self) -> PathBuf {
+        self.root.join("cas").join("blobs")
+    }
+
+    // Wheels built from source distributions: builds/<source digest>/<BuildTarget key>
+    // holds the sha256 of the wheel blob.
+    fn build_dir(&self) -> PathBuf {
+        self.root.join("cas").join("builds")
+    }
+
+    fn history_dir(&self) -> PathBuf {
+        self.root.join("cas").join("history")
+    }
+
+    fn solution_dir(&self) -> PathBuf {
+        self.root.join("cas").join("solutions")
+    }
+
+    // Blobs are stored without an extension under blobs/<algorithm>/<xx>/<digest>, next
+    // to a <digest>.meta file recording what they hold.
+    fn blob_path(&self, algorithm: HashAlgorithm, digest: &str) -> PathBuf {
+        let digest = digest.to_ascii_lowercase();
+        let prefix = if digest.len() >= 2 { &digest[..2] } else { "00" };
+        self.blob_dir().join(algorithm.name()).join(prefix).join(&digest)
+    }
+}
+
+// The .meta file of a blob: its content type and the file name it was downloaded as,
+// which a source distribution needs to be built.
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+struct BlobMeta {
+    content_type: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    file_name: String,
+}
+
+impl BlobMeta {
+    fn for_file(file_name: &str) -> Self {
+        Self {
+            content_type: artifact_content_type(file_name).to_string(),
+            file_name: file_name.to_string(),
+        }
+    }
+
+    fn path(blob: &Path) -> PathBuf {
+        blob.with_extension("meta")
+    }
+
+    fn read(blob: &Path) -> Option<Self> {
+        let data = fs::read(Self::path(blob)).ok()?;
+        serde_json::from_slice(&data).ok()
+    }
+
+    fn write(&self, blob: &Path) -> Result<()> {
+        let path = Self::path(blob);
+        if let Some(parent) = path.parent() {
+            fs::create_dir_all(parent).with_context(|| format!("failed to create {}", parent.display()))?;
+        }
+        write_file_atomic(&path, &serde_json::to_vec(self)?)
+    }
+}
+
+fn artifact_content_type(file_name: &str) -> &'static str {
+    let lower = file_name.to_lowercase();
+    if lower.ends_with(".whl") {
+        "application/x-wheel+zip"
+    } else if lower.ends_with(".tar.gz") || lower.ends_with(".tgz") {
+        "application/gzip"
+    } else if lower.ends_with(".tar.bz2") {
+        "application/x-bzip2"
+    } else if lower.ends_with(".tar.xz") {
+        "application/x-xz"
+    } else if lower.ends_with(".zip") {
+        "application/zip"
+    } else if lower.ends_with(".tar") {
+        "application/x-tar"
+    } else {
+        "application/octet-stream"
+    }
+}
+
+// Content type of a blob whose file name is unknown. Legacy blobs were mostly wheels, so
+// zip archives are taken to be one.
+fn sniff_content_type(magic: &[u8]) -> &'static str {
+    if magic.starts_with(b"PK\x03\x04") {
+        "application/x-wheel+zip"
+    } else if magic.starts_with(&[0x1f, 0x8b]) {
+        "application/gzip"
+    } else {
+        "application/octet-stream"
+    }
+}
+
+#[derive(Debug, Clone, Deserialize)]
+struct PipPkg {
+    name: String,
+    version: String,
+}
+
+fn parse_pip_list_output(out: &[u8]) -> Result<Vec<PipPkg>> {
+    let trimmed = out
+        .iter()
+        .copied()
+        .skip_while(|b| b.is_ascii_whitespace())
+        .collect::<Vec<_>>();
+    if trimmed.is_empty() {
+        return Ok(Vec::new());
+    }
+
+    if let Ok(direct) = serde_json::from_slice::<Vec<PipPkg>>(&trimmed) {
+        return Ok(direct);
+    }
+
+    let mut start = 0usize;
+    while start < trimmed.len() {
+        if let Some(open_rel) = trimmed[start..].iter().position(|b| *b == b'[') {
+            let open = start + open_rel;
+            let mut depth: i32 = 0;
+            for idx in open..trimmed.len() {
+                match trimmed[idx] {
+                    b'[' => depth += 1,
+                    b']' => {
+                        depth -= 1;
+                        if depth == 0 {
+                            let chunk = &trimmed[open..=idx];
+                            if let Ok(pkgs) = serde_json::from_slice::<Vec<PipPkg>>(chunk) {
+                                return Ok(pkgs);
+                            }
+                            break;
+                        }
+                    }
+                    _ => {}
+                }
+            }
+            start = open + 1;
+        } else {
+            break;
+        }
     }
+    bail!("pip JSON payload not found in output")
+}
 
-    fn exists(&self, name: &str) -> bool {
-        self.base_dir.join(name).exists()
-    }
+// One distribution found in site-packages. Size and installer are unknown when the
+// listing came from pip.
+struct InstalledDist {
+    name: String,
+    version: String,
+    size: Option<u64>,
+    installer: Option<String>,
+}
 
-    fn delete(&self, name: &str) -> Result<()> {
-        if name.trim().is_empty() {
-            bail!("venv name required");
-        }
-        let path = self.base_dir.join(name);
-        if path.exists() {
-            fs::remove_dir_all(&path).with_context(|| format!("failed to remove {}", path.display()))?;
-        }
-        Ok(())
+// Every .dist-info in `site_packages`. The name comes from METADATA (falling back to the
+// directory name), the size is the sum of the files RECORD lists, and the installer is
+// whatever wrote INSTALLER (pip, xe, uv, ...).
+fn list_installed_packages(site_packages: &Path) -> Vec<InstalledDist> {
+    let mut out = Vec::new();
+    for entry in fs::read_dir(site_packages).into_iter().flatten().flatten() {
+        let dir_name = entry.file_name().to_string_lossy().to_string();
+        let Some((dist, version)) = dir_name
+            .strip_suffix(".dist-info")
+            .and_then(|base| base.rsplit_once('-'))
+        else {
+            continue;
+        };
+        let path = entry.path();
+        let name = fs::read_to_string(path.join("METADATA"))
+            .ok()
+            .and_then(|metadata| {
+                metadata
+                    .lines()
+                    .take_while(|line| !line.is_empty())
+                    .find_map(|line| line.strip_prefix("Name:").map(|n| n.trim().to_string()))
+            })
+            .unwrap_or_else(|| dist.to_string());
+        let size = fs::read_to_string(path.join("RECORD")).ok().map(|record| {
+            record
+                .lines()
+                .filter_map(|line| {
+                    let mut fields = line.rsplitn(3, ',');
+                    let size = fields.next()?;
+                    let file = fields.nth(1)?.trim_matches('"');
+                    size.parse::<u64>()
+                        .ok()
+                        .or_else(|| fs::metadata(site_packages.join(file)).ok().map(|m| m.len()))
+                })
+                .sum()
+        });
+        let installer = fs::read_to_string(path.join("INSTALLER"))
+            .ok()
+            .map(|text| text.trim().to_string())
+            .filter(|text| !text.is_empty());
+        out.push(InstalledDist {
+            name,
+            version: version.to_string(),
+            size,
+            installer,
+        });
     }
+    out
+}
 
-    fn list(&self) -> Result<Vec<String>> {
-        let mut out = Vec::new();
-        for entry in fs::read_dir(&self.base_dir)
-            .with_context(|| format!("failed to read {}", self.base_dir.display()))?
-        {
-            let entry = entry?;
-            if entry.file_type()?.is_dir() {
-                out.push(entry.file_name().to_string_lossy().to_string());
-            }
-        }
-        Ok(out)
-    }
+// Columns `xe list --columns` accepts; `direct` is whether xe.toml declares the package.
+const LIST_COLUMNS: [&str; 7] = ["name", "version", "latest", "size", "installer", "group", "direct"];
 
-    fn get_python_exe(&self, name: &str) -> PathBuf {
-        if cfg!(windows) {
-            self.base_dir.join(name).join("Scripts").join("python.exe")
-        } else {
-            self.base_dir.join(name).join("bin").join("python")
+struct ListRow {
+    dist: InstalledDist,
+    groups: Vec<String>,
+    latest: Option<String>,
+}
+
+impl ListRow {
+    fn cell(&self, column: &str) -> String {
+        let dash = || "-".to_string();
+        match column {
+            "name" => self.dist.name.clone(),
+            "version" => self.dist.version.clone(),
+            "latest" => self.latest.clone().unwrap_or_else(dash),
+            "size" => self.dist.size.map(human_bytes).unwrap_or_else(dash),
+            "installer" => self.dist.installer.clone().unwrap_or_else(dash),
+            "group" if !self.groups.is_empty() => self.groups.join(","),
+            "direct" => if self.groups.is_empty() { "no" } else { "yes" }.to_string(),
+            _ => dash(),
         }
     }
+}
 
-    fn get_site_packages_dir(&self, name: &str) -> PathBuf {
-        if cfg!(windows) {
-            self.base_dir.join(name).join("Lib").join("site-packages")
-        } else {
-            self.base_dir.join(name).join("lib")
-        }
+fn print_pkg_table(rows: &[ListRow], columns: &[String]) {
+    let header = |column: &str| match column {
+        "name" => "Package".to_string(),
+        other => format!("{}{}", other[..1].to_uppercase(), &other[1..]),
+    };
+    let cells = rows
+        .iter()
+        .map(|row| columns.iter().map(|c| row.cell(c)).collect::<Vec<_>>())
+        .collect::<Vec<_>>();
+    let widths = columns
+        .iter()
+        .enumerate()
+        .map(|(idx, c)| cells.iter().map(|r| r[idx].len()).fold(header(c).len(), usize::max))
+        .collect::<Vec<_>>();
+    let line = |values: Vec<String>| {
+        let padded = values
+            .iter()
+            .zip(columns)
+            .zip(&widths)
+            .map(|((value, column), width)| match column.as_str() {
+                "size" => format!("{value:>width$}"),
+                _ => format!("{value:<width$}"),
+            })
+            .collect::<Vec<_>>();
+        println!("{}", padded.join("  ").trim_end());
+    };
+    line(columns.iter().map(|c| header(c)).collect());
+    for row in cells {
+        line(row);
     }
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
-struct Package {
-    #[serde(alias = "Name")]
+struct PypiResponse {
+    info: PypiInfo,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct PypiInfo {
     name: String,
-    #[serde(alias = "Version")]
     version: String,
-    #[serde(default, alias = "DownloadURL")]
-    download_url: String,
-    #[serde(default, alias = "Hash")]
-    hash: String,
+    #[serde(default)]
+    summary: String,
+    #[serde(default)]
+    home_page: String,
 }
 
-fn extract_zip_to_dir(zip_path: &Path, target_dir: &Path) -> Result<()> {
-    let file = File::open(zip_path).with_context(|| format!("failed to open {}", zip_path.display()))?;
-    let mut archive = ZipArchive::new(file).with_context(|| format!("failed to parse {}", zip_path.display()))?;
-    for index in 0..archive.len() {
-        let mut entry = archive.by_index(index).with_context(|| format!("failed to read entry {}", index))?;
-        let out_path = match entry.enclosed_name() {
-            Some(name) => target_dir.join(name),
-            None => continue,
-        };
-        if entry.name().ends_with('/') {
-            fs::create_dir_all(&out_path)
-                .with_context(|| format!("failed to create {}", out_path.display()))?;
-            continue;
-        }
-        if let Some(parent) = out_path.parent() {
-            fs::create_dir_all(parent)
-                .with_context(|| format!("failed to create {}", parent.display()))?;
-        }
-        let mut out = File::create(&out_path).with_context(|| format!("failed to create {}", out_path.display()))?;
-        io::copy(&mut entry, &mut out)
-            .with_context(|| format!("failed to write {}", out_path.display()))?;
-    }
-    Ok(())
+// PyPI metadata younger than this is used without asking PyPI again; older entries are
+// revalidated with their ETag / Last-Modified.
+const METADATA_FRESH: Duration = Duration::from_secs(600);
+
+// One PyPI JSON API response in the on-disk metadata cache (cas/metadata/<name>.json).
+#[derive(Serialize, Deserialize)]
+struct CachedMetadata {
+    fetched_at: u64,
+    #[serde(default)]
+    etag: Option<String>,
+    #[serde(default)]
+    last_modified: Option<String>,
+    response: PypiResponse,
 }
 
-fn patch_embeddable_pth(python_dir: &Path) -> Result<()> {
-    for entry in fs::read_dir(python_dir).with_context(|| format!("failed to read {}", python_dir.display()))? {
-        let entry = entry?;
-        let name = entry.file_name().to_string_lossy().to_string();
-        if !name.to_lowercase().ends_with("._pth") {
-            continue;
-        }
-        let path = entry.path();
-        let content = fs::read_to_string(&path).with_context(|| format!("failed to read {}", path.display()))?;
-        if content.contains("\nimport site") || content.starts_with("import site") {
-            continue;
+fn metadata_memo() -> &'static Mutex<HashMap<String, (Instant, PypiResponse)>> {
+    static MEMO: OnceLock<Mutex<HashMap<String, (Instant, PypiResponse)>>> = OnceLock::new();
+    MEMO.get_or_init(Default::default)
+}
+
+// Looks a package up in this process's memory, then the daemon, then the on-disk cache
+// under `cache_dir`, and only then PyPI. The daemon keeps the default cache, so it is
+// only asked when `cache_dir` is that one.
+fn fetch_metadata_from_pypi(pkg_name: &str, cache_dir: &Path) -> Result<PypiResponse> {
+    let name = normalize_dep_name(pkg_name);
+    if let Some((fetched, response)) = metadata_memo().lock().ok().and_then(|memo| memo.get(&name).cloned()) {
+        if fetched.elapsed() < METADATA_FRESH {
+            return Ok(response);
         }
-        let updated = if content.contains("#import site") {
-            content.replace("#import site", "import site")
-        } else {
-            format!("{content}\nimport site\n")
-        };
-        fs::write(&path, updated).with_context(|| format!("failed to write {}", path.display()))?;
     }
-    Ok(())
+    let from_daemon = (cache_dir == xe_cache_dir())
+        .then(|| daemon_request(&json!({"op": "metadata", "name": name})))
+        .flatten()
+        .and_then(|cached| serde_json::from_value(cached).ok());
+    let response = match from_daemon {
+        Some(response) => response,
+        None => fetch_metadata_cached(&name, cache_dir)?,
+    };
+    if let Ok(mut memo) = metadata_memo().lock() {
+        memo.insert(name, (Instant::now(), response.clone()));
+    }
+    Ok(response)
 }
 
-fn bootstrap_pip(python_exe: &Path) -> Result<()> {
-    info("Bootstrapping pip...");
-    let mut resp = Client::builder()
-        .timeout(Duration::from_secs(120))
+// PyPI metadata for many packages, in the order of `names`. Lookups wait on the network
+// rather than the CPU, so they run on a pool sized by http_concurrency and share the HTTP
+// client's connections instead of going one at a time.
+fn fetch_metadata_parallel(ctx: &AppContext, names: &[String], cache_dir: &Path) -> Result<Vec<Result<PypiResponse>>> {
+    let pool = rayon::ThreadPoolBuilder::new()
+        .num_threads(http_concurrency(ctx).min(names.len().max(1)))
         .build()
-        .context("failed to build HTTP client")?
-        .get("https://bootstrap.pypa.io/get-pip.py")
-        .send()
-        .context("failed to download get-pip.py")?;
-    if !resp.status().is_success() {
-        bail!("failed to download get-pip.py: {}", resp.status());
-    }
-    let script_path = python_exe
-        .parent()
-        .unwrap_or_else(|| Path::new("."))
-        .join("get-pip.py");
-    let mut script_file =
-        File::create(&script_path).with_context(|| format!("failed to create {}", script_path.display()))?;
-    io::copy(&mut resp, &mut script_file)
-        .with_context(|| format!("failed to write {}", script_path.display()))?;
-
-    let output = Command::new(python_exe)
-        .arg(&script_path)
-        .output()
-        .context("failed to bootstrap pip")?;
-    let _ = fs::remove_file(&script_path);
-    if !output.status.success() {
-        let stderr = String::from_utf8_lossy(&output.stderr);
-        let stdout = String::from_utf8_lossy(&output.stdout);
-        bail!("failed to bootstrap pip: {}\n{}{}", output.status, stdout, stderr);
-    }
-    Ok(())
+        .context("failed to start metadata pool")?;
+    Ok(pool.install(|| names.par_iter().map(|name| fetch_metadata_from_pypi(name, cache_dir)).collect()))
 }
 
-#[derive(Debug, Clone, Serialize, Deserialize)]
-struct SolveGraph {
-    #[serde(alias = "PythonVersion")]
-    python_version: String,
-    #[serde(default, alias = "Requirements")]
-    requirements: Vec<String>,
-    #[serde(default, alias = "Packages")]
-    packages: Vec<Package>,
+fn metadata_cache_len() -> usize {
+    metadata_memo().lock().map(|memo| memo.len()).unwrap_or(0)
 }
 
-struct Installer {
-    cas: Cas,
+// Serves fresh entries from cas/metadata without a request, revalidates stale ones and
+// falls back to the stale entry when PyPI cannot be reached, so `xe check` and
+// `xe upgrade` keep working offline for packages seen before.
+fn fetch_metadata_cached(name: &str, cache_dir: &Path) -> Result<PypiResponse> {
+    let path = cache_dir.join("cas").join("metadata").join(format!("{name}.json"));
+    let cached = fs::read(&path)
+        .ok()
+        .and_then(|bytes| serde_json::from_slice::<CachedMetadata>(&bytes).ok());
+    let now = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .unwrap_or_else(|_| Duration::from_secs(0))
+        .as_secs();
+    let age = |entry: &CachedMetadata| Duration::from_secs(now.saturating_sub(entry.fetched_at));
+    if let Some(entry) = cached.as_ref().filter(|entry| age(entry) < METADATA_FRESH) {
+        debug(&format!("Using cached PyPI metadata for {name}"));
+        return Ok(entry.response.clone());
+    }
+
+    let mut request = http_client()?
+        .get(format!("https://pypi.org/pypi/{name}/json"))
+        .timeout(Duration::from_secs(30));
+    if let Some(entry) = cached.as_ref() {
+        if let Some(etag) = entry.etag.as_deref() {
+            request = request.header(reqwest::header::IF_NONE_MATCH, etag);
+        }
+        if let Some(modified) = entry.last_modified.as_deref() {
+            request = request.header(reqwest::header::IF_MODIFIED_SINCE, modified);
+        }
+    }
+    let resp = match request.send() {
+        Ok(resp) if resp.status().is_server_error() => {
+            let status = resp.status();
+            let Some(entry) = cached else {
+                bail_kind!(ErrorKind::Network, "PyPI answered {status} for {name}; try again later");
+            };
+            debug(&format!("PyPI answered {status} for {name}"));
+            warning(&format!(
+                "PyPI is unavailable; using metadata for {name} cached {} ago",
+                human_duration(age(&entry))
+            ));
+            return Ok(entry.response);
+        }
+        Ok(resp) => resp,
+        Err(err) => {
+            let Some(entry) = cached else {
+                return Err(kind_error(ErrorKind::Network, format!("failed to request PyPI metadata: {err}")));
+            };
+            debug(&format!("PyPI request for {name} failed: {err}"));
+            warning(&format!(
+                "PyPI is unreachable; using metadata for {name} cached {} ago",
+                human_duration(age(&entry))
+            ));
+            return Ok(entry.response);
+        }
+    };
+    let header = |name: reqwest::header::HeaderName| {
+        resp.headers()
+            .get(name)
+            .and_then(|value| value.to_str().ok())
+            .map(str::to_string)
+    };
+    let etag = header(reqwest::header::ETAG);
+    let last_modified = header(reqwest::header::LAST_MODIFIED);
+    let entry = match cached {
+        Some(entry) if resp.status() == StatusCode::NOT_MODIFIED => {
+            debug(&format!("PyPI metadata for {name} is unchanged"));
+            CachedMetadata {
+                fetched_at: now,
+                etag: etag.or(entry.etag),
+                last_modified: last_modified.or(entry.last_modified),
+                response: entry.response,
+            }
+        }
+        _ if matches!(resp.status(), StatusCode::NOT_FOUND | StatusCode::GONE) => {
+            bail_kind!(ErrorKind::PackageNotFound, "package {} not found on PyPI", name);
+        }
+        _ if !resp.status().is_success() => {
+            bail!("PyPI answered {} for {name}", resp.status());
+        }
+        _ => CachedMetadata {
+            fetched_at: now,
+            etag,
+            last_modified,
+            response: resp.json::<PypiResponse>().context("failed to parse PyPI response")?,
+        },
+    };
+    if let Some(parent) = path.parent() {
+        if fs::create_dir_all(parent).is_ok() {
+            if let Err(err) = write_file_atomic(&path, &serde_json::to_vec(&entry)?) {
+                debug(&format!("could not cache PyPI metadata for {name}: {err:#}"));
+            }
+        }
+    }
+    Ok(entry.response)
 }
 
-impl Installer {
-    fn new(global_cache_dir: &Path) -> Result<Self> {
-        Ok(Self {
-            cas: Cas::new(global_cache_dir)?,
-        })
+// Normalized project name, [project].dependencies and [project].optional-dependencies
+// (extra name -> requirements) of a pyproject.toml.
+fn read_pyproject_requirements(path: &Path) -> Result<(String, Vec<String>, BTreeMap<String, Vec<String>>)> {
+    let text = fs::read_to_string(path).with_context(|| format!("failed to read {}", path.display()))?;
+    let doc: toml::Value = toml::from_str(&text).with_context(|| format!("failed to parse {}", path.display()))?;
+    let project = doc.get("project");
+    let strings = |value: Option<&toml::Value>| {
+        value
+            .and_then(toml::Value::as_array)
+            .into_iter()
+            .flatten()
+            .filter_map(toml::Value::as_str)
+            .map(str::to_string)
+            .collect::<Vec<_>>()
+    };
+    let name = project
+        .and_then(|p| p.get("name"))
+        .and_then(toml::Value::as_str)
+        .map(normalize_dep_name)
+        .unwrap_or_default();
+    let deps = strings(project.and_then(|p| p.get("dependencies")));
+    let extras = project
+        .and_then(|p| p.get("optional-dependencies"))
+        .and_then(toml::Value::as_table)
+        .into_iter()
+        .flatten()
+        .map(|(extra, reqs)| (normalize_dep_name(extra), strings(Some(reqs))))
+        .collect();
+    if project.and_then(|p| p.get("dynamic")).is_some_and(|d| {
+        strings(Some(d)).iter().any(|f| f == "dependencies" || f == "optional-dependencies")
+    }) {
+        warning(&format!(
+            "{} declares dynamic dependencies; only static ones are imported",
+            path.display()
+        ));
     }
+    Ok((name, deps, extras))
+}
 
-    fn install(
-        &self,
-        ctx: &AppContext,
-        cfg: &Config,
-        requirements: &[String],
-        project_dir: &Path,
-        install_site_packages: &Path,
-        python_exe: &Path,
-    ) -> Result<Vec<Package>> {
-        let _span = span(
-            ctx,
-            "install.total",
-            json!({"python_version": cfg.python.version, "raw_requirements": requirements.len()}),
-        );
-        let reqs = normalize_requirements(requirements);
-        if reqs.is_empty() {
-            return Ok(Vec::new());
+// The same for setup.cfg: [metadata] name, [options] install_requires and
+// [options.extras_require]. Values are multi-line lists or `file:` references.
+fn read_setup_cfg_requirements(path: &Path) -> Result<(String, Vec<String>, BTreeMap<String, Vec<String>>)> {
+    let text = fs::read_to_string(path).with_context(|| format!("failed to read {}", path.display()))?;
+    let mut values: BTreeMap<(String, String), String> = BTreeMap::new();
+    let mut section = String::new();
+    let mut key: Option<String> = None;
+    for line in text.lines() {
+        let trimmed = line.trim();
+        if trimmed.is_empty() || trimmed.starts_with('#') || trimmed.starts_with(';') {
+            continue;
+        }
+        if line.starts_with(char::is_whitespace) {
+            if let Some(key) = &key {
+                let value = values.entry((section.clone(), key.clone())).or_default();
+                value.push('\n');
+                value.push_str(trimmed);
+            }
+            continue;
+        }
+        if let Some(name) = trimmed.strip_prefix('[').and_then(|s| s.strip_suffix(']')) {
+            section = name.trim().to_string();
+            key = None;
+            continue;
+        }
+        if let Some((k, v)) = trimmed.split_once(['=', ':']) {
+            let k = k.trim().to_string();
+            values.insert((section.clone(), k.clone()), v.trim().to_string());
+            key = Some(k);
+        }
+    }
+    let base = path.parent().unwrap_or_else(|| Path::new("."));
+    let requirements = |value: &str| -> Result<Vec<String>> {
+        if let Some(files) = value.trim().strip_prefix("file:") {
+            let mut out = Vec::new();
+            for file in files.split(',').map(str::trim).filter(|f| !f.is_empty()) {
+                out.extend(parse_requirements(&base.join(file))?);
+            }
+            return Ok(out);
+        }
+        Ok(value
+            .lines()
+            .map(|l| l.split(" #").next().unwrap_or_default().trim())
+            .filter(|l| !l.is_empty())
+            .map(str::to_string)
+            .collect())
+    };
+    let name = values
+        .get(&("metadata".to_string(), "name".to_string()))
+        .map(|n| normalize_dep_name(n))
+        .unwrap_or_default();
+    let deps = match values.get(&("options".to_string(), "install_requires".to_string())) {
+        Some(value) => requirements(value)?,
+        None => Vec::new(),
+    };
+    let mut extras = BTreeMap::new();
+    for ((sec, extra), value) in &values {
+        if sec == "options.extras_require" {
+            extras.insert(normalize_dep_name(extra), requirements(value)?);
         }
+    }
+    Ok((name, deps, extras))
+}
 
-        let cache_key = solve_key(&cfg.python.version, &reqs);
-        let mut graph = if let Some(cached) = self.cas.load_solution::<SolveGraph>(&cache_key)? {
-            cached
-        } else {
-            let solved = reqs
-                .par_iter()
-                .map(|req| resolve_requirement(req, python_exe))
-                .collect::<Result<Vec<Vec<Package>>>>()?
-                .into_iter()
-                .flatten()
-                .collect::<Vec<_>>();
+// Reads a pip requirements file. Backslash continuations are joined and nested `-r`
+// files are followed relative to the file naming them; constraint files are refused
+// because xe has nowhere to apply them. Other pip options are skipped.
+fn parse_requirements(path: &Path) -> Result<Vec<String>> {
+    let mut reqs = Vec::new();
+    read_requirements_file(path, &mut Vec::new(), &mut reqs)?;
+    Ok(reqs)
+}
 
-            let solved = dedupe_packages(solved);
-            let graph = SolveGraph {
-                python_version: cfg.python.version.clone(),
-                requirements: reqs.clone(),
-                packages: solved,
-            };
-            self.cas.save_solution(&cache_key, &graph)?;
-            graph
+fn read_requirements_file(path: &Path, stack: &mut Vec<PathBuf>, reqs: &mut Vec<String>) -> Result<()> {
+    let text = fs::read_to_string(path).with_context(|| format!("failed to open {}", path.display()))?;
+    let canonical = fs::canonicalize(path).unwrap_or_else(|_| path.to_path_buf());
+    if stack.contains(&canonical) {
+        bail_kind!(ErrorKind::Config, "{} includes itself", path.display());
+    }
+    stack.push(canonical);
+    let base = path.parent().unwrap_or_else(|| Path::new("."));
+    let mut pending = String::new();
+    for raw in text.lines() {
+        let raw = match raw.find(" #") {
+            Some(idx) => &raw[..idx],
+            None if raw.trim_start().starts_with('#') => "",
+            None => raw,
         };
+        if let Some(head) = raw.trim_end().strip_suffix('\\') {
+            pending.push_str(head);
+            pending.push(' ');
+            continue;
+        }
+        pending.push_str(raw);
+        let line = std::mem::take(&mut pending);
+        let line = line.trim();
+        if line.is_empty() {
+            continue;
+        }
+        let option_value = |names: &[&str]| {
+            names.iter().find_map(|name| {
+                let rest = line.strip_prefix(name)?;
+                let rest = rest.strip_prefix('=').or_else(|| rest.strip_prefix(' '))?;
+                Some(rest.trim().to_string())
+            })
+        };
+        if let Some(file) = option_value(&["-r", "--requirement"]) {
+            read_requirements_file(&base.join(file), stack, reqs)?;
+            continue;
+        }
+        if option_value(&["-c", "--constraint"]).is_some() {
+            bail_kind!(
+                ErrorKind::Config,
+                "{}: constraint files are not supported; pin the versions in xe.toml instead",
+                path.display()
+            );
+        }
+        if line.starts_with('-') {
+            continue;
+        }
+        // Per-requirement options such as `--hash=...` follow the requirement itself.
+        let req = line.split(" --").next().unwrap_or(line).trim();
+        if !req.is_empty() {
+            reqs.push(req.to_string());
+        }
+    }
+    stack.pop();
+    Ok(())
+}
 
-        let mut download_plan = graph.packages.clone();
-        download_plan.sort_by(|a, b| a.name.cmp(&b.name));
-
-        let target_site_packages = if install_site_packages.as_os_str().is_empty() {
-            project_dir.join("xe").join("site-packages")
-        } else {
-            install_site_packages.to_path_buf()
-        };
-        fs::create_dir_all(&target_site_packages)
-            .with_context(|| format!("failed to create {}", target_site_packages.display()))?;
+fn create_snapshot(name: &str) -> Result<PathBuf> {
+    create_snapshot_in(&xe_home(), name)
+}
 
-        let installed_set = Arc::new(Mutex::new(installed_package_key_set(&target_site_packages)?));
-        download_plan.par_iter().try_for_each(|pkg| -> Result<()> {
-            let key = package_identity_key(&pkg.name, &pkg.version);
-            {
-                let guard = installed_set.lock().map_err(|_| anyhow!("install state poisoned"))?;
-                if guard.contains(&key) {
-                    return Ok(());
-                }
-            }
-            if pkg.download_url.trim().is_empty() {
-                return Ok(());
-            }
+fn create_snapshot_in(xe_dir: &Path, name: &str) -> Result<PathBuf> {
+    if name.is_empty() || name.contains(['/', '\\']) || name.starts_with('.') {
+        bail_kind!(ErrorKind::Usage, "invalid snapshot name '{name}'");
+    }
+    let snaps_dir = xe_dir.join("snaps");
+    fs::create_dir_all(&snaps_dir).with_context(|| format!("failed to create {}", snaps_dir.display()))?;
+    let ts = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .unwrap_or_else(|_| Duration::from_secs(0))
+        .as_secs();
+    let snap_path = snaps_dir.join(format!("{name}_{ts}.zip"));
+    zip_directory(xe_dir, &snap_path, &["snaps"])?;
+    Ok(snap_path)
+}
 
-            let blob = self
-                .cas
-                .store_blob_from_url(&pkg.download_url, pkg.hash.as_str())?;
-            install_wheel_blob(&blob, &target_site_packages)?;
-            {
-                let mut guard = installed_set.lock().map_err(|_| anyhow!("install state poisoned"))?;
-                guard.insert(key);
-            }
-            Ok(())
-        })?;
+// A snapshot archive in `snaps/`, named `<name>_<unix seconds>.zip`.
+struct SnapshotFile {
+    name: String,
+    path: PathBuf,
+    created: u64,
+    size_bytes: u64,
+}
 
-        graph.packages.sort_by(|a, b| a.name.cmp(&b.name));
-        Ok(graph.packages)
+fn list_snapshots() -> Result<Vec<SnapshotFile>> {
+    let snaps_dir = xe_home().join("snaps");
+    let Ok(entries) = fs::read_dir(&snaps_dir) else {
+        return Ok(Vec::new());
+    };
+    let mut snapshots = Vec::new();
+    for entry in entries {
+        let entry = entry?;
+        let path = entry.path();
+        let file_name = entry.file_name().to_string_lossy().to_string();
+        let Some(stem) = file_name.strip_suffix(".zip") else {
+            continue;
+        };
+        let Some((name, ts)) = stem.rsplit_once('_') else {
+            continue;
+        };
+        let Ok(created) = ts.parse::<u64>() else {
+            continue;
+        };
+        let size_bytes = entry.metadata().map(|m| m.len()).unwrap_or(0);
+        snapshots.push(SnapshotFile {
+            name: name.to_string(),
+            path,
+            created,
+            size_bytes,
+        });
     }
+    snapshots.sort_by(|a, b| a.created.cmp(&b.created).then_with(|| a.name.cmp(&b.name)));
+    Ok(snapshots)
 }
 
-fn normalize_requirements(reqs: &[String]) -> Vec<String> {
-    let mut out = reqs
-        .iter()
-        .map(|r| r.trim().to_string())
-        .filter(|r| !r.is_empty())
+// Snapshots for `name`, oldest first. A full `<name>_<ts>` stem selects one archive.
+fn matching_snapshots(name: &str) -> Result<Vec<SnapshotFile>> {
+    let matches = list_snapshots()?
+        .into_iter()
+        .filter(|snap| {
+            snap.name == name || snap.path.file_stem().is_some_and(|stem| stem.to_string_lossy() == name)
+        })
         .collect::<Vec<_>>();
-    out.sort();
-    out
+    if matches.is_empty() {
+        bail_kind!(
+            ErrorKind::Usage,
+            "snapshot '{name}' not found (see `xe snapshot list`)"
+        );
+    }
+    Ok(matches)
 }
 
-fn solve_key(python_version: &str, reqs: &[String]) -> String {
-    let mut hasher = Sha1::new();
-    hasher.update(python_version.as_bytes());
-    hasher.update(b"|");
-    for req in reqs {
-        hasher.update(req.as_bytes());
-        hasher.update(b"|");
+fn snapshot_date(created: u64) -> String {
+    match OffsetDateTime::from_unix_timestamp(created as i64) {
+        Ok(dt) => format!("{} {:02}:{:02}:{:02}", dt.date(), dt.hour(), dt.minute(), dt.second()),
+        Err(_) => created.to_string(),
     }
-    hex::encode(hasher.finalize())
 }
 
-fn dedupe_packages(pkgs: Vec<Package>) -> Vec<Package> {
-    let mut seen = BTreeMap::new();
-    for pkg in pkgs {
-        let key = format!("{}=={}", pkg.name.to_lowercase(), pkg.version);
-        seen.insert(key, pkg);
+fn print_snapshot_table(snapshots: &[SnapshotFile]) {
+    let width = snapshots.iter().map(|s| s.name.len()).max().unwrap_or(0).max("Name".len());
+    println!("{:<width$}  {:<19}  {:>10}", "Name", "Created (UTC)", "Size");
+    for snap in snapshots {
+        println!(
+            "{:<width$}  {:<19}  {:>10}",
+            snap.name,
+            snapshot_date(snap.created),
+            human_bytes(snap.size_bytes)
+        );
     }
-    seen.into_values().collect()
 }
 
-fn normalize_package_identity(name: &str) -> String {
-    name.trim()
-        .to_lowercase()
-        .replace('-', "_")
-        .replace('.', "_")
+// Restores the newest snapshot matching `name` over the xe home. The archive is unpacked
+// into a staging directory first, so a corrupt archive leaves the current state alone,
+// and the current state is saved as a `pre-restore` snapshot before it is replaced.
+fn restore_snapshot(name: &str) -> Result<(SnapshotFile, PathBuf)> {
+    let snapshot = matching_snapshots(name)?
+        .pop()
+        .expect("matching_snapshots returns at least one snapshot");
+    let backup = restore_snapshot_into(&xe_home(), &snapshot.path)?;
+    Ok((snapshot, backup))
 }
 
-fn package_identity_key(name: &str, version: &str) -> String {
-    format!("{}=={}", normalize_package_identity(name), version.trim())
+// Replaces everything in `xe_dir` but `snaps/` with the contents of `archive` and returns
+// the `pre-restore` backup.
+fn restore_snapshot_into(xe_dir: &Path, archive: &Path) -> Result<PathBuf> {
+    let staging = xe_dir.join("snaps").join(format!(".restore-{}", std::process::id()));
+    if staging.exists() {
+        fs::remove_dir_all(&staging).with_context(|| format!("failed to remove {}", staging.display()))?;
+    }
+    if let Err(err) = extract_snapshot(archive, &staging) {
+        let _ = fs::remove_dir_all(&staging);
+        return Err(err.context(format!("snapshot {} is unreadable", archive.display())));
+    }
+
+    let backup = create_snapshot_in(xe_dir, "pre-restore")?;
+    if let Err(err) = swap_in_snapshot(xe_dir, &staging, &backup) {
+        let _ = fs::remove_dir_all(&staging);
+        return Err(err);
+    }
+    fs::remove_dir_all(&staging).with_context(|| format!("failed to remove {}", staging.display()))?;
+    Ok(backup)
 }
 
-fn installed_package_key_set(site_packages: &Path) -> Result<HashSet<String>> {
-    let mut out = HashSet::new();
-    if !site_packages.exists() {
-        return Ok(out);
+// Replaces the xe home with the unpacked snapshot in `staging`. A failure part way leaves
+// the home half replaced, so the `backup` taken just before is unpacked back over it.
+fn swap_in_snapshot(xe_dir: &Path, staging: &Path, backup: &Path) -> Result<()> {
+    let swapped = clear_xe_home(xe_dir).and_then(|()| {
+        for entry in fs::read_dir(staging).with_context(|| format!("failed to read {}", staging.display()))? {
+            let entry = entry?;
+            if entry.file_name() == "snaps" {
+                continue;
+            }
+            let target = xe_dir.join(entry.file_name());
+            fs::rename(entry.path(), &target)
+                .with_context(|| format!("failed to restore {}", target.display()))?;
+        }
+        Ok(())
+    });
+    let Err(err) = swapped else {
+        return Ok(());
+    };
+    let stem = backup.file_stem().unwrap_or_default().to_string_lossy();
+    match clear_xe_home(xe_dir).and_then(|()| extract_snapshot(backup, xe_dir)) {
+        Ok(()) => Err(err.context(format!("restore failed; the previous state was put back from {stem}"))),
+        Err(rollback) => Err(err.context(format!(
+            "restore failed and putting the previous state back failed too ({rollback:#}); run `xe restore {stem}` to recover"
+        ))),
     }
-    for entry in fs::read_dir(site_packages)
-        .with_context(|| format!("failed to read {}", site_packages.display()))?
-    {
+}
+
+// Removes everything in the xe home except the snapshots.
+fn clear_xe_home(xe_dir: &Path) -> Result<()> {
+    for entry in fs::read_dir(xe_dir).with_context(|| format!("failed to read {}", xe_dir.display()))? {
         let entry = entry?;
-        if !entry.file_type()?.is_dir() {
-            continue;
-        }
-        let name = entry.file_name().to_string_lossy().to_string();
-        if !name.to_lowercase().ends_with(".dist-info") {
+        if entry.file_name() == "snaps" {
             continue;
         }
-        let base = name.trim_end_matches(".dist-info");
-        if let Some(idx) = base.rfind('-') {
-            if idx > 0 && idx + 1 < base.len() {
-                let key = package_identity_key(&base[..idx], &base[idx + 1..]);
-                out.insert(key);
-            }
-        }
+        let path = entry.path();
+        let removed = if entry.file_type()?.is_dir() {
+            fs::remove_dir_all(&path)
+        } else {
+            fs::remove_file(&path)
+        };
+        removed.with_context(|| format!("failed to remove {}", path.display()))?;
     }
-    Ok(out)
+    Ok(())
 }
 
-fn install_wheel_blob(blob_path: &Path, site_packages: &Path) -> Result<()> {
-    fs::create_dir_all(site_packages)
-        .with_context(|| format!("failed to create {}", site_packages.display()))?;
-    let file = File::open(blob_path).with_context(|| format!("failed to open {}", blob_path.display()))?;
-    let mut archive = ZipArchive::new(file).with_context(|| format!("failed to parse {}", blob_path.display()))?;
+// Unpacks a snapshot made by zip_directory. Unlike extract_zip_to_dir it restores the
+// recorded unix permissions, so runtime and venv executables stay executable, and
+// recreates symlinks, which are made last so no entry is written through one.
+fn extract_snapshot(zip_path: &Path, target_dir: &Path) -> Result<()> {
+    let file = File::open(zip_path).with_context(|| format!("failed to open {}", zip_path.display()))?;
+    let mut archive = ZipArchive::new(file).with_context(|| format!("failed to parse {}", zip_path.display()))?;
+    let mut links = Vec::new();
     for index in 0..archive.len() {
         let mut entry = archive.by_index(index).with_context(|| format!("failed to read entry {}", index))?;
-        let enclosed = entry
-            .enclosed_name()
-            .ok_or_else(|| anyhow!("unsafe wheel entry path: {}", entry.name()))?
-            .to_path_buf();
-        let out_path = site_packages.join(enclosed);
+        let out_path = match entry.enclosed_name() {
+            Some(name) => target_dir.join(name),
+            None => continue,
+        };
+        let mode = entry.unix_mode();
         if entry.name().ends_with('/') {
-            fs::create_dir_all(&out_path).with_context(|| format!("failed to create {}", out_path.display()))?;
+            fs::create_dir_all(&out_path)
+                .with_context(|| format!("failed to create {}", out_path.display()))?;
             continue;
         }
         if let Some(parent) = out_path.parent() {
             fs::create_dir_all(parent)
                 .with_context(|| format!("failed to create {}", parent.display()))?;
         }
-        let mut out_file =
-            File::create(&out_path).with_context(|| format!("failed to create {}", out_path.display()))?;
-        io::copy(&mut entry, &mut out_file)
+        if mode.is_some_and(|mode| mode & 0o170000 == 0o120000) {
+            let mut link_target = String::new();
+            entry
+                .read_to_string(&mut link_target)
+                .with_context(|| format!("failed to read link {}", entry.name()))?;
+            links.push((out_path, link_target));
+            continue;
+        }
+        let mut out = File::create(&out_path).with_context(|| format!("failed to create {}", out_path.display()))?;
+        io::copy(&mut entry, &mut out)
             .with_context(|| format!("failed to write {}", out_path.display()))?;
+        #[cfg(unix)]
+        if let Some(mode) = mode {
+            use std::os::unix::fs::PermissionsExt;
+            fs::set_permissions(&out_path, fs::Permissions::from_mode(mode & 0o7777))
+                .with_context(|| format!("failed to set permissions on {}", out_path.display()))?;
+        }
+    }
+    for (path, link_target) in links {
+        #[cfg(unix)]
+        std::os::unix::fs::symlink(&link_target, &path)
+            .with_context(|| format!("failed to link {} -> {link_target}", path.display()))?;
+        #[cfg(not(unix))]
+        warning(&format!("skipped symlink {} -> {link_target}", path.display()));
     }
     Ok(())
 }
 
-#[derive(Debug, Deserialize)]
-struct PipReport {
-    #[serde(default)]
-    install: Vec<PipInstallItem>,
-}
+// Archives `source` for a snapshot, keeping unix permissions and storing symlinks as
+// links rather than following them. `exclude` names top-level entries to leave out.
+fn zip_directory(source: &Path, target: &Path, exclude: &[&str]) -> Result<()> {
+    let file = File::create(target).with_context(|| format!("failed to create {}", target.display()))?;
+    let mut writer = ZipWriter::new(file);
+    let options = FileOptions::default().compression_method(zip::CompressionMethod::Deflated);
 
-#[derive(Debug, Deserialize)]
-struct PipInstallItem {
-    metadata: PipMetadata,
-    #[serde(default)]
-    download_info: PipDownloadInfo,
+    for entry in WalkDir::new(source) {
+        let entry = entry?;
+        let path = entry.path();
+        if path == source {
+            continue;
+        }
+        let rel = path
+            .strip_prefix(source)
+            .with_context(|| format!("failed to strip prefix for {}", path.display()))?;
+        let excluded = rel.components().next().is_some_and(|first| {
+            exclude.iter().any(|name| first == std::path::Component::Normal(name.as_ref()))
+        });
+        if excluded {
+            continue;
+        }
+        let rel_str = rel.to_string_lossy().replace('\\', "/");
+
+        #[cfg(unix)]
+        let options = {
+            use std::os::unix::fs::PermissionsExt;
+            let mode = entry.metadata()?.permissions().mode();
+            options.unix_permissions(mode & 0o7777)
+        };
+        if entry.file_type().is_symlink() {
+            let link_target = fs::read_link(path).with_context(|| format!("failed to read link {}", path.display()))?;
+            writer
+                .add_symlink(rel_str.clone(), link_target.to_string_lossy(), options)
+                .with_context(|| format!("failed to add link {}", rel_str))?;
+            continue;
+        }
+        if entry.file_type().is_dir() {
+            writer
+                .add_directory(format!("{rel_str}/"), options)
+                .with_context(|| format!("failed to add dir {}", rel_str))?;
+            continue;
+        }
+        writer
+            .start_file(rel_str.clone(), options)
+            .with_context(|| format!("failed to add file {}", rel_str))?;
+        let mut input = File::open(path).with_context(|| format!("failed to open {}", path.display()))?;
+        io::copy(&mut input, &mut writer).with_context(|| format!("failed to write {}", rel_str))?;
+    }
+    writer.finish().context("failed to finalize snapshot zip")?;
+    Ok(())
 }
 
-#[derive(Debug, Deserialize)]
-struct PipMetadata {
-    name: String,
-    version: String,
+fn remove_path(path: &Path, description: &str) -> Result<()> {
+    if path.exists() {
+        info(&format!("Removing {} at {}...", description, path.display()));
+        if path.is_dir() {
+            fs::remove_dir_all(path).with_context(|| format!("failed to remove {}", path.display()))?;
+        } else {
+            fs::remove_file(path).with_context(|| format!("failed to remove {}", path.display()))?;
+        }
+    }
+    Ok(())
 }
 
-#[derive(Debug, Deserialize, Default)]
-struct PipDownloadInfo {
-    #[serde(default)]
-    url: String,
-    #[serde(default)]
-    archive_info: PipArchiveInfo,
+fn read_stdin_line() -> Result<String> {
+    let mut line = String::new();
+    io::stdin().read_line(&mut line)?;
+    Ok(line)
 }
 
-#[derive(Debug, Deserialize, Default)]
-struct PipArchiveInfo {
-    #[serde(default)]
-    hashes: HashMap<String, String>,
+static ASSUME_YES: AtomicBool = AtomicBool::new(false);
+static NON_INTERACTIVE: AtomicBool = AtomicBool::new(false);
+
+// CI systems set CI=true; prompting there would hang the job. A prompt also needs a
+// terminal to answer it, so piped or redirected stdin counts as non-interactive.
+fn is_interactive() -> bool {
+    if NON_INTERACTIVE.load(AtomicOrdering::Relaxed) || !io::stdin().is_terminal() {
+        return false;
+    }
+    let ci = env::var("CI").unwrap_or_default().to_lowercase();
+    !(ci == "true" || ci == "1")
 }
 
-fn resolve_requirement(requirement: &str, python_exe: &Path) -> Result<Vec<Package>> {
-    let report_file = tempfile_path("xe-report", "json");
-    let output = Command::new(python_exe)
-        .arg("-m")
-        .arg("pip")
-        .arg("install")
-        .arg(requirement)
-        .arg("--dry-run")
-        .arg("--report")
-        .arg(&report_file)
-        .output()
-        .with_context(|| format!("dependency resolution failed for {requirement}"))?;
-    if !output.status.success() {
-        let stderr = String::from_utf8_lossy(&output.stderr);
-        let stdout = String::from_utf8_lossy(&output.stdout);
-        bail!(
-            "dependency resolution failed for {}: {}\n{}{}",
-            requirement,
-            output.status,
-            stdout,
-            stderr
+// Yes/no prompt. --yes answers yes; without a terminal the default is taken when it is
+// "yes", otherwise the command fails instead of silently proceeding.
+fn confirm(question: &str, default: bool) -> Result<bool> {
+    if ASSUME_YES.load(AtomicOrdering::Relaxed) {
+        return Ok(true);
+    }
+    if !is_interactive() {
+        if default {
+            return Ok(true);
+        }
+        bail_kind!(
+            ErrorKind::Usage,
+            "\"{}\" needs an answer but xe is running non-interactively; re-run with --yes to proceed",
+            question
         );
     }
-    let report_data = fs::read(&report_file)
-        .with_context(|| format!("failed to read pip report {}", report_file.display()))?;
-    let _ = fs::remove_file(&report_file);
-    let sanitized = sanitize_json(&report_data);
-    let report: PipReport = serde_json::from_slice(&sanitized)
-        .with_context(|| format!("failed to parse pip report for {}", requirement))?;
-    let mut packages = Vec::with_capacity(report.install.len());
-    for item in report.install {
-        let hash = item
-            .download_info
-            .archive_info
-            .hashes
-            .get("sha256")
-            .cloned()
-            .unwrap_or_default();
-        packages.push(Package {
-            name: item.metadata.name,
-            version: item.metadata.version,
-            download_url: item.download_info.url,
-            hash,
-        });
+    print!("{question} ({}): ", if default { "Y/n" } else { "y/N" });
+    io::stdout().flush().ok();
+    let answer = read_stdin_line()?.trim().to_lowercase();
+    if answer.is_empty() {
+        return Ok(default);
+    }
+    Ok(answer == "y" || answer == "yes")
+}
+
+// Asks for a selection out of `count` numbered items ("1,3", "2-4", "all" or empty for none).
+// Returns zero-based indices. --yes selects everything.
+fn select_many(what: &str, count: usize, non_interactive_hint: &str) -> Result<Vec<usize>> {
+    if ASSUME_YES.load(AtomicOrdering::Relaxed) {
+        return Ok((0..count).collect());
+    }
+    loop {
+        let answer = prompt_line(
+            &format!("{what} (e.g. 1,3-4, all; empty for none)"),
+            non_interactive_hint,
+        )?;
+        match parse_selection(&answer, count) {
+            Ok(picked) => return Ok(picked),
+            Err(err) => warning(&err.to_string()),
+        }
     }
-    Ok(packages)
 }
 
-fn sanitize_json(data: &[u8]) -> Vec<u8> {
-    let trimmed = trim_json_start(data);
-    if trimmed.is_empty() {
-        return data.to_vec();
+fn parse_selection(answer: &str, count: usize) -> Result<Vec<usize>> {
+    let answer = answer.trim();
+    if answer.eq_ignore_ascii_case("all") || answer == "*" {
+        return Ok((0..count).collect());
     }
-    let mut de = serde_json::Deserializer::from_slice(trimmed);
-    match Value::deserialize(&mut de) {
-        Ok(value) => serde_json::to_vec(&value).unwrap_or_else(|_| trimmed.to_vec()),
-        Err(_) => trimmed.to_vec(),
+    let mut picked = Vec::new();
+    for part in answer.split(|c: char| c == ',' || c.is_whitespace()) {
+        if part.is_empty() {
+            continue;
+        }
+        let (start, end) = part.split_once('-').unwrap_or((part, part));
+        let parse = |n: &str| -> Result<usize> {
+            match n.trim().parse::<usize>() {
+                Ok(n) if (1..=count).contains(&n) => Ok(n - 1),
+                _ => bail!("invalid selection \"{part}\"; pick numbers between 1 and {count}"),
+            }
+        };
+        for idx in parse(start)?..=parse(end)? {
+            if !picked.contains(&idx) {
+                picked.push(idx);
+            }
+        }
     }
+    picked.sort_unstable();
+    Ok(picked)
 }
 
-fn trim_json_start(data: &[u8]) -> &[u8] {
-    match data.iter().position(|b| *b == b'{' || *b == b'[') {
-        Some(idx) => &data[idx..],
-        None => data,
+fn prompt_line(what: &str, non_interactive_hint: &str) -> Result<String> {
+    if !is_interactive() {
+        bail_kind!(
+            ErrorKind::Usage,
+            "{} is required but xe is running non-interactively; {}",
+            what,
+            non_interactive_hint
+        );
     }
+    print!("Enter {what}: ");
+    io::stdout().flush().ok();
+    Ok(read_stdin_line()?.trim().to_string())
 }
 
-struct Cas {
-    root: PathBuf,
+fn tokens_dir() -> PathBuf {
+    xe_home().join("tokens")
 }
 
-impl Cas {
-    fn new(root: &Path) -> Result<Self> {
-        let cas = Self {
-            root: root.to_path_buf(),
-        };
-        fs::create_dir_all(cas.blob_dir()).with_context(|| "failed to create CAS blob dir")?;
-        fs::create_dir_all(cas.solution_dir())
-            .with_context(|| "failed to create CAS solution dir")?;
-        Ok(cas)
+fn token_file_stem(repository: &str) -> String {
+    repository
+        .chars()
+        .map(|c| if c.is_ascii_alphanumeric() || c == '-' || c == '_' || c == '.' { c } else { '_' })
+        .collect()
+}
+
+// Plaintext token files written by earlier versions: tokens/<repo> and, for PyPI, the
+// single `credentials` file. They are read as a last resort and removed on save/revoke.
+fn legacy_token_paths(repository: &str) -> Vec<PathBuf> {
+    let mut paths = vec![tokens_dir().join(token_file_stem(repository))];
+    if repository == "pypi" {
+        paths.push(xe_home().join("credentials"));
     }
+    paths
+}
 
-    fn store_blob_from_url(&self, url: &str, expected_sha256: &str) -> Result<PathBuf> {
-        if !expected_sha256.trim().is_empty() {
-            let target = self.blob_path(expected_sha256);
-            if target.exists() {
-                return Ok(target);
-            }
-        }
+// Publishing token storage. Each repository's token is stored under its own account.
+trait TokenStore {
+    fn name(&self) -> String;
+    fn get(&self, account: &str) -> Result<Option<String>>;
+    fn set(&self, account: &str, token: &str) -> Result<()>;
+    fn delete(&self, account: &str) -> Result<()>;
+}
 
-        let client = Client::builder()
-            .timeout(Duration::from_secs(120))
-            .build()
-            .context("failed to build HTTP client")?;
-        let mut resp = client
-            .get(url)
-            .send()
-            .with_context(|| format!("failed to download {}", url))?;
-        if !resp.status().is_success() {
-            bail!("download failed: {}", resp.status());
-        }
+const TOKEN_SERVICE: &str = "xe";
 
-        fs::create_dir_all(&self.root).with_context(|| format!("failed to create {}", self.root.display()))?;
-        let tmp_path = tempfile_path_in(&self.root, "xe-download", "tmp");
-        let mut tmp_file = File::create(&tmp_path)
-            .with_context(|| format!("failed to create {}", tmp_path.display()))?;
-        let mut hasher = Sha256::new();
-        let mut buffer = [0u8; 64 * 1024];
-        loop {
-            let read = resp.read(&mut buffer).context("failed while downloading blob")?;
-            if read == 0 {
-                break;
-            }
-            hasher.update(&buffer[..read]);
-            tmp_file
-                .write_all(&buffer[..read])
-                .with_context(|| format!("failed to write {}", tmp_path.display()))?;
-        }
-        tmp_file.flush().ok();
-        let actual = hex::encode(hasher.finalize());
+// The platform keychain when one is usable, otherwise None (callers use the file store).
+// XE_TOKEN_STORE=file forces the encrypted file store.
+fn platform_token_store() -> Option<Box<dyn TokenStore>> {
+    if env::var("XE_TOKEN_STORE").map(|v| v == "file").unwrap_or(false) {
+        return None;
+    }
+    if cfg!(target_os = "macos") && command_exists("security") {
+        return Some(Box::new(KeychainStore));
+    }
+    if cfg!(target_os = "linux")
+        && env::var_os("DBUS_SESSION_BUS_ADDRESS").is_some()
+        && command_exists("secret-tool")
+    {
+        return Some(Box::new(SecretServiceStore));
+    }
+    None
+}
 
-        if !expected_sha256.trim().is_empty() && !expected_sha256.eq_ignore_ascii_case(&actual) {
-            let _ = fs::remove_file(&tmp_path);
-            bail!(
-                "checksum mismatch: expected={} actual={}",
-                expected_sha256,
-                actual
-            );
-        }
+fn command_exists(program: &str) -> bool {
+    env::var_os("PATH")
+        .map(|paths| {
+            env::split_paths(&paths).any(|dir| {
+                dir.join(program).is_file() || dir.join(format!("{program}.exe")).is_file()
+            })
+        })
+        .unwrap_or(false)
+}
 
-        let target = self.blob_path(&actual);
-        if target.exists() {
-            let _ = fs::remove_file(&tmp_path);
-            return Ok(target);
-        }
-        if let Some(parent) = target.parent() {
-            fs::create_dir_all(parent).with_context(|| format!("failed to create {}", parent.display()))?;
+// macOS login keychain through the `security` tool.
+struct KeychainStore;
+
+impl TokenStore for KeychainStore {
+    fn name(&self) -> String {
+        "the macOS Keychain".to_string()
+    }
+
+    fn get(&self, account: &str) -> Result<Option<String>> {
+        let output = Command::new("security")
+            .args(["find-generic-password", "-s", TOKEN_SERVICE, "-a", account, "-w"])
+            .stderr(Stdio::null())
+            .output()
+            .context("failed to run security")?;
+        // 44 is errSecItemNotFound.
+        if output.status.code() == Some(44) {
+            return Ok(None);
         }
-        match fs::rename(&tmp_path, &target) {
-            Ok(_) => {}
-            Err(_) => {
-                fs::copy(&tmp_path, &target)
-                    .with_context(|| format!("failed to store blob at {}", target.display()))?;
-                let _ = fs::remove_file(&tmp_path);
-            }
+        if !output.status.success() {
+            bail!("security find-generic-password failed: {}", output.status);
         }
-        Ok(target)
+        Ok(Some(String::from_utf8_lossy(&output.stdout).trim().to_string()))
     }
 
-    fn save_solution<T: Serialize>(&self, key: &str, value: &T) -> Result<()> {
-        let path = self.solution_dir().join(format!("{key}.json"));
-        if let Some(parent) = path.parent() {
-            fs::create_dir_all(parent).with_context(|| format!("failed to create {}", parent.display()))?;
+    // With `-w` last, security prompts for the password and reads it (twice) from stdin,
+    // so the token never shows up in the process list.
+    fn set(&self, account: &str, token: &str) -> Result<()> {
+        let mut child = Command::new("security")
+            .args(["add-generic-password", "-U", "-s", TOKEN_SERVICE, "-a", account, "-w"])
+            .stdin(Stdio::piped())
+            .stdout(Stdio::null())
+            .stderr(Stdio::null())
+            .spawn()
+            .context("failed to run security")?;
+        if let Some(mut stdin) = child.stdin.take() {
+            stdin
+                .write_all(format!("{token}\n{token}\n").as_bytes())
+                .context("failed to pass the token to security")?;
         }
-        let file = File::create(&path).with_context(|| format!("failed to create {}", path.display()))?;
-        serde_json::to_writer(file, value).with_context(|| format!("failed to write {}", path.display()))
+        let status = child.wait().context("failed to run security")?;
+        if !status.success() {
+            bail!("security add-generic-password failed: {status}");
+        }
+        Ok(())
     }
 
-    fn load_solution<T: for<'de> Deserialize<'de>>(&self, key: &str) -> Result<Option<T>> {
-        let path = self.solution_dir().join(format!("{key}.json"));
-        if !path.exists() {
+    fn delete(&self, account: &str) -> Result<()> {
+        Command::new("security")
+            .args(["delete-generic-password", "-s", TOKEN_SERVICE, "-a", account])
+            .stdout(Stdio::null())
+            .stderr(Stdio::null())
+            .status()
+            .context("failed to run security")?;
+        Ok(())
+    }
+}
+
+// Secret Service (GNOME Keyring, KWallet) through libsecret's `secret-tool`.
+struct SecretServiceStore;
+
+impl TokenStore for SecretServiceStore {
+    fn name(&self) -> String {
+        "the Secret Service keyring".to_string()
+    }
+
+    fn get(&self, account: &str) -> Result<Option<String>> {
+        let output = Command::new("secret-tool")
+            .args(["lookup", "service", TOKEN_SERVICE, "repository", account])
+            .stderr(Stdio::null())
+            .output()
+            .context("failed to run secret-tool")?;
+        let token = String::from_utf8_lossy(&output.stdout).trim().to_string();
+        if !output.status.success() || token.is_empty() {
             return Ok(None);
         }
-        let file = File::open(&path).with_context(|| format!("failed to open {}", path.display()))?;
-        let value = serde_json::from_reader(file).with_context(|| format!("failed to parse {}", path.display()))?;
-        Ok(Some(value))
+        Ok(Some(token))
     }
 
-    fn blob_dir(&self) -> PathBuf {
-        self.root.join("cas").join("blobs")
+    fn set(&self, account: &str, token: &str) -> Result<()> {
+        let mut child = Command::new("secret-tool")
+            .args([
+                "store",
+                &format!("--label=xe token ({account})"),
+                "service",
+                TOKEN_SERVICE,
+                "repository",
+                account,
+            ])
+            .stdin(Stdio::piped())
+            .spawn()
+            .context("failed to run secret-tool")?;
+        if let Some(mut stdin) = child.stdin.take() {
+            stdin
+                .write_all(token.as_bytes())
+                .context("failed to pass the token to secret-tool")?;
+        }
+        let status = child.wait().context("failed to run secret-tool")?;
+        if !status.success() {
+            bail!("secret-tool store failed: {status}");
+        }
+        Ok(())
     }
 
-    fn solution_dir(&self) -> PathBuf {
-        self.root.join("cas").join("solutions")
+    fn delete(&self, account: &str) -> Result<()> {
+        Command::new("secret-tool")
+            .args(["clear", "service", TOKEN_SERVICE, "repository", account])
+            .status()
+            .context("failed to run secret-tool")?;
+        Ok(())
     }
+}
 
-    fn blob_path(&self, sha: &str) -> PathBuf {
-        let prefix = if sha.len() >= 2 { &sha[..2] } else { "00" };
-        self.blob_dir().join(prefix).join(format!("{sha}.whl"))
-    }
+// The credential helper from XE_CREDENTIAL_HELPER or `credential_helper` in the global
+// config, if any.
+fn credential_helper(global: &GlobalConfig) -> Option<HelperStore> {
+    let command = env::var("XE_CREDENTIAL_HELPER")
+        .ok()
+        .filter(|c| !c.trim().is_empty())
+        .unwrap_or_else(|| global.credential_helper.clone());
+    let command = command.trim();
+    (!command.is_empty()).then(|| HelperStore {
+        command: command.to_string(),
+    })
 }
 
-#[derive(Debug, Clone, Deserialize)]
-struct PipPkg {
-    name: String,
-    version: String,
+// An external program that keeps tokens, such as a wrapper around Vault, speaking the
+// docker credential helper protocol: `<helper> get` and `<helper> erase` read the
+// repository name on stdin, `get` prints {"Username", "Secret"} JSON (or the bare token),
+// and `<helper> store` reads {"ServerURL", "Username", "Secret"} JSON. The command runs
+// through the shell, so it may carry its own (quoted) arguments.
+struct HelperStore {
+    command: String,
 }
 
-fn parse_pip_list_output(out: &[u8]) -> Result<Vec<PipPkg>> {
-    let trimmed = out
-        .iter()
-        .copied()
-        .skip_while(|b| b.is_ascii_whitespace())
-        .collect::<Vec<_>>();
-    if trimmed.is_empty() {
-        return Ok(Vec::new());
+const CREDENTIAL_HELPER_TIMEOUT: Duration = Duration::from_secs(60);
+
+impl HelperStore {
+    fn run(&self, action: &str, input: &str) -> Result<Output> {
+        let mut command = if cfg!(windows) {
+            let mut command = Command::new("cmd");
+            command.arg("/C").arg(format!("{} {action}", self.command));
+            command
+        } else {
+            let mut command = Command::new("sh");
+            command.arg("-c").arg(format!("{} \"$@\"", self.command)).arg("sh").arg(action);
+            command
+        };
+        let mut child = command
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::piped())
+            .spawn()
+            .with_context(|| format!("failed to run credential helper `{}`", self.command))?;
+        if let Some(mut stdin) = child.stdin.take() {
+            stdin
+                .write_all(input.as_bytes())
+                .with_context(|| format!("failed to write to credential helper `{}`", self.command))?;
+        }
+        let stdout = drain_pipe(child.stdout.take(), false);
+        let stderr = drain_pipe(child.stderr.take(), false);
+        let what = format!("credential helper `{}`", self.command);
+        // A helper waiting on an interactive login must not hang xe.
+        let Some(status) = wait_or_kill(&mut child, &what, CREDENTIAL_HELPER_TIMEOUT)? else {
+            bail_kind!(
+                ErrorKind::Config,
+                "{what} did not answer `{action}` within {}",
+                human_duration(CREDENTIAL_HELPER_TIMEOUT)
+            );
+        };
+        Ok(Output {
+            status,
+            stdout: stdout.join().unwrap_or_default(),
+            stderr: stderr.join().unwrap_or_default(),
+        })
     }
 
-    if let Ok(direct) = serde_json::from_slice::<Vec<PipPkg>>(&trimmed) {
-        return Ok(direct);
+    fn failure(&self, action: &str, output: &Output) -> anyhow::Error {
+        let mut message = String::from_utf8_lossy(&output.stderr).trim().to_string();
+        if message.is_empty() {
+            message = String::from_utf8_lossy(&output.stdout).trim().to_string();
+        }
+        kind_error(
+            ErrorKind::Config,
+            format!("credential helper `{} {action}` failed ({}): {message}", self.command, output.status),
+        )
     }
+}
 
-    let mut start = 0usize;
-    while start < trimmed.len() {
-        if let Some(open_rel) = trimmed[start..].iter().position(|b| *b == b'[') {
-            let open = start + open_rel;
-            let mut depth: i32 = 0;
-            for idx in open..trimmed.len() {
-                match trimmed[idx] {
-                    b'[' => depth += 1,
-                    b']' => {
-                        depth -= 1;
-                        if depth == 0 {
-                            let chunk = &trimmed[open..=idx];
-                            if let Ok(pkgs) = serde_json::from_slice::<Vec<PipPkg>>(chunk) {
-                                return Ok(pkgs);
-                            }
-                            break;
-                        }
-                    }
-                    _ => {}
-                }
+impl TokenStore for HelperStore {
+    fn name(&self) -> String {
+        format!("the credential helper `{}`", self.command)
+    }
+
+    fn get(&self, account: &str) -> Result<Option<String>> {
+        let output = self.run("get", &format!("{account}\n"))?;
+        let stdout = String::from_utf8_lossy(&output.stdout).trim().to_string();
+        if !output.status.success() {
+            // Docker helpers report a missing entry as "credentials not found".
+            if stdout.to_lowercase().contains("not found") {
+                return Ok(None);
             }
-            start = open + 1;
-        } else {
-            break;
+            return Err(self.failure("get", &output));
         }
+        let token = match serde_json::from_str::<Value>(&stdout) {
+            Ok(Value::Object(fields)) => fields.get("Secret").and_then(Value::as_str).unwrap_or_default().to_string(),
+            _ => stdout,
+        };
+        Ok((!token.trim().is_empty()).then(|| token.trim().to_string()))
     }
-    bail!("pip JSON payload not found in output")
-}
 
-fn print_pkg_table(pkgs: &[PipPkg]) {
-    let mut width = "Package".len();
-    for pkg in pkgs {
-        if pkg.name.len() > width {
-            width = pkg.name.len();
+    fn set(&self, account: &str, token: &str) -> Result<()> {
+        let input = json!({"ServerURL": account, "Username": "__token__", "Secret": token});
+        let output = self.run("store", &input.to_string())?;
+        if !output.status.success() {
+            return Err(self.failure("store", &output));
         }
+        Ok(())
     }
-    println!("{:<width$}  Version", "Package", width = width);
-    for pkg in pkgs {
-        println!("{:<width$}  {}", pkg.name, pkg.version, width = width);
+
+    fn delete(&self, account: &str) -> Result<()> {
+        let output = self.run("erase", &format!("{account}\n"))?;
+        if !output.status.success() && !String::from_utf8_lossy(&output.stdout).to_lowercase().contains("not found") {
+            return Err(self.failure("erase", &output));
+        }
+        Ok(())
     }
 }
 
-#[derive(Debug, Deserialize)]
-struct PypiResponse {
-    info: PypiInfo,
+// ChaCha20-Poly1305 encrypted files under tokens/, keyed by a random per-user key with
+// owner-only permissions. The key lives in the config directory rather than beside the
+// ciphertext, so a copy of the xe home (a snapshot, a backup) does not carry both.
+// Used wherever no keychain is available.
+struct EncryptedFileStore {
+    dir: PathBuf,
 }
 
-#[derive(Debug, Deserialize)]
-struct PypiInfo {
-    name: String,
-    version: String,
-    #[serde(default)]
-    summary: String,
-    #[serde(default)]
-    home_page: String,
-}
+impl EncryptedFileStore {
+    fn new() -> Self {
+        Self { dir: tokens_dir() }
+    }
 
-fn fetch_metadata_from_pypi(pkg_name: &str) -> Result<PypiResponse> {
-    let url = format!("https://pypi.org/pypi/{pkg_name}/json");
-    let resp = Client::builder()
-        .timeout(Duration::from_secs(30))
-        .build()
-        .context("failed to build HTTP client")?
-        .get(url)
-        .send()
-        .context("failed to request PyPI metadata")?;
-    if !resp.status().is_success() {
-        bail!("package {} not found on PyPI", pkg_name);
+    fn path(&self, account: &str) -> PathBuf {
+        self.dir.join(format!("{}.enc", token_file_stem(account)))
     }
-    let parsed = resp.json::<PypiResponse>().context("failed to parse PyPI response")?;
-    Ok(parsed)
-}
 
-fn parse_requirements(path: &Path) -> Result<Vec<String>> {
-    let file = File::open(path).with_context(|| format!("failed to open {}", path.display()))?;
-    let reader = BufReader::new(file);
-    let mut reqs = Vec::new();
-    for line in reader.lines() {
-        let mut line = line?;
-        line = line.trim().to_string();
-        if line.is_empty() || line.starts_with('#') {
-            continue;
-        }
-        if line.starts_with("-r ") || line.starts_with("--requirement ") {
-            continue;
-        }
-        if line.starts_with('-') {
-            continue;
-        }
-        if let Some(idx) = line.find(" #") {
-            line = line[..idx].trim().to_string();
-        }
-        if !line.is_empty() {
-            reqs.push(line);
+    fn key(&self, create: bool) -> Result<Option<aead::LessSafeKey>> {
+        let path = token_key_path();
+        // Earlier releases kept the key in tokens/.key.
+        let legacy = self.dir.join(".key");
+        if !path.is_file() && legacy.is_file() {
+            let bytes = fs::read(&legacy).with_context(|| format!("failed to read {}", legacy.display()))?;
+            write_private_file(&path, &bytes)?;
+            fs::remove_file(&legacy).with_context(|| format!("failed to remove {}", legacy.display()))?;
         }
+        let bytes = if path.is_file() {
+            fs::read(&path).with_context(|| format!("failed to read {}", path.display()))?
+        } else if create {
+            let mut bytes = vec![0u8; 32];
+            SystemRandom::new()
+                .fill(&mut bytes)
+                .map_err(|_| anyhow!("failed to generate a token store key"))?;
+            write_private_file(&path, &bytes)?;
+            bytes
+        } else {
+            return Ok(None);
+        };
+        let key = aead::UnboundKey::new(&aead::CHACHA20_POLY1305, &bytes)
+            .map_err(|_| anyhow!("{} is not a valid token store key", path.display()))?;
+        Ok(Some(aead::LessSafeKey::new(key)))
     }
-    Ok(reqs)
-}
-
-fn create_snapshot(name: &str) -> Result<PathBuf> {
-    let xe_dir = xe_home();
-    let snaps_dir = xe_dir.join("snaps");
-    fs::create_dir_all(&snaps_dir).with_context(|| format!("failed to create {}", snaps_dir.display()))?;
-    let ts = SystemTime::now()
-        .duration_since(UNIX_EPOCH)
-        .unwrap_or_else(|_| Duration::from_secs(0))
-        .as_secs();
-    let snap_path = snaps_dir.join(format!("{name}_{ts}.zip"));
-    zip_directory(&xe_dir, &snap_path, &["snaps"])?;
-    Ok(snap_path)
 }
 
-fn zip_directory(source: &Path, target: &Path, exclude: &[&str]) -> Result<()> {
-    let file = File::create(target).with_context(|| format!("failed to create {}", target.display()))?;
-    let mut writer = ZipWriter::new(file);
-    let options = FileOptions::default().compression_method(zip::CompressionMethod::Deflated);
+impl TokenStore for EncryptedFileStore {
+    fn name(&self) -> String {
+        format!("an encrypted file in {}", self.dir.display())
+    }
 
-    for entry in WalkDir::new(source) {
-        let entry = entry?;
-        let path = entry.path();
-        if path == source {
-            continue;
+    fn get(&self, account: &str) -> Result<Option<String>> {
+        let path = self.path(account);
+        if !path.is_file() {
+            return Ok(None);
         }
-        let rel = path
-            .strip_prefix(source)
-            .with_context(|| format!("failed to strip prefix for {}", path.display()))?;
-        let rel_str = rel.to_string_lossy().replace('\\', "/");
-        if exclude.iter().any(|needle| rel_str.contains(needle)) {
-            continue;
+        let Some(key) = self.key(false)? else {
+            bail!("{} exists but the token store key is missing", path.display());
+        };
+        let data = fs::read(&path).with_context(|| format!("failed to read {}", path.display()))?;
+        if data.len() < aead::NONCE_LEN {
+            bail!("{} is corrupt", path.display());
         }
+        let (nonce, sealed) = data.split_at(aead::NONCE_LEN);
+        let nonce = aead::Nonce::try_assume_unique_for_key(nonce)
+            .map_err(|_| anyhow!("{} is corrupt", path.display()))?;
+        let mut sealed = sealed.to_vec();
+        let plain = key
+            .open_in_place(nonce, aead::Aad::from(account.as_bytes()), &mut sealed)
+            .map_err(|_| anyhow!("failed to decrypt {}", path.display()))?;
+        Ok(Some(String::from_utf8_lossy(plain).to_string()))
+    }
 
-        if entry.file_type().is_dir() {
-            writer
-                .add_directory(format!("{rel_str}/"), options)
-                .with_context(|| format!("failed to add dir {}", rel_str))?;
-            continue;
+    fn set(&self, account: &str, token: &str) -> Result<()> {
+        create_private_dir(&self.dir)?;
+        let key = self.key(true)?.ok_or_else(|| anyhow!("token store key unavailable"))?;
+        let mut nonce = [0u8; aead::NONCE_LEN];
+        SystemRandom::new()
+            .fill(&mut nonce)
+            .map_err(|_| anyhow!("failed to generate a nonce"))?;
+        let mut sealed = token.as_bytes().to_vec();
+        key.seal_in_place_append_tag(
+            aead::Nonce::assume_unique_for_key(nonce),
+            aead::Aad::from(account.as_bytes()),
+            &mut sealed,
+        )
+        .map_err(|_| anyhow!("failed to encrypt the token"))?;
+        let mut data = nonce.to_vec();
+        data.extend_from_slice(&sealed);
+        write_private_file(&self.path(account), &data)
+    }
+
+    fn delete(&self, account: &str) -> Result<()> {
+        let path = self.path(account);
+        if path.exists() {
+            fs::remove_file(&path).with_context(|| format!("failed to remove {}", path.display()))?;
         }
-        writer
-            .start_file(rel_str.clone(), options)
-            .with_context(|| format!("failed to add file {}", rel_str))?;
-        let mut input = File::open(path).with_context(|| format!("failed to open {}", path.display()))?;
-        io::copy(&mut input, &mut writer).with_context(|| format!("failed to write {}", rel_str))?;
+        Ok(())
     }
-    writer.finish().context("failed to finalize snapshot zip")?;
-    Ok(())
 }
 
-fn remove_path(path: &Path, description: &str) -> Result<()> {
-    if path.exists() {
-        info(&format!("Removing {} at {}...", description, path.display()));
-        if path.is_dir() {
-            fs::remove_dir_all(path).with_context(|| format!("failed to remove {}", path.display()))?;
-        } else {
-            fs::remove_file(path).with_context(|| format!("failed to remove {}", path.display()))?;
-        }
+// The token store key: `xe/token.key` in the platform config directory.
+fn token_key_path() -> PathBuf {
+    match dirs::config_dir() {
+        Some(dir) => dir.join("xe").join("token.key"),
+        None => xe_home().join("token.key"),
     }
-    Ok(())
 }
 
-fn read_stdin_line() -> Result<String> {
-    let mut line = String::new();
-    io::stdin().read_line(&mut line)?;
-    Ok(line)
+// Like write_file_atomic, but the file is created owner-only (0600 on unix), so the
+// data is never readable by others, not even between creation and rename.
+fn write_private_file(path: &Path, data: &[u8]) -> Result<()> {
+    if let Some(parent) = path.parent() {
+        create_private_dir(parent)?;
+    }
+    write_atomic(path, data, true)
 }
 
-fn token_path() -> PathBuf {
-    xe_home().join("credentials")
+// Creates `dir` and any missing parents owner-only (0700 on unix); existing directories
+// keep their permissions.
+fn create_private_dir(dir: &Path) -> Result<()> {
+    let mut builder = fs::DirBuilder::new();
+    builder.recursive(true);
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::DirBuilderExt;
+        builder.mode(0o700);
+    }
+    builder
+        .create(dir)
+        .with_context(|| format!("failed to create {}", dir.display()))
 }
 
-fn save_token(token: &str) -> Result<()> {
-    let path = token_path();
-    if let Some(parent) = path.parent() {
-        fs::create_dir_all(parent).with_context(|| format!("failed to create {}", parent.display()))?;
+// Saves with the credential helper when one is configured, otherwise to the platform
+// keychain, falling back to the encrypted file store; returns a description of where the
+// token ended up.
+fn save_token(global: &GlobalConfig, repository: &str, token: &str) -> Result<String> {
+    if let Some(helper) = credential_helper(global) {
+        helper.set(repository, token)?;
+        return Ok(helper.name());
     }
-    fs::write(&path, token).with_context(|| format!("failed to write {}", path.display()))?;
-    Ok(())
+    let file_store = EncryptedFileStore::new();
+    let mut saved_in = None;
+    if let Some(store) = platform_token_store() {
+        match store.set(repository, token) {
+            Ok(()) => {
+                file_store.delete(repository)?;
+                saved_in = Some(store.name());
+            }
+            Err(err) => debug(&format!("{} unavailable, using the file store: {err:#}", store.name())),
+        }
+    }
+    let saved_in = match saved_in {
+        Some(name) => name,
+        None => {
+            file_store.set(repository, token)?;
+            file_store.name()
+        }
+    };
+    for path in legacy_token_paths(repository) {
+        if path.is_file() {
+            fs::remove_file(&path).with_context(|| format!("failed to remove {}", path.display()))?;
+        }
+    }
+    Ok(saved_in)
 }
 
-fn load_token() -> Result<String> {
-    let path = token_path();
-    let token = fs::read_to_string(&path).with_context(|| format!("failed to read {}", path.display()))?;
-    Ok(token)
+// Asks the credential helper first; tokens saved before it was configured are still found
+// in the built-in stores.
+fn load_token(global: &GlobalConfig, repository: &str) -> Result<String> {
+    if let Some(helper) = credential_helper(global) {
+        if let Some(token) = helper.get(repository)? {
+            return Ok(token);
+        }
+    }
+    if let Some(store) = platform_token_store() {
+        match store.get(repository) {
+            Ok(Some(token)) => return Ok(token),
+            Ok(None) => {}
+            Err(err) => debug(&format!("{} unavailable: {err:#}", store.name())),
+        }
+    }
+    if let Some(token) = EncryptedFileStore::new().get(repository)? {
+        return Ok(token);
+    }
+    for path in legacy_token_paths(repository) {
+        if path.is_file() {
+            return fs::read_to_string(&path).with_context(|| format!("failed to read {}", path.display()));
+        }
+    }
+    bail!("no token stored for {repository}")
 }
 
-fn revoke_token() -> Result<()> {
-    let path = token_path();
-    if path.exists() {
-        fs::remove_file(&path).with_context(|| format!("failed to remove {}", path.display()))?;
+fn revoke_token(global: &GlobalConfig, repository: &str) -> Result<()> {
+    if let Some(helper) = credential_helper(global) {
+        helper.delete(repository)?;
+    }
+    if let Some(store) = platform_token_store() {
+        if let Err(err) = store.delete(repository) {
+            debug(&format!("{} unavailable: {err:#}", store.name()));
+        }
+    }
+    EncryptedFileStore::new().delete(repository)?;
+    for path in legacy_token_paths(repository) {
+        if path.exists() {
+            fs::remove_file(&path).with_context(|| format!("failed to remove {}", path.display()))?;
+        }
     }
     Ok(())
 }
@@ -2913,6 +18013,9 @@ struct ProfilerInner {
     info: ProfileInfo,
     file: Mutex<File>,
     started: Instant,
+    trace_id: String,
+    sampler: Mutex<Option<thread::JoinHandle<String>>>,
+    sampler_stop: Arc<AtomicBool>,
 }
 
 #[derive(Clone)]
@@ -2920,10 +18023,20 @@ struct ProfileInfo {
     log_path: PathBuf,
     cpu_path: PathBuf,
     heap_path: PathBuf,
+    detail: Option<ProfileDetail>,
+}
+
+// Extra artifacts written by --profile-detail.
+#[derive(Clone)]
+struct ProfileDetail {
+    metrics_path: PathBuf,
+    threads_path: PathBuf,
 }
 
+const METRICS_INTERVAL: Duration = Duration::from_millis(100);
+
 impl Profiler {
-    fn start(profile_dir: &Path) -> Result<(Self, ProfileInfo)> {
+    fn start(profile_dir: &Path, detail: bool) -> Result<(Self, ProfileInfo)> {
         fs::create_dir_all(profile_dir)
             .with_context(|| format!("failed to create {}", profile_dir.display()))?;
         let stamp = profile_stamp();
@@ -2931,6 +18044,10 @@ impl Profiler {
             log_path: profile_dir.join(format!("trace-{stamp}.jsonl")),
             cpu_path: profile_dir.join(format!("cpu-{stamp}.pprof")),
             heap_path: profile_dir.join(format!("heap-{stamp}.pprof")),
+            detail: detail.then(|| ProfileDetail {
+                metrics_path: profile_dir.join(format!("metrics-{stamp}.jsonl")),
+                threads_path: profile_dir.join(format!("threads-{stamp}.txt")),
+            }),
         };
         let log_file = File::create(&info.log_path)
             .with_context(|| format!("failed to create {}", info.log_path.display()))?;
@@ -2943,8 +18060,19 @@ impl Profiler {
                 info: info.clone(),
                 file: Mutex::new(log_file),
                 started: Instant::now(),
+                trace_id: new_trace_id(),
+                sampler: Mutex::new(None),
+                sampler_stop: Arc::new(AtomicBool::new(false)),
             }),
         };
+        if let Some(detail) = info.detail.as_ref() {
+            let metrics = File::create(&detail.metrics_path)
+                .with_context(|| format!("failed to create {}", detail.metrics_path.display()))?;
+            let handle = spawn_metrics_sampler(metrics, profiler.inner.started, profiler.inner.sampler_stop.clone());
+            if let Ok(mut sampler) = profiler.inner.sampler.lock() {
+                *sampler = Some(handle);
+            }
+        }
         profiler.event(
             "profile.session_start",
             json!({
@@ -2963,6 +18091,7 @@ impl Profiler {
         let mut object = Map::new();
         object.insert("ts".to_string(), json!(timestamp_iso8601()));
         object.insert("event".to_string(), json!(name));
+        object.insert("trace_id".to_string(), json!(self.inner.trace_id));
         if let Value::Object(map) = fields {
             for (key, value) in map {
                 object.insert(key, value);
@@ -2976,30 +18105,168 @@ impl Profiler {
     }
 
     fn stop(&self) -> Result<()> {
-        self.event(
-            "profile.session_stop",
-            json!({
-                "elapsed_ms": self.inner.started.elapsed().as_millis()
-            }),
-        );
+        self.inner.sampler_stop.store(true, AtomicOrdering::Relaxed);
+        let handle = self.inner.sampler.lock().ok().and_then(|mut sampler| sampler.take());
+        if let Some(handle) = handle {
+            handle.thread().unpark();
+            let threads = handle.join().unwrap_or_default();
+            if let Some(detail) = self.inner.info.detail.as_ref() {
+                fs::write(&detail.threads_path, threads)
+                    .with_context(|| format!("failed to write {}", detail.threads_path.display()))?;
+            }
+        }
+        let mut fields = json!({
+            "elapsed_ms": self.inner.started.elapsed().as_millis()
+        });
+        if self.inner.info.detail.is_some() {
+            if let Some(peak) = proc_status_kb("VmHWM") {
+                fields["peak_rss_kb"] = json!(peak);
+            }
+        }
+        self.event("profile.session_stop", fields);
         Ok(())
     }
 }
 
+// Samples process metrics every METRICS_INTERVAL until stopped and returns the thread
+// listing taken when the most threads were alive. The values come from /proc, so on other
+// platforms only the elapsed time is recorded.
+fn spawn_metrics_sampler(mut file: File, started: Instant, stop: Arc<AtomicBool>) -> thread::JoinHandle<String> {
+    let mut busiest = (0usize, String::from("thread listing is not available on this platform\n"));
+    thread::spawn(move || loop {
+        let mut sample = json!({
+            "ts": timestamp_iso8601(),
+            "elapsed_ms": started.elapsed().as_millis(),
+        });
+        if let Some(rss) = proc_status_kb("VmRSS") {
+            sample["rss_kb"] = json!(rss);
+        }
+        if let Some(threads) = proc_status_kb("Threads") {
+            sample["threads"] = json!(threads);
+        }
+        if let Some((user, system)) = proc_cpu_ticks() {
+            sample["cpu_user_ticks"] = json!(user);
+            sample["cpu_system_ticks"] = json!(system);
+        }
+        if let Some((count, listing)) = thread_listing() {
+            if count > busiest.0 {
+                busiest = (count, listing);
+            }
+        }
+        if writeln!(file, "{sample}").is_err() || stop.load(AtomicOrdering::Relaxed) {
+            return busiest.1;
+        }
+        thread::park_timeout(METRICS_INTERVAL);
+        if stop.load(AtomicOrdering::Relaxed) {
+            return busiest.1;
+        }
+    })
+}
+
+// Reads a numeric field such as `VmRSS:  1234 kB` from /proc/self/status.
+fn proc_status_kb(field: &str) -> Option<u64> {
+    let status = fs::read_to_string("/proc/self/status").ok()?;
+    status.lines().find_map(|line| {
+        let value = line.strip_prefix(field)?.strip_prefix(':')?;
+        value.split_whitespace().next()?.parse().ok()
+    })
+}
+
+// utime and stime from /proc/self/stat, in clock ticks.
+fn proc_cpu_ticks() -> Option<(u64, u64)> {
+    let stat = fs::read_to_string("/proc/self/stat").ok()?;
+    // Fields after the parenthesised command name; utime and stime are fields 14 and 15.
+    let rest = &stat[stat.rfind(')')? + 2..];
+    let fields = rest.split_whitespace().collect::<Vec<_>>();
+    Some((fields.get(11)?.parse().ok()?, fields.get(12)?.parse().ok()?))
+}
+
+// Lists every thread of the process with its name and scheduler state, the closest thing
+// to a goroutine dump for a native binary.
+fn thread_listing() -> Option<(usize, String)> {
+    let mut tasks = fs::read_dir("/proc/self/task")
+        .ok()?
+        .flatten()
+        .map(|e| e.path())
+        .collect::<Vec<_>>();
+    tasks.sort();
+    let mut out = String::new();
+    for task in &tasks {
+        let tid = task.file_name().map(|n| n.to_string_lossy().to_string()).unwrap_or_default();
+        let name = fs::read_to_string(task.join("comm")).unwrap_or_default();
+        let state = fs::read_to_string(task.join("status"))
+            .ok()
+            .and_then(|s| s.lines().find_map(|l| l.strip_prefix("State:").map(|v| v.trim().to_string())))
+            .unwrap_or_else(|| "-".to_string());
+        out.push_str(&format!("{tid}\t{}\t{state}\n", name.trim()));
+    }
+    Some((tasks.len(), out))
+}
+
+// Span IDs are unique per process; the trace ID ties them to one run. Together with
+// parent_span_id they let a trace be rebuilt as a tree even when spans from parallel
+// workers interleave in the log.
+static NEXT_SPAN_ID: AtomicU64 = AtomicU64::new(1);
+
+thread_local! {
+    static CURRENT_SPAN: Cell<Option<u64>> = const { Cell::new(None) };
+}
+
+fn new_trace_id() -> String {
+    let mut bytes = [0u8; 16];
+    if SystemRandom::new().fill(&mut bytes).is_err() {
+        let nanos = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .unwrap_or_default()
+            .as_nanos();
+        return format!("{nanos:032x}");
+    }
+    hex::encode(bytes)
+}
+
 struct SpanGuard {
     profiler: Option<Profiler>,
+    timings: Arc<Timings>,
     name: String,
     started: Instant,
     fields: Value,
+    id: u64,
+    parent: Option<u64>,
+    // The thread's current span before this one started, restored on drop.
+    previous: Option<u64>,
+}
+
+impl SpanGuard {
+    // Starts a span under this one. Use it for work handed to other threads, where the
+    // thread-local current span does not carry over.
+    fn child(&self, ctx: &AppContext, name: &str, fields: Value) -> SpanGuard {
+        start_span(ctx, name, fields, Some(self.id))
+    }
+
+    fn ids(&self) -> Map<String, Value> {
+        let mut ids = Map::new();
+        ids.insert("span_id".to_string(), json!(format!("{:016x}", self.id)));
+        if let Some(parent) = self.parent {
+            ids.insert("parent_span_id".to_string(), json!(format!("{parent:016x}")));
+        }
+        ids
+    }
 }
 
 impl Drop for SpanGuard {
     fn drop(&mut self) {
+        CURRENT_SPAN.with(|current| {
+            if current.get() == Some(self.id) {
+                current.set(self.previous);
+            }
+        });
+        self.timings.record(&self.name, self.started.elapsed());
         if let Some(profiler) = self.profiler.as_ref() {
             let mut fields = match self.fields.clone() {
                 Value::Object(map) => map,
                 _ => Map::new(),
             };
+            fields.extend(self.ids());
             fields.insert(
                 "duration_ms".to_string(),
                 json!(self.started.elapsed().as_millis()),
@@ -3009,16 +18276,329 @@ impl Drop for SpanGuard {
     }
 }
 
+// Starts a span whose parent is the innermost open span on this thread.
 fn span(ctx: &AppContext, name: &str, fields: Value) -> SpanGuard {
-    if let Some(profiler) = ctx.profiler.as_ref() {
-        profiler.event(&format!("{}.start", name), fields.clone());
-    }
-    SpanGuard {
+    let parent = CURRENT_SPAN.with(Cell::get);
+    start_span(ctx, name, fields, parent)
+}
+
+fn start_span(ctx: &AppContext, name: &str, fields: Value, parent: Option<u64>) -> SpanGuard {
+    let guard = SpanGuard {
         profiler: ctx.profiler.clone(),
+        timings: ctx.timings.clone(),
         name: name.to_string(),
         started: Instant::now(),
         fields,
+        id: NEXT_SPAN_ID.fetch_add(1, AtomicOrdering::Relaxed),
+        parent,
+        previous: CURRENT_SPAN.with(Cell::get),
+    };
+    CURRENT_SPAN.with(|current| current.set(Some(guard.id)));
+    if let Some(profiler) = ctx.profiler.as_ref() {
+        let mut fields = match guard.fields.clone() {
+            Value::Object(map) => map,
+            _ => Map::new(),
+        };
+        fields.extend(guard.ids());
+        profiler.event(&format!("{}.start", name), Value::Object(fields));
+    }
+    guard
+}
+
+// Span durations and counters collected for every command, independent of --profile.
+// Durations of spans that run in parallel workers are summed.
+#[derive(Default)]
+struct Timings {
+    spans: Mutex<HashMap<String, Duration>>,
+    counters: Mutex<HashMap<String, u64>>,
+}
+
+impl Timings {
+    fn record(&self, name: &str, elapsed: Duration) {
+        if let Ok(mut spans) = self.spans.lock() {
+            *spans.entry(name.to_string()).or_default() += elapsed;
+        }
+    }
+
+    fn count(&self, name: &str) {
+        if let Ok(mut counters) = self.counters.lock() {
+            *counters.entry(name.to_string()).or_default() += 1;
+        }
+    }
+
+    fn span(&self, name: &str) -> Option<Duration> {
+        self.spans.lock().ok().and_then(|spans| spans.get(name).copied())
+    }
+
+    fn counter(&self, name: &str) -> u64 {
+        self.counters
+            .lock()
+            .ok()
+            .and_then(|counters| counters.get(name).copied())
+            .unwrap_or(0)
+    }
+}
+
+const SLOW_STEP: Duration = Duration::from_secs(5);
+
+// How long the last installs took per step, in xe home, so `xe plan` can estimate an
+// install from this machine's own history. Span times add up the per-package work of the
+// download pool rather than wall time.
+const INSTALL_STATS_FILE: &str = "install-stats.json";
+const INSTALL_STATS_KEEP: usize = 20;
+
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+struct InstallStats {
+    #[serde(default)]
+    download_ms: u64,
+    #[serde(default)]
+    downloaded: u64,
+    #[serde(default)]
+    extract_ms: u64,
+    #[serde(default)]
+    extracted: u64,
+    #[serde(default)]
+    build_ms: u64,
+    #[serde(default)]
+    built: u64,
+}
+
+fn load_install_stats() -> Vec<InstallStats> {
+    fs::read(xe_home().join(INSTALL_STATS_FILE))
+        .ok()
+        .and_then(|bytes| serde_json::from_slice(&bytes).ok())
+        .unwrap_or_default()
+}
+
+// Appends the install this command ran, if any. A failed write only costs `xe plan` a
+// data point.
+fn record_install_stats(ctx: &AppContext) {
+    let timings = &ctx.timings;
+    let ms = |name: &str| timings.span(name).unwrap_or_default().as_millis() as u64;
+    let entry = InstallStats {
+        download_ms: ms("install.download"),
+        downloaded: timings.counter("install.downloaded"),
+        extract_ms: ms("install.extract"),
+        extracted: timings.counter("install.extracted"),
+        build_ms: ms("install.build"),
+        built: timings.counter("install.built"),
+    };
+    if entry.extracted == 0 {
+        return;
+    }
+    let mut history = load_install_stats();
+    history.push(entry);
+    let excess = history.len().saturating_sub(INSTALL_STATS_KEEP);
+    history.drain(..excess);
+    let saved = serde_json::to_vec_pretty(&history)
+        .context("failed to encode install stats")
+        .and_then(|data| {
+            fs::create_dir_all(xe_home())?;
+            write_file_atomic(&xe_home().join(INSTALL_STATS_FILE), &data)
+        });
+    if let Err(err) = saved {
+        debug(&format!("failed to record install stats: {err:#}"));
+    }
+}
+
+// Prints where an install spent its time, plus a hint for the dominant slow step.
+fn print_install_summary(ctx: &AppContext) {
+    let timings = &ctx.timings;
+    let Some(total) = timings.span("install.total") else {
+        return;
+    };
+    let secs = |d: Option<Duration>| format!("{:.1}s", d.unwrap_or_default().as_secs_f64());
+    let packages = timings.counter("install.package");
+    info(&format!(
+        "Done in {}: resolve {}{}, download {}, extract {}, cache hits {}/{}",
+        secs(Some(total)),
+        secs(timings.span("install.resolve")),
+        if timings.counter("install.solution_hit") > 0 {
+            " (cached)"
+        } else {
+            ""
+        },
+        secs(timings.span("install.download")),
+        secs(timings.span("install.extract")),
+        timings.counter("install.cache_hit"),
+        packages
+    ));
+    if timings.span("install.resolve").unwrap_or_default() >= SLOW_STEP {
+        info("Hint: resolution is slow; `xe lock` pins versions so later installs reuse the cached resolution.");
+    } else if timings.span("install.download").unwrap_or_default() >= SLOW_STEP {
+        info("Hint: downloads dominate; a closer index configured with `xe mirror` may help.");
+    }
+}
+
+const COMMAND_LOG_MAX_BYTES: u64 = 1024 * 1024;
+const COMMAND_LOG_KEEP: usize = 3;
+
+fn command_log_path() -> PathBuf {
+    xe_home().join("logs").join("commands.log")
+}
+
+fn rotated_log_path(path: &Path, n: usize) -> PathBuf {
+    PathBuf::from(format!("{}.{n}", path.display()))
+}
+
+fn command_log_enabled(ctx: &AppContext) -> bool {
+    if let Ok(value) = env::var("XE_COMMAND_LOG") {
+        return matches!(value.trim().to_lowercase().as_str(), "1" | "on" | "true");
+    }
+    load_global_config(&ctx.config_file)
+        .map(|cfg| cfg.command_log)
+        .unwrap_or(false)
+}
+
+// Appends one JSON line per command when the command log is enabled. Failures to write the
+// log never affect the command itself.
+fn record_command(ctx: &AppContext, args: &[String], elapsed: Duration, result: &Result<()>) {
+    if args.first().map(String::as_str) == Some("log") || !command_log_enabled(ctx) {
+        return;
+    }
+    let path = command_log_path();
+    let mut entry = json!({
+        "ts": timestamp_iso8601(),
+        "args": redact_args(args),
+        "cwd": env::current_dir().map(|d| d.display().to_string()).unwrap_or_default(),
+        "duration_ms": elapsed.as_millis(),
+        "exit_code": result.as_ref().err().map(exit_code).unwrap_or(0),
+        "version": XE_VERSION,
+    });
+    if let Err(err) = result {
+        entry["error"] = json!(format!("{err:#}"));
+        entry["error_code"] = json!(error_kind(err).map_or("error", ErrorKind::code));
+    }
+    let write = || -> Result<()> {
+        if let Some(parent) = path.parent() {
+            fs::create_dir_all(parent).with_context(|| format!("failed to create {}", parent.display()))?;
+        }
+        rotate_command_log(&path)?;
+        let mut file = fs::OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(&path)
+            .with_context(|| format!("failed to open {}", path.display()))?;
+        writeln!(file, "{entry}").with_context(|| format!("failed to write {}", path.display()))?;
+        Ok(())
+    };
+    if let Err(err) = write() {
+        debug(&format!("command log not written: {err:#}"));
+    }
+}
+
+fn rotate_command_log(path: &Path) -> Result<()> {
+    let size = fs::metadata(path).map(|m| m.len()).unwrap_or(0);
+    if size < COMMAND_LOG_MAX_BYTES {
+        return Ok(());
+    }
+    for n in (1..COMMAND_LOG_KEEP).rev() {
+        let from = rotated_log_path(path, n);
+        if from.exists() {
+            fs::rename(&from, rotated_log_path(path, n + 1))
+                .with_context(|| format!("failed to rotate {}", from.display()))?;
+        }
+    }
+    fs::rename(path, rotated_log_path(path, 1)).with_context(|| format!("failed to rotate {}", path.display()))
+}
+
+// Keeps credentials passed on the command line out of the log: values of secret flags,
+// and the user:password part of any URL, such as an index URL or a `pkg @ https://...`
+// requirement.
+fn redact_args(args: &[String]) -> Vec<String> {
+    const SECRET_FLAGS: &[&str] = &["--token", "--password"];
+    let url = Regex::new(r"[A-Za-z][A-Za-z0-9+.-]*://[^\s,;]+").expect("valid URL regex");
+    let mut out = Vec::with_capacity(args.len());
+    let mut hide_next = false;
+    for arg in args {
+        if hide_next {
+            out.push("***".to_string());
+            hide_next = false;
+            continue;
+        }
+        match arg.split_once('=') {
+            Some((flag, _)) if SECRET_FLAGS.contains(&flag) => out.push(format!("{flag}=***")),
+            _ => {
+                hide_next = SECRET_FLAGS.contains(&arg.as_str());
+                out.push(url.replace_all(arg, |caps: &regex::Captures| url_without_userinfo(&caps[0])).into_owned());
+            }
+        }
+    }
+    out
+}
+
+fn cmd_log(ctx: &AppContext, args: &[String]) -> Result<()> {
+    const USAGE: &str = "usage: xe log <show [--last <n>]|on|off|path>";
+    match args.first().map(String::as_str) {
+        Some("on") | Some("off") if args.len() == 1 => {
+            let mut global = load_global_config(&ctx.config_file)?;
+            global.command_log = args[0] == "on";
+            save_global_config(&ctx.config_file, &global)?;
+            if global.command_log {
+                success(&format!("Command log enabled: {}", command_log_path().display()));
+            } else {
+                success("Command log disabled");
+            }
+            Ok(())
+        }
+        Some("path") if args.len() == 1 => {
+            println!("{}", command_log_path().display());
+            Ok(())
+        }
+        Some("show") => {
+            let mut last = 20usize;
+            let mut idx = 1usize;
+            while idx < args.len() {
+                match args[idx].as_str() {
+                    "-n" | "--last" => {
+                        last = args
+                            .get(idx + 1)
+                            .and_then(|v| v.parse().ok())
+                            .ok_or_else(|| anyhow!("{USAGE}"))?;
+                        idx += 2;
+                    }
+                    _ => bail!("{USAGE}"),
+                }
+            }
+            show_command_log(last)
+        }
+        _ => bail!("{USAGE}"),
+    }
+}
+
+fn show_command_log(last: usize) -> Result<()> {
+    let path = command_log_path();
+    let mut entries = Vec::new();
+    for n in (0..=COMMAND_LOG_KEEP).rev() {
+        let file = if n == 0 { path.clone() } else { rotated_log_path(&path, n) };
+        let Ok(text) = fs::read_to_string(&file) else {
+            continue;
+        };
+        entries.extend(text.lines().filter_map(|line| serde_json::from_str::<Value>(line).ok()));
+    }
+    if entries.is_empty() {
+        info("No commands recorded. Enable the log with `xe log on`.");
+        return Ok(());
     }
+    let skip = entries.len().saturating_sub(last);
+    for entry in &entries[skip..] {
+        let args = entry["args"]
+            .as_array()
+            .map(|a| a.iter().filter_map(Value::as_str).collect::<Vec<_>>().join(" "))
+            .unwrap_or_default();
+        let secs = entry["duration_ms"].as_u64().unwrap_or(0) as f64 / 1000.0;
+        println!(
+            "{}  {:>7.1}s  exit {:<3}  xe {}",
+            entry["ts"].as_str().unwrap_or("-"),
+            secs,
+            entry["exit_code"].as_i64().unwrap_or(0),
+            args
+        );
+        if let Some(err) = entry["error"].as_str() {
+            println!("    {}", err.lines().next().unwrap_or_default());
+        }
+    }
+    Ok(())
 }
 
 fn profile_stamp() -> String {
@@ -3073,6 +18653,22 @@ fn xe_plugin_dir() -> PathBuf {
     xe_home().join("plugins")
 }
 
+fn xe_template_dir() -> PathBuf {
+    xe_home().join("templates")
+}
+
+fn xe_tool_cache_dir() -> PathBuf {
+    xe_home().join("tool-envs")
+}
+
+fn xe_script_env_dir() -> PathBuf {
+    xe_home().join("script-envs")
+}
+
+fn xe_tools_dir() -> PathBuf {
+    xe_home().join("tools")
+}
+
 fn tempfile_path(prefix: &str, ext: &str) -> PathBuf {
     tempfile_path_in(&env::temp_dir(), prefix, ext)
 }
@@ -3086,20 +18682,177 @@ fn tempfile_path_in(dir: &Path, prefix: &str, ext: &str) -> PathBuf {
     dir.join(format!("{prefix}-{pid}-{stamp}.{ext}"))
 }
 
-fn download_file(url: &str, prefix: &str, ext: &str) -> Result<PathBuf> {
+// Idle connections kept per host; enough for a full download pool against one file host.
+const HTTP_MAX_IDLE_PER_HOST: usize = 32;
+const DEFAULT_HTTP_CONCURRENCY: usize = 16;
+
+// The process-wide HTTP client. Sharing it lets the resolver, the CAS and the Python
+// manager reuse connections (and HTTP/2 sessions where the server offers them) instead of
+// opening one per request. Callers set their own request timeouts; the client only
+// bounds connecting.
+fn http_client() -> Result<&'static Client> {
+    static CLIENT: OnceLock<Client> = OnceLock::new();
+    if let Some(client) = CLIENT.get() {
+        return Ok(client);
+    }
     let client = Client::builder()
-        .timeout(Duration::from_secs(180))
+        .user_agent(format!("xe/{XE_VERSION}"))
+        .connect_timeout(Duration::from_secs(15))
+        .tcp_keepalive(Duration::from_secs(60))
+        .pool_idle_timeout(Duration::from_secs(90))
+        .pool_max_idle_per_host(HTTP_MAX_IDLE_PER_HOST)
         .build()
         .context("failed to build HTTP client")?;
-    let mut resp = client
+    Ok(CLIENT.get_or_init(|| client))
+}
+
+// Parallel downloads during installs: XE_HTTP_CONCURRENCY, else `http_concurrency` in the
+// global config.
+fn http_concurrency(ctx: &AppContext) -> usize {
+    env::var("XE_HTTP_CONCURRENCY")
+        .ok()
+        .and_then(|v| v.trim().parse::<usize>().ok())
+        .or_else(|| load_global_config(&ctx.config_file).ok()?.http_concurrency)
+        .filter(|n| *n > 0)
+        .unwrap_or(DEFAULT_HTTP_CONCURRENCY)
+}
+
+fn download_file(url: &str, prefix: &str, ext: &str) -> Result<PathBuf> {
+    let mut resp = http_client()?
         .get(url)
+        .timeout(Duration::from_secs(180))
         .send()
         .with_context(|| format!("failed to download {}", url))?;
     if !resp.status().is_success() {
-        bail!("failed to download {}: {}", url, resp.status());
+        bail_kind!(ErrorKind::Network, "failed to download {}: {}", url, resp.status());
     }
     let path = tempfile_path(prefix, ext);
     let mut out = File::create(&path).with_context(|| format!("failed to create {}", path.display()))?;
-    io::copy(&mut resp, &mut out).with_context(|| format!("failed to write {}", path.display()))?;
+    if let Err(err) = io::copy(&mut Interruptible(&mut resp), &mut out) {
+        let _ = fs::remove_file(&path);
+        return Err(err).with_context(|| format!("failed to write {}", path.display()));
+    }
     Ok(path)
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    // A fresh directory under the system temp dir, unique to this test and process.
+    fn test_dir(name: &str) -> PathBuf {
+        let dir = env::temp_dir().join(format!("xe-test-{name}-{}", std::process::id()));
+        let _ = fs::remove_dir_all(&dir);
+        fs::create_dir_all(&dir).unwrap();
+        dir
+    }
+
+    fn write(path: &Path, contents: &str) {
+        fs::create_dir_all(path.parent().unwrap()).unwrap();
+        fs::write(path, contents).unwrap();
+    }
+
+    #[test]
+    fn snapshot_round_trip_keeps_paths_that_mention_snaps() {
+        let home = test_dir("snapshot-round-trip");
+        let kept = home.join("venvs/app/lib/site-packages/snapshottest/__init__.py");
+        write(&kept, "VERSION = 1");
+        write(&home.join("snapshots.txt"), "notes");
+        write(&home.join("snaps/old_1.zip"), "not part of the snapshot");
+
+        let archive = create_snapshot_in(&home, "before").unwrap();
+        fs::remove_dir_all(home.join("venvs")).unwrap();
+        write(&home.join("added.txt"), "made after the snapshot");
+        restore_snapshot_into(&home, &archive).unwrap();
+
+        assert_eq!(fs::read_to_string(&kept).unwrap(), "VERSION = 1");
+        assert_eq!(fs::read_to_string(home.join("snapshots.txt")).unwrap(), "notes");
+        assert!(!home.join("added.txt").exists());
+        assert!(home.join("snaps/old_1.zip").exists());
+        fs::remove_dir_all(&home).unwrap();
+    }
+
+    #[test]
+    fn failed_restore_puts_the_previous_state_back() {
+        let home = test_dir("failed-restore");
+        write(&home.join("config.toml"), "kept");
+        write(&home.join("venvs/app/pyvenv.cfg"), "home = /usr");
+        let backup = create_snapshot_in(&home, "pre-restore").unwrap();
+
+        // The staging directory is gone, so the swap fails after the home was cleared.
+        let err = swap_in_snapshot(&home, &home.join("snaps/.missing"), &backup).unwrap_err();
+        assert!(format!("{err:#}").contains("the previous state was put back"), "{err:#}");
+        assert_eq!(fs::read_to_string(home.join("config.toml")).unwrap(), "kept");
+        assert_eq!(fs::read_to_string(home.join("venvs/app/pyvenv.cfg")).unwrap(), "home = /usr");
+        assert!(backup.exists());
+        fs::remove_dir_all(&home).unwrap();
+    }
+
+    #[test]
+    fn typosquat_ignores_exact_names() {
+        assert_eq!(typosquat_target("requests", &[]), None);
+        assert_eq!(typosquat_target("pyyaml", &[]), None);
+        assert_eq!(typosquat_target("acme-billing", &["acme-billing".to_string()]), None);
+    }
+
+    #[test]
+    fn typosquat_flags_near_misses() {
+        assert_eq!(typosquat_target("requets", &[]).as_deref(), Some("requests"));
+        assert_eq!(typosquat_target("requestss", &[]).as_deref(), Some("requests"));
+        assert_eq!(typosquat_target("pnadas", &[]).as_deref(), Some("pandas"));
+        assert_eq!(typosquat_target("pyymal", &[]).as_deref(), Some("pyyaml"));
+        let known = ["acme-billing".to_string()];
+        assert_eq!(typosquat_target("acme-bliling", &known).as_deref(), Some("acme-billing"));
+        assert_eq!(typosquat_target("acme-biling", &known).as_deref(), Some("acme-billing"));
+    }
+
+    #[test]
+    fn typosquat_leaves_short_names_alone() {
+        assert_eq!(typosquat_target("six", &[]), None);
+        assert_eq!(typosquat_target("attr", &[]), None);
+        assert_eq!(typosquat_target("sixx", &[]), None);
+        assert_eq!(typosquat_target("mokc", &[]).as_deref(), Some("mock"));
+    }
+
+    fn policy(files: &[(&[&str], &[&str])]) -> PackagePolicy {
+        let files = files
+            .iter()
+            .enumerate()
+            .map(|(idx, (allow, block))| {
+                let file = PolicyFile {
+                    allow: allow.iter().map(|p| p.to_string()).collect(),
+                    block: block.iter().map(|p| p.to_string()).collect(),
+                };
+                (PathBuf::from(format!("policy-{idx}.toml")), file)
+            })
+            .collect();
+        PackagePolicy { files }
+    }
+
+    fn permitted(policy: &PackagePolicy, name: &str) -> bool {
+        policy.check(std::iter::once(name.to_string())).is_ok()
+    }
+
+    #[test]
+    fn policy_globs_match_normalized_names() {
+        assert!(glob_matches("django-*", "django-filter"));
+        assert!(!glob_matches("django-*", "django"));
+        assert!(glob_matches("py?aml", "pyyaml"));
+        assert!(policy_pattern_matches("Django_*", "django-filter"));
+    }
+
+    #[test]
+    fn policy_block_wins_over_allow() {
+        let single = policy(&[(&["django*"], &["django-evil*"])]);
+        assert!(permitted(&single, "django"));
+        assert!(permitted(&single, "django-filter"));
+        assert!(!permitted(&single, "django-evil-toolbar"));
+        assert!(!permitted(&single, "flask"));
+
+        // A project file can narrow the global allow list but not undo its blocks.
+        let layered = policy(&[(&[], &["left-pad"]), (&["left-pad", "requests"], &[])]);
+        assert!(permitted(&layered, "requests"));
+        assert!(!permitted(&layered, "left-pad"));
+        assert!(!permitted(&layered, "numpy"));
+    }
+}